@@ -3,6 +3,7 @@ package build
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -180,18 +181,39 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 	var postBuildOutput string
 	var cacheKey []byte
 	var metadata *core.BuildMetadata
+	var reasons []string
 
 	if target.HasLabel("go") {
 		// Create a dummy go.mod file so Go tooling ignores the contents of plz-out.
 		goModOnce.Do(writeGoMod)
 	}
 
+	// In dynamic mode, we might build locally instead (or as well).
+	dynamic := false
+	if runRemotely && state.Config.Remote.Dynamic {
+		if !state.RemoteClient.Healthy() {
+			defer fallBackToLocal(tid, state, target)()
+			runRemotely = false
+		} else if state.ShouldRunDynamically(target) {
+			dynamic = true
+			runRemotely = false
+		}
+	}
+
 	if runRemotely {
 		metadata, err = state.RemoteClient.Build(tid, target)
-		if err != nil {
+		if err != nil && state.Config.Remote.Dynamic && !state.RemoteClient.Healthy() {
+			log.Warning("Failed to build %s remotely, will retry locally: %s", target.Label, err)
+			defer fallBackToLocal(tid, state, target)()
+			runRemotely = false
+		} else if err != nil && target.IsRemoteFile && state.Config.Remote.LocalFetchFallback {
+			log.Warning("Failed to fetch %s remotely, will fetch it locally: %s", target.Label, err)
+			runRemotely = false
+		} else if err != nil {
 			return err
 		}
-	} else {
+	}
+	if !runRemotely {
 		// Ensure we have downloaded any previous dependencies if that's relevant.
 		if err := downloadInputsIfNeeded(tid, state, target); err != nil {
 			return err
@@ -252,6 +274,9 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 			buildLinks(state, target)
 			return nil
 		}
+		// Keep the record of the last build before it gets replaced; we only work out why we're
+		// rebuilding once we know we aren't going to get it from the cache.
+		lastMetadata, lastMetadataErr := loadTargetMetadata(target)
 		if err := prepareDirectories(target); err != nil {
 			return fmt.Errorf("Error preparing directories for %s: %s", target.Label, err)
 		}
@@ -288,20 +313,33 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 		if err := target.CheckSecrets(); err != nil {
 			return err
 		}
+		if reasons = rebuildReasonsSince(state, target, lastMetadata, lastMetadataErr); len(reasons) == 0 {
+			if state.ShouldRebuild(target) {
+				reasons = []string{"a rebuild was forced"}
+			} else {
+				reasons = []string{"its outputs were missing or had been modified"}
+			}
+		}
 		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Preparing...")
 		if err := prepareSources(state.Graph, target); err != nil {
 			return fmt.Errorf("Error preparing sources for %s: %s", target.Label, err)
 		}
 
 		state.LogBuildResult(tid, target.Label, core.TargetBuilding, target.BuildingDescription)
-		metadata, err = buildMaybeRemotely(state, target, cacheKey)
+		if dynamic {
+			metadata, runRemotely, err = raceBuild(tid, state, target, cacheKey)
+		} else {
+			metadata, err = buildMaybeRemotely(context.Background(), state, target, cacheKey)
+		}
 		if err != nil {
 			return err
 		}
 
-		metadata.OutputDirOuts, err = addOutputDirectoriesToBuildOutput(target)
-		if err != nil {
-			return err
+		if !runRemotely {
+			metadata.OutputDirOuts, err = addOutputDirectoriesToBuildOutput(target)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -335,8 +373,16 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 			buildLinks(state, target)
 		}
 		return nil
-	} else if err := StoreTargetMetadata(target, metadata); err != nil {
+	}
+	metadata.InputHashes = inputHashes(state, target)
+	metadata.RebuildReasons = reasons
+	if err := StoreTargetMetadata(target, metadata); err != nil {
 		return fmt.Errorf("failed to store target build metadata for %s: %w", target.Label, err)
+	} else if state.RemoteClient != nil {
+		// Any outputs recorded from an earlier remote build are now superseded by these ones.
+		if err := core.RemoveRemoteOutputs(target); err != nil {
+			return fmt.Errorf("failed to remove remote outputs manifest for %s: %w", target.Label, err)
+		}
 	}
 
 	state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Collecting outputs...")
@@ -347,6 +393,12 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget, runR
 	if _, err = calculateAndCheckRuleHash(state, target); err != nil {
 		return fmt.Errorf("failed to calculate hash: %w", err)
 	}
+	if target.IsRemoteFile && state.RemoteClient != nil && state.Config.Remote.PushRemoteFiles {
+		state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Pushing...")
+		if err := state.RemoteClient.PushRemoteFile(target); err != nil {
+			log.Warning("Failed to push %s to the remote asset server: %s", target.Label, err)
+		}
+	}
 	if outputsChanged {
 		target.SetState(core.Built)
 	} else {
@@ -456,7 +508,7 @@ func retrieveArtifacts(tid int, state *core.BuildState, target *core.BuildTarget
 
 // runBuildCommand runs the actual command to build a target.
 // On success it returns the stdout of the target, otherwise an error.
-func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command string, inputHash []byte) ([]byte, error) {
+func runBuildCommand(ctx context.Context, state *core.BuildState, target *core.BuildTarget, command string, inputHash []byte) ([]byte, error) {
 	if target.IsRemoteFile {
 		return nil, fetchRemoteFile(state, target)
 	}
@@ -465,8 +517,10 @@ func runBuildCommand(state *core.BuildState, target *core.BuildTarget, command s
 	}
 	env := core.StampedBuildEnvironment(state, target, inputHash, path.Join(core.RepoRoot, target.TmpDir()))
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, env, command)
-	out, combined, err := state.ProcessExecutor.ExecWithTimeoutShell(target, target.TmpDir(), env, target.BuildTimeout, state.ShowAllOutput, command, target.Sandbox)
-	if err != nil {
+	out, combined, err := state.ProcessExecutor.ExecWithTimeoutShellContext(ctx, target, target.TmpDir(), env, target.BuildTimeout, state.ShowAllOutput, command, target.Sandbox)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
 		return nil, fmt.Errorf("Error building target %s: %s\n%s", target.Label, err, combined)
 	}
 	return out, nil
@@ -1049,8 +1103,8 @@ func fetchRemoteFile(state *core.BuildState, target *core.BuildTarget) error {
 		return err
 	}
 	var err error
-	for _, src := range target.Sources {
-		if e := fetchOneRemoteFile(state, target, src.String()); e != nil {
+	for _, url := range target.MirroredURLs(state.Config) {
+		if e := fetchOneRemoteFile(state, target, url); e != nil {
 			err = multierror.Append(err, e)
 		} else {
 			return nil
@@ -1090,6 +1144,9 @@ func fetchOneRemoteFile(state *core.BuildState, target *core.BuildTarget, url st
 		return err
 	}
 	req.Header.Set("User-Agent", fmt.Sprintf("please.build/%s", core.PleaseVersion))
+	for k, v := range target.ExpandedURLHeaders(url, env) {
+		req.Header.Set(k, v)
+	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
@@ -1130,14 +1187,14 @@ func (r *progressReader) Read(b []byte) (int, error) {
 
 // buildMaybeRemotely builds a target, either sending it to a remote worker if needed,
 // or locally if not.
-func buildMaybeRemotely(state *core.BuildState, target *core.BuildTarget, inputHash []byte) (*core.BuildMetadata, error) {
+func buildMaybeRemotely(ctx context.Context, state *core.BuildState, target *core.BuildTarget, inputHash []byte) (*core.BuildMetadata, error) {
 	metadata := new(core.BuildMetadata)
 
 	workerCmd, workerArgs, localCmd, err := core.WorkerCommandAndArgs(state, target)
 	if err != nil {
 		return nil, err
 	} else if workerCmd == "" {
-		metadata.Stdout, err = runBuildCommand(state, target, localCmd, inputHash)
+		metadata.Stdout, err = runBuildCommand(ctx, state, target, localCmd, inputHash)
 		return metadata, err
 	}
 	// The scheme here is pretty minimal; remote workers currently have quite a bit less info than
@@ -1175,7 +1232,7 @@ func buildMaybeRemotely(state *core.BuildState, target *core.BuildTarget, inputH
 	}
 	// Okay, now we might need to do something locally too...
 	if localCmd != "" {
-		out2, err := runBuildCommand(state, target, localCmd, inputHash)
+		out2, err := runBuildCommand(ctx, state, target, localCmd, inputHash)
 		metadata.Stdout = append([]byte(out+"\n"), out2...)
 		return metadata, err
 	}
@@ -13,6 +13,8 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -393,6 +395,45 @@ func TestFetchLocalRemoteFile(t *testing.T) {
 	assert.True(t, fs.FileExists(path.Join(target.TmpDir(), "local_remote_file.txt")))
 }
 
+func TestFetchRemoteFileHeadersAndMirrors(t *testing.T) {
+	os.Setenv("REMOTE_FILE_TEST_TOKEN", "abc123")
+	defer os.Unsetenv("REMOTE_FILE_TEST_TOKEN")
+	var requests, mirrorHeaders []string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		mirrorHeaders = append(mirrorHeaders, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer mirror.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer abc123" {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.Write([]byte("original"))
+		}
+	}))
+	defer srv.Close()
+
+	config, _ := core.ReadConfigFiles(nil, nil)
+	config.Build.Mirror = []string{mirror.URL + "/mirror"}
+	config.Build.PassUnsafeEnv = []string{"REMOTE_FILE_TEST_TOKEN"}
+	state := core.NewBuildState(config)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//package4:target3", ""))
+	state.Graph.AddTarget(target)
+	target.AddSource(core.URLLabel(srv.URL + "/remote_file.txt"))
+	target.AddOutput("remote_file.txt")
+	target.URLHeaders = map[string]string{"Authorization": "Bearer $REMOTE_FILE_TEST_TOKEN"}
+	err := fetchRemoteFile(state, target)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/mirror/" + strings.TrimPrefix(srv.URL, "http://") + "/remote_file.txt", "/remote_file.txt"}, requests)
+	// The header is only sent to the original host, not the mirror.
+	assert.Equal(t, []string{""}, mirrorHeaders)
+	b, err := ioutil.ReadFile(path.Join(target.TmpDir(), "remote_file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(b))
+}
+
 func TestFetchLocalRemoteFileCannotBeRelative(t *testing.T) {
 	state, target := newState("//package4:target2")
 	target.AddSource(core.URLLabel("src/build/test_data/local_remote_file.txt"))
@@ -435,6 +476,48 @@ func TestBuildMetadatafileIsCreated(t *testing.T) {
 	assert.Equal(t, stdOut, string(md.Stdout))
 }
 
+func TestRebuildReasons(t *testing.T) {
+	state, target := newState("//package1:explain")
+	target.AddOutput("file1")
+	require.NoError(t, buildTarget(rand.Int(), state, target, false))
+	md, err := loadTargetMetadata(target)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"there is no record of a previous build"}, md.RebuildReasons)
+	assert.Contains(t, md.InputHashes, "command")
+
+	target.Command = "echo -n 'explain' > $OUT"
+	target.RuleHash = nil // Have to force a reset of this
+	assert.Equal(t, []string{"command changed"}, rebuildReasons(state, target))
+	require.NoError(t, buildTarget(rand.Int(), state, target, false))
+	md, err = loadTargetMetadata(target)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"command changed"}, md.RebuildReasons)
+	assert.Nil(t, rebuildReasons(state, target))
+}
+
+func TestDiffInputHashes(t *testing.T) {
+	old := map[string][]byte{
+		"rule":         {1},
+		"source a.txt": {2},
+		"source b.txt": {3},
+		"env FOO":      {4},
+	}
+	assert.Nil(t, diffInputHashes(old, old))
+	assert.Equal(t, []string{"env FOO changed", "source a.txt changed", "source b.txt was removed", "source c.txt was added"}, diffInputHashes(old, map[string][]byte{
+		"rule":         {5},
+		"source a.txt": {6},
+		"source c.txt": {7},
+		"env FOO":      {8},
+	}))
+	// The rule hash is only mentioned if nothing more specific explains it.
+	assert.Equal(t, []string{"rule definition changed", "source a.txt changed"}, diffInputHashes(old, map[string][]byte{
+		"rule":         {5},
+		"source a.txt": {6},
+		"source b.txt": {3},
+		"env FOO":      {4},
+	}))
+}
+
 // Should return the hash of the first item
 func TestSha1SingleHash(t *testing.T) {
 	testCases := []struct {
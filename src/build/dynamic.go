@@ -0,0 +1,129 @@
+// Dynamic execution, where build actions are raced locally against remote execution.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sync/atomic"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// DynamicStatsFile is the file that the outcomes of dynamic execution are written to at the end of each build.
+const DynamicStatsFile = "plz-out/log/dynamic_stats.json"
+
+// localSlots limits the number of builds that dynamic execution runs locally at once.
+// They happen on the remote worker threads, of which there are usually many more than local ones.
+var localSlots chan struct{}
+
+// A raceResult is the outcome of one side of a race between a local and a remote build.
+type raceResult struct {
+	metadata *core.BuildMetadata
+	err      error
+	remote   bool
+}
+
+// raceBuild builds a target locally and remotely at once and uses whichever finishes first, cancelling
+// the other. The target's temporary directory must already have been prepared.
+// It returns true if the remote build was used, in which case the local outputs should be ignored.
+func raceBuild(tid int, state *core.BuildState, target *core.BuildTarget, inputHash []byte) (*core.BuildMetadata, bool, error) {
+	select {
+	case localSlots <- struct{}{}:
+		defer func() { <-localSlots }()
+	default:
+		log.Debug("No local capacity to race %s, building it remotely", target.Label)
+		metadata, err := state.RemoteClient.Build(tid, target)
+		return metadata, true, err
+	}
+	localCtx, cancelLocal := context.WithCancel(context.Background())
+	defer cancelLocal()
+	remoteCtx, cancelRemote := context.WithCancel(context.Background())
+	defer cancelRemote()
+	ch := make(chan raceResult, 2)
+	go func() {
+		metadata, err := buildMaybeRemotely(localCtx, state, target, inputHash)
+		ch <- raceResult{metadata: metadata, err: err}
+	}()
+	go func() {
+		metadata, err := state.RemoteClient.BuildContext(remoteCtx, tid, target)
+		ch <- raceResult{metadata: metadata, err: err, remote: true}
+	}()
+	first := <-ch
+	if first.err != nil {
+		// Don't give up yet; the failure might be particular to one side (e.g. a missing local tool).
+		log.Debug("%s build of %s failed, waiting for the other one: %s", raceSide(first.remote), target.Label, first.err)
+		second := <-ch
+		if second.err == nil {
+			return raceWon(state, target, second)
+		} else if first.remote {
+			return nil, false, second.err // Prefer the local error, it's more likely to be useful.
+		}
+		return nil, false, first.err
+	}
+	// Stop the other side and wait for it to finish, so it can't interfere with the outputs later.
+	if first.remote {
+		cancelLocal()
+	} else {
+		cancelRemote()
+	}
+	if second := <-ch; second.remote && second.err == nil {
+		// The remote build finished before it noticed it had been cancelled, so it has already
+		// recorded its outputs. Use it for consistency with that.
+		return raceWon(state, target, second)
+	}
+	return raceWon(state, target, first)
+}
+
+// raceWon records the winner of a race.
+func raceWon(state *core.BuildState, target *core.BuildTarget, result raceResult) (*core.BuildMetadata, bool, error) {
+	log.Debug("%s build of %s won", raceSide(result.remote), target.Label)
+	if result.remote {
+		atomic.AddInt64(&state.DynamicStats.RemoteWins, 1)
+	} else {
+		atomic.AddInt64(&state.DynamicStats.LocalWins, 1)
+	}
+	return result.metadata, result.remote, nil
+}
+
+func raceSide(remote bool) string {
+	if remote {
+		return "Remote"
+	}
+	return "Local"
+}
+
+// fallBackToLocal records that a target is being built locally because the remote server is unavailable.
+// It returns a function that must be called once the local build is done.
+func fallBackToLocal(tid int, state *core.BuildState, target *core.BuildTarget) func() {
+	log.Debug("Remote server is unavailable, building %s locally", target.Label)
+	atomic.AddInt64(&state.DynamicStats.Fallbacks, 1)
+	state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Waiting to build locally...")
+	localSlots <- struct{}{}
+	return func() { <-localSlots }
+}
+
+// WriteDynamicStats logs the outcomes of dynamic execution during this build and writes them to DynamicStatsFile.
+// Nothing is written if nothing was raced or fell back to building locally.
+func WriteDynamicStats(state *core.BuildState) {
+	stats := core.DynamicStats{
+		LocalWins:  atomic.LoadInt64(&state.DynamicStats.LocalWins),
+		RemoteWins: atomic.LoadInt64(&state.DynamicStats.RemoteWins),
+		Fallbacks:  atomic.LoadInt64(&state.DynamicStats.Fallbacks),
+	}
+	if stats.LocalWins+stats.RemoteWins+stats.Fallbacks == 0 {
+		return
+	}
+	log.Info("Dynamic execution: %d builds won locally, %d won remotely, %d fell back to local", stats.LocalWins, stats.RemoteWins, stats.Fallbacks)
+	filename := path.Join(core.RepoRoot, DynamicStatsFile)
+	if b, err := json.MarshalIndent(stats, "", "  "); err != nil {
+		log.Warning("Failed to serialise dynamic execution stats: %s", err)
+	} else if err := fs.EnsureDir(filename); err != nil {
+		log.Warning("Failed to write dynamic execution stats: %s", err)
+	} else if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		log.Warning("Failed to write dynamic execution stats: %s", err)
+	}
+}
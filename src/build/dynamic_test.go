@@ -0,0 +1,121 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestDynamicLocalWins(t *testing.T) {
+	cancelled := false
+	state, target := newDynamicState("//package1:dynamic1", func(ctx context.Context) (*core.BuildMetadata, error) {
+		<-ctx.Done()
+		cancelled = true
+		return nil, ctx.Err()
+	})
+	err := buildTarget(1, state, target, true)
+	assert.NoError(t, err)
+	assert.Equal(t, core.Built, target.State())
+	assert.True(t, cancelled)
+	assert.EqualValues(t, 1, state.DynamicStats.LocalWins)
+	assert.EqualValues(t, 0, state.DynamicStats.RemoteWins)
+}
+
+func TestDynamicRemoteWins(t *testing.T) {
+	state, target := newDynamicState("//package1:dynamic2", func(ctx context.Context) (*core.BuildMetadata, error) {
+		return &core.BuildMetadata{}, nil
+	})
+	target.Command = "sleep 10 && " + target.Command
+	start := time.Now()
+	err := buildTarget(1, state, target, true)
+	assert.NoError(t, err)
+	assert.Equal(t, core.BuiltRemotely, target.State())
+	assert.True(t, time.Since(start) < 5*time.Second, "Local build should have been cancelled")
+	assert.EqualValues(t, 0, state.DynamicStats.LocalWins)
+	assert.EqualValues(t, 1, state.DynamicStats.RemoteWins)
+}
+
+func TestDynamicRemoteFailureFallsBackToLocalBuild(t *testing.T) {
+	state, target := newDynamicState("//package1:dynamic3", func(ctx context.Context) (*core.BuildMetadata, error) {
+		return nil, fmt.Errorf("remote build failed")
+	})
+	target.Command = "sleep 0.1 && " + target.Command
+	err := buildTarget(1, state, target, true)
+	assert.NoError(t, err)
+	assert.Equal(t, core.Built, target.State())
+	assert.EqualValues(t, 1, state.DynamicStats.LocalWins)
+}
+
+func TestDynamicBothFail(t *testing.T) {
+	state, target := newDynamicState("//package1:dynamic4", func(ctx context.Context) (*core.BuildMetadata, error) {
+		return nil, fmt.Errorf("remote build failed")
+	})
+	target.Command = "false"
+	err := buildTarget(1, state, target, true)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "remote build failed")
+}
+
+func TestDynamicUnhealthy(t *testing.T) {
+	state, target := newDynamicState("//package1:dynamic5", func(ctx context.Context) (*core.BuildMetadata, error) {
+		panic("should not build remotely")
+	})
+	state.RemoteClient.(*fakeRemoteClient).unhealthy = true
+	err := buildTarget(1, state, target, true)
+	assert.NoError(t, err)
+	assert.Equal(t, core.Built, target.State())
+	assert.EqualValues(t, 1, state.DynamicStats.Fallbacks)
+	assert.EqualValues(t, 0, state.DynamicStats.LocalWins)
+}
+
+func TestShouldRunDynamically(t *testing.T) {
+	state, target := newDynamicState("//package1:dynamic6", nil)
+	assert.True(t, state.ShouldRunDynamically(target))
+	state.Config.Remote.DynamicLabel = []string{"small"}
+	assert.False(t, state.ShouldRunDynamically(target))
+	target.AddLabel("small")
+	assert.True(t, state.ShouldRunDynamically(target))
+	target.Local = true
+	assert.False(t, state.ShouldRunDynamically(target))
+}
+
+func newDynamicState(label string, build func(ctx context.Context) (*core.BuildMetadata, error)) (*core.BuildState, *core.BuildTarget) {
+	state, target := newState(label)
+	state.Config.Remote.URL = "127.0.0.1:8980"
+	state.Config.Remote.NumExecutors = 1
+	state.Config.Remote.Dynamic = true
+	state.RemoteClient = &fakeRemoteClient{build: build}
+	target.AddOutput(target.Label.Name)
+	return state, target
+}
+
+// A fakeRemoteClient implements core.RemoteClient for the dynamic execution tests above.
+type fakeRemoteClient struct {
+	unhealthy bool
+	build     func(ctx context.Context) (*core.BuildMetadata, error)
+}
+
+func (c *fakeRemoteClient) Build(tid int, target *core.BuildTarget) (*core.BuildMetadata, error) {
+	return c.build(context.Background())
+}
+
+func (c *fakeRemoteClient) BuildContext(ctx context.Context, tid int, target *core.BuildTarget) (*core.BuildMetadata, error) {
+	return c.build(ctx)
+}
+
+func (c *fakeRemoteClient) Test(tid int, target *core.BuildTarget, run int) (*core.BuildMetadata, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeRemoteClient) Run(target *core.BuildTarget) error            { return fmt.Errorf("not implemented") }
+func (c *fakeRemoteClient) Download(target *core.BuildTarget) error       { return nil }
+func (c *fakeRemoteClient) PrintHashes(target *core.BuildTarget, _ bool)  {}
+func (c *fakeRemoteClient) DataRate() (int, int, int, int)                { return 0, 0, 0, 0 }
+func (c *fakeRemoteClient) Healthy() bool                                 { return !c.unhealthy }
+func (c *fakeRemoteClient) Degraded() bool                                { return c.unhealthy }
+func (c *fakeRemoteClient) PushRemoteFile(target *core.BuildTarget) error { return nil }
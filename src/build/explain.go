@@ -0,0 +1,183 @@
+// Utilities to explain why targets get rebuilt.
+//
+// Each time a target is built we record a hash of each of its inputs (sources, tools,
+// dependencies, command, environment and config) alongside its metadata. When it needs
+// rebuilding, comparing those against the current state tells us exactly which of them
+// changed, which is a lot more useful than knowing that the overall hash is different.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// inputHashes returns the hash of each individual input to a target, keyed by a description of it.
+// Inputs that can't be hashed (e.g. because they don't exist) have an empty hash.
+func inputHashes(state *core.BuildState, target *core.BuildTarget) map[string][]byte {
+	hashes := map[string][]byte{}
+	for name, h := range state.Hashes.ConfigComponents {
+		hashes["config "+name] = h
+	}
+	hashes["rule"] = RuleHash(state, target, false, false)
+	hashes["command"] = hashString(target.GetCommand(state))
+	for k, v := range target.Env {
+		hashes["env "+k] = hashString(v)
+	}
+	if target.PassEnv != nil {
+		for _, env := range *target.PassEnv {
+			hashes["env "+env] = hashString(os.Getenv(env))
+		}
+	}
+	for source := range core.IterSources(state.Graph, target, false) {
+		hashes["source "+source.Src] = hashPathOrNil(state, source.Src)
+	}
+	for _, tool := range target.AllTools() {
+		for _, path := range tool.FullPaths(state.Graph) {
+			hashes["tool "+path] = hashPathOrNil(state, path)
+		}
+	}
+	for _, dep := range target.Dependencies() {
+		h := sha1.New()
+		for _, out := range dep.FullOutputs() {
+			h.Write(hashPathOrNil(state, out))
+		}
+		hashes["dependency "+dep.Label.String()] = h.Sum(nil)
+	}
+	if h, err := secretHash(state, target); err == nil {
+		hashes["secrets"] = h
+	}
+	return hashes
+}
+
+// rebuildReasons returns a description of each input to the target that has changed since it was last built.
+// If nothing has changed it returns nil.
+func rebuildReasons(state *core.BuildState, target *core.BuildTarget) []string {
+	md, err := loadTargetMetadata(target)
+	return rebuildReasonsSince(state, target, md, err)
+}
+
+// rebuildReasonsSince is like rebuildReasons but compares against the given metadata from a previous
+// build (and the error from loading it).
+func rebuildReasonsSince(state *core.BuildState, target *core.BuildTarget, md *core.BuildMetadata, err error) []string {
+	if err != nil {
+		return []string{"there is no record of a previous build"}
+	} else if md.InputHashes == nil {
+		return []string{"the previous build didn't record its inputs"}
+	}
+	return diffInputHashes(md.InputHashes, inputHashes(state, target))
+}
+
+// diffInputHashes returns a description of each input that differs between the two sets of hashes.
+func diffInputHashes(old, new map[string][]byte) []string {
+	reasons := []string{}
+	ruleChanged := false
+	for name, h := range new {
+		if oldHash, present := old[name]; !present {
+			reasons = append(reasons, name+" was added")
+		} else if !bytes.Equal(oldHash, h) {
+			if name == "rule" {
+				ruleChanged = true
+			} else {
+				reasons = append(reasons, name+" changed")
+			}
+		}
+	}
+	for name := range old {
+		if _, present := new[name]; !present {
+			reasons = append(reasons, name+" was removed")
+		}
+	}
+	// The rule hash covers the command & env too, so only mention it if nothing more specific did.
+	if ruleChanged && !anyRuleReason(reasons) {
+		reasons = append(reasons, "rule definition changed")
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// anyRuleReason returns true if any of the given reasons are about parts of the rule definition.
+func anyRuleReason(reasons []string) bool {
+	for _, reason := range reasons {
+		if strings.HasPrefix(reason, "command ") || strings.HasPrefix(reason, "env ") {
+			return true
+		} else if !strings.HasPrefix(reason, "config ") && (strings.HasSuffix(reason, " was added") || strings.HasSuffix(reason, " was removed")) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintRebuildReasons prints why each of the given targets was rebuilt by the last build.
+// It's used by plz build --explain.
+func PrintRebuildReasons(targets []*core.BuildTarget) {
+	for _, target := range targets {
+		if md, err := loadTargetMetadata(target); err == nil && len(md.RebuildReasons) > 0 {
+			printReasons(fmt.Sprintf("%s was rebuilt because", target.Label), md.RebuildReasons)
+		}
+	}
+}
+
+// PrintWhyRebuilt prints what has changed for each of the given targets since they were last built,
+// or if nothing has, why they were rebuilt last time.
+// It's used by plz query why_rebuilt.
+func PrintWhyRebuilt(state *core.BuildState, labels []core.BuildLabel) {
+	for _, label := range labels {
+		target := state.Graph.TargetOrDie(label)
+		if reasons := whyRebuilt(state, target, map[*core.BuildTarget][]string{}); len(reasons) > 0 {
+			printReasons(fmt.Sprintf("%s needs rebuilding because", label), reasons)
+		} else if md, err := loadTargetMetadata(target); err == nil && len(md.RebuildReasons) > 0 {
+			printReasons(fmt.Sprintf("%s is unchanged since it was last built; it was rebuilt then because", label), md.RebuildReasons)
+		} else {
+			fmt.Printf("%s is unchanged since it was last built\n", label)
+		}
+	}
+}
+
+// whyRebuilt is like rebuildReasons but also considers whether any dependencies need rebuilding;
+// since we haven't built them, their outputs on disk may not reflect what they'd produce now.
+func whyRebuilt(state *core.BuildState, target *core.BuildTarget, done map[*core.BuildTarget][]string) []string {
+	if reasons, present := done[target]; present {
+		return reasons
+	}
+	done[target] = nil // Guards against cycles; there shouldn't be any, but best to be safe.
+	reasons := rebuildReasons(state, target)
+	for _, dep := range target.Dependencies() {
+		if len(whyRebuilt(state, dep, done)) > 0 {
+			reasons = append(reasons, "dependency "+dep.Label.String()+" needs rebuilding")
+		}
+	}
+	done[target] = reasons
+	return reasons
+}
+
+func printReasons(heading string, reasons []string) {
+	fmt.Printf("%s:\n", heading)
+	for _, reason := range reasons {
+		fmt.Printf("  %s\n", reason)
+	}
+}
+
+// hashString returns the sha1 hash of a string.
+func hashString(s string) []byte {
+	h := sha1.Sum([]byte(s))
+	return h[:]
+}
+
+// hashPathOrNil returns the hash of a path, or nil if it can't be hashed.
+func hashPathOrNil(state *core.BuildState, path string) []byte {
+	h, err := state.PathHasher.Hash(path, false, true)
+	if err != nil {
+		return nil
+	}
+	return h
+}
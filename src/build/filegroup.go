@@ -32,6 +32,7 @@ func Init(state *core.BuildState) {
 		built: map[string]bool{},
 	}
 	state.TargetHasher = newTargetHasher(state)
+	localSlots = make(chan struct{}, state.Config.Please.NumThreads)
 }
 
 // A filegroupBuilder is a singleton that we have that builds all filegroups.
@@ -281,6 +281,8 @@ func ruleHash(state *core.BuildState, target *core.BuildTarget, runtime bool) []
 
 	hashMap(h, target.EntryPoints)
 	hashMap(h, target.Env)
+	hashMap(h, target.RemotePlatform)
+	hashMap(h, target.URLHeaders)
 
 	h.Write([]byte(target.FileContent))
 
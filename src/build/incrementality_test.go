@@ -57,6 +57,8 @@ var KnownFields = map[string]bool{
 	"ExitOnError":                 true,
 	"EntryPoints":                 true,
 	"Env":                         true,
+	"RemotePlatform":              true,
+	"URLHeaders":                  true,
 
 	// These only contribute to the runtime hash, not at build time.
 	"Data":              true,
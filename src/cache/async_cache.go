@@ -2,6 +2,7 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/thought-machine/please/src/core"
 )
@@ -15,6 +16,7 @@ type asyncCache struct {
 	requests  chan cacheRequest
 	realCache core.Cache
 	wg        sync.WaitGroup
+	pending   int64
 }
 
 // A cacheRequest models an incoming cache request on our queue.
@@ -37,6 +39,7 @@ func newAsyncCache(realCache core.Cache, config *core.Configuration) core.Cache
 }
 
 func (c *asyncCache) Store(target *core.BuildTarget, key []byte, files []string) {
+	atomic.AddInt64(&c.pending, 1)
 	c.requests <- cacheRequest{
 		target: target,
 		key:    key,
@@ -61,12 +64,27 @@ func (c *asyncCache) Shutdown() {
 	close(c.requests)
 	c.wg.Wait()
 	log.Debug("Shut down all cache workers")
+	c.realCache.Shutdown()
+}
+
+// CacheStats returns the statistics of the underlying cache, if it records any.
+func (c *asyncCache) CacheStats() []core.CacheStats {
+	if provider, ok := c.realCache.(core.CacheStatsProvider); ok {
+		return provider.CacheStats()
+	}
+	return nil
+}
+
+// PendingStores returns the number of store requests that haven't been completed yet.
+func (c *asyncCache) PendingStores() int {
+	return int(atomic.LoadInt64(&c.pending))
 }
 
 // run implements the actual async logic.
 func (c *asyncCache) run() {
 	for r := range c.requests {
 		c.realCache.Store(r.target, r.key, r.files)
+		atomic.AddInt64(&c.pending, -1)
 	}
 	c.wg.Done()
 }
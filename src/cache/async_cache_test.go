@@ -38,6 +38,17 @@ func TestClean(t *testing.T) {
 	assert.True(t, mCache.completed[target])
 }
 
+func TestPendingStores(t *testing.T) {
+	_, aCache := makeCaches()
+	provider := aCache.(core.CacheStatsProvider)
+	target := makeTarget1("//pkg1:test_pending")
+	aCache.Store(target, nil, target.Outputs())
+	assert.Equal(t, 1, provider.PendingStores())
+	aCache.Shutdown()
+	assert.Equal(t, 0, provider.PendingStores())
+	assert.Nil(t, provider.CacheStats())
+}
+
 func TestSimulateBuild(t *testing.T) {
 	// Attempt to simulate what a normal build would do and confirm that the actions come
 	// back out in the correct order.
@@ -3,11 +3,17 @@
 package cache
 
 import (
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"gopkg.in/op/go-logging.v1"
 
 	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/remote"
 )
 
 var log = logging.MustGetLogger("cache")
@@ -23,25 +29,103 @@ func NewCache(state *core.BuildState) core.Cache {
 
 // newSyncCache creates a new cache, possibly multiplexing many underneath.
 func newSyncCache(state *core.BuildState, remoteOnly bool) core.Cache {
-	mplex := &cacheMultiplexer{}
+	if mplex := newTiers(state, remoteOnly); len(mplex.caches) > 0 {
+		return mplex
+	}
+	return nil
+}
+
+// newTiers creates a multiplexer of all the configured caches.
+// Unlike newSyncCache, it always returns a multiplexer even if there are no caches or only one.
+func newTiers(state *core.BuildState, remoteOnly bool) *cacheMultiplexer {
+	caches := map[string]core.Cache{}
 	if state.Config.Cache.Dir != "" && !remoteOnly {
-		mplex.caches = append(mplex.caches, newDirCache(state.Config))
+		caches["dir"] = newDirCache(state.Config, state.PathHasher)
 	}
 	if state.Config.Cache.HTTPURL != "" {
-		mplex.caches = append(mplex.caches, newHTTPCache(state.Config))
+		caches["http"] = newHTTPCache(state.Config)
+	}
+	if state.Config.Cache.RemoteURL != "" {
+		caches["remote"] = remote.NewCache(state)
+	}
+	return newCacheMultiplexer(caches, state.Config.Cache.Tiers, state.Config.CacheTier)
+}
+
+// defaultTiers is the order that caches are consulted in if not otherwise configured.
+var defaultTiers = []string{"dir", "http", "remote"}
+
+// newCacheMultiplexer creates a new multiplexer from the given caches, ordered by the given tiers.
+// Any caches that aren't mentioned in the ordering are added afterwards in the default order.
+func newCacheMultiplexer(caches map[string]core.Cache, order []string, policies map[string]*core.CacheTier) *cacheMultiplexer {
+	for name := range policies {
+		if !isValidTier(name) {
+			log.Warning("Unknown cache tier %s in config; should be one of %s", name, strings.Join(defaultTiers, ", "))
+		}
 	}
-	if len(mplex.caches) == 0 {
-		return nil
-	} else if len(mplex.caches) == 1 {
-		return mplex.caches[0] // Skip the extra layer of indirection
+	mplex := &cacheMultiplexer{}
+	seen := map[string]bool{}
+	for _, name := range append(append([]string{}, order...), defaultTiers...) {
+		if !isValidTier(name) {
+			log.Warning("Unknown cache tier %s in config; should be one of %s", name, strings.Join(defaultTiers, ", "))
+		} else if cache, present := caches[name]; present && !seen[name] {
+			mplex.caches = append(mplex.caches, cacheTier{Cache: cache, policy: policies[name], stats: &core.CacheStats{Name: name}})
+		}
+		seen[name] = true
 	}
 	return mplex
 }
 
+func isValidTier(name string) bool {
+	for _, tier := range defaultTiers {
+		if tier == name {
+			return true
+		}
+	}
+	return false
+}
+
 // A cacheMultiplexer multiplexes several caches into one.
 // Used when we have several active (eg. http, dir).
 type cacheMultiplexer struct {
-	caches []core.Cache
+	caches []cacheTier
+}
+
+// A cacheTier is one of the caches in a multiplexer, along with the policy that applies to it.
+type cacheTier struct {
+	core.Cache
+	policy *core.CacheTier
+	stats  *core.CacheStats
+}
+
+// shouldRetrieve returns true if this tier should be used to retrieve the given target.
+func (tier *cacheTier) shouldRetrieve(target *core.BuildTarget) bool {
+	return tier.policy == nil || (!tier.policy.WriteOnly && tier.matchesLabels(target))
+}
+
+// shouldStore returns true if this tier should be used to store the given target.
+// size is the total size of its outputs, or -1 if that couldn't be determined.
+func (tier *cacheTier) shouldStore(target *core.BuildTarget, size int64) bool {
+	if tier.policy == nil {
+		return true
+	} else if tier.policy.ReadOnly || !tier.matchesLabels(target) {
+		return false
+	} else if tier.policy.MaxSize == 0 {
+		return true
+	} else if size < 0 {
+		return false
+	} else if size > int64(tier.policy.MaxSize) {
+		log.Debug("Not storing %s in %s cache; outputs are %s which is over the limit of %s", target.Label, tier.stats.Name, humanize.Bytes(uint64(size)), humanize.Bytes(uint64(tier.policy.MaxSize)))
+		return false
+	}
+	return true
+}
+
+// matchesLabels returns true if the given target's labels are acceptable for this tier.
+func (tier *cacheTier) matchesLabels(target *core.BuildTarget) bool {
+	if len(tier.policy.IncludeLabel) > 0 && !target.HasAnyLabel(tier.policy.IncludeLabel) {
+		return false
+	}
+	return !target.HasAnyLabel(tier.policy.ExcludeLabel)
 }
 
 func (mplex cacheMultiplexer) Store(target *core.BuildTarget, key []byte, files []string) {
@@ -54,17 +138,26 @@ func (mplex cacheMultiplexer) Store(target *core.BuildTarget, key []byte, files
 // This is a little inefficient since we could write the file to plz-out then copy it to the dir cache,
 // but it's hard to fix that without breaking the cache abstraction.
 func (mplex cacheMultiplexer) storeUntil(target *core.BuildTarget, key []byte, files []string, stopAt int) {
+	size := outputSize(target, files)
 	// Attempt to store on all caches simultaneously.
 	var wg sync.WaitGroup
-	for i, cache := range mplex.caches {
+	for i, tier := range mplex.caches {
 		if i == stopAt {
 			break
+		} else if !tier.shouldStore(target, size) {
+			continue
 		}
 		wg.Add(1)
-		go func(cache core.Cache) {
-			cache.Store(target, key, files)
+		go func(tier cacheTier) {
+			start := time.Now()
+			tier.Store(target, key, files)
+			atomic.AddInt64((*int64)(&tier.stats.StoreTime), int64(time.Since(start)))
+			atomic.AddInt64(&tier.stats.Stores, 1)
+			if size > 0 {
+				atomic.AddInt64(&tier.stats.BytesStored, size)
+			}
 			wg.Done()
-		}(cache)
+		}(tier)
 	}
 	wg.Wait()
 }
@@ -72,16 +165,42 @@ func (mplex cacheMultiplexer) storeUntil(target *core.BuildTarget, key []byte, f
 func (mplex cacheMultiplexer) Retrieve(target *core.BuildTarget, key []byte, files []string) bool {
 	// Retrieve from caches sequentially; if we did them simultaneously we could
 	// easily write the same file from two goroutines at once.
-	for i, cache := range mplex.caches {
-		if ok := cache.Retrieve(target, key, files); ok {
-			// Store this into other caches
-			mplex.storeUntil(target, key, files, i)
-			return ok
+	for i, tier := range mplex.caches {
+		if !tier.shouldRetrieve(target) {
+			continue
+		}
+		start := time.Now()
+		retrieved := tier.Retrieve(target, key, files)
+		atomic.AddInt64((*int64)(&tier.stats.RetrieveTime), int64(time.Since(start)))
+		if !retrieved {
+			atomic.AddInt64(&tier.stats.Misses, 1)
+			continue
 		}
+		atomic.AddInt64(&tier.stats.Hits, 1)
+		if size := outputSize(target, files); size > 0 {
+			atomic.AddInt64(&tier.stats.BytesRetrieved, size)
+		}
+		// Store this into other caches
+		mplex.storeUntil(target, key, files, i)
+		return true
 	}
 	return false
 }
 
+// outputSize returns the total size of the given outputs of a target, or -1 if it can't be determined.
+func outputSize(target *core.BuildTarget, files []string) int64 {
+	var size uint64
+	for _, file := range files {
+		s, err := findSize(path.Join(core.RepoRoot, target.OutDir(), file))
+		if err != nil {
+			log.Warning("Failed to determine size of %s: %s", file, err)
+			return -1
+		}
+		size += s
+	}
+	return int64(size)
+}
+
 func (mplex cacheMultiplexer) Clean(target *core.BuildTarget) {
 	for _, cache := range mplex.caches {
 		cache.Clean(target)
@@ -98,4 +217,28 @@ func (mplex cacheMultiplexer) Shutdown() {
 	for _, cache := range mplex.caches {
 		cache.Shutdown()
 	}
+	mplex.writeStats()
+}
+
+// CacheStats returns a snapshot of the statistics for each tier.
+func (mplex cacheMultiplexer) CacheStats() []core.CacheStats {
+	ret := make([]core.CacheStats, len(mplex.caches))
+	for i, tier := range mplex.caches {
+		ret[i] = core.CacheStats{
+			Name:           tier.stats.Name,
+			Hits:           atomic.LoadInt64(&tier.stats.Hits),
+			Misses:         atomic.LoadInt64(&tier.stats.Misses),
+			Stores:         atomic.LoadInt64(&tier.stats.Stores),
+			BytesRetrieved: atomic.LoadInt64(&tier.stats.BytesRetrieved),
+			BytesStored:    atomic.LoadInt64(&tier.stats.BytesStored),
+			RetrieveTime:   time.Duration(atomic.LoadInt64((*int64)(&tier.stats.RetrieveTime))),
+			StoreTime:      time.Duration(atomic.LoadInt64((*int64)(&tier.stats.StoreTime))),
+		}
+	}
+	return ret
+}
+
+// PendingStores always returns zero since the multiplexer stores synchronously.
+func (mplex cacheMultiplexer) PendingStores() int {
+	return 0
 }
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestTierOrder(t *testing.T) {
+	dir, http, remote := &tierCache{}, &tierCache{}, &tierCache{}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http, "remote": remote}, []string{"remote", "dir"}, nil)
+	assert.Equal(t, []core.Cache{remote, dir, http}, caches(mplex))
+	// Caches that aren't configured are skipped.
+	mplex = newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, []string{"remote", "http"}, nil)
+	assert.Equal(t, []core.Cache{http, dir}, caches(mplex))
+}
+
+func TestRetrieveBackfills(t *testing.T) {
+	dir, http := &tierCache{}, &tierCache{retrieve: true}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, nil, nil)
+	target := makeTarget1("//pkg1:backfill")
+	assert.True(t, mplex.Retrieve(target, nil, nil))
+	assert.True(t, dir.stored[target])
+	assert.False(t, http.stored[target])
+}
+
+func TestReadOnlyTier(t *testing.T) {
+	dir, http := &tierCache{}, &tierCache{retrieve: true}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, nil, map[string]*core.CacheTier{
+		"dir": {ReadOnly: true},
+	})
+	target := makeTarget1("//pkg1:read_only")
+	assert.True(t, mplex.Retrieve(target, nil, nil))
+	assert.False(t, dir.stored[target])
+	mplex.Store(target, nil, nil)
+	assert.False(t, dir.stored[target])
+	assert.True(t, http.stored[target])
+}
+
+func TestWriteOnlyTier(t *testing.T) {
+	dir, http := &tierCache{}, &tierCache{retrieve: true}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, nil, map[string]*core.CacheTier{
+		"http": {WriteOnly: true},
+	})
+	target := makeTarget1("//pkg1:write_only")
+	assert.False(t, mplex.Retrieve(target, nil, nil))
+	mplex.Store(target, nil, nil)
+	assert.True(t, http.stored[target])
+}
+
+func TestTierLabels(t *testing.T) {
+	dir, http := &tierCache{retrieve: true}, &tierCache{retrieve: true}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, []string{"http", "dir"}, map[string]*core.CacheTier{
+		"http": {IncludeLabel: []string{"shared"}, ExcludeLabel: []string{"large"}},
+	})
+	target1 := makeTarget1("//pkg1:unlabelled")
+	target2 := makeTarget1("//pkg1:shared")
+	target2.AddLabel("shared")
+	target3 := makeTarget1("//pkg1:shared_large")
+	target3.AddLabel("shared")
+	target3.AddLabel("large")
+	for _, target := range []*core.BuildTarget{target1, target2, target3} {
+		mplex.Store(target, nil, nil)
+		assert.True(t, dir.stored[target])
+		assert.True(t, mplex.Retrieve(target, nil, nil))
+	}
+	assert.False(t, http.stored[target1])
+	assert.True(t, http.stored[target2])
+	assert.False(t, http.stored[target3])
+	assert.False(t, http.retrieved[target1])
+	assert.True(t, http.retrieved[target2])
+	assert.False(t, http.retrieved[target3])
+}
+
+func TestTierMaxSize(t *testing.T) {
+	dir, http := &tierCache{}, &tierCache{}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, nil, map[string]*core.CacheTier{
+		"http": {MaxSize: 1000},
+	})
+	small := makeSizedTarget(t, "//pkg1:small", 500)
+	large := makeSizedTarget(t, "//pkg1:large", 2000)
+	mplex.Store(small, nil, small.Outputs())
+	mplex.Store(large, nil, large.Outputs())
+	assert.True(t, dir.stored[small])
+	assert.True(t, dir.stored[large])
+	assert.True(t, http.stored[small])
+	assert.False(t, http.stored[large])
+}
+
+func TestMultiplexerStats(t *testing.T) {
+	dir, http := &tierCache{}, &tierCache{retrieve: true}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, nil, map[string]*core.CacheTier{
+		"http": {IncludeLabel: []string{"shared"}},
+	})
+	target1 := makeTarget1("//pkg1:stats1")
+	target1.AddLabel("shared")
+	target2 := makeTarget1("//pkg1:stats2")
+	assert.True(t, mplex.Retrieve(target1, nil, nil))
+	assert.False(t, mplex.Retrieve(target2, nil, nil))
+	assert.EqualValues(t, 0, mplex.caches[0].stats.Hits)
+	assert.EqualValues(t, 2, mplex.caches[0].stats.Misses)
+	assert.EqualValues(t, 1, mplex.caches[1].stats.Hits)
+	assert.EqualValues(t, 0, mplex.caches[1].stats.Misses)
+	assert.Equal(t, 1.0, mplex.caches[1].stats.HitRate())
+	// The hit from http gets backfilled into dir.
+	stats := mplex.CacheStats()
+	assert.EqualValues(t, 1, stats[0].Stores)
+	assert.EqualValues(t, 0, stats[1].Stores)
+}
+
+func TestMultiplexerBytes(t *testing.T) {
+	dir, http := &tierCache{}, &tierCache{retrieve: true}
+	mplex := newCacheMultiplexer(map[string]core.Cache{"dir": dir, "http": http}, []string{"http", "dir"}, nil)
+	target := makeSizedTarget(t, "//pkg1:bytes", 300)
+	mplex.Store(target, nil, target.Outputs())
+	assert.True(t, mplex.Retrieve(target, nil, target.Outputs()))
+	stats := mplex.CacheStats()
+	assert.Equal(t, "http", stats[0].Name)
+	assert.EqualValues(t, 300, stats[0].BytesRetrieved)
+	assert.EqualValues(t, 300, stats[0].BytesStored)
+	assert.EqualValues(t, 1, stats[0].Stores)
+	assert.Equal(t, "dir", stats[1].Name)
+	assert.EqualValues(t, 0, stats[1].BytesRetrieved)
+	assert.EqualValues(t, 300, stats[1].BytesStored)
+	assert.True(t, stats[0].RetrieveTime > 0)
+}
+
+func TestSingleTierWithPolicy(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = ".plz-cache-tier"
+	config.CacheTier = map[string]*core.CacheTier{"dir": {ReadOnly: true}}
+	_, ok := newSyncCache(core.NewBuildState(config), false).(*cacheMultiplexer)
+	assert.True(t, ok)
+}
+
+func caches(mplex *cacheMultiplexer) []core.Cache {
+	ret := make([]core.Cache, len(mplex.caches))
+	for i, tier := range mplex.caches {
+		ret[i] = tier.Cache
+	}
+	return ret
+}
+
+func makeSizedTarget(t *testing.T, label string, size int) *core.BuildTarget {
+	target := makeTarget1(label)
+	target.AddOutput(target.Label.Name + ".txt")
+	filename := path.Join(target.OutDir(), target.Label.Name+".txt")
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(filename, make([]byte, size), 0644))
+	return target
+}
+
+// A tierCache is a fake cache that records what has been stored & retrieved from it.
+type tierCache struct {
+	sync.Mutex
+	retrieve  bool
+	stored    map[*core.BuildTarget]bool
+	retrieved map[*core.BuildTarget]bool
+}
+
+func (c *tierCache) Store(target *core.BuildTarget, key []byte, files []string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.stored == nil {
+		c.stored = map[*core.BuildTarget]bool{}
+	}
+	c.stored[target] = true
+}
+
+func (c *tierCache) Retrieve(target *core.BuildTarget, key []byte, files []string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.retrieved == nil {
+		c.retrieved = map[*core.BuildTarget]bool{}
+	}
+	c.retrieved[target] = true
+	return c.retrieve
+}
+
+func (c *tierCache) Clean(target *core.BuildTarget) {}
+func (c *tierCache) CleanAll()                      {}
+func (c *tierCache) Shutdown()                      {}
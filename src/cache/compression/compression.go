@@ -0,0 +1,41 @@
+// Package compression implements the content encodings used by the v2 HTTP cache protocol.
+// It's shared between the client in src/cache and the server in tools/http_cache.
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// NewEncoder returns a writer that compresses using the given encoding.
+func NewEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("Unknown encoding %s", encoding)
+}
+
+// NewDecoder returns a reader that decompresses using the given encoding.
+// An empty encoding or identity returns the original contents.
+func NewDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("Unknown content encoding %s", encoding)
+}
@@ -5,9 +5,12 @@ package cache
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/base64"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -27,13 +30,19 @@ import (
 type dirCache struct {
 	Dir      string
 	Compress bool
+	CAS      bool
 	Suffix   string
 	mtime    time.Time
 	added    map[string]uint64
 	mutex    sync.Mutex
+	hasher   *fs.PathHasher
 }
 
 func (cache *dirCache) Store(target *core.BuildTarget, key []byte, files []string) {
+	if cache.CAS {
+		cache.storeCAS(target, key, files)
+		return
+	}
 	cacheDir := cache.getPath(target, key, "")
 	tmpDir := cache.getFullPath(target, key, "", "=")
 	cache.markDir(cacheDir, 0)
@@ -195,6 +204,9 @@ func (cache *dirCache) retrieve(target *core.BuildTarget, key []byte, suffix str
 }
 
 func (cache *dirCache) retrieveFiles(target *core.BuildTarget, cacheDir string, outs []string) (bool, error) {
+	if cache.CAS {
+		return cache.retrieveCAS(target, cacheDir)
+	}
 	if !core.PathExists(cacheDir) {
 		log.Debug("%s: %s doesn't exist in dir cache", target.Label, cacheDir)
 		return false, nil
@@ -313,7 +325,7 @@ func (cache *dirCache) getPath(target *core.BuildTarget, key []byte, extra strin
 
 func (cache *dirCache) getFullPath(target *core.BuildTarget, key []byte, extra, suffix string) string {
 	// The extra identifier is not needed for non-compressed caches.
-	if !cache.Compress {
+	if !cache.Compress || cache.CAS {
 		extra = ""
 	} else {
 		extra = strings.ReplaceAll(extra, "/", "_")
@@ -338,15 +350,19 @@ func (cache *dirCache) isMarked(path string) (uint64, bool) {
 	return size, present
 }
 
-func newDirCache(config *core.Configuration) *dirCache {
+func newDirCache(config *core.Configuration, hasher *fs.PathHasher) *dirCache {
 	cache := &dirCache{
-		Compress: config.Cache.DirCompress,
+		Compress: config.Cache.DirCompress && !config.Cache.DirCAS,
+		CAS:      config.Cache.DirCAS,
 		Dir:      config.Cache.Dir,
 		added:    map[string]uint64{},
 		mtime:    time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		hasher:   hasher,
 	}
 	if cache.Compress {
 		cache.Suffix = ".tar.gz"
+	} else if cache.CAS {
+		cache.Suffix = casManifestSuffix
 	}
 	// Absolute paths are allowed. Relative paths are interpreted relative to the repo root.
 	if config.Cache.Dir[0] != '/' {
@@ -390,6 +406,9 @@ func findSize(path string) (uint64, error) {
 // clean runs background cleaning of this cache until the process exits.
 // Returns the total size of the cache after it's finished.
 func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
+	if cache.CAS {
+		return cache.cleanCAS(highWaterMark, lowWaterMark)
+	}
 	entries := []cacheEntry{}
 	var totalSize uint64
 	if err := fs.Walk(cache.Dir, func(path string, isDir bool) error {
@@ -459,8 +478,8 @@ func (cache *dirCache) clean(highWaterMark, lowWaterMark uint64) uint64 {
 // shouldClean returns true if we should clean this file.
 // We track this in order to clean only entire entries in the cache, not just individual files from them.
 func (cache *dirCache) shouldClean(name string, isDir bool) bool {
-	if cache.Compress == isDir {
-		return false // If we're compressing, don't look for directories. If we're not, only look at directories.
+	if (cache.Compress || cache.CAS) == isDir {
+		return false // If we're compressing or using manifests, don't look for directories. If we're not, only look at directories.
 	} else if !strings.HasSuffix(name, cache.Suffix) {
 		return false // Suffix must match.
 	}
@@ -471,3 +490,123 @@ func (cache *dirCache) shouldClean(name string, isDir bool) bool {
 	// Similarly for sha256 which is length 44.
 	return ((len(name) == 28 || len(name) == 29) && name[27] == '=') || ((len(name) == 44 || len(name) == 45) && name[43] == '=')
 }
+
+// Entries implements core.EnumerableCache.
+func (cache *dirCache) Entries() ([]*core.CacheEntry, error) {
+	if cache.CAS {
+		return cache.casEntries()
+	}
+	entries := []*core.CacheEntry{}
+	err := fs.Walk(cache.Dir, func(name string, isDir bool) error {
+		if !cache.shouldClean(filepath.Base(name), isDir) {
+			return nil
+		}
+		entry := cache.newEntry(name)
+		if entry == nil {
+			return nil // Not a complete entry; probably one that's still being written.
+		}
+		size, err := findSize(name)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		entry.Size = size
+		entry.Accessed = atime.Get(info)
+		entries = append(entries, entry)
+		if isDir {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// newEntry creates a new cache entry from its path, or returns nil if the path isn't a valid entry.
+// Entries are stored at <pkg>/<name>/<key>, so we can work out the target's label from them.
+func (cache *dirCache) newEntry(filename string) *core.CacheEntry {
+	dir, file := path.Split(strings.TrimPrefix(filename, cache.Dir+"/"))
+	key, err := base64.URLEncoding.DecodeString(strings.TrimSuffix(file, cache.Suffix))
+	if err != nil {
+		return nil
+	}
+	pkg, name := path.Split(strings.TrimSuffix(dir, "/"))
+	return &core.CacheEntry{
+		Label: core.BuildLabel{PackageName: strings.TrimSuffix(pkg, "/"), Name: name},
+		Key:   key,
+		Path:  filename,
+	}
+}
+
+// Verify implements core.EnumerableCache.
+// Compressed entries are checked against the checksums in the tarball; uncompressed ones are
+// checked against any hashes recorded on their files when they were built.
+func (cache *dirCache) Verify(entry *core.CacheEntry) error {
+	if cache.CAS {
+		return cache.verifyCAS(entry)
+	} else if cache.Compress {
+		return cache.verifyCompressed(entry)
+	}
+	return fs.WalkMode(entry.Path, func(name string, isDir bool, mode os.FileMode) error {
+		if isDir || mode&os.ModeSymlink != 0 {
+			return nil
+		}
+		recorded := cache.hasher.RecordedHash(name)
+		if recorded == nil {
+			return nil
+		}
+		hash, err := cache.hashFile(name)
+		if err != nil {
+			return err
+		} else if !bytes.Equal(hash, recorded) {
+			return fmt.Errorf("%s doesn't match its recorded hash", name)
+		}
+		return nil
+	})
+}
+
+// hashFile returns the hash of a single file in the cache.
+// It doesn't use the usual memoisation since we want to know the file's current contents.
+func (cache *dirCache) hashFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := cache.hasher.NewHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyCompressed verifies a single compressed entry by reading it fully, which checks its checksum.
+func (cache *dirCache) verifyCompressed(entry *core.CacheEntry) error {
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Remove implements core.EnumerableCache.
+func (cache *dirCache) Remove(entry *core.CacheEntry) error {
+	return os.RemoveAll(entry.Path)
+}
@@ -0,0 +1,438 @@
+// Content-addressed storage for the directory cache.
+//
+// In this mode each file is stored once as a blob named by its hash, and each (target, key)
+// entry is just a small manifest describing where those blobs go in the output tree.
+// Identical outputs from different targets (or different keys of the same target) therefore
+// only take up space once.
+
+package cache
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/djherbis/atime"
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// casBlobDir is the directory under the cache root that blobs are stored in.
+// It's deliberately not a valid package name so it can't clash with any manifests.
+const casBlobDir = ".blobs"
+
+// casManifestSuffix is the suffix applied to manifest files.
+const casManifestSuffix = ".manifest"
+
+// A casManifest describes a single stored entry in the CAS-backed cache.
+type casManifest struct {
+	Entries []casEntry `json:"entries"`
+}
+
+// A casEntry is a single file, directory or symlink within a manifest.
+type casEntry struct {
+	// Path of the entry, relative to the target's output directory.
+	Path string `json:"path"`
+	// Mode of the entry, including type bits.
+	Mode os.FileMode `json:"mode"`
+	// Hex-encoded digest of the file's contents. Only set for regular files.
+	Digest string `json:"digest,omitempty"`
+	// Destination of the link. Only set for symlinks.
+	Link string `json:"link,omitempty"`
+}
+
+// storeCAS stores the given files as blobs and writes a manifest referencing them.
+func (cache *dirCache) storeCAS(target *core.BuildTarget, key []byte, files []string) {
+	manifestPath := cache.getPath(target, key, "")
+	cache.markDir(manifestPath, 0)
+	manifest, err := cache.storeBlobs(target, files)
+	if err != nil {
+		log.Warning("Failed to store %s in dir cache: %s", target.Label, err)
+		return
+	}
+	if err := cache.writeManifest(manifestPath, manifest); err != nil {
+		log.Warning("Failed to write cache manifest %s: %s", manifestPath, err)
+	}
+}
+
+// storeBlobs stores the contents of all the given outputs into the blob store.
+func (cache *dirCache) storeBlobs(target *core.BuildTarget, files []string) (*casManifest, error) {
+	return newCASManifest(path.Join(core.RepoRoot, target.OutDir()), files, func(name string, entry *casEntry) error {
+		// This is the key in the blob store so it must reflect the current contents, not a memoised value.
+		digest, err := cache.hasher.Hash(name, true, true)
+		if err != nil {
+			return err
+		}
+		entry.Digest = hex.EncodeToString(digest)
+		return cache.storeBlob(name, entry.Digest, entry.Mode)
+	})
+}
+
+// newCASManifest walks the given outputs and creates a manifest for them.
+// The given function is called for each regular file and must set the entry's digest.
+func newCASManifest(outDir string, files []string, storeFile func(name string, entry *casEntry) error) (*casManifest, error) {
+	manifest := &casManifest{}
+	for _, file := range files {
+		if err := fs.WalkMode(path.Join(outDir, file), func(name string, isDir bool, mode os.FileMode) error {
+			entry := casEntry{Path: strings.TrimLeft(strings.TrimPrefix(name, outDir), "/")}
+			info, err := os.Lstat(name)
+			if err != nil {
+				return err
+			}
+			entry.Mode = info.Mode()
+			if mode&os.ModeSymlink != 0 {
+				if entry.Link, err = os.Readlink(name); err != nil {
+					return err
+				}
+			} else if !isDir {
+				if err := storeFile(name, &entry); err != nil {
+					return err
+				}
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// storeBlob stores a single file as a blob, if it isn't already present.
+// It's written to a unique temporary file first so concurrent writers of the same blob can't
+// interfere with one another; whichever renames last wins, but they have the same contents anyway.
+func (cache *dirCache) storeBlob(filename, digest string, mode os.FileMode) error {
+	blob := cache.blobPath(digest)
+	info, err := os.Stat(blob)
+	if err == nil {
+		cache.markDir(blob, uint64(info.Size()))
+		return nil
+	}
+	dir := path.Dir(blob)
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		return err
+	}
+	log.Debug("Storing blob %s in dir cache", digest)
+	// The suffix keeps it out of findBlobs while it's being written.
+	tmp, err := ioutil.TempFile(dir, digest+".*=")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Harmless if it's been renamed already.
+	size, err := copyBlob(filename, tmp, mode)
+	if err != nil {
+		return err
+	}
+	// Mark this before it becomes visible so a concurrent clean doesn't consider it an orphan.
+	cache.markDir(blob, uint64(size))
+	return os.Rename(tmp.Name(), blob)
+}
+
+// copyBlob copies the given file into a blob's temporary file, and closes it.
+func copyBlob(filename string, tmp *os.File, mode os.FileMode) (int64, error) {
+	defer tmp.Close()
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := io.Copy(tmp, f)
+	if err != nil {
+		return 0, err
+	} else if err := tmp.Chmod(mode.Perm()); err != nil {
+		return 0, err
+	}
+	return size, tmp.Close()
+}
+
+// writeManifest writes a manifest file to the given path.
+func (cache *dirCache) writeManifest(filename string, manifest *casManifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	} else if err := cache.ensureStoreReady(filename + "="); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(filename+"=", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+"=", filename)
+}
+
+// readManifest reads a manifest file from the given path.
+func (cache *dirCache) readManifest(filename string) (*casManifest, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &casManifest{}
+	return manifest, json.Unmarshal(b, manifest)
+}
+
+// retrieveCAS retrieves the outputs of a target via the given manifest.
+func (cache *dirCache) retrieveCAS(target *core.BuildTarget, manifestPath string) (bool, error) {
+	manifest, err := cache.readManifest(manifestPath)
+	if os.IsNotExist(err) {
+		log.Debug("%s: %s doesn't exist in dir cache", target.Label, manifestPath)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// Check all the blobs are present before we start touching the output directory.
+	for _, entry := range manifest.Entries {
+		if entry.Digest != "" && !core.PathExists(cache.blobPath(entry.Digest)) {
+			log.Debug("%s: blob %s for %s is missing from dir cache", target.Label, entry.Digest, entry.Path)
+			return false, nil
+		}
+	}
+	cache.markDir(manifestPath, 0)
+	for _, entry := range manifest.Entries {
+		if entry.Mode.IsDir() {
+			if err := os.MkdirAll(path.Join(core.RepoRoot, target.OutDir(), entry.Path), core.DirPermissions); err != nil {
+				return false, err
+			}
+			continue
+		}
+		out, err := cache.ensureRetrieveReady(target, entry.Path)
+		if err != nil {
+			return false, err
+		} else if entry.Mode&os.ModeSymlink != 0 {
+			if err := os.Symlink(entry.Link, out); err != nil {
+				return false, err
+			}
+		} else if err := cache.retrieveBlob(entry, out); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// retrieveBlob retrieves a single blob to the given output file.
+// Blobs are shared between entries that may have different permissions, so it's only linked
+// if the permissions match; otherwise it's copied.
+func (cache *dirCache) retrieveBlob(entry casEntry, out string) error {
+	blob := cache.blobPath(entry.Digest)
+	cache.markDir(blob, 0)
+	info, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	link := info.Mode().Perm() == entry.Mode.Perm()
+	return fs.CopyOrLinkFile(blob, out, info.Mode(), entry.Mode.Perm(), link, true)
+}
+
+// blobPath returns the path to the blob with the given digest.
+func (cache *dirCache) blobPath(digest string) string {
+	return path.Join(cache.Dir, casBlobDir, digest[:2], digest)
+}
+
+// A casManifestEntry represents a single manifest in the cache, as found when cleaning.
+type casManifestEntry struct {
+	Path    string
+	Atime   int64
+	Digests []string
+}
+
+// cleanCAS is the equivalent of clean for content-addressed caches.
+// Blobs are reference counted by the manifests that refer to them; manifests are evicted in
+// LRU order and a blob is only deleted once nothing refers to it any more.
+func (cache *dirCache) cleanCAS(highWaterMark, lowWaterMark uint64) uint64 {
+	blobs, totalSize, err := cache.findBlobs()
+	if err != nil {
+		log.Error("error walking cache blob directory: %s", err)
+		return totalSize
+	}
+	entries, refs, err := cache.findManifests()
+	if err != nil {
+		log.Error("error walking cache directory: %s", err)
+		return totalSize
+	}
+	log.Info("Total cache size: %s in %d blobs", humanize.Bytes(totalSize), len(blobs))
+	if totalSize < highWaterMark {
+		return totalSize
+	}
+	// Anything nobody refers to can go straight away.
+	for digest, size := range blobs {
+		if refs[digest] == 0 && cache.removeBlob(digest) {
+			totalSize -= size
+			delete(blobs, digest)
+		}
+	}
+	if totalSize < lowWaterMark {
+		return totalSize
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Atime < entries[j].Atime
+	})
+	for _, entry := range entries {
+		if _, marked := cache.isMarked(entry.Path); marked {
+			continue
+		}
+		log.Debug("Cleaning %s, accessed %s", entry.Path, humanize.Time(time.Unix(entry.Atime, 0)))
+		if err := os.Remove(entry.Path); err != nil {
+			log.Errorf("Couldn't remove %s: %s", entry.Path, err)
+			continue
+		}
+		for _, digest := range entry.Digests {
+			if refs[digest]--; refs[digest] == 0 {
+				if size, present := blobs[digest]; present && cache.removeBlob(digest) {
+					totalSize -= size
+				}
+			}
+		}
+		if totalSize < lowWaterMark {
+			break
+		}
+	}
+	return totalSize
+}
+
+// findBlobs returns the sizes of all blobs in the cache, and their total size.
+func (cache *dirCache) findBlobs() (map[string]uint64, uint64, error) {
+	blobs := map[string]uint64{}
+	var totalSize uint64
+	dir := path.Join(cache.Dir, casBlobDir)
+	if !core.PathExists(dir) {
+		return blobs, 0, nil
+	}
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.IsDir() && !strings.HasSuffix(name, "=") {
+			blobs[info.Name()] = uint64(info.Size())
+			totalSize += uint64(info.Size())
+		}
+		return nil
+	})
+	return blobs, totalSize, err
+}
+
+// findManifests returns all the manifests in the cache, and the number of references to each blob.
+func (cache *dirCache) findManifests() ([]casManifestEntry, map[string]int, error) {
+	entries := []casManifestEntry{}
+	refs := map[string]int{}
+	err := fs.Walk(cache.Dir, func(name string, isDir bool) error {
+		if isDir && filepath.Base(name) == casBlobDir {
+			return filepath.SkipDir
+		} else if !cache.shouldClean(filepath.Base(name), isDir) {
+			return nil
+		}
+		// Stat this before reading it, which may update its atime.
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		manifest, err := cache.readManifest(name)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %s", name, err)
+		}
+		entry := casManifestEntry{Path: name, Atime: atime.Get(info).Unix()}
+		for _, e := range manifest.Entries {
+			if e.Digest != "" {
+				entry.Digests = append(entry.Digests, e.Digest)
+				refs[e.Digest]++
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, refs, err
+}
+
+// removeBlob removes a single blob from the cache. It returns true if it was removed.
+func (cache *dirCache) removeBlob(digest string) bool {
+	blob := cache.blobPath(digest)
+	if _, marked := cache.isMarked(blob); marked {
+		return false
+	}
+	log.Debug("Removing unreferenced blob %s", digest)
+	if err := os.Remove(blob); err != nil {
+		log.Errorf("Couldn't remove %s: %s", blob, err)
+		return false
+	}
+	return true
+}
+
+// casEntries returns all the entries in a content-addressed cache.
+func (cache *dirCache) casEntries() ([]*core.CacheEntry, error) {
+	blobs, _, err := cache.findBlobs()
+	if err != nil {
+		return nil, err
+	}
+	manifests, _, err := cache.findManifests()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*core.CacheEntry, 0, len(manifests))
+	for _, manifest := range manifests {
+		entry := cache.newEntry(manifest.Path)
+		if entry == nil {
+			continue
+		}
+		entry.Accessed = time.Unix(manifest.Atime, 0)
+		seen := map[string]bool{}
+		for _, digest := range manifest.Digests {
+			if !seen[digest] {
+				entry.Size += blobs[digest]
+				seen[digest] = true
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// verifyCAS verifies a single entry in a content-addressed cache by rehashing all its blobs.
+func (cache *dirCache) verifyCAS(entry *core.CacheEntry) error {
+	manifest, err := cache.readManifest(entry.Path)
+	if err != nil {
+		return err
+	}
+	for _, e := range manifest.Entries {
+		if e.Digest == "" {
+			continue
+		}
+		hash, err := cache.hashFile(cache.blobPath(e.Digest))
+		if err != nil {
+			return err
+		} else if digest := hex.EncodeToString(hash); digest != e.Digest {
+			return fmt.Errorf("blob for %s has digest %s, expected %s", e.Path, digest, e.Digest)
+		}
+	}
+	return nil
+}
+
+// removeOrphans removes any blobs that are no longer referenced by any manifest.
+// This is needed after removing entries, since that only removes their manifests.
+// It returns the number of bytes freed.
+func (cache *dirCache) removeOrphans() uint64 {
+	if !cache.CAS {
+		return 0
+	}
+	blobs, _, err := cache.findBlobs()
+	if err != nil {
+		log.Error("error walking cache blob directory: %s", err)
+		return 0
+	}
+	_, refs, err := cache.findManifests()
+	if err != nil {
+		log.Error("error walking cache directory: %s", err)
+		return 0
+	}
+	var freed uint64
+	for digest, size := range blobs {
+		if refs[digest] == 0 && cache.removeBlob(digest) {
+			freed += size
+		}
+	}
+	return freed
+}
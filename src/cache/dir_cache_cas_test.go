@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func manifestPath(target *core.BuildTarget) string {
+	return path.Join(".plz-cache-"+target.Label.PackageName, target.Label.PackageName, target.Label.Name, b64Hash+".manifest")
+}
+
+func inCASCache(target *core.BuildTarget) bool {
+	return core.PathExists(manifestPath(target))
+}
+
+func makeCASCache(dir string) *dirCache {
+	cache := makeCache(dir, false)
+	cache.CAS = true
+	cache.Suffix = casManifestSuffix
+	return cache
+}
+
+func TestStoreAndRetrieveCAS(t *testing.T) {
+	cache := makeCASCache(".plz-cache-test8")
+	target := makeTarget2("//test8:target8", 20)
+	cache.Store(target, hash, target.Outputs())
+	assert.True(t, inCASCache(target))
+	out := path.Join(target.OutDir(), "test.go")
+	assert.NoError(t, os.Remove(out))
+	assert.True(t, cache.Retrieve(target, hash, target.Outputs()))
+	assert.True(t, core.PathExists(out))
+	// Should be able to store it again without problems
+	cache.Store(target, hash, target.Outputs())
+	assert.True(t, inCASCache(target))
+	assert.True(t, cache.Retrieve(target, hash, target.Outputs()))
+}
+
+func TestRetrieveCASMissingBlob(t *testing.T) {
+	cache := makeCASCache(".plz-cache-test9")
+	target := makeTarget2("//test9:target9", 20)
+	cache.Store(target, hash, target.Outputs())
+	assert.NoError(t, os.RemoveAll(path.Join(cache.Dir, casBlobDir)))
+	assert.False(t, cache.Retrieve(target, hash, target.Outputs()))
+}
+
+func TestCASDeduplicates(t *testing.T) {
+	cache := makeCASCache(".plz-cache-test10")
+	target1 := makeTarget2("//test10:target1", 2000)
+	cache.Store(target1, hash, target1.Outputs())
+	target2 := makeTarget2("//test10/sub:target2", 2000)
+	cache.Store(target2, hash, target2.Outputs())
+	// Both have the same contents so are only stored once.
+	assert.EqualValues(t, 6000, cache.clean(20000, 1000))
+}
+
+func TestCleanCAS(t *testing.T) {
+	const dir = ".plz-cache-test11"
+	cache := makeCASCache(dir)
+	target1 := makeTarget2("//test11/a:target1", 2000)
+	cache.Store(target1, hash, target1.Outputs())
+	target2 := makeTarget2("//test11/b:target2", 2000)
+	cache.Store(target2, hash, target2.Outputs())
+	target3 := makeTarget2("//test11/c:target3", 1000)
+	cache.Store(target3, hash, target3.Outputs())
+	// Use a new cache so nothing is marked as recently used; set the access times explicitly
+	// so target1 is the oldest, then target3, then target2.
+	cache = makeCASCache(dir)
+	now := time.Now()
+	for i, target := range []*core.BuildTarget{target1, target3, target2} {
+		when := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(path.Join(dir, target.Label.PackageName, target.Label.Name, b64Hash+".manifest"), when, when)
+	}
+	// Cleaning target1 frees nothing since target2 shares its blob; cleaning target3 does.
+	assert.EqualValues(t, 6000, cache.clean(8000, 7000))
+	assert.False(t, core.PathExists(path.Join(dir, "test11/a/target1", b64Hash+".manifest")))
+	assert.True(t, core.PathExists(path.Join(dir, "test11/b/target2", b64Hash+".manifest")))
+	assert.False(t, core.PathExists(path.Join(dir, "test11/c/target3", b64Hash+".manifest")))
+	assert.True(t, cache.Retrieve(target2, hash, target2.Outputs()))
+}
+
+func TestVerifyCAS(t *testing.T) {
+	cache := makeCASCache(".plz-cache-test14")
+	target := makeTarget2("//test14:target1", 20)
+	cache.Store(target, hash, target.Outputs())
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, target.Label, entries[0].Label)
+	assert.EqualValues(t, 60, entries[0].Size)
+	assert.NoError(t, cache.Verify(entries[0]))
+	blobs, _, err := cache.findBlobs()
+	assert.NoError(t, err)
+	for digest := range blobs {
+		writeFile(cache.blobPath(digest), 10)
+	}
+	assert.Error(t, cache.Verify(entries[0]))
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	cache := makeCASCache(".plz-cache-test15")
+	target1 := makeTarget2("//test15/a:target1", 20)
+	cache.Store(target1, hash, target1.Outputs())
+	target2 := makeTarget2("//test15/b:target2", 30)
+	cache.Store(target2, hash, target2.Outputs())
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	for _, entry := range entries {
+		if entry.Label == target1.Label {
+			assert.NoError(t, cache.Remove(entry))
+		}
+	}
+	// Use a new cache so the blobs aren't marked as recently added.
+	cache = makeCASCache(".plz-cache-test15")
+	assert.EqualValues(t, 60, cache.removeOrphans())
+	assert.True(t, cache.Retrieve(target2, hash, target2.Outputs()))
+}
+
+func TestStoreBlobConcurrently(t *testing.T) {
+	cache := makeCASCache(".plz-cache-test16")
+	const src = ".plz-cache-test16-src/blob.txt"
+	writeFile(src, 100)
+	const digest = "0123456789abcdef0123456789abcdef01234567"
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cache.storeBlob(src, digest, 0644)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	b, err := ioutil.ReadFile(cache.blobPath(digest))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, len(b))
+	// None of the temporary files should be left lying around.
+	files, err := ioutil.ReadDir(path.Dir(cache.blobPath(digest)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
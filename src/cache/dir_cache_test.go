@@ -2,6 +2,7 @@ package cache
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/base64"
 	"io/ioutil"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
 )
 
 var hash = []byte("12345678901234567890")
@@ -148,12 +150,47 @@ func TestCleanCompressed(t *testing.T) {
 	assert.True(t, inCompressedCache(target2))
 }
 
+func TestEntries(t *testing.T) {
+	cache := makeCache(".plz-cache-test12", false)
+	target1 := makeTarget2("//test12:target1", 20)
+	cache.Store(target1, hash, target1.Outputs())
+	target2 := makeTarget2("//test12:target2", 30)
+	cache.Store(target2, hash, target2.Outputs())
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	labels := map[core.BuildLabel]*core.CacheEntry{}
+	for _, entry := range entries {
+		labels[entry.Label] = entry
+		assert.Equal(t, hash, entry.Key)
+	}
+	// Sizes include the directories too, so we can't be exact about them.
+	assert.True(t, labels[target1.Label].Size >= 60)
+	assert.True(t, labels[target2.Label].Size >= 90)
+	assert.NoError(t, cache.Remove(labels[target1.Label]))
+	assert.False(t, inCache(target1))
+	assert.True(t, inCache(target2))
+}
+
+func TestVerifyCompressed(t *testing.T) {
+	cache := makeCache(".plz-cache-test13", true)
+	target := makeTarget2("//test13:target1", 200)
+	cache.Store(target, hash, target.Outputs())
+	entries, err := cache.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.NoError(t, cache.Verify(entries[0]))
+	// Truncate it, which should make it fail.
+	assert.NoError(t, os.Truncate(entries[0].Path, int64(entries[0].Size)/2))
+	assert.Error(t, cache.Verify(entries[0]))
+}
+
 func makeCache(dir string, compress bool) *dirCache {
 	config := core.DefaultConfiguration()
 	config.Cache.Dir = dir
 	config.Cache.DirClean = false // We will do this explicitly
 	config.Cache.DirCompress = compress
-	return newDirCache(config)
+	return newDirCache(config, fs.NewPathHasher(".", false, sha1.New, "sha1"))
 }
 
 func makeTarget2(label string, size int) *core.BuildTarget {
@@ -22,9 +22,11 @@ import (
 )
 
 type httpCache struct {
-	url      string
-	writable bool
-	client   *retryablehttp.Client
+	url         string
+	writable    bool
+	v2          bool
+	compression string
+	client      *retryablehttp.Client
 
 	requestLimiter limiter
 }
@@ -50,6 +52,12 @@ func (cache *httpCache) Store(target *core.BuildTarget, key []byte, files []stri
 		cache.requestLimiter.acquire()
 		defer cache.requestLimiter.release()
 
+		if cache.v2 {
+			if err := cache.storeV2(target, key, files); err != nil {
+				log.Warning("Failed to store files in HTTP cache: %s", err)
+			}
+			return
+		}
 		r, w := io.Pipe()
 		go cache.write(w, target, files)
 		req, err := retryablehttp.NewRequest(http.MethodPut, cache.makeURL(key), r)
@@ -138,6 +146,9 @@ func (cache *httpCache) Retrieve(target *core.BuildTarget, key []byte, files []s
 }
 
 func (cache *httpCache) retrieve(target *core.BuildTarget, key []byte) (bool, error) {
+	if cache.v2 {
+		return cache.retrieveV2(target, key)
+	}
 	req, err := retryablehttp.NewRequest(http.MethodGet, cache.makeURL(key), nil)
 	if err != nil {
 		return false, err
@@ -207,8 +218,10 @@ func (cache *httpCache) Shutdown() {}
 
 func newHTTPCache(config *core.Configuration) *httpCache {
 	return &httpCache{
-		url:      config.Cache.HTTPURL.String(),
-		writable: config.Cache.HTTPWriteable,
+		url:         config.Cache.HTTPURL.String(),
+		writable:    config.Cache.HTTPWriteable,
+		v2:          config.Cache.HTTPProtocol == "v2",
+		compression: config.Cache.HTTPCompression,
 		client: &retryablehttp.Client{
 			HTTPClient: &http.Client{
 				Timeout: time.Duration(config.Cache.HTTPTimeout),
@@ -1,10 +1,15 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,6 +17,12 @@ import (
 	"github.com/thought-machine/please/src/core"
 )
 
+var server = &testServer{
+	data:      map[string][]byte{},
+	encodings: map[string]string{},
+	puts:      map[string]int{},
+}
+
 func init() {
 	os.Chdir("src/cache/test_data")
 	// Split up the listen and serve parts to avoid race conditions.
@@ -20,9 +31,7 @@ func init() {
 		log.Fatalf("%s", err)
 	}
 	go func() {
-		http.Serve(lis, &testServer{
-			data: map[string][]byte{},
-		})
+		http.Serve(lis, server)
 	}()
 }
 
@@ -49,14 +58,131 @@ func TestStoreAndRetrieveHTTP(t *testing.T) {
 	assert.Equal(t, b, b2)
 }
 
+func TestStoreAndRetrieveHTTPV2(t *testing.T) {
+	for _, compression := range []string{"zstd", "gzip", "none"} {
+		t.Run(compression, func(t *testing.T) {
+			target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "label_name"))
+			target.AddOutput("testfile2")
+			cache := newV2Cache(compression)
+
+			key := []byte("test_key_" + compression)
+			cache.Store(target, key, target.Outputs())
+			b, err := ioutil.ReadFile("plz-out/gen/pkg/name/testfile2")
+			assert.NoError(t, err)
+
+			assert.NoError(t, os.Remove("plz-out/gen/pkg/name/testfile2"))
+			assert.True(t, cache.Retrieve(target, key, nil))
+			b2, err := ioutil.ReadFile("plz-out/gen/pkg/name/testfile2")
+			assert.NoError(t, err)
+			assert.Equal(t, b, b2)
+		})
+	}
+}
+
+func TestHTTPV2DoesNotReuploadFiles(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "label_name"))
+	target.AddOutput("testfile2")
+	cache := newV2Cache("zstd")
+	cache.Store(target, []byte("test_key_reupload_1"), target.Outputs())
+	cache.Store(target, []byte("test_key_reupload_2"), target.Outputs())
+	digest, err := sha256File("plz-out/gen/pkg/name/testfile2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.Puts("/v2/cas/"+digest))
+	assert.Equal(t, 1, server.Puts("/v2/ac/"+hex.EncodeToString([]byte("test_key_reupload_2"))))
+}
+
+func TestHTTPV2MissingBlob(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "label_name"))
+	target.AddOutput("testfile2")
+	cache := newV2Cache("gzip")
+	key := []byte("test_key_missing")
+	cache.Store(target, key, target.Outputs())
+	digest, err := sha256File("plz-out/gen/pkg/name/testfile2")
+	assert.NoError(t, err)
+	server.Delete("/v2/cas/" + digest)
+	assert.False(t, cache.Retrieve(target, key, nil))
+	// Put it back so the file is available for other tests.
+	cache.Store(target, key, target.Outputs())
+}
+
+func TestHTTPV2RejectsPathsOutsideOutDir(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "label_name"))
+	target.AddOutput("testfile2")
+	cache := newV2Cache("none")
+	for i, p := range []string{"../escaped", "/tmp/escaped", "dir/../../escaped", ""} {
+		key := []byte("test_key_escape" + string(rune('0'+i)))
+		server.Put("/v2/ac/"+hex.EncodeToString(key), []byte(`{"entries":[{"path":"`+p+`","mode":420}]}`))
+		assert.False(t, cache.Retrieve(target, key, nil), p)
+	}
+	assert.False(t, core.PathExists("plz-out/gen/pkg/escaped"))
+}
+
+func TestHTTPV2RejectsUnsafeSymlinks(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "label_name"))
+	target.AddOutput("testfile2")
+	cache := newV2Cache("none")
+	h := sha256.Sum256([]byte("symlinked"))
+	digest := hex.EncodeToString(h[:])
+	server.Put("/v2/cas/"+digest, []byte("symlinked"))
+	link := fmt.Sprintf(`{"path":"link","mode":%d,"link":"%%s"}`, os.ModeSymlink|0777)
+	for i, manifest := range []string{
+		fmt.Sprintf(link, "/etc"),
+		fmt.Sprintf(link, "../../escaped"),
+		// The link itself is fine, but the following entry is written through it.
+		fmt.Sprintf(`{"path":"sub","mode":%d},`, os.ModeDir|0755) + fmt.Sprintf(link, "sub") + `,{"path":"link/file","mode":420,"digest":"` + digest + `"}`,
+	} {
+		key := []byte("test_key_symlink" + string(rune('0'+i)))
+		server.Put("/v2/ac/"+hex.EncodeToString(key), []byte(`{"entries":[`+manifest+`]}`))
+		assert.False(t, cache.Retrieve(target, key, nil), manifest)
+	}
+	assert.False(t, core.PathExists(path.Join(core.RepoRoot, target.OutDir(), "sub/file")))
+}
+
+func TestCheckLink(t *testing.T) {
+	assert.NoError(t, checkLink("/repo/plz-out/gen/pkg", "/repo/plz-out/gen/pkg/dir/link", "../file.txt"))
+	assert.NoError(t, checkLink("/repo/plz-out/gen/pkg", "/repo/plz-out/gen/pkg/link", "dir/file.txt"))
+	assert.Error(t, checkLink("/repo/plz-out/gen/pkg", "/repo/plz-out/gen/pkg/link", "../pkg2/file.txt"))
+	assert.Error(t, checkLink("/repo/plz-out/gen/pkg", "/repo/plz-out/gen/pkg/link", "/etc/passwd"))
+}
+
+func TestOutputPath(t *testing.T) {
+	out, err := outputPath("/repo/plz-out/gen/pkg", "dir/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/repo/plz-out/gen/pkg/dir/file.txt", out)
+	_, err = outputPath("/repo/plz-out/gen/pkg", "../pkg2/file.txt")
+	assert.Error(t, err)
+	_, err = outputPath("/repo/plz-out/gen/pkg", "dir/../../file.txt")
+	assert.Error(t, err)
+	_, err = outputPath("/repo/plz-out/gen/pkg", "/etc/passwd")
+	assert.Error(t, err)
+	_, err = outputPath("/repo/plz-out/gen/pkg", ".")
+	assert.Error(t, err)
+}
+
+func newV2Cache(compression string) *httpCache {
+	config := core.DefaultConfiguration()
+	config.Cache.HTTPURL = "http://127.0.0.1:8989"
+	config.Cache.HTTPWriteable = true
+	config.Cache.HTTPProtocol = "v2"
+	config.Cache.HTTPCompression = compression
+	return newHTTPCache(config)
+}
+
 type testServer struct {
-	data map[string][]byte
+	mutex     sync.Mutex
+	data      map[string][]byte
+	encodings map[string]string
+	puts      map[string]int
 }
 
 func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if r.Method == http.MethodPut {
 		b, _ := ioutil.ReadAll(r.Body)
 		s.data[r.URL.Path] = b
+		s.encodings[r.URL.Path] = r.Header.Get("Content-Encoding")
+		s.puts[r.URL.Path]++
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -64,6 +190,34 @@ func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !present {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if r.Method == http.MethodHead {
+		return
+	}
+	// This doesn't bother negotiating; it always sends back whatever it received.
+	if encoding := s.encodings[r.URL.Path]; encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
 	}
 	w.Write(data)
 }
+
+// Puts returns the number of times the given path has been stored.
+func (s *testServer) Puts(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.puts[path]
+}
+
+// Put stores the given data directly on the server.
+func (s *testServer) Put(path string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data[path] = data
+	s.encodings[path] = ""
+}
+
+// Delete removes the given path from the server.
+func (s *testServer) Delete(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.data, path)
+}
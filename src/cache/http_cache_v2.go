@@ -0,0 +1,279 @@
+// Version 2 of the HTTP cache protocol.
+//
+// Each file is stored individually under /v2/cas/<sha256>, and each entry is a manifest
+// under /v2/ac/<key> describing how to lay those files out again (in the same format as the
+// content-addressed dir cache uses). Before uploading a file we check whether the server
+// already has it, so unchanged files are never uploaded twice and an interrupted store only
+// needs to upload whatever it didn't get to last time.
+//
+// Uploads are compressed according to the config and downloads are negotiated via the
+// Accept-Encoding header.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	"github.com/thought-machine/please/src/cache/compression"
+	"github.com/thought-machine/please/src/core"
+)
+
+// acceptEncoding is the set of encodings we accept for downloads, in order of preference.
+const acceptEncoding = "zstd, gzip"
+
+// storeV2 stores the given files using the v2 protocol.
+func (cache *httpCache) storeV2(target *core.BuildTarget, key []byte, files []string) error {
+	manifest, err := newCASManifest(path.Join(core.RepoRoot, target.OutDir()), files, func(name string, entry *casEntry) error {
+		digest, err := sha256File(name)
+		if err != nil {
+			return err
+		}
+		entry.Digest = digest
+		return cache.uploadBlob(name, digest)
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	req, err := retryablehttp.NewRequest(http.MethodPut, cache.makeV2URL("ac", hex.EncodeToString(key)), b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return cache.do(req, nil)
+}
+
+// uploadBlob uploads a single file, if the server doesn't already have it.
+func (cache *httpCache) uploadBlob(filename, digest string) error {
+	url := cache.makeV2URL("cas", digest)
+	req, err := retryablehttp.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cache.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		log.Debug("HTTP cache already has %s, not uploading", digest)
+		return nil
+	} else if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Unexpected response checking for %s: %s", digest, resp.Status)
+	}
+	// This is a function so the body can be recreated if the request gets retried.
+	// It has no known length so is uploaded in chunks as it's compressed.
+	req, err = retryablehttp.NewRequest(http.MethodPut, url, retryablehttp.ReaderFunc(func() (io.Reader, error) {
+		return cache.compressFile(filename)
+	}))
+	if err != nil {
+		return err
+	}
+	if cache.compression != "none" {
+		req.Header.Set("Content-Encoding", cache.compression)
+	}
+	log.Debug("Uploading %s to HTTP cache as %s", filename, digest)
+	return cache.do(req, nil)
+}
+
+// compressFile returns a reader that produces the contents of the given file, compressed
+// according to our configuration.
+func (cache *httpCache) compressFile(filename string) (io.Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer f.Close()
+		w.CloseWithError(cache.compress(w, f))
+	}()
+	return r, nil
+}
+
+// compress copies from the given reader to the writer, compressing according to our configuration.
+func (cache *httpCache) compress(w io.Writer, r io.Reader) error {
+	if cache.compression == "none" {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	enc, err := compression.NewEncoder(cache.compression, w)
+	if err != nil {
+		return err
+	} else if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// retrieveV2 retrieves the given target using the v2 protocol.
+func (cache *httpCache) retrieveV2(target *core.BuildTarget, key []byte) (bool, error) {
+	req, err := retryablehttp.NewRequest(http.MethodGet, cache.makeV2URL("ac", hex.EncodeToString(key)), nil)
+	if err != nil {
+		return false, err
+	}
+	manifest := &casManifest{}
+	if err := cache.do(req, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(manifest)
+	}); err == errNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	outDir := path.Join(core.RepoRoot, target.OutDir())
+	for _, entry := range manifest.Entries {
+		out, err := outputPath(outDir, entry.Path)
+		if err != nil {
+			return false, err
+		}
+		if entry.Mode.IsDir() {
+			if err := checkNoSymlinks(outDir, out); err != nil {
+				return false, err
+			} else if err := os.MkdirAll(out, core.DirPermissions); err != nil {
+				return false, err
+			}
+			continue
+		} else if err := checkNoSymlinks(outDir, path.Dir(out)); err != nil {
+			return false, err
+		} else if err := os.RemoveAll(out); err != nil {
+			return false, err
+		} else if err := os.MkdirAll(path.Dir(out), core.DirPermissions); err != nil {
+			return false, err
+		}
+		if entry.Mode&os.ModeSymlink != 0 {
+			if err := checkLink(outDir, out, entry.Link); err != nil {
+				return false, err
+			} else if err := os.Symlink(entry.Link, out); err != nil {
+				return false, err
+			}
+		} else if err := cache.downloadBlob(entry, out); err == errNotFound {
+			log.Debug("%s: %s is missing from HTTP cache", target.Label, entry.Digest)
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// outputPath returns the location to write a manifest entry to. The manifest comes from the server
+// so we don't trust it; the entry must be a relative path that stays within the output directory.
+func outputPath(outDir, name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("Invalid absolute path %s in cache manifest", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("Invalid path %s in cache manifest", name)
+		}
+	}
+	out := path.Join(outDir, name)
+	if out == outDir || !strings.HasPrefix(out, outDir+"/") {
+		return "", fmt.Errorf("Path %s in cache manifest is outside the output directory", name)
+	}
+	return out, nil
+}
+
+// checkLink checks that a symlink from a manifest points somewhere within the output directory.
+func checkLink(outDir, out, link string) error {
+	if path.IsAbs(link) {
+		return fmt.Errorf("Invalid absolute symlink %s -> %s in cache manifest", out, link)
+	} else if dest := path.Join(path.Dir(out), link); dest != outDir && !strings.HasPrefix(dest, outDir+"/") {
+		return fmt.Errorf("Symlink %s -> %s in cache manifest points outside the output directory", out, link)
+	}
+	return nil
+}
+
+// checkNoSymlinks returns an error if the given path, or any of its parents below the output directory,
+// is an existing symlink. Writing through one could put files outside the output directory.
+func checkNoSymlinks(outDir, name string) error {
+	for ; name != outDir; name = path.Dir(name) {
+		if info, err := os.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Refusing to write through symlink %s from cache manifest", name)
+		}
+	}
+	return nil
+}
+
+// downloadBlob downloads a single file to the given location and verifies its contents.
+func (cache *httpCache) downloadBlob(entry casEntry, out string) error {
+	req, err := retryablehttp.NewRequest(http.MethodGet, cache.makeV2URL("cas", entry.Digest), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	return cache.do(req, func(r io.Reader) error {
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, entry.Mode.Perm())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+			return err
+		} else if digest := hex.EncodeToString(h.Sum(nil)); digest != entry.Digest {
+			return fmt.Errorf("Digest mismatch for %s; expected %s, was %s", entry.Path, entry.Digest, digest)
+		}
+		return f.Close()
+	})
+}
+
+// errNotFound is returned by do when the server responds with a 404.
+var errNotFound = fmt.Errorf("not found")
+
+// do performs a request and checks its response. If f is given it's called with the
+// (decompressed) body of a successful response.
+func (cache *httpCache) do(req *retryablehttp.Request, f func(r io.Reader) error) error {
+	resp, err := cache.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, string(b))
+	} else if f == nil {
+		return nil
+	}
+	r, err := compression.NewDecoder(resp.Header.Get("Content-Encoding"), resp.Body)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return f(r)
+}
+
+// makeV2URL returns the remote URL for an item in the v2 protocol.
+func (cache *httpCache) makeV2URL(kind, name string) string {
+	return cache.url + "/v2/" + kind + "/" + name
+}
+
+// sha256File returns the hex-encoded sha256 hash of the given file.
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
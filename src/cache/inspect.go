@@ -0,0 +1,182 @@
+// Functions for inspecting & maintaining the caches, as used by 'plz cache'.
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// An orphanRemover is implemented by caches that need to clean up after entries are removed.
+type orphanRemover interface {
+	removeOrphans() uint64
+}
+
+// Stats prints statistics about the configured caches and how they were used in the last build.
+func Stats(state *core.BuildState) {
+	lastBuild, err := readStats()
+	if err != nil && !os.IsNotExist(err) {
+		log.Warning("Failed to read cache stats from last build: %s", err)
+	}
+	for _, tier := range newTiers(state, false).caches {
+		fmt.Printf("%s:\n", tier.stats.Name)
+		if cache, ok := tier.Cache.(core.EnumerableCache); ok {
+			if entries, err := cache.Entries(); err != nil {
+				log.Error("Failed to list %s cache: %s", tier.stats.Name, err)
+			} else {
+				var size uint64
+				for _, entry := range entries {
+					size += entry.Size
+				}
+				fmt.Printf("  %d entries, %s\n", len(entries), humanize.Bytes(size))
+			}
+		}
+		if lastBuild != nil {
+			for _, stats := range lastBuild.Tiers {
+				if stats.Name == tier.stats.Name {
+					fmt.Printf("  Last build: %d hits, %d misses (%.1f%% hit rate), %d stores\n", stats.Hits, stats.Misses, 100.0*stats.HitRate(), stats.Stores)
+					fmt.Printf("  Retrieved %s (average %s), stored %s (average %s)\n", humanize.Bytes(uint64(stats.BytesRetrieved)), stats.AverageRetrieveTime(), humanize.Bytes(uint64(stats.BytesStored)), stats.AverageStoreTime())
+				}
+			}
+		}
+	}
+}
+
+// List prints all entries in the caches for the given targets.
+// If no targets are given, everything is listed.
+func List(state *core.BuildState, labels []core.BuildLabel) {
+	forEachEntry(newTiers(state, false), labels, func(tier string, cache core.EnumerableCache, entry *core.CacheEntry) {
+		fmt.Printf("%s\t%s\t%x\t%s\t%s\n", tier, entry.Label, entry.Key, humanize.Bytes(entry.Size), humanize.Time(entry.Accessed))
+	})
+}
+
+// Verify checks the integrity of all entries for the given targets and returns true if they are all OK.
+// If remove is true, any damaged entries are removed.
+func Verify(state *core.BuildState, labels []core.BuildLabel, remove bool) bool {
+	success := true
+	tiers := newTiers(state, false)
+	forEachEntry(tiers, labels, func(tier string, cache core.EnumerableCache, entry *core.CacheEntry) {
+		if err := cache.Verify(entry); err != nil {
+			fmt.Printf("%s: %s in %s cache is damaged: %s\n", entry.Label, entry.Path, tier, err)
+			success = false
+			if remove {
+				removeEntry(cache, entry)
+			}
+		}
+	})
+	removeOrphans(tiers)
+	return success
+}
+
+// Prune removes entries for the given targets that haven't been accessed within maxAge, and then
+// removes further entries in least-recently-used order until each cache is under maxSize.
+// Either can be zero, in which case it is ignored.
+func Prune(state *core.BuildState, labels []core.BuildLabel, maxAge time.Duration, maxSize uint64) {
+	now := time.Now()
+	tiers := newTiers(state, false)
+	remaining := map[core.EnumerableCache][]*core.CacheEntry{}
+	forEachEntry(tiers, labels, func(tier string, cache core.EnumerableCache, entry *core.CacheEntry) {
+		if maxAge > 0 && now.Sub(entry.Accessed) > maxAge {
+			log.Notice("Removing %s from %s cache, last accessed %s", entry.Label, tier, humanize.Time(entry.Accessed))
+			removeEntry(cache, entry)
+		} else {
+			remaining[cache] = append(remaining[cache], entry)
+		}
+	})
+	if maxSize > 0 {
+		for cache, entries := range remaining {
+			var size uint64
+			for _, entry := range entries {
+				size += entry.Size
+			}
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].Accessed.Before(entries[j].Accessed)
+			})
+			for _, entry := range entries {
+				if size <= maxSize {
+					break
+				}
+				log.Notice("Removing %s, last accessed %s", entry.Label, humanize.Time(entry.Accessed))
+				if removeEntry(cache, entry) {
+					size -= entry.Size
+				}
+			}
+		}
+	}
+	removeOrphans(tiers)
+}
+
+// Remove removes all entries for the given targets.
+func Remove(state *core.BuildState, labels []core.BuildLabel) {
+	tiers := newTiers(state, false)
+	forEachEntry(tiers, labels, func(tier string, cache core.EnumerableCache, entry *core.CacheEntry) {
+		log.Notice("Removing %s from %s cache", entry.Label, tier)
+		removeEntry(cache, entry)
+	})
+	removeOrphans(tiers)
+}
+
+// forEachEntry calls the given function for each entry in any enumerable cache that
+// matches one of the given labels.
+func forEachEntry(tiers *cacheMultiplexer, labels []core.BuildLabel, f func(string, core.EnumerableCache, *core.CacheEntry)) {
+	for _, tier := range tiers.caches {
+		cache, ok := tier.Cache.(core.EnumerableCache)
+		if !ok {
+			log.Warning("The %s cache doesn't support listing its contents, skipping", tier.stats.Name)
+			continue
+		}
+		entries, err := cache.Entries()
+		if err != nil {
+			log.Error("Failed to list %s cache: %s", tier.stats.Name, err)
+			continue
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Label.Less(entries[j].Label)
+		})
+		for _, entry := range entries {
+			if matchesLabels(labels, entry.Label) {
+				f(tier.stats.Name, cache, entry)
+			}
+		}
+	}
+}
+
+// matchesLabels returns true if the given label is included in any of the given labels,
+// or if there are none. Internal targets are matched by their parents.
+func matchesLabels(labels []core.BuildLabel, label core.BuildLabel) bool {
+	if len(labels) == 0 {
+		return true
+	}
+	for _, l := range labels {
+		if l.Includes(label) || l.Includes(label.Parent()) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEntry removes a single entry from a cache, returning true if it was successful.
+func removeEntry(cache core.EnumerableCache, entry *core.CacheEntry) bool {
+	if err := cache.Remove(entry); err != nil {
+		log.Error("Failed to remove %s: %s", entry.Path, err)
+		return false
+	}
+	return true
+}
+
+// removeOrphans removes anything left unreferenced after entries have been removed.
+func removeOrphans(tiers *cacheMultiplexer) {
+	for _, tier := range tiers.caches {
+		if r, ok := tier.Cache.(orphanRemover); ok {
+			if freed := r.removeOrphans(); freed > 0 {
+				log.Notice("Freed %s of unreferenced data from %s cache", humanize.Bytes(freed), tier.stats.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Statistics about cache usage during a build.
+
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// StatsFile is the file that statistics about cache usage are written to at the end of each build.
+const StatsFile = "plz-out/log/cache_stats.json"
+
+// cacheStats is the set of statistics written to StatsFile.
+type cacheStats struct {
+	Tiers []core.CacheStats `json:"tiers"`
+}
+
+// writeStats writes the statistics for this multiplexer to StatsFile.
+// Nothing is written if no retrievals were attempted, so things like queries don't overwrite the
+// results of the last build.
+func (mplex cacheMultiplexer) writeStats() {
+	stats := &cacheStats{Tiers: mplex.CacheStats()}
+	var total int64
+	for _, tier := range stats.Tiers {
+		total += tier.Hits + tier.Misses
+	}
+	if total == 0 {
+		return
+	}
+	filename := path.Join(core.RepoRoot, StatsFile)
+	if b, err := json.MarshalIndent(stats, "", "  "); err != nil {
+		log.Warning("Failed to serialise cache stats: %s", err)
+	} else if err := fs.EnsureDir(filename); err != nil {
+		log.Warning("Failed to write cache stats: %s", err)
+	} else if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		log.Warning("Failed to write cache stats: %s", err)
+	}
+	for _, tier := range stats.Tiers {
+		log.Info("%s cache: %d hits, %d misses, %d stores; retrieved %s, stored %s", tier.Name, tier.Hits, tier.Misses, tier.Stores, humanize.Bytes(uint64(tier.BytesRetrieved)), humanize.Bytes(uint64(tier.BytesStored)))
+	}
+}
+
+// readStats reads the statistics written by the last build.
+func readStats() (*cacheStats, error) {
+	b, err := ioutil.ReadFile(path.Join(core.RepoRoot, StatsFile))
+	if err != nil {
+		return nil, err
+	}
+	stats := &cacheStats{}
+	return stats, json.Unmarshal(b, stats)
+}
@@ -5,6 +5,7 @@ package cli
 import (
 	"bytes"
 	"container/list"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -39,12 +40,22 @@ var logLevel = logging.WARNING
 var fileLogLevel = logging.WARNING
 var fileBackend logging.Backend
 
+// logFile is the file that fileBackend writes to.
+var logFile *os.File
+
 // A Verbosity is used as a flag to define logging verbosity.
 type Verbosity = cli.Verbosity
 
 // CurrentBackend is the current interactive logging backend.
 var CurrentBackend *LogBackend
 
+// PanicOnFatal makes fatal log messages panic with ErrFatal once they've been logged, instead of
+// the logger exiting the process. The daemon sets this so one command failing doesn't take it down.
+var PanicOnFatal bool
+
+// ErrFatal is what we panic with after a fatal message is logged if PanicOnFatal is set.
+var ErrFatal = errors.New("Fatal error")
+
 // InitLogging initialises logging backends.
 func InitLogging(verbosity Verbosity) {
 	logLevel = logging.Level(verbosity)
@@ -52,19 +63,23 @@ func InitLogging(verbosity Verbosity) {
 }
 
 // InitFileLogging initialises an optional logging backend to a file.
-func InitFileLogging(logFile string, logFileLevel Verbosity, append bool) {
+func InitFileLogging(filename string, logFileLevel Verbosity, append bool) {
 	fileLogLevel = logging.Level(logFileLevel)
-	if err := os.MkdirAll(path.Dir(logFile), os.ModeDir|0775); err != nil {
+	if err := os.MkdirAll(path.Dir(filename), os.ModeDir|0775); err != nil {
 		log.Fatalf("Error creating log file directory: %s", err)
 	}
 	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	if append {
 		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
 	}
-	file, err := os.OpenFile(logFile, flags, 0666)
+	if logFile != nil {
+		logFile.Close() // We've been called before (e.g. by a daemon running a new command).
+	}
+	file, err := os.OpenFile(filename, flags, 0666)
 	if err != nil {
 		log.Fatalf("Error opening log file: %s", err)
 	}
+	logFile = file
 	fileBackend = logging.NewLogBackend(file, "", 0)
 	fileBackend = logging.NewBackendFormatter(fileBackend, logFormatter(false))
 	setLogBackend(logging.NewLogBackend(os.Stderr, "", 0))
@@ -86,12 +101,26 @@ func logFormatter(coloured bool) logging.Formatter {
 func setLogBackend(backend logging.Backend) {
 	backend = logging.NewBackendFormatter(backend, logFormatter(StdErrIsATerminal))
 	if fileBackend == nil {
-		logging.SetBackend(newLogBackend(backend))
+		logging.SetBackend(fatalBackend{newLogBackend(backend)})
 	} else {
 		fileBackendLeveled := logging.AddModuleLevel(fileBackend)
 		fileBackendLeveled.SetLevel(fileLogLevel, "")
-		logging.SetBackend(newLogBackend(backend), fileBackendLeveled)
+		logging.SetBackend(fatalBackend{logging.MultiLogger(newLogBackend(backend), fileBackendLeveled)})
+	}
+}
+
+// A fatalBackend wraps another backend to panic after fatal messages if PanicOnFatal is set.
+// The logger would otherwise exit the process immediately afterwards.
+type fatalBackend struct {
+	logging.LeveledBackend
+}
+
+func (backend fatalBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	err := backend.LeveledBackend.Log(level, calldepth+1, rec)
+	if level == logging.CRITICAL && PanicOnFatal {
+		panic(ErrFatal)
 	}
+	return err
 }
 
 type logBackendFacade struct {
@@ -3,6 +3,7 @@ package core
 import (
 	"fmt"
 	"github.com/thought-machine/please/src/fs"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -207,6 +208,12 @@ type BuildTarget struct {
 	Env map[string]string `name:"env"`
 	// The content of text_file() rules
 	FileContent string `name:"content"`
+	// RemotePlatform are platform properties to request when executing this target remotely.
+	// They're merged with (and take precedence over) the ones in the [remote] config section.
+	RemotePlatform map[string]string `name:"remote_platform"`
+	// URLHeaders are HTTP headers to send when fetching a remote_file. Their values can refer to
+	// environment variables, which are expanded at fetch time so they aren't part of the rule.
+	URLHeaders map[string]string `name:"url_headers"`
 }
 
 // BuildMetadata is temporary metadata that's stored around a build target - we don't
@@ -225,6 +232,10 @@ type BuildMetadata struct {
 	Test bool
 	// True if the results were retrieved from a cache, false if we ran the full build action.
 	Cached bool
+	// Hashes of each of the inputs to the target when it was built, keyed by a description of the input.
+	InputHashes map[string][]byte
+	// Descriptions of the inputs that had changed since the previous build, which is why this one happened.
+	RebuildReasons []string
 }
 
 // A PreBuildFunction is a type that allows hooking a pre-build callback.
@@ -453,6 +464,55 @@ func (target *BuildTarget) AllURLs(state *BuildState) []string {
 	return ret
 }
 
+// MirroredURLs returns the URLs to try when fetching this target, in order: each of its URLs on
+// each of the configured mirrors, followed by the URLs themselves.
+// Unlike AllURLs, the URLs are returned as written, without any environment variables expanded.
+func (target *BuildTarget) MirroredURLs(config *Configuration) []string {
+	ret := make([]string, 0, len(target.Sources)*(len(config.Build.Mirror)+1))
+	for _, mirror := range config.Build.Mirror {
+		for _, s := range target.Sources {
+			url := string(s.(URLLabel))
+			if idx := strings.Index(url, "://"); idx != -1 && !strings.HasPrefix(url, "file://") {
+				ret = append(ret, strings.TrimSuffix(mirror, "/")+"/"+url[idx+3:])
+			}
+		}
+	}
+	for _, s := range target.Sources {
+		ret = append(ret, string(s.(URLLabel)))
+	}
+	return ret
+}
+
+// ExpandedURLHeaders returns the HTTP headers to send when fetching the given URL for this target,
+// with any environment variables in their values expanded from the given environment, in the same
+// way as the URLs are.
+// Since they often contain credentials, they're only sent to the hosts of the target's own URLs,
+// and never to any mirrors on other hosts.
+func (target *BuildTarget) ExpandedURLHeaders(u string, env BuildEnv) map[string]string {
+	if !target.isURLHost(u, env) {
+		return nil
+	}
+	ret := make(map[string]string, len(target.URLHeaders))
+	for k, v := range target.URLHeaders {
+		ret[k] = os.Expand(v, env.ReplaceEnvironment)
+	}
+	return ret
+}
+
+// isURLHost returns true if the given URL is on the same host as one of this target's URLs.
+func (target *BuildTarget) isURLHost(u string, env BuildEnv) bool {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	for _, s := range target.Sources {
+		if own, err := url.Parse(os.Expand(string(s.(URLLabel)), env.ReplaceEnvironment)); err == nil && strings.EqualFold(own.Host, parsed.Host) {
+			return true
+		}
+	}
+	return false
+}
+
 // DeclaredDependencies returns all the targets this target declared any kind of dependency on (including sources and tools).
 func (target *BuildTarget) DeclaredDependencies() []BuildLabel {
 	ret := make(BuildLabels, len(target.dependencies))
@@ -895,6 +955,16 @@ func (target *BuildTarget) SetState(state BuildTargetState) {
 	atomic.StoreInt32(&target.state, int32(state))
 }
 
+// reset returns the target to the state it was in after parsing, so it can be built again.
+func (target *BuildTarget) reset() {
+	target.SetState(Inactive)
+	target.Progress = 0
+	target.resultsMux.Lock()
+	defer target.resultsMux.Unlock()
+	target.Results = TestSuite{}
+	target.completedRuns = 0
+}
+
 // SyncUpdateState oves the target's state from before to after via a lock.
 // Returns true if successful, false if not (which implies something else changed the state first).
 // The nature of our build graph ensures that most transitions are only attempted by
@@ -1472,6 +1542,12 @@ func (target *BuildTarget) TargetBuildMetadataFileName() string {
 	return ".target_build_metadata_" + target.Label.Name
 }
 
+// RemoteOutputsFileName returns the name of the file recording the outputs of this target that are
+// held remotely, when they have not been downloaded.
+func (target *BuildTarget) RemoteOutputsFileName() string {
+	return ".remote_outputs_" + target.Label.Name
+}
+
 // StampFileName returns the stamp filename for this target.
 func (target *BuildTarget) StampFileName() string {
 	return ".stamp_" + target.Label.Name
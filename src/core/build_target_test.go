@@ -514,6 +514,43 @@ func TestAllURLs(t *testing.T) {
 	}, target.AllURLs(state))
 }
 
+func TestMirroredURLs(t *testing.T) {
+	config := DefaultConfiguration()
+	target := makeTarget1("//src/core:remote1", "")
+	target.IsRemoteFile = true
+	target.AddSource(URLLabel("https://github.com/thought-machine/please/archive/${VERSION}.tar.gz"))
+	target.AddSource(URLLabel("file:///tmp/please.tar.gz"))
+	assert.Equal(t, []string{
+		"https://github.com/thought-machine/please/archive/${VERSION}.tar.gz",
+		"file:///tmp/please.tar.gz",
+	}, target.MirroredURLs(config))
+
+	config.Build.Mirror = []string{"https://mirror1.example.com/", "https://mirror2.example.com"}
+	assert.Equal(t, []string{
+		"https://mirror1.example.com/github.com/thought-machine/please/archive/${VERSION}.tar.gz",
+		"https://mirror2.example.com/github.com/thought-machine/please/archive/${VERSION}.tar.gz",
+		"https://github.com/thought-machine/please/archive/${VERSION}.tar.gz",
+		"file:///tmp/please.tar.gz",
+	}, target.MirroredURLs(config))
+}
+
+func TestExpandedURLHeaders(t *testing.T) {
+	target := makeTarget1("//src/core:remote1", "")
+	target.IsRemoteFile = true
+	target.AddSource(URLLabel("https://github.com/thought-machine/please/archive/${VERSION}.tar.gz"))
+	target.URLHeaders = map[string]string{
+		"Authorization": "Bearer $URL_HEADERS_TEST_TOKEN",
+		"Accept":        "application/octet-stream",
+	}
+	env := BuildEnv{"VERSION=15.5.0", "URL_HEADERS_TEST_TOKEN=abc123"}
+	assert.Equal(t, map[string]string{
+		"Authorization": "Bearer abc123",
+		"Accept":        "application/octet-stream",
+	}, target.ExpandedURLHeaders("https://github.com/thought-machine/please/archive/15.5.0.tar.gz", env))
+	// They shouldn't be sent to a mirror on another host.
+	assert.Equal(t, 0, len(target.ExpandedURLHeaders("https://mirror.example.com/github.com/thought-machine/please/archive/15.5.0.tar.gz", env)))
+}
+
 func TestCheckSecrets(t *testing.T) {
 	target := makeTarget1("//src/core:target1", "")
 	assert.NoError(t, target.CheckSecrets())
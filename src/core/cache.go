@@ -1,5 +1,7 @@
 package core
 
+import "time"
+
 // Cache is our general interface to caches for built targets.
 // The implementations are in //src/cache, but the interface is in this package because
 // it's passed around on the BuildState object.
@@ -22,3 +24,84 @@ type Cache interface {
 	// Shuts down the cache, blocking until any potentially pending requests are done.
 	Shutdown()
 }
+
+// An EnumerableCache is a Cache that can also list and individually remove its entries.
+// Not all implementations support this (for example, remote caches typically have no way
+// of listing what they contain).
+type EnumerableCache interface {
+	Cache
+	// Entries returns all the entries currently in the cache.
+	Entries() ([]*CacheEntry, error)
+	// Verify checks the integrity of a single entry, returning an error if it is damaged.
+	Verify(entry *CacheEntry) error
+	// Remove removes a single entry from the cache.
+	Remove(entry *CacheEntry) error
+}
+
+// A CacheEntry describes a single entry in an EnumerableCache.
+type CacheEntry struct {
+	// Label of the target that the entry was stored for.
+	Label BuildLabel
+	// Key that the entry was stored under.
+	Key []byte
+	// Path to the entry. Its meaning is specific to the implementation.
+	Path string
+	// Size of the entry, in bytes. For caches that deduplicate their contents this
+	// may include space that is shared with other entries.
+	Size uint64
+	// Time that the entry was last accessed.
+	Accessed time.Time
+}
+
+// A CacheStatsProvider is a Cache that records statistics about how it's been used.
+type CacheStatsProvider interface {
+	Cache
+	// CacheStats returns a snapshot of the current statistics for each tier of the cache.
+	CacheStats() []CacheStats
+	// PendingStores returns the number of store requests that are queued but not yet complete.
+	PendingStores() int
+}
+
+// CacheStats records activity on a single tier of a cache during a build.
+type CacheStats struct {
+	// Name of the tier (e.g. "dir", "http").
+	Name string `json:"name"`
+	// Number of successful retrievals.
+	Hits int64 `json:"hits"`
+	// Number of unsuccessful retrievals.
+	Misses int64 `json:"misses"`
+	// Number of artifacts stored.
+	Stores int64 `json:"stores"`
+	// Total size of the outputs retrieved, in bytes.
+	BytesRetrieved int64 `json:"bytes_retrieved"`
+	// Total size of the outputs stored, in bytes.
+	BytesStored int64 `json:"bytes_stored"`
+	// Total time spent retrieving, including misses.
+	RetrieveTime time.Duration `json:"retrieve_time_ns"`
+	// Total time spent storing.
+	StoreTime time.Duration `json:"store_time_ns"`
+}
+
+// HitRate returns the proportion of retrievals from this tier that were successful.
+func (stats *CacheStats) HitRate() float64 {
+	if total := stats.Hits + stats.Misses; total > 0 {
+		return float64(stats.Hits) / float64(total)
+	}
+	return 0.0
+}
+
+// AverageRetrieveTime returns the mean time taken by a retrieval from this tier.
+func (stats *CacheStats) AverageRetrieveTime() time.Duration {
+	if total := stats.Hits + stats.Misses; total > 0 {
+		return stats.RetrieveTime / time.Duration(total)
+	}
+	return 0
+}
+
+// AverageStoreTime returns the mean time taken by a store to this tier.
+func (stats *CacheStats) AverageStoreTime() time.Duration {
+	if stats.Stores > 0 {
+		return stats.StoreTime / time.Duration(stats.Stores)
+	}
+	return 0
+}
@@ -77,19 +77,25 @@ var workerReplacement = regexp.MustCompile(`^(.*)\$\(worker ([^\)]+)\) *([^&]*)(
 
 // ReplaceSequences replaces escape sequences in the given string.
 func ReplaceSequences(state *BuildState, target *BuildTarget, command string) (string, error) {
-	return replaceSequencesInternal(state, target, command, false)
+	return replaceSequencesInternal(state, target, command, false, false)
+}
+
+// ReplaceRemoteSequences is like ReplaceSequences but for a command that will be run on a
+// remote executor, where tools are found relative to the input root rather than in plz-out.
+func ReplaceRemoteSequences(state *BuildState, target *BuildTarget, command string) (string, error) {
+	return replaceSequencesInternal(state, target, command, false, true)
 }
 
 // ReplaceTestSequences replaces escape sequences in the given string when running a test.
 func ReplaceTestSequences(state *BuildState, target *BuildTarget, command string) (string, error) {
 	if command == "" {
 		// An empty test command implies running the test binary.
-		return replaceSequencesInternal(state, target, fmt.Sprintf("$(exe :%s)", target.Label.Name), true)
+		return replaceSequencesInternal(state, target, fmt.Sprintf("$(exe :%s)", target.Label.Name), true, false)
 	} else if strings.HasPrefix(command, "$(worker") {
 		_, _, cmd, err := workerAndArgs(state, target, command)
 		return cmd, err
 	}
-	return replaceSequencesInternal(state, target, command, true)
+	return replaceSequencesInternal(state, target, command, true, false)
 }
 
 // TestWorkerCommand returns the worker & its arguments (if any) for a test, and the command to run for the test itself.
@@ -110,15 +116,15 @@ func workerAndArgs(state *BuildState, target *BuildTarget, command string) (stri
 	} else if match[1] != "" {
 		panic("$(worker) replacements cannot have any commands preceding them.")
 	}
-	cmd1, err := replaceSequencesInternal(state, target, strings.TrimSpace(match[3]), false)
+	cmd1, err := replaceSequencesInternal(state, target, strings.TrimSpace(match[3]), false, false)
 	if err != nil {
 		return "", "", "", err
 	}
-	cmd2, err := replaceSequencesInternal(state, target, match[4], false)
-	return replaceWorkerSequence(state, target, fs.ExpandHomePath(match[2]), true, false, false, true, false, false), cmd1, cmd2, err
+	cmd2, err := replaceSequencesInternal(state, target, match[4], false, false)
+	return replaceWorkerSequence(state, target, fs.ExpandHomePath(match[2]), true, false, false, true, false, false, false), cmd1, cmd2, err
 }
 
-func replaceSequencesInternal(state *BuildState, target *BuildTarget, command string, test bool) (cmd string, err error) {
+func replaceSequencesInternal(state *BuildState, target *BuildTarget, command string, test, remote bool) (cmd string, err error) {
 	// TODO(peterebden): should probably just get rid of all the panics and thread errors around properly.
 	defer func() {
 		if r := recover(); r != nil {
@@ -127,31 +133,31 @@ func replaceSequencesInternal(state *BuildState, target *BuildTarget, command st
 		}
 	}()
 	cmd = locationReplacement.ReplaceAllStringFunc(command, func(in string) string {
-		return replaceSequence(state, target, in[11:len(in)-1], false, false, false, false, false, test)
+		return replaceSequence(state, target, in[11:len(in)-1], false, false, false, false, false, test, remote)
 	})
 	cmd = locationsReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[12:len(in)-1], false, true, false, false, false, test)
+		return replaceSequence(state, target, in[12:len(in)-1], false, true, false, false, false, test, remote)
 	})
 	cmd = exeReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[6:len(in)-1], true, false, false, false, false, test)
+		return replaceSequence(state, target, in[6:len(in)-1], true, false, false, false, false, test, remote)
 	})
 	cmd = outReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[15:len(in)-1], false, false, false, true, false, test)
+		return replaceSequence(state, target, in[15:len(in)-1], false, false, false, true, false, test, remote)
 	})
 	cmd = outsReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[16:len(in)-1], false, true, false, true, false, test)
+		return replaceSequence(state, target, in[16:len(in)-1], false, true, false, true, false, test, remote)
 	})
 	cmd = outExeReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[10:len(in)-1], true, false, false, true, false, test)
+		return replaceSequence(state, target, in[10:len(in)-1], true, false, false, true, false, test, remote)
 	})
 	cmd = dirReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[6:len(in)-1], false, true, true, false, false, test)
+		return replaceSequence(state, target, in[6:len(in)-1], false, true, true, false, false, test, remote)
 	})
 	cmd = outDirReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[10:len(in)-1], false, true, true, true, false, test)
+		return replaceSequence(state, target, in[10:len(in)-1], false, true, true, true, false, test, remote)
 	})
 	cmd = hashReplacement.ReplaceAllStringFunc(cmd, func(in string) string {
-		return replaceSequence(state, target, in[7:len(in)-1], false, true, true, false, true, test)
+		return replaceSequence(state, target, in[7:len(in)-1], false, true, true, false, true, test, remote)
 	})
 	if state.Config.Bazel.Compatibility {
 		// Bazel allows several obscure Make-style variable expansions.
@@ -181,18 +187,18 @@ func splitEntryPoint(label string) (string, string) {
 }
 
 // replaceSequence replaces a single escape sequence in a command.
-func replaceSequence(state *BuildState, target *BuildTarget, in string, runnable, multiple, dir, outPrefix, hash, test bool) string {
+func replaceSequence(state *BuildState, target *BuildTarget, in string, runnable, multiple, dir, outPrefix, hash, test, remote bool) string {
 	if LooksLikeABuildLabel(in) {
 		in, ep := splitEntryPoint(in)
 		label, err := TryParseBuildLabel(in, target.Label.PackageName, target.Label.Subrepo)
 		if err != nil {
 			panic(err)
 		}
-		return replaceSequenceLabel(state, target, label, ep, in, runnable, multiple, dir, outPrefix, hash, test, true)
+		return replaceSequenceLabel(state, target, label, ep, in, runnable, multiple, dir, outPrefix, hash, test, remote, true)
 	}
 	for _, src := range sourcesOrTools(target, runnable) {
 		if label := src.Label(); label != nil && src.String() == in {
-			return replaceSequenceLabel(state, target, *label, "", in, runnable, multiple, dir, outPrefix, hash, test, false)
+			return replaceSequenceLabel(state, target, *label, "", in, runnable, multiple, dir, outPrefix, hash, test, remote, false)
 		} else if runnable && src.String() == in {
 			return src.String()
 		}
@@ -208,11 +214,11 @@ func replaceSequence(state *BuildState, target *BuildTarget, in string, runnable
 
 // replaceWorkerSequence is like replaceSequence but for worker commands, which do not
 // prefix the target's directory if it's not a build label.
-func replaceWorkerSequence(state *BuildState, target *BuildTarget, in string, runnable, multiple, dir, outPrefix, hash, test bool) string {
+func replaceWorkerSequence(state *BuildState, target *BuildTarget, in string, runnable, multiple, dir, outPrefix, hash, test, remote bool) string {
 	if !LooksLikeABuildLabel(in) {
 		return in
 	}
-	return replaceSequence(state, target, in, runnable, multiple, dir, outPrefix, hash, test)
+	return replaceSequence(state, target, in, runnable, multiple, dir, outPrefix, hash, test, remote)
 }
 
 // sourcesOrTools returns either the tools of a target if runnable is true, otherwise its sources.
@@ -223,10 +229,10 @@ func sourcesOrTools(target *BuildTarget, runnable bool) []BuildInput {
 	return target.AllSources()
 }
 
-func replaceSequenceLabel(state *BuildState, target *BuildTarget, label BuildLabel, ep string, in string, runnable, multiple, dir, outPrefix, hash, test, allOutputs bool) string {
+func replaceSequenceLabel(state *BuildState, target *BuildTarget, label BuildLabel, ep string, in string, runnable, multiple, dir, outPrefix, hash, test, remote, allOutputs bool) string {
 	// Check this label is a dependency of the target, otherwise it's not allowed.
 	if label == target.Label { // targets can always use themselves.
-		return checkAndReplaceSequence(state, target, target, ep, in, runnable, multiple, dir, outPrefix, hash, test, allOutputs, false)
+		return checkAndReplaceSequence(state, target, target, ep, in, runnable, multiple, dir, outPrefix, hash, test, remote, allOutputs, false)
 	}
 	// TODO(jpoole): This doesn't handle tools when cross compiling. ///freebsd_amd64//tools:tool
 	// will not match the tool //tools:tool
@@ -236,10 +242,10 @@ func replaceSequenceLabel(state *BuildState, target *BuildTarget, label BuildLab
 	}
 	// TODO(pebers): this does not correctly handle the case where there are multiple deps here
 	//               (but is better than the previous case where it never worked at all)
-	return checkAndReplaceSequence(state, target, deps[0], ep, in, runnable, multiple, dir, outPrefix, hash, test, allOutputs, target.IsTool(label))
+	return checkAndReplaceSequence(state, target, deps[0], ep, in, runnable, multiple, dir, outPrefix, hash, test, remote, allOutputs, target.IsTool(label))
 }
 
-func checkAndReplaceSequence(state *BuildState, target, dep *BuildTarget, ep, in string, runnable, multiple, dir, outPrefix, hash, test, allOutputs, tool bool) string {
+func checkAndReplaceSequence(state *BuildState, target, dep *BuildTarget, ep, in string, runnable, multiple, dir, outPrefix, hash, test, remote, allOutputs, tool bool) string {
 	if allOutputs && !multiple && len(dep.Outputs()) > 1 && ep == "" {
 		// Label must have only one output.
 		panic(fmt.Sprintf("Rule %s can't use %s; %s has multiple outputs.", target.Label, in, dep.Label))
@@ -261,7 +267,7 @@ func checkAndReplaceSequence(state *BuildState, target, dep *BuildTarget, ep, in
 	if ep == "" {
 		for _, out := range dep.Outputs() {
 			if allOutputs || out == in {
-				if tool && !state.WillRunRemotely(target) {
+				if tool && !remote {
 					abs, err := filepath.Abs(handleDir(dep.OutDir(), out, dir))
 					if err != nil {
 						log.Fatalf("Couldn't calculate relative path: %s", err)
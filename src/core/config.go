@@ -5,6 +5,7 @@ package core
 import (
 	"crypto/sha1"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path"
@@ -224,7 +225,9 @@ func ReadConfigFiles(filenames []string, profiles []string) (*Configuration, err
 
 	// We can only verify options by reflection (we need struct tags) so run them quickly through this.
 	return config, config.ApplyOverrides(map[string]string{
-		"build.hashfunction": config.Build.HashFunction,
+		"build.hashfunction":    config.Build.HashFunction,
+		"cache.httpprotocol":    config.Cache.HTTPProtocol,
+		"cache.httpcompression": config.Cache.HTTPCompression,
 	})
 }
 
@@ -287,6 +290,8 @@ func DefaultConfiguration() *Configuration {
 	config.Cache.HTTPTimeout = cli.Duration(25 * time.Second)
 	config.Cache.HTTPConcurrentRequestLimit = 20
 	config.Cache.HTTPRetry = 4
+	config.Cache.HTTPProtocol = "v1"
+	config.Cache.HTTPCompression = "zstd"
 	if dir, err := os.UserCacheDir(); err == nil {
 		config.Cache.Dir = path.Join(dir, "please")
 	}
@@ -344,6 +349,11 @@ func DefaultConfiguration() *Configuration {
 	config.Proto.JavaGrpcDep = "//third_party/java:grpc-all"
 	config.Proto.GoGrpcDep = "//third_party/go:grpc"
 	config.Remote.Timeout = cli.Duration(2 * time.Minute)
+	config.Remote.TokenRefresh = cli.Duration(5 * time.Minute)
+	config.Remote.CircuitBreakerThreshold = 10
+	config.Remote.CircuitBreakerCooldown = cli.Duration(30 * time.Second)
+	config.BuildEvents.Secure = true
+	config.BuildEvents.Timeout = cli.Duration(time.Minute)
 	config.Bazel.Compatibility = usingBazelWorkspace
 
 	// Please tools
@@ -383,6 +393,7 @@ type Configuration struct {
 		BuildDefsDir       []string `help:"Directory to look in when prompted for help topics that aren't known internally." example:"build_defs"`
 		NumThreads         int      `help:"Number of parallel parse operations to run.\nIs overridden by the --num_threads command line flag." example:"6"`
 		GitFunctions       bool     `help:"Activates built-in functions git_branch, git_commit, git_show and git_state. If disabled they will not be usable at parse time."`
+		CacheDir           string   `help:"Directory to store parsed BUILD files in, so unchanged ones don't need parsing again.\nBy default nothing is stored. Entries from other versions of Please are removed when it starts." example:".plz-parse-cache"`
 	} `help:"The [parse] section in the config contains settings specific to parsing files."`
 	Display struct {
 		UpdateTitle  bool   `help:"Updates the title bar of the shell window Please is running in as the build progresses. This isn't on by default because not everyone's shell is configured to reset it again after and we don't want to alter it forever."`
@@ -405,6 +416,7 @@ type Configuration struct {
 		PassEnv              []string     `help:"A list of environment variables to pass from the current environment to build rules. For example\n\nPassEnv = HTTP_PROXY\n\nwould copy your HTTP_PROXY environment variable to the build env for any rules."`
 		PassUnsafeEnv        []string     `help:"Similar to PassEnv, a list of environment variables to pass from the current environment to build rules. Unlike PassEnv, the environment variable values are not used when calculating build target hashes."`
 		HTTPProxy            cli.URL      `help:"A URL to use as a proxy server for downloads. Only applies to internal ones - e.g. self-updates or remote_file rules."`
+		Mirror               []string     `help:"Mirrors to try before the original URLs when fetching remote_file rules. The original URL is appended to the mirror without its scheme, so with a mirror of https://mirror.example.com, https://github.com/foo/bar.tar.gz is first looked for at https://mirror.example.com/github.com/foo/bar.tar.gz.\nAny headers set on the rule aren't sent to mirrors on other hosts, since they often contain credentials." example:"https://mirror.example.com"`
 		HashFunction         string       `help:"The hash function to use internally for build actions." options:"sha1,sha256"`
 		ExitOnError          bool         `help:"True to have build actions automatically fail on error (essentially passing -e to the shell they run in)." var:"EXIT_ON_ERROR"`
 		LinkGeneratedSources bool         `help:"If set, supported build definitions will link generated sources back into the source tree. The list of generated files can be generated for the .gitignore through 'plz query print --label gitignore: //...'. Defaults to false." var:"LINK_GEN_SOURCES"`
@@ -418,44 +430,76 @@ type Configuration struct {
 		DirCacheLowWaterMark       cli.ByteSize `help:"When cleaning the directory cache, it's reduced to at most this size."`
 		DirClean                   bool         `help:"Controls whether entries in the dir cache are cleaned or not. If disabled the cache will only grow."`
 		DirCompress                bool         `help:"Compresses stored artifacts in the dir cache. They are slower to store & retrieve but more compact."`
+		DirCAS                     bool         `help:"Stores artifacts in the dir cache by their content hash, so identical files produced by different targets are only stored once. Each target then only stores a small manifest referencing them.\nTakes precedence over DirCompress if both are set."`
 		HTTPURL                    cli.URL      `help:"Base URL of the HTTP cache.\nNot set to anything by default which means the cache will be disabled."`
 		HTTPWriteable              bool         `help:"If True this plz instance will write content back to the HTTP cache.\nBy default it runs in read-only mode."`
 		HTTPTimeout                cli.Duration `help:"Timeout for operations contacting the HTTP cache, in seconds."`
 		HTTPConcurrentRequestLimit int          `help:"The maximum amount of concurrent requests that can be open. Default 20."`
 		HTTPRetry                  int          `help:"The maximum number of retries before a request will give up, if a request is retryable"`
+		HTTPProtocol               string       `help:"Version of the protocol to use with the HTTP cache.\nv1 uploads a single tarball per target, which works with any server that supports GET and PUT.\nv2 stores each file individually by its content hash, checks which ones the server already has before uploading, and negotiates compression. It requires a server that supports it, such as the one in tools/http_cache." options:"v1,v2"`
+		HTTPCompression            string       `help:"Compression to apply to files uploaded to the HTTP cache when using the v2 protocol." options:"zstd,gzip,none"`
+		RemoteURL                  string       `help:"URL of a remote execution API server to use as a cache for locally built targets. Artifacts are stored in its action cache and CAS under the action digests that remote execution would use, salted with the cache key; the server needn't support execution itself.\nThe instance name, TLS and token settings are taken from the [remote] section."`
+		RemoteWriteable            bool         `help:"If True this plz instance will write content back to the remote cache.\nBy default it runs in read-only mode."`
+		Tiers                      []string     `help:"The order in which the caches are consulted, as a list of dir, http and remote. Artifacts retrieved from a later tier are written back to the earlier ones.\nAny configured caches that aren't listed come after these, in the default order (dir, http, remote). Per-tier rules can be set in a [cachetier] section." example:"dir, remote, http"`
 	} `help:"Please has several built-in caches that can be configured in its config file.\n\nThe simplest one is the directory cache which by default is written into the .plz-cache directory. This allows for fast retrieval of code that has been built before (for example, when swapping Git branches).\n\nThere is also a remote RPC cache which allows using a centralised server to store artifacts. A typical pattern here is to have your CI system write artifacts into it and give developers read-only access so they can reuse its work.\n\nFinally there's a HTTP cache which is very similar, but a little obsolete now since the RPC cache outperforms it and has some extra features. Otherwise the two have similar semantics and share quite a bit of implementation.\n\nPlease has server implementations for both the RPC and HTTP caches."`
-	Test struct {
+	CacheTier map[string]*CacheTier `help:"Per-tier cache policies, keyed by the name of the tier (dir, http or remote). For example:\n\n[cachetier \"http\"]\nreadonly = true\nmaxsize = 100M\nexcludelabel = large\n\nTiers that have no section here are read from and written to for all targets."`
+	Test      struct {
 		Timeout         cli.Duration `help:"Default timeout applied to all tests. Can be overridden on a per-rule basis."`
 		Sandbox         bool         `help:"True to sandbox individual tests, which isolates them from network access, IPC and some aspects of the filesystem. Currently only works on Linux." var:"TEST_SANDBOX"`
 		DisableCoverage []string     `help:"Disables coverage for tests that have any of these labels spcified."`
 		Upload          cli.URL      `help:"URL to upload test results to (in XML format)"`
 	} `help:"A config section describing settings related to testing in general."`
 	Remote struct {
-		URL           string       `help:"URL for the remote server."`
-		CASURL        string       `help:"URL for the CAS service, if it is different to the main one."`
-		AssetURL      string       `help:"URL for the remote asset server, if it is different to the main one."`
-		NumExecutors  int          `help:"Maximum number of remote executors to use simultaneously."`
-		Instance      string       `help:"Remote instance name to request; depending on the server this may be required."`
-		Name          string       `help:"A name for this worker instance. This is attached to artifacts uploaded to remote storage." example:"agent-001"`
-		DisplayURL    string       `help:"A URL to browse the remote server with (e.g. using buildbarn-browser). Only used when printing hashes."`
-		TokenFile     string       `help:"A file containing a token that is attached to outgoing RPCs to authenticate them. This is somewhat bespoke; we are still investigating further options for authentication."`
-		Timeout       cli.Duration `help:"Timeout for connections made to the remote server."`
-		Secure        bool         `help:"Whether to use TLS for communication or not."`
-		VerifyOutputs bool         `help:"Whether to verify all outputs are present after a cached remote execution action. Depending on your server implementation, you may require this to ensure files are really present."`
-		Shell         string       `help:"Path to the shell to use to execute actions in. Default looks up bash based on the build.path setting."`
-		Platform      []string     `help:"Platform properties to request from remote workers, in the format key=value."`
-		CacheDuration cli.Duration `help:"Length of time before we re-check locally cached build actions. Default is unlimited."`
-		BuildID       string       `help:"ID of the build action that's being run, to attach to remote requests."`
+		URL                     string       `help:"URL for the remote server."`
+		CASURL                  string       `help:"URL for the CAS service, if it is different to the main one."`
+		AssetURL                string       `help:"URL for the remote asset server, if it is different to the main one."`
+		NumExecutors            int          `help:"Maximum number of remote executors to use simultaneously."`
+		Instance                string       `help:"Remote instance name to request; depending on the server this may be required."`
+		Name                    string       `help:"A name for this worker instance. This is attached to artifacts uploaded to remote storage." example:"agent-001"`
+		DisplayURL              string       `help:"A URL to browse the remote server with (e.g. using buildbarn-browser). Only used when printing hashes."`
+		TokenFile               string       `help:"A file containing a token that is attached to outgoing RPCs to authenticate them. It is re-read periodically so it can be rotated by another process while Please is running."`
+		TokenCommand            string       `help:"A credential helper command that prints a token to stdout, which is attached to outgoing RPCs to authenticate them. It is run through the shell, and rerun periodically to refresh the token. Can't be used together with TokenFile." example:"gcloud auth print-access-token"`
+		TokenRefresh            cli.Duration `help:"How often to re-read the token from TokenFile or rerun TokenCommand."`
+		Timeout                 cli.Duration `help:"Timeout for connections made to the remote server."`
+		Secure                  bool         `help:"Whether to use TLS for communication or not."`
+		CACertFile              string       `help:"PEM file containing the CA certificates used to verify the remote server, if they aren't in the system's trust store. Only used when Secure is set."`
+		ClientCertFile          string       `help:"PEM file containing a client certificate to authenticate to the remote server with (i.e. mTLS). Requires ClientKeyFile, and is only used when Secure is set."`
+		ClientKeyFile           string       `help:"PEM file containing the private key for ClientCertFile."`
+		VerifyOutputs           bool         `help:"Whether to verify all outputs are present after a cached remote execution action. Depending on your server implementation, you may require this to ensure files are really present."`
+		Shell                   string       `help:"Path to the shell to use to execute actions in. Default looks up bash based on the build.path setting."`
+		Platform                []string     `help:"Platform properties to request from remote workers, in the format key=value."`
+		CacheDuration           cli.Duration `help:"Length of time before we re-check locally cached build actions. Default is unlimited."`
+		BuildID                 string       `help:"ID of the build action that's being run, to attach to remote requests."`
+		Dynamic                 bool         `help:"Enables dynamic execution. Build actions of eligible targets are run locally and remotely at the same time and whichever finishes first is used, and targets are built locally instead while the remote server is unavailable."`
+		DynamicLabel            []string     `help:"Labels of targets whose build actions are raced locally in dynamic mode. If not set, all eligible targets are raced; targets with pre- or post-build functions, filegroups and remote files are never raced." example:"small"`
+		CircuitBreakerThreshold int          `help:"Number of consecutive failed requests after which we stop sending requests to the remote server for a while, since it appears to be degraded. Set to 0 to disable the circuit breaker."`
+		CircuitBreakerCooldown  cli.Duration `help:"Length of time that we stop sending requests to the remote server for once the circuit breaker has tripped, before trying it again."`
+		DownloadMinimal         bool         `help:"Don't download the outputs of remotely built targets after plz build, even ones that were requested explicitly. They are only fetched when something needs them locally, such as a local build action, a test or plz run, or plz build --download. plz query outputs shows which outputs are only held remotely."`
+		PushRemoteFiles         bool         `help:"Pushes remote_file rules that were fetched locally to the remote asset server, so that later builds (for example on CI workers without internet access) can fetch them from there instead."`
+		LocalFetchFallback      bool         `help:"Fetches remote_file rules locally if the remote asset server fails to fetch them, for example because it can't reach their URLs. Combined with PushRemoteFiles, they're then available from the asset server to other builds."`
+		FullFileModes           bool         `help:"Records the full permissions of files in remote actions, if the server supports the unix_mode node property. By default only whether each file is executable is recorded (as mode 0755 or 0644), since otherwise the same file can hash differently on machines with a different umask."`
 	} `help:"Settings related to remote execution & caching using the Google remote execution APIs. This section is still experimental and subject to change."`
-	Size  map[string]*Size `help:"Named sizes of targets; these are the definitions of what can be passed to the 'size' argument."`
-	Cover struct {
+	RemoteRetry map[string]*RemoteRetry `help:"Retry policies for transient failures of remote RPCs, keyed by the class of RPC (execute, waitexecution, casread, caswrite or actioncache). For example:\n\n[remoteretry \"casread\"]\nattempts = 10\nbasedelay = 100ms\nmaxdelay = 5s\n\nClasses without a section here, and fields that are not set, use built-in defaults."`
+	RemoteAuth  map[string]*RemoteAuth  `help:"Credentials for individual remote endpoints, keyed by the setting in the [remote] section that they apply to (url, casurl or asseturl). For example:\n\n[remoteauth \"casurl\"]\ntokenfile = /var/run/cas-token\n\nAny fields not set here use the ones in the [remote] section. Note that since the main and CAS connections are made together, they must use the same TLS settings."`
+	Size        map[string]*Size        `help:"Named sizes of targets; these are the definitions of what can be passed to the 'size' argument."`
+	Cover       struct {
 		FileExtension    []string `help:"Extensions of files to consider for coverage.\nDefaults to a reasonably obvious set for the builtin rules including .go, .py, .java, etc."`
 		ExcludeExtension []string `help:"Extensions of files to exclude from coverage.\nTypically this is for generated code; the default is to exclude protobuf extensions like .pb.go, _pb2.py, etc."`
 	}
+	BuildEvents struct {
+		URL       string       `help:"URL of a server implementing the Build Event Service API to stream structured build events to.\nIf not set, events are only written out locally when --event_file is passed."`
+		Secure    bool         `help:"Whether to use TLS to connect to the build event service."`
+		ProjectID string       `help:"Project ID to attach to events sent to the build event service; some servers require this."`
+		Timeout   cli.Duration `help:"Maximum time to wait for the build event service to acknowledge all events at the end of the build."`
+	} `help:"Please can stream structured events about the build (when it starts, targets being built, test results, etc) to a server implementing the Build Event Service API from the Google remote APIs.\nEach event is sent in the bazel_event field as a google.protobuf.Struct with the same fields as the JSON written by --event_file. Note that this is a Please-specific schema rather than Bazel's Build Event Protocol, so tools that only understand the latter won't be able to interpret it."`
 	Gc struct {
 		Keep      []BuildLabel `help:"Marks targets that gc should always keep. Can include meta-targets such as //test/... and //docs:all."`
 		KeepLabel []string     `help:"Defines a target label to be kept; for example, if you set this to go, no Go targets would ever be considered for deletion." example:"go"`
 	} `help:"Please supports a form of 'garbage collection', by which it means identifying targets that are not used for anything. By default binary targets and all their transitive dependencies are always considered non-garbage, as are any tests directly on those. The config options here allow tweaking this behaviour to retain more things.\n\nNote that it's a very good idea that your BUILD files are in the standard format when running this."`
+	Lint struct {
+		Enable  []string `help:"Lint rules to enable in addition to the default set. See plz lint --list for the available rules." example:"missing-test, wide-visibility"`
+		Disable []string `help:"Lint rules to disable from the default set." example:"unsorted-list"`
+	} `help:"Options relating to use of plz lint, which checks BUILD files for common problems. Individual issues can also be suppressed with a '# nolint' comment, optionally naming the rules to suppress (e.g. '# nolint: unsorted-list, duplicate-dep'), either on the same line as the issue or the line before it or the target it's in."`
 	Go struct {
 		GoTool           string `help:"The binary to use to invoke Go & its subtools with." var:"GO_TOOL"`
 		GoRoot           string `help:"If set, will set the GOROOT environment variable appropriately during build actions." var:"GOROOT"`
@@ -565,6 +609,31 @@ type Alias struct {
 	PositionalLabels bool     `help:"Treats positional arguments after commands as build labels for the purpose of tab completion."`
 }
 
+// A CacheTier represents the policy applied to one of the caches.
+type CacheTier struct {
+	ReadOnly     bool         `help:"Never store artifacts in this tier, including ones retrieved from later tiers."`
+	WriteOnly    bool         `help:"Never retrieve artifacts from this tier; they are only stored in it."`
+	MaxSize      cli.ByteSize `help:"Targets whose outputs are larger than this in total are not stored in this tier."`
+	IncludeLabel []string     `help:"If set, only targets with at least one of these labels use this tier."`
+	ExcludeLabel []string     `help:"Targets with any of these labels do not use this tier."`
+}
+
+// A RemoteRetry represents the retry policy for one class of remote RPC.
+type RemoteRetry struct {
+	Attempts  int          `help:"Maximum number of attempts to make, including the first."`
+	BaseDelay cli.Duration `help:"Delay before the first retry. Subsequent delays grow exponentially and are randomised to avoid many clients retrying in lockstep."`
+	MaxDelay  cli.Duration `help:"Maximum delay between attempts."`
+}
+
+// A RemoteAuth represents the credentials for one remote endpoint.
+type RemoteAuth struct {
+	TokenFile      string `help:"A file containing a token to authenticate RPCs to this endpoint with."`
+	TokenCommand   string `help:"A credential helper command that prints a token for this endpoint to stdout."`
+	CACertFile     string `help:"PEM file containing the CA certificates used to verify this endpoint."`
+	ClientCertFile string `help:"PEM file containing a client certificate to authenticate to this endpoint with."`
+	ClientKeyFile  string `help:"PEM file containing the private key for ClientCertFile."`
+}
+
 // A Size represents a named size in the config.
 type Size struct {
 	Timeout     cli.Duration `help:"Timeout for targets of this size"`
@@ -581,20 +650,46 @@ type storedBuildEnv struct {
 // tool paths which get accounted for on the targets that use them).
 func (config *Configuration) Hash() []byte {
 	h := sha1.New()
+	config.hashInputs(func(name string, value []byte) {
+		h.Write(value)
+	})
+	return h.Sum(nil)
+}
+
+// HashComponents returns hashes of each of the individual values that make up Hash, keyed by
+// the name of the config value. It's used to explain which one changed when the overall hash does.
+func (config *Configuration) HashComponents() map[string][]byte {
+	hashes := map[string]hash.Hash{}
+	config.hashInputs(func(name string, value []byte) {
+		h, present := hashes[name]
+		if !present {
+			h = sha1.New()
+			hashes[name] = h
+		}
+		h.Write(value)
+	})
+	ret := make(map[string][]byte, len(hashes))
+	for name, h := range hashes {
+		ret[name] = h.Sum(nil)
+	}
+	return ret
+}
+
+// hashInputs calls the given function for each value that forms part of the config hash.
+func (config *Configuration) hashInputs(f func(name string, value []byte)) {
 	// These fields are the ones that need to be in the general hash; other things will be
 	// picked up by relevant rules (particularly tool paths etc).
 	// Note that container settings are handled separately.
-	h.Write([]byte(config.Build.Lang))
-	h.Write([]byte(config.Build.Nonce))
+	f("build.lang", []byte(config.Build.Lang))
+	f("build.nonce", []byte(config.Build.Nonce))
 	for _, l := range config.Licences.Reject {
-		h.Write([]byte(l))
+		f("licences.reject", []byte(l))
 	}
 	for _, env := range config.getBuildEnv(false, false) {
 		if !strings.HasPrefix(env, "SECRET") {
-			h.Write([]byte(env))
+			f("env "+strings.SplitN(env, "=", 2)[0], []byte(env))
 		}
 	}
-	return h.Sum(nil)
 }
 
 // GetBuildEnv returns the build environment configured for this config object.
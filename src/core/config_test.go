@@ -256,6 +256,17 @@ func TestPassUnsafeEnvExcludedFromHash(t *testing.T) {
 	assert.Equal(t, expected, config.Hash())
 }
 
+func TestHashComponents(t *testing.T) {
+	config := DefaultConfiguration()
+	components := config.HashComponents()
+	assert.Contains(t, components, "build.lang")
+	assert.Contains(t, components, "build.nonce")
+	config.Build.Nonce = "wibble"
+	components2 := config.HashComponents()
+	assert.NotEqual(t, components["build.nonce"], components2["build.nonce"])
+	assert.Equal(t, components["build.lang"], components2["build.lang"])
+}
+
 func TestBuildPathWithPathEnv(t *testing.T) {
 	config, err := ReadConfigFiles([]string{"src/core/test_data/passenv.plzconfig"}, nil)
 	assert.NoError(t, err)
@@ -301,6 +312,19 @@ func TestParseNewFormatAliases(t *testing.T) {
 	assert.EqualValues(t, []string{"--host", "--repo"}, a.Flag)
 }
 
+func TestParseCacheTiers(t *testing.T) {
+	c, err := ReadConfigFiles([]string{"src/core/test_data/cachetier.plzconfig"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"remote", "dir"}, c.Cache.Tiers)
+	assert.Equal(t, 1, len(c.CacheTier))
+	tier := c.CacheTier["http"]
+	assert.True(t, tier.ReadOnly)
+	assert.False(t, tier.WriteOnly)
+	assert.EqualValues(t, 100*1000*1000, tier.MaxSize)
+	assert.Equal(t, []string{"shared"}, tier.IncludeLabel)
+	assert.Equal(t, []string{"large", "manual"}, tier.ExcludeLabel)
+}
+
 func TestAttachAliasFlags(t *testing.T) {
 	c, err := ReadConfigFiles([]string{"src/core/test_data/alias.plzconfig"}, nil)
 	assert.NoError(t, err)
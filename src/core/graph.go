@@ -282,3 +282,89 @@ func (graph *BuildGraph) DependentTargets(from, to BuildLabel) []BuildLabel {
 	}
 	return []BuildLabel{to}
 }
+
+// RemovePackages removes all packages for which the given function returns true, along with
+// their targets. Any other packages that depend on those (either via their targets or by
+// subincluding them) are removed too, since they'd otherwise refer to targets that no longer exist.
+// It returns the number of packages removed.
+// This is only safe to call when nothing else is using the graph.
+func (graph *BuildGraph) RemovePackages(remove func(*Package) bool) int {
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+	// Work out which packages depend on which.
+	dependents := map[packageKey][]packageKey{}
+	for key, pkg := range graph.packages {
+		for dep := range pkg.dependencies() {
+			dependents[dep] = append(dependents[dep], key)
+		}
+	}
+	removed := map[packageKey]bool{}
+	var removePackage func(key packageKey)
+	removePackage = func(key packageKey) {
+		if removed[key] {
+			return
+		}
+		removed[key] = true
+		for _, dependent := range dependents[key] {
+			removePackage(dependent)
+		}
+	}
+	for key, pkg := range graph.packages {
+		if remove(pkg) {
+			removePackage(key)
+		}
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+	isRemoved := func(label BuildLabel) bool {
+		return removed[packageKey{Name: label.PackageName, Subrepo: label.Subrepo}]
+	}
+	// Subrepos defined by removed packages go too, along with everything in them.
+	for name, subrepo := range graph.subrepos {
+		if subrepo.Target != nil && isRemoved(subrepo.Target.Label) {
+			delete(graph.subrepos, name)
+			for key := range graph.packages {
+				if key.Subrepo == name {
+					removePackage(key)
+				}
+			}
+		}
+	}
+	for key := range removed {
+		if pkg, present := graph.packages[key]; present {
+			for _, target := range pkg.AllTargets() {
+				delete(graph.targets, target.Label)
+				delete(graph.revDeps, target.Label)
+				delete(graph.pendingRevDeps, target.Label)
+			}
+			delete(graph.packages, key)
+		}
+	}
+	for label, revdeps := range graph.revDeps {
+		kept := revdeps[:0]
+		for _, revdep := range revdeps {
+			if !isRemoved(revdep.Label) {
+				kept = append(kept, revdep)
+			}
+		}
+		graph.revDeps[label] = kept
+	}
+	for _, revdeps := range graph.pendingRevDeps {
+		for label := range revdeps {
+			if isRemoved(label) {
+				delete(revdeps, label)
+			}
+		}
+	}
+	return len(removed)
+}
+
+// Reset resets all the targets in the graph so it can be reused for another build.
+func (graph *BuildGraph) Reset() {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	for _, target := range graph.targets {
+		target.reset()
+	}
+}
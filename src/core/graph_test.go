@@ -90,6 +90,44 @@ func TestSubrepo(t *testing.T) {
 	assert.Equal(t, "plz-out/gen/test", subrepo.Root)
 }
 
+func TestRemovePackages(t *testing.T) {
+	graph := NewGraph()
+	target1 := makeTarget3("//src/core:target1")
+	target2 := makeTarget3("//src/build:target2", target1)
+	target3 := makeTarget3("//src/cli:target3")
+	pkg4 := NewPackage("src/parse")
+	pkg4.Subincludes = []BuildLabel{target2.Label}
+	for _, target := range []*BuildTarget{target1, target2, target3} {
+		pkg := NewPackage(target.Label.PackageName)
+		pkg.AddTarget(target)
+		graph.AddPackage(pkg)
+		graph.AddTarget(target)
+	}
+	graph.AddPackage(pkg4)
+	graph.AddDependency(target2.Label, target1.Label)
+	// Removing src/core takes src/build with it since that depends on it, and src/parse since it subincludes from that.
+	assert.Equal(t, 3, graph.RemovePackages(func(pkg *Package) bool { return pkg.Name == "src/core" }))
+	assert.Nil(t, graph.Package("src/core", ""))
+	assert.Nil(t, graph.Package("src/build", ""))
+	assert.Nil(t, graph.Package("src/parse", ""))
+	assert.NotNil(t, graph.Package("src/cli", ""))
+	assert.Nil(t, graph.Target(target1.Label))
+	assert.Nil(t, graph.Target(target2.Label))
+	assert.Equal(t, target3, graph.Target(target3.Label))
+	assert.Equal(t, 0, graph.RemovePackages(func(pkg *Package) bool { return false }))
+}
+
+func TestReset(t *testing.T) {
+	graph := NewGraph()
+	target := makeTarget3("//src/core:target1")
+	graph.AddTarget(target)
+	target.SetState(Built)
+	target.Results.TimedOut = true
+	graph.Reset()
+	assert.Equal(t, Inactive, target.State())
+	assert.False(t, target.Results.TimedOut)
+}
+
 // makeTarget3 creates a new build target for us.
 func makeTarget3(label string, deps ...*BuildTarget) *BuildTarget {
 	target := NewBuildTarget(ParseBuildLabel(label, ""))
@@ -253,3 +253,29 @@ func FindOwningPackage(state *BuildState, file string) BuildLabel {
 	}
 	return BuildLabel{PackageName: "", Name: "all"}
 }
+
+// dependencies returns the set of other packages that this one depends on, either because
+// its targets depend on targets in them or because it subincludes something from them.
+func (pkg *Package) dependencies() map[packageKey]struct{} {
+	pkg.mutex.RLock()
+	defer pkg.mutex.RUnlock()
+	self := packageKey{Name: pkg.Name, Subrepo: pkg.SubrepoName}
+	deps := map[packageKey]struct{}{}
+	add := func(label BuildLabel) {
+		if key := (packageKey{Name: label.PackageName, Subrepo: label.Subrepo}); key != self {
+			deps[key] = struct{}{}
+		}
+	}
+	for _, label := range pkg.Subincludes {
+		add(label)
+	}
+	for _, target := range pkg.targets {
+		for _, dep := range target.dependencies {
+			add(dep.declared)
+			for _, t := range dep.deps {
+				add(t.Label)
+			}
+		}
+	}
+	return deps
+}
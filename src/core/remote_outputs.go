@@ -0,0 +1,68 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// RemoteOutputs is a manifest of the outputs of a target that was built remotely but whose outputs
+// have not been downloaded. It's stored in the target's output directory so that they can still be
+// found (and fetched) later on.
+type RemoteOutputs struct {
+	// Digest of the action that built the target, as hash/size.
+	Action string `json:"action"`
+	// The individual outputs, keyed by their path relative to the target's output directory.
+	Outputs map[string]RemoteOutput `json:"outputs"`
+}
+
+// A RemoteOutput is a single output of a target that is held remotely.
+type RemoteOutput struct {
+	// Digest of the output, as hash/size. For directories this is the digest of their Directory proto.
+	Digest       string `json:"digest,omitempty"`
+	IsExecutable bool   `json:"is_executable,omitempty"`
+	IsDirectory  bool   `json:"is_directory,omitempty"`
+	// For symlinks, the path they point to.
+	Symlink string `json:"symlink,omitempty"`
+}
+
+// remoteOutputsFileName returns the name of the file that the remote outputs manifest is stored in for a target.
+func remoteOutputsFileName(target *BuildTarget) string {
+	return path.Join(target.OutDir(), target.RemoteOutputsFileName())
+}
+
+// StoreRemoteOutputs writes the manifest of remote outputs for a target.
+func StoreRemoteOutputs(target *BuildTarget, outputs *RemoteOutputs) error {
+	b, err := json.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	filename := remoteOutputsFileName(target)
+	if err := os.MkdirAll(path.Dir(filename), DirPermissions); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// LoadRemoteOutputs reads the manifest of remote outputs for a target.
+// It returns nil if there isn't one, i.e. the target's outputs are local (or it hasn't been built).
+func LoadRemoteOutputs(target *BuildTarget) (*RemoteOutputs, error) {
+	b, err := ioutil.ReadFile(remoteOutputsFileName(target))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	outputs := &RemoteOutputs{}
+	return outputs, json.Unmarshal(b, outputs)
+}
+
+// RemoveRemoteOutputs removes any manifest of remote outputs for a target, for example once they
+// have been downloaded.
+func RemoveRemoteOutputs(target *BuildTarget) error {
+	if err := os.Remove(remoteOutputsFileName(target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
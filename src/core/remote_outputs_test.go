@@ -0,0 +1,32 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteOutputs(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core/test_remote_outputs:target1", ""))
+	outputs, err := LoadRemoteOutputs(target)
+	assert.NoError(t, err)
+	assert.Nil(t, outputs)
+
+	outputs = &RemoteOutputs{
+		Action: "4d3f0e63de66b3b0d61c5ca3a8f4c1f8ee0ee1c20aa00fdfe6b94bcc3bc9a4a3/142",
+		Outputs: map[string]RemoteOutput{
+			"out.txt": {Digest: "e70c151d26f755cea2162b627151416f4407ebc8502cea8e68f0d95a3950ea16/42", IsExecutable: true},
+			"link":    {Symlink: "out.txt"},
+		},
+	}
+	assert.NoError(t, StoreRemoteOutputs(target, outputs))
+	loaded, err := LoadRemoteOutputs(target)
+	assert.NoError(t, err)
+	assert.Equal(t, outputs, loaded)
+
+	assert.NoError(t, RemoveRemoteOutputs(target))
+	loaded, err = LoadRemoteOutputs(target)
+	assert.NoError(t, err)
+	assert.Nil(t, loaded)
+	assert.NoError(t, RemoveRemoteOutputs(target)) // Doesn't matter if it's already gone
+}
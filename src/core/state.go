@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"hash/crc64"
 	"io"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -104,6 +106,14 @@ type RemoteClient interface {
 	PrintHashes(target *BuildTarget, isTest bool)
 	// DataRate returns an estimate of the current in/out RPC data rates and totals so far in bytes per second.
 	DataRate() (int, int, int, int)
+	// BuildContext is like Build but abandons the remote build if the given context is cancelled.
+	BuildContext(ctx context.Context, tid int, target *BuildTarget) (*BuildMetadata, error)
+	// Healthy returns true if the remote server is currently believed to be usable.
+	Healthy() bool
+	// Degraded returns true if requests to the remote server have been suspended because it is failing.
+	Degraded() bool
+	// PushRemoteFile pushes the output of a remote_file target, which has been fetched locally, to the remote asset server.
+	PushRemoteFile(target *BuildTarget) error
 }
 
 // A TargetHasher is a thing that knows how to create hashes for targets.
@@ -114,6 +124,22 @@ type TargetHasher interface {
 	SetHash(target *BuildTarget, hash []byte)
 }
 
+// DebugBuildFiles describes how to run the debugger for evaluating BUILD files.
+type DebugBuildFiles struct {
+	// Breakpoints to set initially, each of the form filename:line.
+	Breakpoints []string
+	// Port to serve the Debug Adapter Protocol on. If zero the debugger runs interactively in the terminal.
+	Port int
+}
+
+// ProfileBuildFiles describes where to write a profile of evaluating BUILD files.
+type ProfileBuildFiles struct {
+	// File to write the profile into.
+	Filename string
+	// Format to write it in; either pprof or trace (for Chrome's trace viewer).
+	Format string
+}
+
 // A BuildState tracks the current state of the build & related data.
 // As well as tracking the build graph and config, it also tracks the set of current
 // tasks and maintains a queue of them, along with various related counters which are
@@ -129,6 +155,8 @@ type BuildState struct {
 	StartTime time.Time
 	// Various system statistics. Mostly used during remote communication.
 	Stats *SystemStats
+	// Outcomes of dynamic execution, when it is enabled.
+	DynamicStats *DynamicStats
 	// Configuration options
 	Config *Configuration
 	// Parser implementation. Other things can call this to perform various external parse tasks.
@@ -139,6 +167,8 @@ type BuildState struct {
 	Hashes struct {
 		// Hash of the general config, not including specialised bits.
 		Config []byte
+		// Hashes of each of the individual values that make up Config.
+		ConfigComponents map[string][]byte
 	}
 	// Tracks file hashes during the build.
 	PathHasher *fs.PathHasher
@@ -209,6 +239,10 @@ type BuildState struct {
 	ShowAllOutput bool
 	// True to attach a debugger on test failure.
 	DebugTests bool
+	// Options for the BUILD file debugger; nil if it isn't enabled.
+	DebugBuildFiles *DebugBuildFiles
+	// Options for profiling evaluation of BUILD files; nil if it isn't enabled.
+	ProfileBuildFiles *ProfileBuildFiles
 	// True if we think the underlying filesystem supports xattrs (which affects how we write some metadata).
 	XattrsSupported bool
 	// Experimental directories
@@ -263,6 +297,17 @@ type SystemStats struct {
 	NumWorkerProcesses int
 }
 
+// DynamicStats counts the outcomes of dynamic execution, where build actions are raced locally
+// against remote execution. The fields are updated atomically.
+type DynamicStats struct {
+	// Number of races won by the local build.
+	LocalWins int64 `json:"local_wins"`
+	// Number of races won by the remote build.
+	RemoteWins int64 `json:"remote_wins"`
+	// Number of targets built locally because the remote server was unavailable.
+	Fallbacks int64 `json:"fallbacks"`
+}
+
 // AddActiveTarget increments the counter for a newly active build target.
 func (state *BuildState) AddActiveTarget() {
 	atomic.AddInt64(&state.progress.numActive, 1)
@@ -387,6 +432,17 @@ func (state *BuildState) KillAll() {
 	state.CloseResults()
 }
 
+// Cancel stops the build as soon as possible. No further tasks are started, any subprocesses that
+// are running are killed and the build is marked as unsuccessful.
+// Unlike KillAll the result channels stay open so any tasks still in flight can finish up.
+func (state *BuildState) Cancel() {
+	state.progress.success = false
+	state.pendingTasks.Put(pendingTask{Type: Kill})
+	if state.ProcessExecutor != nil {
+		state.ProcessExecutor.KillAll()
+	}
+}
+
 // CloseResults closes the result channels.
 func (state *BuildState) CloseResults() {
 	if state.results != nil {
@@ -599,6 +655,13 @@ func (state *BuildState) SetTaskNumbers(active, done int64) {
 	atomic.StoreInt64(&state.progress.numDone, done)
 }
 
+// OriginalLabels returns the set of original labels as given, without expanding any pseudo-labels.
+func (state *BuildState) OriginalLabels() BuildLabels {
+	state.progress.originalTargetMutex.Lock()
+	defer state.progress.originalTargetMutex.Unlock()
+	return append(BuildLabels{}, state.progress.originalTargets...)
+}
+
 // ExpandOriginalLabels expands any pseudo-labels (ie. :all, ... has already been resolved to a bunch :all targets)
 // from the set of original labels.
 func (state *BuildState) ExpandOriginalLabels() BuildLabels {
@@ -827,6 +890,19 @@ func (state *BuildState) WillRunRemotely(target *BuildTarget) bool {
 	return state.RemoteClient != nil && state.Config.NumRemoteExecutors() > 0 && !target.Local
 }
 
+// ShouldRunDynamically returns true if the build action for the given target should be raced
+// locally against remote execution.
+func (state *BuildState) ShouldRunDynamically(target *BuildTarget) bool {
+	if !state.Config.Remote.Dynamic || !state.WillRunRemotely(target) {
+		return false
+	} else if target.IsFilegroup || target.IsRemoteFile || target.IsTextFile || target.PreBuildFunction != nil || target.PostBuildFunction != nil {
+		return false // These either aren't worth racing or can modify the target as they build.
+	} else if strings.HasPrefix(target.GetCommand(state), "$(worker") {
+		return false // Persistent workers can't be interrupted.
+	}
+	return len(state.Config.Remote.DynamicLabel) == 0 || target.HasAnyLabel(state.Config.Remote.DynamicLabel)
+}
+
 // EnsureDownloaded ensures that a target has been downloaded when built remotely.
 // If remote execution is not enabled it has no effect.
 func (state *BuildState) EnsureDownloaded(target *BuildTarget) error {
@@ -938,6 +1014,44 @@ func (state *BuildState) ForArch(arch cli.Arch) *BuildState {
 	return s
 }
 
+// ReuseGraph replaces this state's graph with one from a previous build, which is reset so that its
+// targets can be built again. Any subrepos in it are updated to refer to states derived from this one.
+func (state *BuildState) ReuseGraph(graph *BuildGraph) {
+	graph.Reset()
+	state.Graph = graph
+	graph.mutex.RLock()
+	subrepos := make([]*Subrepo, 0, len(graph.subrepos))
+	for _, subrepo := range graph.subrepos {
+		subrepos = append(subrepos, subrepo)
+	}
+	graph.mutex.RUnlock()
+	rebased := map[*BuildState]*BuildState{}
+	for _, subrepo := range subrepos {
+		// Anything that referred to the previous root state now refers to this one.
+		rebased[subrepo.State.progress.allStates[0]] = state
+	}
+	for _, subrepo := range subrepos {
+		s, present := rebased[subrepo.State]
+		if !present {
+			s = state.withConfig(subrepo.State.Config, subrepo.State.Arch)
+			rebased[subrepo.State] = s
+		}
+		subrepo.State = s
+	}
+}
+
+// withConfig creates a copy of this BuildState with the given config and architecture.
+func (state *BuildState) withConfig(config *Configuration, arch cli.Arch) *BuildState {
+	state.progress.mutex.Lock()
+	defer state.progress.mutex.Unlock()
+	s := &BuildState{}
+	*s = *state
+	s.Config = config
+	s.Arch = arch
+	state.progress.allStates = append(state.progress.allStates, s)
+	return s
+}
+
 // findArch returns an existing state for the given architecture, if one exists.
 func (state *BuildState) findArch(arch cli.Arch) *BuildState {
 	state.progress.mutex.Lock()
@@ -1017,6 +1131,7 @@ func NewBuildState(config *Configuration) *BuildState {
 		TargetArch:      config.Build.Arch,
 		Arch:            cli.HostArch(),
 		Stats:           &SystemStats{},
+		DynamicStats:    &DynamicStats{},
 		progress: &stateProgress{
 			numActive:       1, // One for the initial target adding on the main thread.
 			numRunning:      1, // Similarly.
@@ -1030,6 +1145,7 @@ func NewBuildState(config *Configuration) *BuildState {
 	state.PathHasher = state.Hasher(config.Build.HashFunction)
 	state.progress.allStates = []*BuildState{state}
 	state.Hashes.Config = config.Hash()
+	state.Hashes.ConfigComponents = config.HashComponents()
 	for _, exp := range config.Parse.ExperimentalDir {
 		state.experimentalLabels = append(state.experimentalLabels, BuildLabel{PackageName: exp, Name: "..."})
 	}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// Forward forwards a command to the daemon, if one is running for this repo, and returns its exit code.
+// The second return value is false if the command wasn't run, in which case the caller should run it itself.
+func Forward(args []string, dir string) (int, bool) {
+	conn, err := dial()
+	if err != nil {
+		log.Debug("Not forwarding command to daemon: %s", err)
+		return 0, false
+	}
+	defer conn.Close()
+	resp, err := send(conn, &request{
+		Command: "run",
+		Version: core.PleaseVersion.String(),
+		Args:    args,
+		Dir:     dir,
+		Env:     os.Environ(),
+	})
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Once the request is sent, the daemon may have started running it, so we can't try again here.
+		log.Error("The daemon exited while running this command; see plz-out/log for details")
+		return 1, true
+	} else if err != nil {
+		log.Warning("Failed to forward command to daemon: %s", err)
+		return 0, false
+	} else if resp.Error != "" {
+		log.Warning("Daemon can't run this command, running it locally: %s", resp.Error)
+		return 0, false
+	}
+	return resp.ExitCode, true
+}
+
+// GetStatus returns the status of the daemon running for this repo.
+func GetStatus() (*Status, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("No daemon is running: %s", err)
+	}
+	defer conn.Close()
+	resp, err := send(conn, &request{Command: "status", Version: core.PleaseVersion.String()})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Status, nil
+}
+
+// Stop asks the daemon running for this repo to stop once it's finished any command it's running.
+func Stop() error {
+	conn, err := dial()
+	if err != nil {
+		return fmt.Errorf("No daemon is running: %s", err)
+	}
+	defer conn.Close()
+	resp, err := send(conn, &request{Command: "stop", Version: core.PleaseVersion.String()})
+	if err != nil {
+		return err
+	} else if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return nil
+}
+
+// dial connects to the daemon's socket.
+func dial() (*net.UnixConn, error) {
+	return net.DialUnix("unix", nil, &net.UnixAddr{Name: SocketPath, Net: "unix"})
+}
+
+// send sends a request to the daemon, along with our stdin, stdout & stderr, and waits for its response.
+func send(conn *net.UnixConn, req *request) (*response, error) {
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(0, 1, 2), nil); err != nil {
+		return nil, err
+	} else if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &response{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
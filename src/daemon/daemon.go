@@ -0,0 +1,431 @@
+// Package daemon implements a long-running server that keeps the parsed build graph in memory
+// between commands, so they don't have to reparse the repo each time.
+//
+// The daemon listens on a Unix socket in plz-out. Commands are forwarded to it by the CLI along
+// with its stdin, stdout & stderr, which the daemon uses while it runs the command so the output
+// looks exactly as it would have done otherwise. Packages are invalidated by watching the files
+// and directories they were parsed from; anything that depends on an invalidated package (or
+// subincludes from it) is discarded along with it and reparsed next time it's needed.
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+var log = logging.MustGetLogger("daemon")
+
+// SocketPath is the path to the socket the daemon listens on, relative to the repo root.
+// It's relative to keep it under the length limit for socket paths.
+var SocketPath = path.Join(core.OutDir, "plzd.sock")
+
+// A RunFunc runs a single command with the given arguments and returns its exit code.
+type RunFunc func(args []string) int
+
+// A request is sent from the client to the daemon.
+type request struct {
+	// Command is one of "run", "status" or "stop".
+	Command string   `json:"command"`
+	Version string   `json:"version"`
+	Args    []string `json:"args,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	Env     []string `json:"env,omitempty"`
+}
+
+// A response is sent from the daemon back to the client.
+type response struct {
+	ExitCode int `json:"exit_code"`
+	// Error is set if the daemon couldn't run the command; in that case the client runs it itself.
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status describes the state of a running daemon.
+type Status struct {
+	PID      int       `json:"pid"`
+	Version  string    `json:"version"`
+	Started  time.Time `json:"started"`
+	Commands int64     `json:"commands"`
+	Packages int       `json:"packages"`
+	Targets  int       `json:"targets"`
+}
+
+// A server is the daemon itself.
+type server struct {
+	run      RunFunc
+	listener *net.UnixListener
+	watcher  *watcher
+	started  time.Time
+	commands int64
+	// When the current command started.
+	commandStarted time.Time
+	// Only one command runs at a time, since they share the process' stdio, environment & working directory.
+	runMutex sync.Mutex
+	// The graph from the last command, and the key of the config it was built with.
+	graph    *core.BuildGraph
+	graphKey []byte
+	// The state of the current command, and whether it's been cancelled.
+	state     *core.BuildState
+	cancelled bool
+	// Protects the above
+	mutex   sync.Mutex
+	stopped bool
+}
+
+// current is the running server, or nil if we aren't running as a daemon.
+var current *server
+
+// Serve starts the daemon and runs commands forwarded to it with the given function.
+// It returns once it's been asked to stop.
+func Serve(run RunFunc) error {
+	if conn, err := dial(); err == nil {
+		conn.Close()
+		return fmt.Errorf("A daemon is already running for this repo")
+	}
+	os.Remove(SocketPath) // In case a previous daemon died without cleaning up.
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: SocketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// The listener removes the socket when it's closed, but that doesn't happen if we're killed by a signal.
+	cli.AtExit(func() {
+		os.Remove(SocketPath)
+	})
+	// Clients can go away while we're writing to their stdout; that shouldn't take us with them.
+	signal.Ignore(syscall.SIGPIPE)
+	w, err := newWatcher()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	s := &server{
+		run:      run,
+		listener: l,
+		watcher:  w,
+		started:  time.Now(),
+	}
+	current = s
+	// Commands often die on errors, which mustn't kill us too; runCommand recovers these instead.
+	cli.PanicOnFatal = true
+	defer func() {
+		cli.PanicOnFatal = false
+	}()
+	log.Notice("Daemon listening on %s", SocketPath)
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if s.stopped {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle handles a single connection from a client.
+func (s *server) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	files, err := receiveFiles(conn)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		log.Error("Failed to receive file descriptors from client: %s", err)
+		return
+	}
+	req := &request{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		log.Error("Failed to decode request: %s", err)
+		return
+	}
+	resp := &response{}
+	switch req.Command {
+	case "status":
+		resp.Status = s.status()
+	case "stop":
+		defer s.stop()
+	case "run":
+		if req.Version != core.PleaseVersion.String() {
+			resp.Error = fmt.Sprintf("daemon is running version %s, not %s", core.PleaseVersion, req.Version)
+		} else if len(files) != 3 {
+			resp.Error = fmt.Sprintf("expected 3 file descriptors, got %d", len(files))
+		} else {
+			resp.ExitCode = s.runCommand(req, files, conn)
+		}
+	default:
+		resp.Error = fmt.Sprintf("unknown command %s", req.Command)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Error("Failed to send response: %s", err)
+	}
+}
+
+// runCommand runs a single command using the client's stdio, environment & working directory.
+func (s *server) runCommand(req *request, files []*os.File, conn *net.UnixConn) (code int) {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	atomic.AddInt64(&s.commands, 1)
+	s.commandStarted = time.Now()
+	defer s.setState(nil, false)
+	restoreFiles, err := redirect(files)
+	if err != nil {
+		log.Error("Failed to redirect output: %s", err)
+		return 1
+	}
+	defer restoreFiles()
+	defer setEnv(req.Env, os.Environ())()
+	if wd, err := os.Getwd(); err == nil {
+		defer os.Chdir(wd)
+	}
+	if err := os.Chdir(req.Dir); err != nil {
+		log.Error("%s", err)
+		return 1
+	}
+	defer func(args []string) {
+		os.Args = args
+	}(os.Args)
+	os.Args = req.Args
+	done := make(chan struct{})
+	defer close(done)
+	go s.cancelOnDisconnect(conn, done)
+	defer func() {
+		if r := recover(); r != nil {
+			if r != cli.ErrFatal { // Fatal errors have already been logged.
+				log.Error("%s", r)
+			}
+			s.abandon()
+			code = 1
+		}
+	}()
+	log.Debug("Running %s", strings.Join(req.Args, " "))
+	return s.run(req.Args)
+}
+
+// cancelOnDisconnect cancels the current command if the client goes away before it's done
+// (typically because the user hit Ctrl+C). The daemon itself keeps running.
+func (s *server) cancelOnDisconnect(conn *net.UnixConn, done <-chan struct{}) {
+	conn.Read(make([]byte, 1))
+	select {
+	case <-done:
+	default:
+		log.Warning("Client disconnected, cancelling command")
+		s.cancel()
+	}
+}
+
+// cancel cancels the current command. If it hasn't got as far as creating its state yet,
+// it's cancelled as soon as it does.
+func (s *server) cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cancelled = true
+	if s.state != nil {
+		s.state.Cancel()
+	}
+}
+
+// abandon cancels the current command after it's died part way through. Its graph is discarded
+// since it may have been left inconsistent.
+func (s *server) abandon() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state != nil {
+		s.state.Cancel()
+	}
+	s.graph = nil
+}
+
+// setState sets the state of the current command.
+func (s *server) setState(state *core.BuildState, cancelled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = state
+	s.cancelled = cancelled
+}
+
+// status returns the current status of the daemon.
+func (s *server) status() *Status {
+	status := &Status{
+		PID:      os.Getpid(),
+		Version:  core.PleaseVersion.String(),
+		Started:  s.started,
+		Commands: atomic.LoadInt64(&s.commands),
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.graph != nil {
+		status.Packages = len(s.graph.PackageMap())
+		status.Targets = s.graph.Len()
+	}
+	return status
+}
+
+// stop stops the daemon once any running command is finished.
+func (s *server) stop() {
+	s.runMutex.Lock()
+	defer s.runMutex.Unlock()
+	log.Notice("Stopping daemon")
+	s.stopped = true
+	s.listener.Close()
+}
+
+// PrepareState sets up the given state to reuse the build graph from the previous command, having
+// discarded any packages that have been invalidated since then. The state is also cancelled if the
+// client disconnects before the command finishes.
+// It does nothing if we aren't running as a daemon; the graph isn't reused if there isn't a suitable one.
+func PrepareState(state *core.BuildState) {
+	if current == nil {
+		return
+	}
+	// The default is when the process started, which isn't very meaningful for us.
+	state.StartTime = current.commandStarted
+	current.mutex.Lock()
+	defer current.mutex.Unlock()
+	current.state = state
+	if current.cancelled {
+		state.Cancel()
+	}
+	invalid := current.watcher.Invalidated()
+	key := configKey(state)
+	if current.graph == nil {
+		return
+	} else if !bytes.Equal(key, current.graphKey) {
+		log.Info("Configuration has changed, not reusing build graph")
+		current.graph = nil
+		return
+	}
+	n := current.graph.RemovePackages(func(pkg *core.Package) bool {
+		return invalid[pkg.Label()] || isVolatile(pkg)
+	})
+	log.Info("Reusing build graph from previous command, %d packages invalidated", n)
+	state.ReuseGraph(current.graph)
+}
+
+// StoreState stores the graph from the given state so it can be reused by the next command.
+// It does nothing if we aren't running as a daemon.
+func StoreState(state *core.BuildState) {
+	if current == nil {
+		return
+	}
+	current.mutex.Lock()
+	defer current.mutex.Unlock()
+	current.graph = state.Graph
+	current.graphKey = configKey(state)
+	current.watcher.Watch(state.Graph, state.Config.Parse.BuildFileName)
+}
+
+// isVolatile returns true if a package can't be reused because building it changes its targets.
+func isVolatile(pkg *core.Package) bool {
+	for _, target := range pkg.AllTargets() {
+		if target.PreBuildFunction != nil || target.PostBuildFunction != nil || target.AddedPostBuild {
+			return true
+		}
+	}
+	return false
+}
+
+// configKey returns a key identifying the configuration of the given state.
+// A graph can only be reused by a later state with the same key.
+func configKey(state *core.BuildState) []byte {
+	b, err := json.Marshal(state.Config)
+	if err != nil {
+		log.Warning("Failed to serialise config: %s", err)
+		return nil
+	}
+	h := sha1.New()
+	h.Write(b)
+	h.Write([]byte(state.TargetArch.String()))
+	return h.Sum(nil)
+}
+
+// receiveFiles receives file descriptors sent by the client.
+func receiveFiles(conn *net.UnixConn) ([]*os.File, error) {
+	oob := make([]byte, syscall.CmsgSpace(3*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	files := []*os.File{}
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return files, err
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)))
+		}
+	}
+	return files, nil
+}
+
+// redirect replaces our stdin, stdout & stderr with the given files. It returns a function that restores them.
+func redirect(files []*os.File) (func(), error) {
+	saved := make([]int, len(files))
+	for i, f := range files {
+		fd, err := unix.Dup(i)
+		if err != nil {
+			return nil, err
+		}
+		saved[i] = fd
+		if err := unix.Dup2(int(f.Fd()), i); err != nil {
+			return nil, err
+		}
+	}
+	updateTerminals()
+	return func() {
+		for i, fd := range saved {
+			unix.Dup2(fd, i)
+			unix.Close(fd)
+		}
+		updateTerminals()
+	}, nil
+}
+
+// updateTerminals updates whether we think we're outputting to a terminal after redirecting stdio.
+func updateTerminals() {
+	cli.StdErrIsATerminal = terminal.IsTerminal(int(os.Stderr.Fd()))
+	cli.StdOutIsATerminal = terminal.IsTerminal(int(os.Stdout.Fd()))
+	cli.ShowColouredOutput = cli.StdErrIsATerminal
+}
+
+// setEnv replaces the environment with the given one and returns a function that restores the original.
+func setEnv(env, original []string) func() {
+	replaceEnv(env)
+	return func() {
+		replaceEnv(original)
+	}
+}
+
+func replaceEnv(env []string) {
+	os.Clearenv()
+	for _, kv := range env {
+		if idx := strings.IndexByte(kv, '='); idx > 0 {
+			os.Setenv(kv[:idx], kv[idx+1:])
+		}
+	}
+}
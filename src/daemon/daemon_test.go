@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestStatusAndStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plzd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	SocketPath = path.Join(dir, "plzd.sock")
+	ch := make(chan error)
+	go func() {
+		ch <- Serve(func(args []string) int { return 0 })
+	}()
+	var status *Status
+	for i := 0; i < 50 && status == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		status, err = GetStatus()
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), status.PID)
+	assert.Equal(t, core.PleaseVersion.String(), status.Version)
+	assert.EqualValues(t, 0, status.Commands)
+	assert.NoError(t, Stop())
+	assert.NoError(t, <-ch)
+	_, err = GetStatus()
+	assert.Error(t, err)
+}
+
+func TestFatalErrorDoesNotStopDaemon(t *testing.T) {
+	cli.InitLogging(cli.MinVerbosity)
+	dir, err := ioutil.TempDir("", "plzd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	SocketPath = path.Join(dir, "plzd.sock")
+	ch := make(chan error)
+	go func() {
+		ch <- Serve(func(args []string) int {
+			log.Fatalf("Command failed")
+			return 0
+		})
+	}()
+	var status *Status
+	for i := 0; i < 50 && status == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		status, err = GetStatus()
+	}
+	assert.NoError(t, err)
+	code, forwarded := Forward([]string{"plz", "build"}, dir)
+	assert.True(t, forwarded)
+	assert.Equal(t, 1, code)
+	status, err = GetStatus()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, status.Commands)
+	assert.NoError(t, Stop())
+	assert.NoError(t, <-ch)
+}
+
+func TestCancel(t *testing.T) {
+	s := &server{}
+	state := core.NewDefaultBuildState()
+	s.setState(state, false)
+	assert.True(t, state.Successful())
+	s.cancel()
+	assert.False(t, state.Successful())
+}
+
+func TestCancelBeforeStateIsPrepared(t *testing.T) {
+	current = &server{watcher: &watcher{invalid: map[core.BuildLabel]bool{}}}
+	defer func() { current = nil }()
+	current.cancel()
+	state := core.NewDefaultBuildState()
+	PrepareState(state)
+	assert.False(t, state.Successful())
+	current.setState(nil, false)
+	state = core.NewDefaultBuildState()
+	PrepareState(state)
+	assert.True(t, state.Successful())
+}
+
+func TestInvalidate(t *testing.T) {
+	pkg1 := core.ParseBuildLabel("//src/core:all", "")
+	pkg2 := core.ParseBuildLabel("//src/build:all", "")
+	w := &watcher{
+		files: map[string][]core.BuildLabel{
+			"/repo/src/core/BUILD":      {pkg1},
+			"/repo/build_defs/go.build": {pkg1, pkg2},
+		},
+		dirs: map[string]core.BuildLabel{
+			"/repo/src/core":  pkg1,
+			"/repo/src/build": pkg2,
+		},
+		invalid: map[core.BuildLabel]bool{},
+	}
+	// Modifying a source file doesn't affect the package, but creating one might change a glob.
+	w.handle(fsnotify.Event{Name: "/repo/src/build/build.go", Op: fsnotify.Write})
+	assert.Equal(t, map[core.BuildLabel]bool{}, w.Invalidated())
+	w.handle(fsnotify.Event{Name: "/repo/src/build/build.go", Op: fsnotify.Create})
+	assert.Equal(t, map[core.BuildLabel]bool{pkg2: true}, w.Invalidated())
+	w.handle(fsnotify.Event{Name: "/repo/src/core/BUILD", Op: fsnotify.Write})
+	assert.Equal(t, map[core.BuildLabel]bool{pkg1: true}, w.Invalidated())
+	w.handle(fsnotify.Event{Name: "/repo/build_defs/go.build", Op: fsnotify.Write})
+	assert.Equal(t, map[core.BuildLabel]bool{pkg1: true, pkg2: true}, w.Invalidated())
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plzd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "pkg/sub"), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pkg/BUILD"), nil, 0644))
+	w, err := newWatcher()
+	assert.NoError(t, err)
+	graph := core.NewGraph()
+	pkg := core.NewPackage("pkg")
+	pkg.Filename = path.Join(dir, "pkg/BUILD")
+	graph.AddPackage(pkg)
+	w.Watch(graph, []string{"BUILD"})
+	assert.Equal(t, map[string]core.BuildLabel{
+		path.Join(dir, "pkg"):     pkg.Label(),
+		path.Join(dir, "pkg/sub"): pkg.Label(),
+	}, w.dirs)
+
+	// The package hasn't changed, so it shouldn't be walked again.
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "pkg/sub2"), core.DirPermissions))
+	w.Watch(graph, []string{"BUILD"})
+	assert.Equal(t, 2, len(w.dirs))
+
+	// Once the package is removed, nothing should be watched any more.
+	w.Watch(core.NewGraph(), []string{"BUILD"})
+	assert.Equal(t, 0, len(w.dirs))
+	assert.Equal(t, 0, len(w.files))
+	assert.Equal(t, 0, len(w.watched))
+}
+
+func TestReplaceEnv(t *testing.T) {
+	original := os.Environ()
+	restore := setEnv([]string{"PLZD_TEST=a=b"}, original)
+	assert.Equal(t, []string{"PLZD_TEST=a=b"}, os.Environ())
+	restore()
+	assert.Equal(t, original, os.Environ())
+}
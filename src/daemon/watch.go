@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// A watcher watches the files & directories that packages were parsed from, and records which
+// packages have been invalidated by changes to them.
+type watcher struct {
+	watcher *fsnotify.Watcher
+	// Files that affect packages (i.e. their BUILD files and the sources of anything they subinclude).
+	files map[string][]core.BuildLabel
+	// Directories belonging to each package. Files being created or removed in them can change globs.
+	dirs map[string]core.BuildLabel
+	// Packages that have been invalidated since we last checked.
+	invalid map[core.BuildLabel]bool
+	mutex   sync.Mutex
+	// The packages we're currently watching, and everything we've added to the underlying watcher.
+	// These are only used by Watch so aren't protected by the mutex.
+	packages map[core.BuildLabel]*watchedPackage
+	watched  map[string]bool
+}
+
+// A watchedPackage records a package we're watching and the directories that belong to it.
+type watchedPackage struct {
+	pkg  *core.Package
+	dirs []string
+}
+
+func newWatcher() (*watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watcher := &watcher{
+		watcher:  w,
+		files:    map[string][]core.BuildLabel{},
+		dirs:     map[string]core.BuildLabel{},
+		invalid:  map[core.BuildLabel]bool{},
+		packages: map[core.BuildLabel]*watchedPackage{},
+		watched:  map[string]bool{},
+	}
+	go watcher.run()
+	return watcher, nil
+}
+
+// run handles events from the underlying watcher. It never returns.
+func (w *watcher) run() {
+	for {
+		select {
+		case event := <-w.watcher.Events:
+			w.handle(event)
+		case err := <-w.watcher.Errors:
+			log.Error("Error watching files: %s", err)
+		}
+	}
+}
+
+// handle handles a single event, invalidating any packages it affects.
+func (w *watcher) handle(event fsnotify.Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, label := range w.files[event.Name] {
+		w.invalidate(label, event)
+	}
+	if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+		if label, present := w.dirs[path.Dir(event.Name)]; present {
+			w.invalidate(label, event)
+		}
+	}
+}
+
+// invalidate marks a package as invalid. The caller must hold the lock.
+func (w *watcher) invalidate(label core.BuildLabel, event fsnotify.Event) {
+	if !w.invalid[label] {
+		log.Debug("Invalidating %s: %s", label, event)
+		w.invalid[label] = true
+	}
+}
+
+// Invalidated returns the set of packages that have been invalidated since this was last called.
+func (w *watcher) Invalidated() map[core.BuildLabel]bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	invalid := w.invalid
+	w.invalid = map[core.BuildLabel]bool{}
+	return invalid
+}
+
+// Watch starts watching everything that affects the packages in the given graph.
+// Anything watched for a previous graph that isn't in this one is no longer considered.
+// Packages that haven't changed since the last call keep their existing watches; only new
+// (or reparsed) ones have their directories walked.
+func (w *watcher) Watch(graph *core.BuildGraph, buildFileNames []string) {
+	packages := map[core.BuildLabel]*watchedPackage{}
+	files := map[string][]core.BuildLabel{}
+	dirs := map[string]core.BuildLabel{}
+	watched := map[string]bool{}
+	invalid := map[core.BuildLabel]bool{}
+	// add adds a file or directory to the underlying watcher. Anything already being watched is
+	// only added again if refresh is true, since it might have been replaced since.
+	add := func(name string, refresh bool) error {
+		if w.watched[name] && !refresh {
+			watched[name] = true
+			return nil
+		} else if err := w.watcher.Add(name); err != nil {
+			return err
+		}
+		watched[name] = true
+		return nil
+	}
+	for _, pkg := range graph.PackageMap() {
+		if pkg.Filename == "" || strings.HasPrefix(abs(pkg.Filename), abs(core.OutDir)+"/") {
+			continue // Generated packages (e.g. subrepos) are only invalidated by whatever generated them.
+		}
+		label := pkg.Label()
+		wp := w.packages[label]
+		changed := wp == nil || wp.pkg != pkg
+		if changed {
+			wp = &watchedPackage{pkg: pkg}
+		}
+		packages[label] = wp
+		filename := abs(pkg.Filename)
+		pkgFiles := []string{filename}
+		for _, subinclude := range pkg.Subincludes {
+			if target := graph.Target(subinclude); target != nil {
+				for _, src := range target.AllLocalSources() {
+					pkgFiles = append(pkgFiles, abs(src))
+				}
+			}
+		}
+		for _, f := range pkgFiles {
+			files[f] = append(files[f], label)
+			if err := add(f, changed); err != nil && !fs.PathExists(f) {
+				// It's not an error for a subincluded file to not exist yet; it may not have been built.
+				continue
+			} else if err != nil {
+				log.Warning("Failed to watch %s: %s", f, err)
+				invalid[label] = true
+			}
+		}
+		if changed {
+			root := path.Dir(filename)
+			if err := fs.Walk(root, func(name string, isDir bool) error {
+				if !isDir {
+					return nil
+				} else if name != root && (strings.HasPrefix(path.Base(name), ".") || name == abs(core.OutDir) || fs.IsPackage(buildFileNames, name)) {
+					return filepath.SkipDir // Hidden directories, plz-out and other packages aren't part of this one.
+				}
+				wp.dirs = append(wp.dirs, name)
+				return add(name, true)
+			}); err != nil {
+				log.Warning("Failed to watch %s, it will be reparsed every time: %s", pkg.Label(), err)
+				invalid[label] = true
+				delete(packages, label) // Ensure it gets walked again next time.
+			}
+		}
+		for _, dir := range wp.dirs {
+			dirs[dir] = label
+			watched[dir] = true
+		}
+	}
+	// Stop watching anything that no longer affects any package.
+	for name := range w.watched {
+		if !watched[name] {
+			w.watcher.Remove(name) // This fails if it's been deleted, which is fine.
+		}
+	}
+	w.packages = packages
+	w.watched = watched
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.files = files
+	w.dirs = dirs
+	for label := range invalid {
+		w.invalid[label] = true
+	}
+}
+
+// abs returns the absolute path of a file, which if not absolute already is relative to the repo root.
+func abs(filename string) string {
+	if path.IsAbs(filename) {
+		return filename
+	}
+	return path.Join(core.RepoRoot, filename)
+}
@@ -210,6 +210,16 @@ func (hasher *PathHasher) hash(path string, store, read bool) ([]byte, error) {
 	return hash, err
 }
 
+// RecordedHash returns the hash previously stored on a file as an xattr, or nil if there isn't one.
+// Note that since hardlinks share xattrs, this can also be used on files that were linked from plz-out.
+func (hasher *PathHasher) RecordedHash(path string) []byte {
+	if !hasher.useXattrs {
+		return nil
+	}
+	b, _ := xattr.LGet(path, hasher.xattrName)
+	return b
+}
+
 // storeHash stores the hash of a file on it as an xattr.
 // This is best-effort since if it fails we can always fall back to a slower but reliable rehash.
 func (hasher *PathHasher) storeHash(path string, hash []byte) {
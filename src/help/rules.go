@@ -85,7 +85,6 @@ func addAllFunctions(m map[string]*asp.Statement, stmts []*asp.Statement, builti
 
 // getRuleArgs retrieves the arguments of builtin rules. It's split from PrintRuleArgs for testing.
 func getRuleArgs(state *core.BuildState) environment {
-	argsRegex := regexp.MustCompile("\n +Args: *\n")
 	env := environment{Functions: map[string]function{}}
 	for name, stmt := range AllBuiltinFunctions(state) {
 		f := stmt.FuncDef
@@ -93,8 +92,8 @@ func getRuleArgs(state *core.BuildState) environment {
 		if strings.HasSuffix(f.EoDef.Filename, "_rules.build_defs") {
 			r.Language = strings.TrimSuffix(f.EoDef.Filename, "_rules.build_defs")
 		}
-		if indices := argsRegex.FindStringIndex(r.Docstring); indices != nil {
-			r.Comment = strings.TrimSpace(r.Docstring[:indices[0]])
+		if argsRegex.MatchString(r.Docstring) {
+			r.Comment = FunctionComment(f)
 		}
 		r.Args = make([]functionArg, len(f.Arguments))
 		for i, a := range f.Arguments {
@@ -102,10 +101,7 @@ func getRuleArgs(state *core.BuildState) environment {
 				Name:     a.Name,
 				Types:    a.Type,
 				Required: a.Value == nil,
-			}
-			regex := regexp.MustCompile(a.Name + `(?: \(.*\))?: ((?s:.*))`)
-			if match := regex.FindStringSubmatch(r.Docstring); match != nil {
-				r.Args[i].Comment = filterMatch(match[1])
+				Comment:  ArgumentDocstring(f, a.Name),
 			}
 		}
 		env.Functions[name] = r
@@ -113,6 +109,27 @@ func getRuleArgs(state *core.BuildState) environment {
 	return env
 }
 
+var argsRegex = regexp.MustCompile("\n +Args: *\n")
+
+// FunctionComment returns the part of a function's docstring that describes the function itself,
+// i.e. everything before the description of its arguments.
+func FunctionComment(f *asp.FuncDef) string {
+	if indices := argsRegex.FindStringIndex(f.Docstring); indices != nil {
+		return strings.TrimSpace(f.Docstring[:indices[0]])
+	}
+	return strings.TrimSpace(f.Docstring)
+}
+
+// ArgumentDocstring returns the part of a function's docstring that describes the given argument,
+// or the empty string if it isn't described there.
+func ArgumentDocstring(f *asp.FuncDef, name string) string {
+	regex := regexp.MustCompile(regexp.QuoteMeta(name) + `(?: \(.*\))?: ((?s:.*))`)
+	if match := regex.FindStringSubmatch(f.Docstring); match != nil {
+		return filterMatch(match[1])
+	}
+	return ""
+}
+
 type environment struct {
 	Functions map[string]function `json:"functions"`
 }
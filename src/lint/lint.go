@@ -0,0 +1,291 @@
+// Package lint implements checks on BUILD files for common mistakes and stylistic problems.
+//
+// The checks work on the AST from parse/asp; most of them only need to look at a single file
+// but a couple need the whole build graph to be parsed, which is much more expensive, so they
+// are disabled by default.
+package lint
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+	"github.com/thought-machine/please/src/parse/asp"
+	"github.com/thought-machine/please/src/utils"
+)
+
+var log = logging.MustGetLogger("lint")
+
+// maxFixPasses is the maximum number of times we'll re-lint a file after applying fixes to it.
+const maxFixPasses = 10
+
+// An Issue is a single problem found in a BUILD file.
+type Issue struct {
+	Rule    string
+	Message string
+	Pos     asp.Position
+	fix     *fix
+}
+
+// Fixable returns true if this issue can be fixed automatically.
+func (issue *Issue) Fixable() bool {
+	return issue.fix != nil
+}
+
+// A fix is a replacement of a range of bytes in a file.
+type fix struct {
+	Start, End  int // Byte offsets, zero-indexed and end-exclusive.
+	Replacement string
+}
+
+// A Rule is a single check that can be applied to BUILD files.
+type Rule struct {
+	Name        string
+	Description string
+	// True if the rule is enabled when nothing is configured.
+	Default bool
+	// True if the rule needs the build graph to be parsed.
+	NeedsGraph bool
+	check      func(l *linter, f *file) []*Issue
+}
+
+// AllRules returns all the known rules, sorted by name.
+func AllRules() []*Rule {
+	ret := make([]*Rule, len(allRules))
+	copy(ret, allRules)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// EnabledRules returns the set of rules enabled by the given config, with the given additional rules
+// enabled or disabled on top of it.
+func EnabledRules(config *core.Configuration, enable, disable []string) ([]*Rule, error) {
+	enabled := map[string]bool{}
+	for _, rule := range allRules {
+		enabled[rule.Name] = rule.Default
+	}
+	for _, names := range []struct {
+		names []string
+		value bool
+	}{
+		{names: config.Lint.Enable, value: true},
+		{names: config.Lint.Disable, value: false},
+		{names: enable, value: true},
+		{names: disable, value: false},
+	} {
+		for _, name := range names.names {
+			if _, present := enabled[name]; !present {
+				return nil, fmt.Errorf("Unknown lint rule %s", name)
+			}
+			enabled[name] = names.value
+		}
+	}
+	ret := []*Rule{}
+	for _, rule := range AllRules() {
+		if enabled[rule.Name] {
+			ret = append(ret, rule)
+		}
+	}
+	return ret, nil
+}
+
+// NeedsGraph returns true if any of the given rules need the build graph to be parsed.
+func NeedsGraph(rules []*Rule) bool {
+	for _, rule := range rules {
+		if rule.NeedsGraph {
+			return true
+		}
+	}
+	return false
+}
+
+// Lint lints the given BUILD files with the given rules and returns any issues found.
+// If no files are given then all BUILD files under the repo root are discovered.
+// If fix is true, any issues that can be fixed safely are fixed in-place and are not returned.
+func Lint(state *core.BuildState, rules []*Rule, filenames []string, fix bool) ([]*Issue, error) {
+	l := &linter{state: state, rules: rules, parser: asp.NewParser(state)}
+	if len(filenames) == 0 {
+		for filename := range utils.FindAllBuildFiles(state.Config, core.RepoRoot, "") {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+	}
+	issues := []*Issue{}
+	for _, filename := range filenames {
+		fileIssues, err := l.lintFile(filename, fix)
+		if err != nil {
+			return issues, err
+		}
+		issues = append(issues, fileIssues...)
+	}
+	return issues, nil
+}
+
+// A linter holds the state needed to lint files.
+type linter struct {
+	state  *core.BuildState
+	rules  []*Rule
+	parser *asp.Parser
+}
+
+// A file is a single BUILD file that is being linted.
+type file struct {
+	Filename   string
+	Package    string
+	Data       []byte
+	Lines      [][]byte
+	Statements []*asp.Statement
+}
+
+// IsBuildDefs returns true if this file is a .build_defs file rather than a BUILD file.
+func (f *file) IsBuildDefs() bool {
+	return strings.HasSuffix(f.Filename, ".build_defs")
+}
+
+// Source returns the source code for the given expression, or the empty string if we can't identify it reliably.
+func (f *file) Source(expr *asp.Expression) string {
+	start := expr.Pos.Offset - 1
+	end := expr.EndPos.Offset - 1
+	if start < 0 || end > len(f.Data) || start >= end {
+		return ""
+	}
+	return string(f.Data[start:end])
+}
+
+func (l *linter) lintFile(filename string, fix bool) ([]*Issue, error) {
+	for i := 0; ; i++ {
+		f, err := l.parseFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		issues := l.lint(f)
+		if !fix || i == maxFixPasses {
+			return issues, nil
+		}
+		data, fixed := applyFixes(f.Data, issues)
+		if fixed == 0 {
+			return issues, nil
+		}
+		log.Notice("Fixed %d issues in %s", fixed, filename)
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		} else if err := fs.WriteFile(bytes.NewReader(data), filename, info.Mode()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *linter) parseFile(filename string) (*file, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// Report everything relative to the repo root, which is also what we need to identify the package.
+	if abs, err := filepath.Abs(filename); err == nil {
+		if rel, err := filepath.Rel(core.RepoRoot, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			filename = rel
+		}
+	}
+	stmts, err := l.parser.ParseData(data, filename)
+	if err != nil {
+		return nil, err
+	}
+	pkg := filepath.Dir(filename)
+	if pkg == "." {
+		pkg = ""
+	}
+	return &file{
+		Filename:   filename,
+		Package:    pkg,
+		Data:       data,
+		Lines:      bytes.Split(data, []byte{'\n'}),
+		Statements: stmts,
+	}, nil
+}
+
+// lint runs all the rules on a single file and returns the issues that aren't suppressed, sorted by position.
+func (l *linter) lint(f *file) []*Issue {
+	issues := []*Issue{}
+	for _, rule := range l.rules {
+		for _, issue := range rule.check(l, f) {
+			issue.Rule = rule.Name
+			issue.Pos.Filename = f.Filename
+			if !f.suppressed(issue) {
+				issues = append(issues, issue)
+			}
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Pos.Line != issues[j].Pos.Line {
+			return issues[i].Pos.Line < issues[j].Pos.Line
+		}
+		return issues[i].Pos.Column < issues[j].Pos.Column
+	})
+	return issues
+}
+
+// suppressionRegex matches inline suppressions, e.g. '# nolint' or '# nolint: unsorted-list, duplicate-dep'.
+var suppressionRegex = regexp.MustCompile(`#\s*nolint(?:\s*:\s*([a-z\-, ]+))?\s*$`)
+
+// suppressed returns true if the given issue is suppressed by a comment on the same line, the line
+// before it, or the line before the top-level statement containing it.
+func (f *file) suppressed(issue *Issue) bool {
+	lines := []int{issue.Pos.Line, issue.Pos.Line - 1}
+	for _, stmt := range f.Statements {
+		if stmt.Pos.Line <= issue.Pos.Line && issue.Pos.Line <= stmt.EndPos.Line {
+			lines = append(lines, stmt.Pos.Line-1)
+			break
+		}
+	}
+	for _, line := range lines {
+		if line < 1 || line > len(f.Lines) {
+			continue
+		}
+		match := suppressionRegex.FindSubmatch(f.Lines[line-1])
+		if match == nil {
+			continue
+		} else if len(match[1]) == 0 {
+			return true
+		}
+		for _, rule := range strings.Split(string(match[1]), ",") {
+			if strings.TrimSpace(rule) == issue.Rule {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyFixes applies the fixes for the given issues to some data. It skips any that overlap,
+// which can be applied on a later pass. It returns the new data and the number of fixes applied.
+func applyFixes(data []byte, issues []*Issue) ([]byte, int) {
+	fixes := []*fix{}
+	for _, issue := range issues {
+		if issue.fix != nil {
+			fixes = append(fixes, issue.fix)
+		}
+	}
+	// Apply from the end backwards so the offsets of the remaining ones stay valid.
+	sort.SliceStable(fixes, func(i, j int) bool { return fixes[i].Start > fixes[j].Start })
+	applied := 0
+	limit := len(data)
+	for _, fix := range fixes {
+		if fix.End > limit {
+			continue // Overlaps with one we've already done.
+		}
+		data = append(data[:fix.Start:fix.Start], append([]byte(fix.Replacement), data[fix.End:]...)...)
+		limit = fix.Start
+		applied++
+	}
+	return data, applied
+}
@@ -0,0 +1,222 @@
+package lint
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestUnusedVariables(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/variables.build", "unused-variable")
+	assert.Equal(t, []string{
+		"src/lint/test_data/variables.build:3:1: [unused-variable] Variable x is assigned but never used",
+		"src/lint/test_data/variables.build:10:5: [unused-variable] Variable unused is assigned but never used",
+	}, issues)
+}
+
+func TestUnusedLoads(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/variables.build", "unused-load")
+	assert.Equal(t, []string{
+		"src/lint/test_data/variables.build:1:48: [unused-load] unused_thing is loaded but never used",
+	}, issues)
+}
+
+func TestMutableDefaults(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/variables.build", "mutable-default")
+	assert.Equal(t, []string{
+		"src/lint/test_data/variables.build:8:25: [mutable-default] Argument b to f has a mutable default value which is modified in the function; that modification will be shared between calls",
+	}, issues)
+}
+
+func TestShadowedBuiltins(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/variables.build", "shadowed-builtin")
+	assert.Equal(t, []string{
+		"src/lint/test_data/variables.build:15:1: [shadowed-builtin] Loop variable len shadows the builtin function of the same name",
+	}, issues)
+}
+
+func TestUnsortedLists(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/lists.build", "unsorted-list")
+	assert.Equal(t, []string{
+		"src/lint/test_data/lists.build:3:12: [unsorted-list] srcs is not sorted; a.go should come before b.go",
+		"src/lint/test_data/lists.build:7:12: [unsorted-list] deps is not sorted; :a should come before :b",
+	}, issues)
+}
+
+func TestDuplicateDeps(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/lists.build", "duplicate-dep")
+	assert.Equal(t, []string{
+		"src/lint/test_data/lists.build:12:9: [duplicate-dep] :a is given more than once in deps",
+	}, issues)
+}
+
+func TestDeprecatedArguments(t *testing.T) {
+	issues := lintFile(t, "src/lint/test_data/lists.build", "deprecated-argument")
+	assert.Equal(t, []string{
+		"src/lint/test_data/lists.build:25:5: [deprecated-argument] Argument write_main to cc_test is deprecated: Deprecated, has no effect. See `plz help testmain` for more information",
+	}, issues)
+}
+
+func TestFix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile("src/lint/test_data/lists.build")
+	require.NoError(t, err)
+	filename := filepath.Join(dir, "BUILD")
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+
+	state := core.NewDefaultBuildState()
+	rules, err := EnabledRules(state.Config, nil, nil)
+	require.NoError(t, err)
+	issues, err := Lint(state, rules, []string{filename}, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(issues))
+	assert.Equal(t, "deprecated-argument", issues[0].Rule)
+
+	fixed, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, `go_library(
+    name = "lib",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+    deps = [
+        ":a",
+        ":b",
+        "//third_party/go:xz",
+        "//third_party/go/zip",
+    ],
+)
+`, string(fixed[:bytes.Index(fixed, []byte("\n\ngo_test"))+1]))
+	// The suppressed lines should not have been touched.
+	assert.Contains(t, string(fixed), `srcs = ["z_test.go", "a_test.go"],  # nolint: unsorted-list`)
+	assert.Contains(t, string(fixed), `deps = [":lib", ":lib"],  # nolint`)
+}
+
+func TestGraphRules(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	pkg := core.NewPackage("src/lint/test_data")
+	addTarget := func(name string, test bool, deps ...string) {
+		target := core.NewBuildTarget(core.NewBuildLabel("src/lint/test_data", name))
+		target.IsTest = test
+		target.Visibility = core.WholeGraph
+		for _, dep := range deps {
+			target.AddDependency(core.NewBuildLabel("src/lint/test_data", dep))
+		}
+		pkg.AddTarget(target)
+		state.Graph.AddTarget(target)
+		for _, dep := range deps {
+			state.Graph.AddDependency(target.Label, core.NewBuildLabel("src/lint/test_data", dep))
+		}
+	}
+	addTarget("public_lib", false)
+	addTarget("tested_lib", false, "public_lib")
+	addTarget("test", true, "tested_lib")
+	state.Graph.AddPackage(pkg)
+
+	issues := lintState(t, state, "src/lint/test_data/graph.build", "wide-visibility")
+	assert.Equal(t, []string{
+		"src/lint/test_data/graph.build:4:5: [wide-visibility] //src/lint/test_data:public_lib is visible to PUBLIC but only used within its own package",
+		"src/lint/test_data/graph.build:10:5: [wide-visibility] //src/lint/test_data:tested_lib is visible to PUBLIC but only used within its own package",
+	}, issues)
+	issues = lintState(t, state, "src/lint/test_data/graph.build", "missing-test")
+	assert.Equal(t, 0, len(issues))
+	addTarget("untested_lib", false)
+	issues = lintState(t, state, "src/lint/test_data/graph.build", "missing-test")
+	assert.Equal(t, []string{
+		"src/lint/test_data/graph.build:1:1: [missing-test] //src/lint/test_data:untested_lib is not depended on by any test",
+	}, issues)
+}
+
+func TestEnabledRules(t *testing.T) {
+	config := core.DefaultConfiguration()
+	rules, err := EnabledRules(config, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, NeedsGraph(rules))
+	config.Lint.Enable = []string{"missing-test"}
+	config.Lint.Disable = []string{"unsorted-list"}
+	rules, err = EnabledRules(config, nil, []string{"missing-test"})
+	assert.NoError(t, err)
+	assert.False(t, NeedsGraph(rules))
+	for _, rule := range rules {
+		assert.NotEqual(t, "unsorted-list", rule.Name)
+	}
+	rules, err = EnabledRules(config, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, NeedsGraph(rules))
+	_, err = EnabledRules(config, []string{"wibble"}, nil)
+	assert.Error(t, err)
+}
+
+func TestWriteJSON(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	rules, _ := EnabledRules(state.Config, nil, nil)
+	issues, err := Lint(state, rules, []string{"src/lint/test_data/lists.build"}, false)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, issues, rules, "json"))
+	results := []jsonIssue{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &results))
+	require.Equal(t, 4, len(results))
+	assert.Equal(t, jsonIssue{
+		Rule:    "unsorted-list",
+		Message: "srcs is not sorted; a.go should come before b.go",
+		File:    "src/lint/test_data/lists.build",
+		Line:    3,
+		Column:  12,
+		Fixable: true,
+	}, results[0])
+}
+
+func TestWriteSARIF(t *testing.T) {
+	state := core.NewDefaultBuildState()
+	rules, _ := EnabledRules(state.Config, nil, nil)
+	issues, err := Lint(state, rules, []string{"src/lint/test_data/lists.build"}, false)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, issues, rules, "sarif"))
+	log := &sarifLog{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), log))
+	assert.Equal(t, "2.1.0", log.Version)
+	require.Equal(t, 1, len(log.Runs))
+	assert.Equal(t, len(rules), len(log.Runs[0].Tool.Driver.Rules))
+	require.Equal(t, 4, len(log.Runs[0].Results))
+	result := log.Runs[0].Results[3]
+	assert.Equal(t, "deprecated-argument", result.RuleID)
+	assert.Equal(t, "deprecated-argument", log.Runs[0].Tool.Driver.Rules[result.RuleIndex].ID)
+	assert.Equal(t, "src/lint/test_data/lists.build", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, 25, result.Locations[0].PhysicalLocation.Region.StartLine)
+}
+
+// lintFile lints a single file with a single rule and returns the issues in text format.
+func lintFile(t *testing.T, filename, rule string) []string {
+	return lintState(t, core.NewDefaultBuildState(), filename, rule)
+}
+
+func lintState(t *testing.T, state *core.BuildState, filename, rule string) []string {
+	rules := []*Rule{}
+	for _, r := range allRules {
+		if r.Name == rule {
+			rules = append(rules, r)
+		}
+	}
+	require.Equal(t, 1, len(rules))
+	issues, err := Lint(state, rules, []string{filename}, false)
+	require.NoError(t, err)
+	ret := []string{}
+	for _, issue := range issues {
+		ret = append(ret, fmt.Sprintf("%s: [%s] %s", issue.Pos, issue.Rule, issue.Message))
+	}
+	return ret
+}
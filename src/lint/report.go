@@ -0,0 +1,150 @@
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Write writes the given issues to the given writer in the given format, which is one of text, json or sarif.
+// The rules are the ones that were run; they're used to describe the issues in SARIF output.
+func Write(w io.Writer, issues []*Issue, rules []*Rule, format string) error {
+	switch format {
+	case "text":
+		for _, issue := range issues {
+			if _, err := fmt.Fprintf(w, "%s: [%s] %s\n", issue.Pos, issue.Rule, issue.Message); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		return writeJSON(w, toJSON(issues))
+	case "sarif":
+		return writeJSON(w, toSARIF(issues, rules))
+	}
+	return fmt.Errorf("Unknown output format %s", format)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type jsonIssue struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Fixable bool   `json:"fixable"`
+}
+
+func toJSON(issues []*Issue) []jsonIssue {
+	ret := make([]jsonIssue, len(issues))
+	for i, issue := range issues {
+		ret[i] = jsonIssue{
+			Rule:    issue.Rule,
+			Message: issue.Message,
+			File:    issue.Pos.Filename,
+			Line:    issue.Pos.Line,
+			Column:  issue.Pos.Column,
+			Fixable: issue.Fixable(),
+		}
+	}
+	return ret
+}
+
+// The following types describe the subset of SARIF that we produce.
+// See https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html for the full thing.
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+}
+
+func toSARIF(issues []*Issue, rules []*Rule) *sarifLog {
+	driver := sarifDriver{
+		Name:           "plz lint",
+		InformationURI: "https://please.build/commands.html#lint",
+		Rules:          make([]sarifRule, len(rules)),
+	}
+	indices := map[string]int{}
+	for i, rule := range rules {
+		driver.Rules[i] = sarifRule{ID: rule.Name, ShortDescription: sarifMessage{Text: rule.Description}}
+		indices[rule.Name] = i
+	}
+	results := make([]sarifResult, len(issues))
+	for i, issue := range issues {
+		results[i] = sarifResult{
+			RuleID:    issue.Rule,
+			RuleIndex: indices[issue.Rule],
+			Level:     "warning",
+			Message:   sarifMessage{Text: issue.Message},
+			Locations: []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: issue.Pos.Filename},
+					Region:           sarifRegion{StartLine: issue.Pos.Line, StartColumn: issue.Pos.Column},
+				},
+			}},
+		}
+	}
+	return &sarifLog{
+		Version: "2.1.0",
+		Schema:  sarifSchema,
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	}
+}
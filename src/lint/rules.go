@@ -0,0 +1,585 @@
+package lint
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// allRules is the set of all known lint rules.
+var allRules = []*Rule{
+	{
+		Name:        "unused-variable",
+		Description: "Variables that are assigned but never read.",
+		Default:     true,
+		check:       checkUnusedVariables,
+	},
+	{
+		Name:        "unused-load",
+		Description: "Names imported with load() that are never used.",
+		Default:     true,
+		check:       checkUnusedLoads,
+	},
+	{
+		Name:        "mutable-default",
+		Description: "Function arguments with a list or dict default value that the function modifies, which would then be shared between calls.",
+		Default:     true,
+		check:       checkMutableDefaults,
+	},
+	{
+		Name:        "shadowed-builtin",
+		Description: "Variables, arguments and functions with the same name as a builtin function.",
+		Default:     true,
+		check:       checkShadowedBuiltins,
+	},
+	{
+		Name:        "unsorted-list",
+		Description: "srcs and deps lists that aren't sorted.",
+		Default:     true,
+		check:       checkUnsortedLists,
+	},
+	{
+		Name:        "duplicate-dep",
+		Description: "Dependencies that are given more than once.",
+		Default:     true,
+		check:       checkDuplicateDeps,
+	},
+	{
+		Name:        "deprecated-argument",
+		Description: "Arguments to builtin rules that are deprecated.",
+		Default:     true,
+		check:       checkDeprecatedArguments,
+	},
+	{
+		Name:        "wide-visibility",
+		Description: "Targets that are visible to everything, but are only used within their own package.",
+		NeedsGraph:  true,
+		check:       checkWideVisibility,
+	},
+	{
+		Name:        "missing-test",
+		Description: "Library targets that no test depends on.",
+		NeedsGraph:  true,
+		check:       checkMissingTests,
+	},
+}
+
+// sortedArgs are the names of arguments that we expect to be sorted.
+var sortedArgs = map[string]bool{"srcs": true, "deps": true}
+
+// depArgs are the names of arguments that we check for duplicate dependencies.
+var depArgs = map[string]bool{"deps": true, "exported_deps": true}
+
+// mutatingMethods are the methods that modify a dict in-place.
+// Note that list.append and list.extend don't; the parser rewrites them to create new lists.
+var mutatingMethods = map[string]bool{
+	"setdefault": true,
+}
+
+func checkUnusedVariables(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	check := func(stmts []*asp.Statement) {
+		reads := readNames(stmts)
+		done := map[string]bool{}
+		assignments(stmts, func(name string, pos asp.Position) {
+			if !reads[name] && !done[name] && !strings.HasPrefix(name, "_") {
+				done[name] = true
+				issues = append(issues, &Issue{Pos: pos, Message: fmt.Sprintf("Variable %s is assigned but never used", name)})
+			}
+		})
+	}
+	// Top-level variables in .build_defs files can be used by anything that subincludes them.
+	if !f.IsBuildDefs() {
+		check(f.Statements)
+	}
+	asp.WalkAST(f.Statements, func(stmt *asp.Statement) bool {
+		if stmt.FuncDef != nil {
+			check(stmt.FuncDef.Statements)
+		}
+		return true
+	})
+	return issues
+}
+
+func checkUnusedLoads(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	reads := readNames(f.Statements)
+	for _, stmt := range f.Statements {
+		if stmt.Ident == nil || stmt.Ident.Name != "load" || stmt.Ident.Action == nil || stmt.Ident.Action.Call == nil {
+			continue
+		}
+		for i, arg := range stmt.Ident.Action.Call.Arguments {
+			name := arg.Name
+			if name == "" && i > 0 {
+				name = stringLiteral(&arg.Value)
+			}
+			if name != "" && !reads[name] {
+				issues = append(issues, &Issue{Pos: arg.Value.Pos, Message: fmt.Sprintf("%s is loaded but never used", name)})
+			}
+		}
+	}
+	return issues
+}
+
+func checkMutableDefaults(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	asp.WalkAST(f.Statements, func(fd *asp.FuncDef) bool {
+		for _, arg := range fd.Arguments {
+			if arg.Value == nil || arg.Value.Val == nil || (arg.Value.Val.List == nil && arg.Value.Val.Dict == nil) {
+				continue
+			}
+			name := arg.Name
+			if mutated(fd.Statements, name) {
+				issues = append(issues, &Issue{
+					Pos:     arg.Value.Pos,
+					Message: fmt.Sprintf("Argument %s to %s has a mutable default value which is modified in the function; that modification will be shared between calls", name, fd.Name),
+				})
+			}
+		}
+		return true
+	})
+	return issues
+}
+
+// mutated returns true if the given variable is modified in-place in the given statements.
+// Augmented assignment isn't counted since it always creates a new object.
+func mutated(stmts []*asp.Statement, name string) (ret bool) {
+	asp.WalkAST(stmts, func(stmt *asp.IdentStatement) bool {
+		if stmt.Name != name {
+			return true
+		} else if stmt.Index != nil && (stmt.Index.Assign != nil || stmt.Index.AugAssign != nil) {
+			ret = true
+		} else if stmt.Action != nil && stmt.Action.Property != nil && mutatingMethods[stmt.Action.Property.Name] {
+			ret = true
+		}
+		return true
+	})
+	return ret
+}
+
+func checkShadowedBuiltins(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	builtins := loadBuiltins()
+	check := func(name, what string, pos asp.Position) {
+		if fd, present := builtins.Functions[name]; present && fd.EoDef.Filename != filepath.Base(f.Filename) {
+			issues = append(issues, &Issue{Pos: pos, Message: fmt.Sprintf("%s %s shadows the builtin function of the same name", what, name)})
+		}
+	}
+	assignments(f.Statements, func(name string, pos asp.Position) { check(name, "Variable", pos) })
+	asp.WalkAST(f.Statements, func(stmt *asp.Statement) bool {
+		if fd := stmt.FuncDef; fd != nil {
+			check(fd.Name, "Function", stmt.Pos)
+			for _, arg := range fd.Arguments {
+				check(arg.Name, "Argument", stmt.Pos)
+			}
+			assignments(fd.Statements, func(name string, pos asp.Position) { check(name, "Variable", pos) })
+		} else if stmt.For != nil {
+			for _, name := range stmt.For.Names {
+				check(name, "Loop variable", stmt.Pos)
+			}
+		}
+		return true
+	})
+	return issues
+}
+
+func checkUnsortedLists(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	asp.WalkAST(f.Statements, func(arg *asp.CallArgument) bool {
+		if !sortedArgs[arg.Name] {
+			return false
+		}
+		values := stringList(&arg.Value)
+		if values == nil {
+			return false
+		}
+		sorted := make([]string, len(values))
+		copy(sorted, values)
+		sort.SliceStable(sorted, func(i, j int) bool { return labelLess(sorted[i], sorted[j]) })
+		for i, v := range values {
+			if v != sorted[i] {
+				issues = append(issues, &Issue{
+					Pos:     arg.Value.Pos,
+					Message: fmt.Sprintf("%s is not sorted; %s should come before %s", arg.Name, sorted[i], v),
+					fix:     sortFix(f, arg.Value.Val.List.Values),
+				})
+				break
+			}
+		}
+		return false
+	})
+	return issues
+}
+
+// labelLess orders two strings in a list of dependencies; local labels come first, then
+// absolute ones, then ones in other repos. Within those they're sorted by package and then
+// by name, so //a:b comes before //a/b.
+func labelLess(a, b string) bool {
+	if pa, pb := labelPriority(a), labelPriority(b); pa != pb {
+		return pa < pb
+	}
+	pkgA, nameA := splitLabel(a)
+	pkgB, nameB := splitLabel(b)
+	if pkgA != pkgB {
+		return pkgA < pkgB
+	}
+	return nameA < nameB
+}
+
+// splitLabel splits a string into the package and name parts of a build label.
+// Strings that aren't labels are treated as a package with no name.
+func splitLabel(s string) (string, string) {
+	if idx := strings.LastIndexByte(s, ':'); idx != -1 {
+		return s[:idx], s[idx+1:]
+	}
+	return s, ""
+}
+
+func labelPriority(s string) int {
+	if strings.HasPrefix(s, ":") {
+		return 0
+	} else if strings.HasPrefix(s, "@") || strings.HasPrefix(s, "///") {
+		return 2
+	}
+	return 1
+}
+
+// sortFix returns a fix that sorts the given list of string literals, or nil if we can't do it safely.
+func sortFix(f *file, values []*asp.Expression) *fix {
+	sources, ok := elementSources(f, values)
+	if !ok {
+		return nil
+	}
+	sorted := make([]int, len(values))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return labelLess(stringLiteral(values[sorted[i]]), stringLiteral(values[sorted[j]]))
+	})
+	var b strings.Builder
+	for i, idx := range sorted {
+		b.WriteString(sources[idx])
+		if i < len(values)-1 {
+			// Keep the original separators (i.e. comma & whitespace) between elements.
+			b.WriteString(string(f.Data[values[i].EndPos.Offset-1 : values[i+1].Pos.Offset-1]))
+		}
+	}
+	return &fix{
+		Start:       values[0].Pos.Offset - 1,
+		End:         values[len(values)-1].EndPos.Offset - 1,
+		Replacement: b.String(),
+	}
+}
+
+// elementSources returns the source code of each of a list of string literals.
+// It returns false if any of them can't be identified reliably, or if there are comments
+// between them that we'd lose by moving them around.
+func elementSources(f *file, values []*asp.Expression) ([]string, bool) {
+	sources := make([]string, len(values))
+	for i, v := range values {
+		src := f.Source(v)
+		if len(src) < 2 || (src[0] != '"' && src[0] != '\'') || src[1:len(src)-1] != stringLiteral(v) {
+			return nil, false
+		}
+		sources[i] = src
+		if i > 0 && strings.Contains(string(f.Data[values[i-1].EndPos.Offset-1:v.Pos.Offset-1]), "#") {
+			return nil, false
+		}
+	}
+	return sources, true
+}
+
+func checkDuplicateDeps(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	asp.WalkAST(f.Statements, func(arg *asp.CallArgument) bool {
+		if !depArgs[arg.Name] {
+			return false
+		}
+		values := stringList(&arg.Value)
+		seen := map[string]bool{}
+		for i, v := range values {
+			label := v
+			if l, err := core.TryParseBuildLabel(v, f.Package, ""); err == nil {
+				label = l.String()
+			}
+			if seen[label] {
+				expr := arg.Value.Val.List.Values[i]
+				issues = append(issues, &Issue{
+					Pos:     expr.Pos,
+					Message: fmt.Sprintf("%s is given more than once in %s", v, arg.Name),
+					fix:     removeFix(f, arg.Value.Val.List.Values, i),
+				})
+			}
+			seen[label] = true
+		}
+		return false
+	})
+	return issues
+}
+
+// removeFix returns a fix that removes the given element (which is never the first) from a list of string literals.
+func removeFix(f *file, values []*asp.Expression, i int) *fix {
+	if _, ok := elementSources(f, values); !ok {
+		return nil
+	}
+	return &fix{Start: values[i-1].EndPos.Offset - 1, End: values[i].EndPos.Offset - 1}
+}
+
+func checkDeprecatedArguments(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	builtins := loadBuiltins()
+	check := func(name string, call *asp.Call) {
+		deprecated := builtins.Deprecated[name]
+		for _, arg := range call.Arguments {
+			if msg, present := deprecated[arg.Name]; present {
+				issues = append(issues, &Issue{Pos: arg.Pos, Message: fmt.Sprintf("Argument %s to %s is deprecated: %s", arg.Name, name, msg)})
+			}
+		}
+	}
+	asp.WalkAST(f.Statements, func(stmt *asp.IdentStatement) bool {
+		if stmt.Action != nil && stmt.Action.Call != nil {
+			check(stmt.Name, stmt.Action.Call)
+		}
+		return true
+	})
+	asp.WalkAST(f.Statements, func(expr *asp.IdentExpr) bool {
+		if len(expr.Action) > 0 && expr.Action[0].Call != nil {
+			check(expr.Name, expr.Action[0].Call)
+		}
+		return true
+	})
+	return issues
+}
+
+func checkWideVisibility(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	for _, target := range l.packageTargets(f) {
+		if target.IsBinary || target.IsTest || strings.HasPrefix(target.Label.Name, "_") || !isPublic(target) {
+			continue
+		}
+		revdeps := l.state.Graph.ReverseDependencies(target)
+		if len(revdeps) == 0 {
+			continue // Probably a top-level target that's built on its own.
+		}
+		local := true
+		for _, revdep := range revdeps {
+			if revdep.Label.PackageName != target.Label.PackageName || revdep.Label.Subrepo != target.Label.Subrepo {
+				local = false
+				break
+			}
+		}
+		if local {
+			issues = append(issues, &Issue{
+				Pos:     targetPosition(f, target, "visibility"),
+				Message: fmt.Sprintf("%s is visible to PUBLIC but only used within its own package", target.Label),
+			})
+		}
+	}
+	return issues
+}
+
+func isPublic(target *core.BuildTarget) bool {
+	for _, vis := range target.Visibility {
+		if vis == core.WholeGraph[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func checkMissingTests(l *linter, f *file) []*Issue {
+	issues := []*Issue{}
+	tested := l.testedTargets()
+	for _, target := range l.packageTargets(f) {
+		if target.IsBinary || target.IsTest || target.TestOnly || target.IsFilegroup || target.IsRemoteFile || strings.HasPrefix(target.Label.Name, "_") {
+			continue
+		} else if !tested[target.Label] {
+			issues = append(issues, &Issue{
+				Pos:     targetPosition(f, target, ""),
+				Message: fmt.Sprintf("%s is not depended on by any test", target.Label),
+			})
+		}
+	}
+	return issues
+}
+
+// packageTargets returns the targets in the graph that were defined by the given file.
+func (l *linter) packageTargets(f *file) []*core.BuildTarget {
+	if f.IsBuildDefs() {
+		return nil
+	}
+	pkg := l.state.Graph.Package(f.Package, "")
+	if pkg == nil {
+		return nil
+	}
+	return pkg.AllTargets()
+}
+
+// testedTargets returns the set of all targets that some test depends on (directly or transitively).
+func (l *linter) testedTargets() map[core.BuildLabel]bool {
+	tested := map[core.BuildLabel]bool{}
+	var visit func(target *core.BuildTarget)
+	visit = func(target *core.BuildTarget) {
+		for _, dep := range target.Dependencies() {
+			if !tested[dep.Label] {
+				tested[dep.Label] = true
+				visit(dep)
+			}
+		}
+	}
+	for _, target := range l.state.Graph.AllTargets() {
+		if target.IsTest {
+			visit(target)
+		}
+	}
+	// Internal targets (e.g. go_library's #lib) are the ones tests depend on; count them towards their parent.
+	for label := range tested {
+		tested[label.Parent()] = true
+	}
+	return tested
+}
+
+// targetPosition returns the position of a target in the given file, or of the given argument to it if it has one.
+func targetPosition(f *file, target *core.BuildTarget, argName string) asp.Position {
+	stmt := asp.FindTarget(f.Statements, target.Label.Parent().Name)
+	if stmt == nil {
+		return asp.Position{Line: 1, Column: 1}
+	} else if arg := asp.FindArgument(stmt, argName); argName != "" && arg != nil {
+		return arg.Pos
+	}
+	return stmt.Pos
+}
+
+// assignments calls the given function for every variable assigned in the given statements.
+// It doesn't descend into function definitions since they have their own scope.
+func assignments(stmts []*asp.Statement, f func(name string, pos asp.Position)) {
+	for _, stmt := range stmts {
+		if stmt.Ident != nil && stmt.Ident.Unpack != nil {
+			f(stmt.Ident.Name, stmt.Pos)
+			for _, name := range stmt.Ident.Unpack.Names {
+				f(name, stmt.Pos)
+			}
+		} else if stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Assign != nil {
+			f(stmt.Ident.Name, stmt.Pos)
+		} else if stmt.For != nil {
+			assignments(stmt.For.Statements, f)
+		} else if stmt.If != nil {
+			assignments(stmt.If.Statements, f)
+			for _, elif := range stmt.If.Elif {
+				assignments(elif.Statements, f)
+			}
+			assignments(stmt.If.ElseStatements, f)
+		}
+	}
+}
+
+// readNames returns the names of all variables that are read anywhere within the given statements.
+func readNames(stmts []*asp.Statement) map[string]bool {
+	names := map[string]bool{}
+	asp.WalkAST(stmts, func(expr *asp.IdentExpr) bool {
+		names[expr.Name] = true
+		return true
+	})
+	asp.WalkAST(stmts, func(stmt *asp.IdentStatement) bool {
+		if stmt.Index != nil || (stmt.Action != nil && stmt.Action.Assign == nil) {
+			names[stmt.Name] = true
+		}
+		return true
+	})
+	asp.WalkAST(stmts, func(fs *asp.FString) bool {
+		for _, v := range fs.Vars {
+			names[v.Var] = true
+		}
+		return true
+	})
+	return names
+}
+
+// stringLiteral returns the value of an expression if it's a plain string literal, or the empty string if not.
+func stringLiteral(expr *asp.Expression) string {
+	if expr.Val == nil || expr.UnaryOp != nil || len(expr.Op) > 0 || expr.If != nil || len(expr.Val.Slices) > 0 || expr.Val.Property != nil || len(expr.Val.String) < 2 {
+		return ""
+	}
+	return strings.Trim(expr.Val.String, `"`)
+}
+
+// stringList returns the values of an expression if it is a plain list of string literals, or nil if not.
+func stringList(expr *asp.Expression) []string {
+	if expr.Val == nil || expr.Val.List == nil || expr.Val.List.Comprehension != nil || len(expr.Op) > 0 || expr.If != nil || len(expr.Val.Slices) > 0 || expr.Val.Property != nil {
+		return nil
+	}
+	ret := make([]string, len(expr.Val.List.Values))
+	for i, v := range expr.Val.List.Values {
+		if ret[i] = stringLiteral(v); ret[i] == "" {
+			return nil
+		}
+	}
+	return ret
+}
+
+// builtinInfo describes the builtin functions that we lint against.
+type builtinInfo struct {
+	Functions map[string]*asp.FuncDef
+	// Deprecated arguments to each function, with the description of why.
+	Deprecated map[string]map[string]string
+}
+
+var builtins *builtinInfo
+var builtinsOnce sync.Once
+
+// loadBuiltins loads the builtin functions from the rules that are compiled into Please.
+func loadBuiltins() *builtinInfo {
+	builtinsOnce.Do(func() {
+		builtins = &builtinInfo{
+			Functions:  map[string]*asp.FuncDef{},
+			Deprecated: map[string]map[string]string{},
+		}
+		p := asp.NewParser(core.NewDefaultBuildState())
+		dir, _ := rules.AssetDir("")
+		for _, filename := range dir {
+			if !strings.HasSuffix(filename, ".build_defs") {
+				continue
+			}
+			stmts, err := p.ParseData(rules.MustAsset(filename), filename)
+			if err != nil {
+				log.Warning("Failed to parse builtin rules from %s: %s", filename, err)
+				continue
+			}
+			for _, stmt := range stmts {
+				if fd := stmt.FuncDef; fd != nil && !strings.HasPrefix(fd.Name, "_") && !isMethod(fd) {
+					builtins.Functions[fd.Name] = fd
+					if deprecated := deprecatedArguments(fd); len(deprecated) > 0 {
+						builtins.Deprecated[fd.Name] = deprecated
+					}
+				}
+			}
+		}
+	})
+	return builtins
+}
+
+// isMethod returns true if the given function is a method on a builtin type (e.g. str.split), which
+// are defined as top-level functions taking a 'self' argument.
+func isMethod(fd *asp.FuncDef) bool {
+	return len(fd.Arguments) > 0 && fd.Arguments[0].Name == "self"
+}
+
+// deprecatedArguments returns the arguments of a function that its docstring says are deprecated.
+func deprecatedArguments(fd *asp.FuncDef) map[string]string {
+	ret := map[string]string{}
+	for _, arg := range fd.Arguments {
+		regex := regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(arg.Name) + `(?: \(.*\))?: *(Deprecated.*)$`)
+		if match := regex.FindStringSubmatch(fd.Docstring); match != nil {
+			ret[arg.Name] = strings.TrimSpace(match[1])
+		}
+	}
+	return ret
+}
@@ -0,0 +1,164 @@
+package output
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// streamBufferSize is the number of events we buffer while waiting to send them to the server.
+const streamBufferSize = 1000
+
+// A streamSink sends events to a server implementing the Build Event Service API.
+// Events are sent asynchronously so a slow server doesn't hold up the build; any failures
+// are logged but otherwise don't affect it. If the server falls too far behind, the sink
+// gives up on it rather than blocking the build.
+type streamSink struct {
+	conn      *grpc.ClientConn
+	stream    bpb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	cancel    context.CancelFunc
+	streamID  *bpb.StreamId
+	projectID string
+	timeout   time.Duration
+	ch        chan *bpb.OrderedBuildEvent
+	sent      sync.WaitGroup
+	acked     chan error
+	sequence  int64
+	failed    bool
+}
+
+func newStreamSink(config *core.Configuration, streamID *bpb.StreamId) (*streamSink, error) {
+	opts := []grpc.DialOption{}
+	if config.BuildEvents.Secure {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(config.BuildEvents.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := bpb.NewPublishBuildEventClient(conn).PublishBuildToolEventStream(ctx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	sink := &streamSink{
+		conn:      conn,
+		stream:    stream,
+		cancel:    cancel,
+		streamID:  streamID,
+		projectID: config.BuildEvents.ProjectID,
+		timeout:   time.Duration(config.BuildEvents.Timeout),
+		ch:        make(chan *bpb.OrderedBuildEvent, streamBufferSize),
+		acked:     make(chan error, 1),
+	}
+	sink.sent.Add(1)
+	go sink.send()
+	go sink.receive()
+	return sink, nil
+}
+
+func (ss *streamSink) Write(event *buildEvent, ordered *bpb.OrderedBuildEvent) error {
+	ss.sequence = ordered.SequenceNumber
+	ss.enqueue(ordered)
+	return nil
+}
+
+// enqueue queues an event to be sent to the server without blocking.
+// If the buffer is full the stream is abandoned, since the server requires every event in sequence
+// so there's no point sending any more once one has been dropped.
+func (ss *streamSink) enqueue(event *bpb.OrderedBuildEvent) {
+	if ss.failed {
+		return
+	}
+	select {
+	case ss.ch <- event:
+	default:
+		log.Warning("Build event service is not keeping up, no more events will be sent to it")
+		ss.failed = true
+		ss.cancel()
+	}
+}
+
+// Close sends the final event on the stream and waits for the server to acknowledge everything.
+// If that takes longer than the configured timeout the stream is cancelled.
+func (ss *streamSink) Close() error {
+	defer ss.conn.Close()
+	defer ss.cancel()
+	ss.enqueue(&bpb.OrderedBuildEvent{
+		StreamId:       ss.streamID,
+		SequenceNumber: ss.sequence + 1,
+		Event: &bpb.BuildEvent{
+			EventTime: ptypes.TimestampNow(),
+			Event: &bpb.BuildEvent_ComponentStreamFinished{
+				ComponentStreamFinished: &bpb.BuildEvent_BuildComponentStreamFinished{
+					Type: bpb.BuildEvent_BuildComponentStreamFinished_FINISHED,
+				},
+			},
+		},
+	})
+	close(ss.ch)
+	if ss.failed {
+		return fmt.Errorf("Gave up sending events to the build event service after it fell behind")
+	}
+	done := make(chan error, 1)
+	go func() {
+		ss.sent.Wait()
+		done <- <-ss.acked
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(ss.timeout):
+		return fmt.Errorf("Timed out waiting for the build event service to acknowledge events")
+	}
+}
+
+// send sends events to the server as they arrive.
+func (ss *streamSink) send() {
+	defer ss.sent.Done()
+	var err error
+	for event := range ss.ch {
+		if err != nil {
+			continue // Keep draining so writers never block, but there's no point trying to send any more.
+		}
+		err = ss.stream.Send(&bpb.PublishBuildToolEventStreamRequest{
+			OrderedBuildEvent: event,
+			ProjectId:         ss.projectID,
+		})
+		if err != nil {
+			log.Warning("Failed to send build event: %s", err)
+		}
+	}
+	if err == nil {
+		if err := ss.stream.CloseSend(); err != nil {
+			log.Warning("Failed to close build event stream: %s", err)
+		}
+	}
+}
+
+// receive receives acknowledgements from the server until it's done.
+func (ss *streamSink) receive() {
+	for {
+		if _, err := ss.stream.Recv(); err == io.EOF {
+			ss.acked <- nil
+			return
+		} else if err != nil {
+			ss.acked <- err
+			return
+		}
+	}
+}
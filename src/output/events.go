@@ -0,0 +1,357 @@
+// Writes a structured stream of build events, in the vein of Bazel's Build Event Protocol.
+// These are intended for consumption by other tools (CI systems, dashboards etc) and are
+// written to a file either as JSON lines or length-delimited protobufs, and optionally
+// streamed to a server implementing the Build Event Service API.
+
+package output
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A buildEvent is a single event in the stream. Exactly one of the event fields is populated.
+type buildEvent struct {
+	Sequence         int64                  `json:"sequence"`
+	Time             time.Time              `json:"time"`
+	BuildStarted     *buildStartedEvent     `json:"build_started,omitempty"`
+	TargetConfigured *targetConfiguredEvent `json:"target_configured,omitempty"`
+	ActionCompleted  *actionCompletedEvent  `json:"action_completed,omitempty"`
+	TestResult       *testResultEvent       `json:"test_result,omitempty"`
+	BuildFinished    *buildFinishedEvent    `json:"build_finished,omitempty"`
+}
+
+type buildStartedEvent struct {
+	BuildID      string   `json:"build_id"`
+	InvocationID string   `json:"invocation_id"`
+	Version      string   `json:"version"`
+	Command      []string `json:"command"`
+	Targets      []string `json:"targets"`
+	WorkingDir   string   `json:"working_dir"`
+}
+
+type targetConfiguredEvent struct {
+	Label  string   `json:"label"`
+	Labels []string `json:"labels,omitempty"`
+	Binary bool     `json:"binary,omitempty"`
+	Test   bool     `json:"test,omitempty"`
+}
+
+type actionCompletedEvent struct {
+	Label     string    `json:"label"`
+	Success   bool      `json:"success"`
+	Cached    bool      `json:"cached"`
+	Stopped   bool      `json:"stopped,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	Duration  float64   `json:"duration"` // in seconds
+	Outputs   []string  `json:"outputs,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type testResultEvent struct {
+	Label       string  `json:"label"`
+	Success     bool    `json:"success"`
+	Cached      bool    `json:"cached"`
+	TimedOut    bool    `json:"timed_out,omitempty"`
+	Duration    float64 `json:"duration"` // in seconds
+	Passed      int     `json:"passed"`
+	Failed      int     `json:"failed"`
+	Errored     int     `json:"errored"`
+	Skipped     int     `json:"skipped"`
+	Flaky       int     `json:"flaky"`
+	ResultsFile string  `json:"results_file"`
+	TestDir     string  `json:"test_dir"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type buildFinishedEvent struct {
+	Success  bool     `json:"success"`
+	Duration float64  `json:"duration"` // in seconds
+	Built    int      `json:"built"`
+	Cached   int      `json:"cached"`
+	Failed   []string `json:"failed,omitempty"`
+}
+
+// An eventSink is something that build events are written to.
+type eventSink interface {
+	Write(event *buildEvent, ordered *bpb.OrderedBuildEvent) error
+	Close() error
+}
+
+// An eventWriter converts build results into events and writes them to any number of sinks.
+type eventWriter struct {
+	sinks    []eventSink
+	streamID *bpb.StreamId
+	sequence int64
+	started  map[core.BuildLabel]time.Time
+	built    int
+	cached   int
+}
+
+// newEventWriter returns a new eventWriter writing to the given file and to the Build Event Service, if configured.
+// If neither are set it silently discards everything given to it.
+func newEventWriter(state *core.BuildState, filename, format string) *eventWriter {
+	ew := &eventWriter{
+		streamID: &bpb.StreamId{
+			BuildId:      state.Config.Remote.BuildID,
+			InvocationId: newInvocationID(),
+			Component:    bpb.StreamId_TOOL,
+		},
+		started: map[core.BuildLabel]time.Time{},
+	}
+	if ew.streamID.BuildId == "" {
+		ew.streamID.BuildId = ew.streamID.InvocationId
+	}
+	if filename != "" {
+		if sink, err := newFileSink(filename, format); err != nil {
+			log.Errorf("Couldn't create build event file: %s", err)
+		} else {
+			ew.sinks = append(ew.sinks, sink)
+		}
+	}
+	if state.Config.BuildEvents.URL != "" {
+		if sink, err := newStreamSink(state.Config, ew.streamID); err != nil {
+			log.Errorf("Couldn't connect to build event service: %s", err)
+		} else {
+			ew.sinks = append(ew.sinks, sink)
+		}
+	}
+	return ew
+}
+
+// newInvocationID returns a new random ID for this invocation.
+func newInvocationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// BuildStarted writes the initial event of the build.
+func (ew *eventWriter) BuildStarted(state *core.BuildState) {
+	if len(ew.sinks) == 0 {
+		return
+	}
+	wd, _ := os.Getwd()
+	labels := state.OriginalLabels()
+	targets := make([]string, len(labels))
+	for i, l := range labels {
+		targets[i] = l.String()
+	}
+	ew.write(&buildEvent{
+		Time: state.StartTime,
+		BuildStarted: &buildStartedEvent{
+			BuildID:      ew.streamID.BuildId,
+			InvocationID: ew.streamID.InvocationId,
+			Version:      core.PleaseVersion.String(),
+			Command:      os.Args,
+			Targets:      targets,
+			WorkingDir:   wd,
+		},
+	})
+}
+
+// AddResult writes any events corresponding to a single build result.
+func (ew *eventWriter) AddResult(state *core.BuildState, result *core.BuildResult) {
+	if len(ew.sinks) == 0 {
+		return
+	}
+	switch result.Status {
+	case core.TargetBuilding:
+		if _, present := ew.started[result.Label]; present {
+			return // Already seen this one, it's just a progress update.
+		}
+		ew.started[result.Label] = result.Time
+		event := &targetConfiguredEvent{Label: result.Label.String()}
+		if target := state.Graph.Target(result.Label); target != nil {
+			event.Labels = target.Labels
+			event.Binary = target.IsBinary
+			event.Test = target.IsTest
+		}
+		ew.write(&buildEvent{Time: result.Time, TargetConfigured: event})
+	case core.TargetBuilt, core.TargetCached, core.TargetBuildFailed, core.TargetBuildStopped:
+		start, present := ew.started[result.Label]
+		if !present {
+			start = result.Time
+		}
+		event := &actionCompletedEvent{
+			Label:     result.Label.String(),
+			Success:   result.Status == core.TargetBuilt || result.Status == core.TargetCached,
+			Cached:    result.Status == core.TargetCached,
+			Stopped:   result.Status == core.TargetBuildStopped,
+			StartTime: start,
+			Duration:  result.Time.Sub(start).Seconds(),
+			Error:     errorString(result.Err),
+		}
+		if event.Success {
+			if target := state.Graph.Target(result.Label); target != nil {
+				event.Outputs = target.FullOutputs()
+			}
+			if event.Cached {
+				ew.cached++
+			} else {
+				ew.built++
+			}
+		}
+		ew.write(&buildEvent{Time: result.Time, ActionCompleted: event})
+	case core.TargetTested, core.TargetTestFailed:
+		event := &testResultEvent{
+			Label:    result.Label.String(),
+			Success:  result.Status == core.TargetTested,
+			Cached:   result.Tests.Cached,
+			TimedOut: result.Tests.TimedOut,
+			Duration: result.Tests.Duration.Seconds(),
+			Passed:   result.Tests.Passes(),
+			Failed:   result.Tests.Failures(),
+			Errored:  result.Tests.Errors(),
+			Skipped:  result.Tests.Skips(),
+			Flaky:    result.Tests.FlakyPasses(),
+			Error:    errorString(result.Err),
+		}
+		if target := state.Graph.Target(result.Label); target != nil {
+			event.ResultsFile = target.TestResultsFile()
+			event.TestDir = target.TestDirs()
+		}
+		ew.write(&buildEvent{Time: result.Time, TestResult: event})
+	}
+}
+
+// BuildFinished writes the final event of the build.
+func (ew *eventWriter) BuildFinished(failed []core.BuildLabel, t time.Time, duration time.Duration) {
+	if len(ew.sinks) == 0 {
+		return
+	}
+	event := &buildFinishedEvent{
+		Success:  len(failed) == 0,
+		Duration: duration.Seconds(),
+		Built:    ew.built,
+		Cached:   ew.cached,
+	}
+	for _, label := range failed {
+		event.Failed = append(event.Failed, label.String())
+	}
+	ew.write(&buildEvent{Time: t, BuildFinished: event})
+}
+
+// Close closes this writer and all its sinks.
+func (ew *eventWriter) Close() error {
+	var lastErr error
+	for _, sink := range ew.sinks {
+		if err := sink.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (ew *eventWriter) write(event *buildEvent) {
+	ew.sequence++
+	event.Sequence = ew.sequence
+	ordered, err := ew.toProto(event)
+	if err != nil {
+		log.Errorf("Failed to convert build event: %s", err)
+		return
+	}
+	for _, sink := range ew.sinks {
+		if err := sink.Write(event, ordered); err != nil {
+			log.Errorf("Failed to write build event: %s", err)
+		}
+	}
+}
+
+// toProto converts an event into the Build Event Service's representation.
+// The event itself is carried as a google.protobuf.Struct with the same fields as the JSON representation,
+// packed into the bazel_event field since that's the only one the API provides for tool-specific payloads.
+// Note that it's Please's own schema, not Bazel's Build Event Protocol, so tools that expect the latter
+// won't understand it; consumers should check that the payload's type is google.protobuf.Struct.
+func (ew *eventWriter) toProto(event *buildEvent) (*bpb.OrderedBuildEvent, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	s := &structpb.Struct{}
+	if err := jsonpb.UnmarshalString(string(b), s); err != nil {
+		return nil, err
+	}
+	payload, err := ptypes.MarshalAny(s)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := ptypes.TimestampProto(event.Time)
+	if err != nil {
+		return nil, err
+	}
+	return &bpb.OrderedBuildEvent{
+		StreamId:       ew.streamID,
+		SequenceNumber: event.Sequence,
+		Event: &bpb.BuildEvent{
+			EventTime: ts,
+			Event:     &bpb.BuildEvent_BazelEvent{BazelEvent: payload},
+		},
+	}, nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// A fileSink writes events to a file, either as JSON lines or length-delimited protobufs.
+type fileSink struct {
+	b     *bufio.Writer
+	f     *os.File
+	proto bool
+}
+
+func newFileSink(filename, format string) (*fileSink, error) {
+	if format != "json" && format != "proto" {
+		return nil, fmt.Errorf("Unknown build event format %s", format)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{b: bufio.NewWriter(f), f: f, proto: format == "proto"}, nil
+}
+
+func (fs *fileSink) Write(event *buildEvent, ordered *bpb.OrderedBuildEvent) error {
+	if !fs.proto {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fs.b.Write(b)
+		return fs.b.WriteByte('\n')
+	}
+	b, err := proto.Marshal(ordered)
+	if err != nil {
+		return err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	fs.b.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+	_, err = fs.b.Write(b)
+	return err
+}
+
+func (fs *fileSink) Close() error {
+	if err := fs.b.Flush(); err != nil {
+		fs.f.Close()
+		return err
+	}
+	return fs.f.Close()
+}
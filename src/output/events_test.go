@@ -0,0 +1,240 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bpb "google.golang.org/genproto/googleapis/devtools/build/v1"
+	"google.golang.org/grpc"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestJSONEvents(t *testing.T) {
+	state, filename := newEventState(t)
+	writeEvents(state, filename, "json")
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	events := []*buildEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := &buildEvent{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), event))
+		events = append(events, event)
+	}
+	require.Equal(t, 5, len(events))
+	for i, event := range events {
+		assert.EqualValues(t, i+1, event.Sequence)
+	}
+	assert.NotNil(t, events[0].BuildStarted)
+	assert.Equal(t, []string{"//src/output:test"}, events[0].BuildStarted.Targets)
+	assert.Equal(t, &targetConfiguredEvent{Label: "//src/output:test", Test: true}, events[1].TargetConfigured)
+	assert.Equal(t, "//src/output:test", events[2].ActionCompleted.Label)
+	assert.True(t, events[2].ActionCompleted.Success)
+	assert.False(t, events[2].ActionCompleted.Cached)
+	assert.Equal(t, 2.0, events[2].ActionCompleted.Duration)
+	assert.Equal(t, []string{"plz-out/gen/src/output/test.txt"}, events[2].ActionCompleted.Outputs)
+	assert.False(t, events[3].TestResult.Success)
+	assert.Equal(t, 1, events[3].TestResult.Passed)
+	assert.Equal(t, 1, events[3].TestResult.Failed)
+	assert.Equal(t, "plz-out/gen/src/output/.test_results_test", events[3].TestResult.ResultsFile)
+	assert.Equal(t, "1 test failed", events[3].TestResult.Error)
+	assert.Equal(t, &buildFinishedEvent{Duration: 5, Built: 1, Failed: []string{"//src/output:test"}}, events[4].BuildFinished)
+}
+
+func TestProtoEvents(t *testing.T) {
+	state, filename := newEventState(t)
+	writeEvents(state, filename, "proto")
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	r := bufio.NewReader(f)
+	events := []*bpb.OrderedBuildEvent{}
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		require.NoError(t, err)
+		event := &bpb.OrderedBuildEvent{}
+		require.NoError(t, proto.Unmarshal(b, event))
+		events = append(events, event)
+	}
+	require.Equal(t, 5, len(events))
+	assert.EqualValues(t, 3, events[2].SequenceNumber)
+	assert.Equal(t, bpb.StreamId_TOOL, events[2].StreamId.Component)
+	s := &structpb.Struct{}
+	require.NoError(t, ptypes.UnmarshalAny(events[2].Event.GetBazelEvent(), s))
+	action := s.Fields["action_completed"].GetStructValue()
+	require.NotNil(t, action)
+	assert.Equal(t, "//src/output:test", action.Fields["label"].GetStringValue())
+}
+
+func TestStreamEvents(t *testing.T) {
+	srv := &eventServer{}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	bpb.RegisterPublishBuildEventServer(s, srv)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	state, _ := newEventState(t)
+	state.Config.BuildEvents.URL = lis.Addr().String()
+	state.Config.BuildEvents.Secure = false
+	state.Config.BuildEvents.ProjectID = "please"
+	writeEvents(state, "", "json")
+
+	require.Equal(t, 6, len(srv.requests))
+	for i, req := range srv.requests {
+		assert.EqualValues(t, i+1, req.OrderedBuildEvent.SequenceNumber)
+		assert.Equal(t, "please", req.ProjectId)
+	}
+	assert.NotNil(t, srv.requests[0].OrderedBuildEvent.Event.GetBazelEvent())
+	assert.NotNil(t, srv.requests[5].OrderedBuildEvent.Event.GetComponentStreamFinished())
+}
+
+func TestStreamSinkDoesNotBlock(t *testing.T) {
+	cancelled := false
+	ss := &streamSink{
+		ch:     make(chan *bpb.OrderedBuildEvent, 1),
+		cancel: func() { cancelled = true },
+	}
+	assert.NoError(t, ss.Write(nil, &bpb.OrderedBuildEvent{SequenceNumber: 1}))
+	assert.False(t, ss.failed)
+	// The buffer is now full and nothing is draining it, so this should give up rather than block.
+	assert.NoError(t, ss.Write(nil, &bpb.OrderedBuildEvent{SequenceNumber: 2}))
+	assert.True(t, ss.failed)
+	assert.True(t, cancelled)
+	assert.NoError(t, ss.Write(nil, &bpb.OrderedBuildEvent{SequenceNumber: 3}))
+	assert.Equal(t, 1, len(ss.ch))
+}
+
+func TestStreamSinkCloseTimeout(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	bpb.RegisterPublishBuildEventServer(s, &stuckEventServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	config := core.DefaultConfiguration()
+	config.BuildEvents.URL = lis.Addr().String()
+	config.BuildEvents.Secure = false
+	config.BuildEvents.Timeout = cli.Duration(100 * time.Millisecond)
+	ss, err := newStreamSink(config, &bpb.StreamId{})
+	require.NoError(t, err)
+	// These are big enough that sending them will block since the server never reads them.
+	for i := 1; i <= 3; i++ {
+		event := &bpb.OrderedBuildEvent{
+			SequenceNumber: int64(i),
+			Event: &bpb.BuildEvent{
+				Event: &bpb.BuildEvent_BazelEvent{BazelEvent: &any.Any{Value: make([]byte, 1024*1024)}},
+			},
+		}
+		require.NoError(t, ss.Write(nil, event))
+	}
+	start := time.Now()
+	assert.Error(t, ss.Close())
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// newEventState returns a build state with a single test target in it, and a filename to write events to.
+func newEventState(t *testing.T) (*core.BuildState, string) {
+	dir, err := ioutil.TempDir("", "events_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	state := core.NewDefaultBuildState()
+	state.StartTime = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/output:test", ""))
+	target.IsTest = true
+	target.AddOutput("test.txt")
+	state.Graph.AddTarget(target)
+	state.AddOriginalTarget(target.Label, true)
+	return state, filepath.Join(dir, "events")
+}
+
+// writeEvents writes a typical sequence of events for building & testing the target from newEventState.
+func writeEvents(state *core.BuildState, filename, format string) {
+	label := core.ParseBuildLabel("//src/output:test", "")
+	ew := newEventWriter(state, filename, format)
+	ew.BuildStarted(state)
+	ew.AddResult(state, &core.BuildResult{Time: state.StartTime.Add(time.Second), Label: label, Status: core.TargetBuilding})
+	ew.AddResult(state, &core.BuildResult{Time: state.StartTime.Add(2 * time.Second), Label: label, Status: core.TargetBuilding})
+	ew.AddResult(state, &core.BuildResult{Time: state.StartTime.Add(3 * time.Second), Label: label, Status: core.TargetBuilt})
+	ew.AddResult(state, &core.BuildResult{Time: state.StartTime.Add(3 * time.Second), Label: label, Status: core.TargetTesting})
+	ew.AddResult(state, &core.BuildResult{
+		Time:   state.StartTime.Add(4 * time.Second),
+		Label:  label,
+		Status: core.TargetTestFailed,
+		Err:    errors.New("1 test failed"),
+		Tests: core.TestSuite{
+			TestCases: core.TestCases{
+				{Name: "TestPass", Executions: []core.TestExecution{{}}},
+				{Name: "TestFail", Executions: []core.TestExecution{{Failure: &core.TestResultFailure{}}}},
+			},
+		},
+	})
+	ew.BuildFinished([]core.BuildLabel{label}, state.StartTime.Add(5*time.Second), 5*time.Second)
+	ew.Close()
+}
+
+// An eventServer is a fake implementation of the Build Event Service that records everything it receives.
+type eventServer struct {
+	bpb.UnimplementedPublishBuildEventServer
+	mutex    sync.Mutex
+	requests []*bpb.PublishBuildToolEventStreamRequest
+}
+
+func (s *eventServer) PublishBuildToolEventStream(srv bpb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	for {
+		req, err := srv.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.requests = append(s.requests, req)
+		s.mutex.Unlock()
+		if err := srv.Send(&bpb.PublishBuildToolEventStreamResponse{
+			StreamId:       req.OrderedBuildEvent.StreamId,
+			SequenceNumber: req.OrderedBuildEvent.SequenceNumber,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// A stuckEventServer is a fake implementation of the Build Event Service that never reads anything.
+type stuckEventServer struct {
+	bpb.UnimplementedPublishBuildEventServer
+}
+
+func (s *stuckEventServer) PublishBuildToolEventStream(srv bpb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	<-srv.Context().Done()
+	return srv.Context().Err()
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -96,9 +97,17 @@ func (d *displayer) printLines() {
 		if d.state.RemoteClient != nil {
 			in, out, _, _ := d.state.RemoteClient.DataRate()
 			printf("  ${BOLD_WHITE}RPC data in: %6s/s out: %6s/s${RESET}", humanize.Bytes(uint64(in)), humanize.Bytes(uint64(out)))
+			if d.state.Config.Remote.Dynamic {
+				stats := d.state.DynamicStats
+				printf("  ${BOLD_WHITE}Won locally: %d remotely: %d fallbacks: %d${RESET}", atomic.LoadInt64(&stats.LocalWins), atomic.LoadInt64(&stats.RemoteWins), atomic.LoadInt64(&stats.Fallbacks))
+			}
+			if d.state.RemoteClient.Degraded() {
+				printf("  ${BOLD_RED}Remote server degraded${RESET}")
+			}
 		}
 		printf("${ERASE_AFTER}\n")
 		d.lines++
+		d.printCacheStats()
 	}
 	workers := 0
 	anyRemote := d.numRemote > 0
@@ -122,6 +131,29 @@ func (d *displayer) printLines() {
 	printf("${RESET}")
 }
 
+// printCacheStats prints a line summarising cache activity, if there's been any.
+func (d *displayer) printCacheStats() {
+	provider, ok := d.state.Cache.(core.CacheStatsProvider)
+	if !ok {
+		return
+	}
+	stats := provider.CacheStats()
+	pending := provider.PendingStores()
+	active := pending > 0
+	for _, tier := range stats {
+		active = active || tier.Hits+tier.Misses+tier.Stores > 0
+	}
+	if !active {
+		return
+	}
+	printf("  ${BOLD_WHITE}Cache:${RESET}")
+	for _, tier := range stats {
+		printf(" %s ${BOLD_WHITE}%d/%d${RESET} hits, %s in, %s out;", tier.Name, tier.Hits, tier.Hits+tier.Misses, humanize.Bytes(uint64(tier.BytesRetrieved)), humanize.Bytes(uint64(tier.BytesStored)))
+	}
+	printf(" ${BOLD_WHITE}%d${RESET} pending uploads${ERASE_AFTER}\n", pending)
+	d.lines++
+}
+
 func (d *displayer) numRemoteActive() int {
 	count := 0
 	for i := 0; i < d.numRemote; i++ {
@@ -49,7 +49,8 @@ type buildingTargetData struct {
 
 // MonitorState monitors the build while it's running and prints output.
 // The caller must cancel the given context once they want this function to stop displaying things.
-func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, detailedTests, streamTestResults bool, traceFile string) {
+// If eventFile is given, structured build events are written to it in the given format (json or proto).
+func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, detailedTests, streamTestResults bool, traceFile, eventFile, eventFormat string) {
 	initPrintf(state.Config)
 	failedTargetMap := map[core.BuildLabel]error{}
 	buildingTargets := make([]buildingTarget, state.Config.Please.NumThreads+state.Config.NumRemoteExecutors())
@@ -74,17 +75,25 @@ func MonitorState(ctx context.Context, state *core.BuildState, plainOutput, deta
 	failedTargets := []core.BuildLabel{}
 	failedNonTests := []core.BuildLabel{}
 	tw := newTraceWriter(traceFile)
+	ew := newEventWriter(state, eventFile, eventFormat)
+	ew.BuildStarted(state)
 	for result := range state.Results() {
 		if state.DebugTests && result.Status == core.TargetTesting {
 			cancel() // signals the interactive display goroutines to stop
 		}
 		processResult(state, result, buildingTargets, plainOutput, &failedTargets, &failedNonTests, failedTargetMap, tw, streamTestResults)
+		ew.AddResult(state, result)
 	}
 	<-ctx.Done()
 	wg.Wait()
+	tw.AddCacheCounters(state.Cache, time.Now())
 	if err := tw.Close(); err != nil {
 		log.Error("Failed to write trace data: %s", err)
 	}
+	ew.BuildFinished(failedTargets, time.Now(), time.Since(state.StartTime))
+	if err := ew.Close(); err != nil {
+		log.Error("Failed to write build events: %s", err)
+	}
 	duration := time.Since(state.StartTime).Round(durationGranularity)
 	if len(failedNonTests) > 0 { // Something failed in the build step.
 		printFailedBuildResults(failedNonTests, failedTargetMap, duration)
@@ -175,6 +184,9 @@ func processResult(state *core.BuildState, result *core.BuildResult, buildingTar
 	// Parse events can overlap in weird ways that mess up the display.
 	if !parse {
 		tw.AddTrace(result, buildingTargets[result.ThreadID].Label, active)
+		if !active {
+			tw.AddCacheCounters(state.Cache, result.Time)
+		}
 	}
 	target := state.Graph.Target(label)
 	if !parse { // Parse tasks happen on a different set of threads.
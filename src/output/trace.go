@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
+	"time"
 
 	"gopkg.in/op/go-logging.v1"
 
@@ -20,7 +22,8 @@ var log = logging.MustGetLogger("output")
 type traceWriter struct {
 	b     *bufio.Writer
 	f     *os.File
-	first bool // have we written the first record
+	first bool              // have we written the first record
+	cache []core.CacheStats // last cache stats we wrote
 }
 
 // newTraceWriter returns a new traceWriter writing to the given file.
@@ -71,12 +74,44 @@ func (tw *traceWriter) AddTrace(result *core.BuildResult, previous core.BuildLab
 	}
 }
 
-func (tw *traceWriter) writeEvent(result *core.BuildResult, phase string) {
-	if !tw.first {
-		tw.first = true
-	} else {
-		tw.b.Write([]byte{',', '\n'})
+// AddCacheCounters adds counter events for the current statistics of the given cache.
+// Nothing is written if the cache doesn't record any or they haven't changed since last time.
+func (tw *traceWriter) AddCacheCounters(cache core.Cache, t time.Time) {
+	provider, ok := cache.(core.CacheStatsProvider)
+	if tw.b == nil || !ok {
+		return
 	}
+	stats := provider.CacheStats()
+	if reflect.DeepEqual(stats, tw.cache) {
+		return
+	}
+	tw.cache = stats
+	for _, tier := range stats {
+		tw.writeCounter(tier.Name+" cache", t, map[string]int64{
+			"hits":   tier.Hits,
+			"misses": tier.Misses,
+			"stores": tier.Stores,
+		})
+		tw.writeCounter(tier.Name+" cache bytes", t, map[string]int64{
+			"retrieved": tier.BytesRetrieved,
+			"stored":    tier.BytesStored,
+		})
+	}
+}
+
+func (tw *traceWriter) writeCounter(name string, t time.Time, args map[string]int64) {
+	tw.writeSeparator()
+	b, _ := json.Marshal(traceCounter{
+		Name: name,
+		Ph:   "C",
+		Ts:   t.UnixNano() / 1000,
+		Args: args,
+	})
+	tw.b.Write(b)
+}
+
+func (tw *traceWriter) writeEvent(result *core.BuildResult, phase string) {
+	tw.writeSeparator()
 	entry := traceEntry{
 		Name:  result.Label.String(),
 		Cat:   result.Status.Category(),
@@ -97,6 +132,14 @@ func (tw *traceWriter) writeEvent(result *core.BuildResult, phase string) {
 	tw.b.Write(b)
 }
 
+func (tw *traceWriter) writeSeparator() {
+	if !tw.first {
+		tw.first = true
+	} else {
+		tw.b.Write([]byte{',', '\n'})
+	}
+}
+
 type traceEntry struct {
 	Name  string `json:"name"`
 	Cat   string `json:"cat"`
@@ -110,3 +153,12 @@ type traceEntry struct {
 		Err         string `json:"err,omitempty"`
 	} `json:"args"`
 }
+
+// A traceCounter is a counter event, which Chrome draws as a stacked graph of its args.
+type traceCounter struct {
+	Name string           `json:"name"`
+	Ph   string           `json:"ph"`
+	Pid  int32            `json:"pid"`
+	Ts   int64            `json:"ts"`
+	Args map[string]int64 `json:"args"`
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/manifoldco/promptui"
+	"hash/fnv"
 	"io"
 	"path"
 	"reflect"
@@ -17,7 +18,7 @@ import (
 )
 
 // A few sneaky globals for when we don't have a scope handy
-var stringMethods, dictMethods, configMethods map[string]*pyFunc
+var stringMethods, dictMethods, setMethods, configMethods map[string]*pyFunc
 
 // A nativeFunc is a function that implements a builtin function natively.
 type nativeFunc func(*scope, []pyObject) pyObject
@@ -36,10 +37,21 @@ func registerBuiltins(s *scope) {
 	setNativeCode(s, "enumerate", enumerate)
 	setNativeCode(s, "zip", zip).varargs = true
 	setNativeCode(s, "len", lenFunc)
+	setNativeCode(s, "any", anyFunc)
+	setNativeCode(s, "all", allFunc)
+	setNativeCode(s, "min", minFunc).varargs = true
+	setNativeCode(s, "max", maxFunc).varargs = true
+	setNativeCode(s, "sum", sum)
+	setNativeCode(s, "reversed", reversed)
+	setNativeCode(s, "filter", filter)
+	setNativeCode(s, "map", mapFunc)
+	setNativeCode(s, "hash", hashFunc)
 	setNativeCode(s, "glob", glob)
 	setNativeCode(s, "bool", boolType)
 	setNativeCode(s, "int", intType)
 	setNativeCode(s, "str", strType)
+	setNativeCode(s, "set", setType)
+	setNativeCode(s, "frozenset", frozensetType)
 	setNativeCode(s, "join_path", joinPath).varargs = true
 	setNativeCode(s, "get_base_path", packageName)
 	setNativeCode(s, "package_name", packageName)
@@ -85,6 +97,15 @@ func registerBuiltins(s *scope) {
 		"values":     setNativeCode(s, "values", dictValues),
 		"copy":       setNativeCode(s, "copy", dictCopy),
 	}
+	setMethods = map[string]*pyFunc{
+		"add":          setNativeCode(s, "add", setAdd),
+		"discard":      setNativeCode(s, "discard", setDiscard),
+		"union":        setNativeCode(s, "union", setUnion),
+		"intersection": setNativeCode(s, "intersection", setIntersection),
+		"difference":   setNativeCode(s, "difference", setDifference),
+		"issubset":     setNativeCode(s, "issubset", setIsSubset),
+		"issuperset":   setNativeCode(s, "issuperset", setIsSuperset),
+	}
 	configMethods = map[string]*pyFunc{
 		"get":        setNativeCode(s, "config_get", configGet),
 		"setdefault": s.Lookup("setdefault").(*pyFunc),
@@ -222,7 +243,7 @@ func bazelLoad(s *scope, args []pyObject) pyObject {
 		}
 		filename = subrepo.Dir(filename)
 	}
-	s.SetAll(s.interpreter.Subinclude(filename, l, s.contextPkg), false)
+	s.SetAll(s.interpreter.Subinclude(s, filename, l, s.contextPkg), false)
 	return None
 }
 
@@ -254,7 +275,7 @@ func subinclude(s *scope, args []pyObject) pyObject {
 		l := pkg.Label()
 		s.Assert(l.CanSee(s.state, t), "Target %s isn't visible to be subincluded into %s", t.Label, l)
 		for _, out := range t.Outputs() {
-			s.SetAll(s.interpreter.Subinclude(path.Join(t.OutDir(), out), t.Label, pkg), false)
+			s.SetAll(s.interpreter.Subinclude(s, path.Join(t.OutDir(), out), t.Label, pkg), false)
 		}
 	}
 	return None
@@ -306,6 +327,10 @@ func objLen(obj pyObject) pyInt {
 		return pyInt(len(t))
 	case pyString:
 		return pyInt(len(t))
+	case pySet:
+		return pyInt(len(t))
+	case pyFrozenSet:
+		return pyInt(len(t.pySet))
 	}
 	panic("object of type " + obj.Type() + " has no len()")
 }
@@ -340,6 +365,10 @@ func isType(obj pyObject, name string) bool {
 		return name == "list"
 	case pyDict:
 		return name == "dict"
+	case pySet:
+		return name == "set"
+	case pyFrozenSet:
+		return name == "set" || name == "frozenset"
 	case *pyConfig:
 		return name == "config"
 	}
@@ -555,6 +584,9 @@ func dictCopy(s *scope, args []pyObject) pyObject {
 }
 
 func sorted(s *scope, args []pyObject) pyObject {
+	if set, ok := asSet(args[0]); ok {
+		return set.Items()
+	}
 	l, ok := args[0].(pyList)
 	s.Assert(ok, "unsortable type %s", args[0].Type())
 	l = l[:]
@@ -644,6 +676,192 @@ func zip(s *scope, args []pyObject) pyObject {
 	return ret
 }
 
+// iterable returns the given object as a list, allowing sets as well as lists.
+func iterable(s *scope, obj pyObject, name string) pyList {
+	if l, ok := asList(obj); ok {
+		return l
+	} else if set, ok := asSet(obj); ok {
+		return set.Items()
+	}
+	s.Error("Argument to %s must be a list or set, not %s", name, obj.Type())
+	return nil
+}
+
+// callFunc calls a function object from native code with the given positional arguments.
+func callFunc(s *scope, name string, f pyObject, args ...pyObject) pyObject {
+	c := &Call{Arguments: make([]CallArgument, len(args))}
+	for i, arg := range args {
+		c.Arguments[i].Value.Optimised = &OptimisedExpression{Constant: arg}
+	}
+	return s.callObject(name, f, c)
+}
+
+func anyFunc(s *scope, args []pyObject) pyObject {
+	for _, x := range iterable(s, args[0], "any") {
+		if x.IsTruthy() {
+			return True
+		}
+	}
+	return False
+}
+
+func allFunc(s *scope, args []pyObject) pyObject {
+	for _, x := range iterable(s, args[0], "all") {
+		if !x.IsTruthy() {
+			return False
+		}
+	}
+	return True
+}
+
+func minFunc(s *scope, args []pyObject) pyObject {
+	return minMax(s, args, "min", false)
+}
+
+func maxFunc(s *scope, args []pyObject) pyObject {
+	return minMax(s, args, "max", true)
+}
+
+// minMax implements min() and max(), which take either a single list or set, or multiple arguments.
+func minMax(s *scope, args []pyObject, name string, max bool) pyObject {
+	l := pyList(args)
+	if len(args) == 1 {
+		l = iterable(s, args[0], name)
+	}
+	s.Assert(len(l) > 0, "%s() arg is an empty sequence", name)
+	ret := l[0]
+	for _, x := range l[1:] {
+		if max {
+			if ret.Operator(LessThan, x).IsTruthy() {
+				ret = x
+			}
+		} else if x.Operator(LessThan, ret).IsTruthy() {
+			ret = x
+		}
+	}
+	return ret
+}
+
+func sum(s *scope, args []pyObject) pyObject {
+	ret := args[1]
+	for _, x := range iterable(s, args[0], "sum") {
+		ret = ret.Operator(Add, x)
+	}
+	return ret
+}
+
+func reversed(s *scope, args []pyObject) pyObject {
+	l, ok := asList(args[0])
+	s.Assert(ok, "Argument to reversed must be a list, not %s", args[0].Type())
+	ret := make(pyList, len(l))
+	for i, x := range l {
+		ret[len(l)-i-1] = x
+	}
+	return ret
+}
+
+// filter implements the filter() builtin. If the function is None then it filters
+// on the truthiness of the items themselves.
+func filter(s *scope, args []pyObject) pyObject {
+	ret := pyList{}
+	for _, x := range iterable(s, args[1], "filter") {
+		if args[0] == None {
+			if x.IsTruthy() {
+				ret = append(ret, x)
+			}
+		} else if callFunc(s, "filter", args[0], x).IsTruthy() {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
+
+func mapFunc(s *scope, args []pyObject) pyObject {
+	l := iterable(s, args[1], "map")
+	ret := make(pyList, len(l))
+	for i, x := range l {
+		ret[i] = callFunc(s, "map", args[0], x)
+	}
+	return ret
+}
+
+// hashFunc implements the hash() builtin. Unlike Python, the hash of a string is stable
+// between runs, so it is safe to use it in the definition of a target.
+func hashFunc(s *scope, args []pyObject) pyObject {
+	obj := args[0]
+	s.Assert(isHashable(obj), "unhashable type: %s", obj.Type())
+	switch obj := obj.(type) {
+	case pyInt:
+		return obj
+	case pyBool:
+		if obj {
+			return pyInt(1)
+		}
+		return pyInt(0)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(obj.Type()))
+	h.Write([]byte{0})
+	h.Write([]byte(obj.String()))
+	return pyInt(int(h.Sum64() >> 1))
+}
+
+func setType(s *scope, args []pyObject) pyObject {
+	return newPySet(iterable(s, args[0], "set"))
+}
+
+func frozensetType(s *scope, args []pyObject) pyObject {
+	return newPySet(iterable(s, args[0], "frozenset")).Freeze()
+}
+
+// setArg returns the argument to a set method as a set; like Python they accept any iterable.
+func setArg(s *scope, obj pyObject, name string) pySet {
+	if set, ok := asSet(obj); ok {
+		return set
+	}
+	return newPySet(iterable(s, obj, name))
+}
+
+func setAdd(s *scope, args []pyObject) pyObject {
+	self := args[0].(pySet)
+	s.Assert(isHashable(args[1]), "unhashable type: %s", args[1].Type())
+	self.Add(args[1])
+	return None
+}
+
+func setDiscard(s *scope, args []pyObject) pyObject {
+	self := args[0].(pySet)
+	if isHashable(args[1]) {
+		delete(self, args[1])
+	}
+	return None
+}
+
+func setUnion(s *scope, args []pyObject) pyObject {
+	self, _ := asSet(args[0])
+	return self.Union(setArg(s, args[1], "union"))
+}
+
+func setIntersection(s *scope, args []pyObject) pyObject {
+	self, _ := asSet(args[0])
+	return self.Intersection(setArg(s, args[1], "intersection"))
+}
+
+func setDifference(s *scope, args []pyObject) pyObject {
+	self, _ := asSet(args[0])
+	return self.Difference(setArg(s, args[1], "difference"))
+}
+
+func setIsSubset(s *scope, args []pyObject) pyObject {
+	self, _ := asSet(args[0])
+	return newPyBool(self.IsSubset(setArg(s, args[1], "issubset")))
+}
+
+func setIsSuperset(s *scope, args []pyObject) pyObject {
+	self, _ := asSet(args[0])
+	return newPyBool(setArg(s, args[1], "issuperset").IsSubset(self))
+}
+
 // getLabels returns the set of labels for a build target and its transitive dependencies.
 // The labels are filtered by the given prefix, which is stripped from the returned labels.
 // Two formats are supported here: either passing just the name of a target in the current
@@ -906,27 +1124,26 @@ func subrepo(s *scope, args []pyObject) pyObject {
 
 // breakpoint implements an interactive debugger for the breakpoint() builtin
 func breakpoint(s *scope, args []pyObject) pyObject {
+	if d := s.interpreter.debugger; d != nil {
+		// The full debugger is running; stop in that instead.
+		f := s.frame
+		if f == nil {
+			f = s.interpreter.enterFrame(nil, s.contextPkg.Filename, Position{Filename: s.contextPkg.Filename}, s)
+		}
+		d.Stop(f, "breakpoint")
+		return None
+	}
 	// Take this mutex to ensure only one debugger runs at a time
 	s.interpreter.breakpointMutex.Lock()
 	defer s.interpreter.breakpointMutex.Unlock()
 	fmt.Printf("breakpoint() encountered in %s, entering interactive debugger...\n", s.contextPkg.Filename)
-	// This is a small hack to get the return value back from an ident statement, which
-	// is normally not available since we don't have implicit returns.
-	interpretStatements := func(stmts []*Statement) (ret pyObject, err error) {
-		if len(stmts) == 1 && stmts[0].Ident != nil {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("%s", r)
-				}
-			}()
-			return s.interpretIdentStatement(stmts[0].Ident), nil
-		}
-		return s.interpreter.interpretStatements(s, stmts)
-	}
 	for {
 		prompt := promptui.Prompt{
 			Label: "plz",
 			Validate: func(input string) error {
+				if _, err := s.interpreter.parser.ParseData([]byte("_ = "+input), "<stdin>"); err == nil {
+					return nil // It's a valid expression
+				}
 				_, err := s.interpreter.parser.ParseData([]byte(input), "<stdin>")
 				return err
 			},
@@ -937,9 +1154,7 @@ func breakpoint(s *scope, args []pyObject) pyObject {
 			} else if err.Error() != "^C" {
 				log.Error("%s", err)
 			}
-		} else if stmts, err := s.interpreter.parser.ParseData([]byte(input), "<stdin>"); err != nil {
-			log.Error("Syntax error: %s", err)
-		} else if ret, err := interpretStatements(stmts); err != nil {
+		} else if ret, err := s.evaluate(input); err != nil {
 			log.Error("%s", err)
 		} else if ret != nil && ret != None {
 			fmt.Printf("%s\n", ret)
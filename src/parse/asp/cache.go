@@ -0,0 +1,97 @@
+package asp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/coreos/go-semver/semver"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// A parseCache stores parsed ASTs on disk, keyed by the name & hash of the file they were parsed from.
+// The name is part of the key since the AST's positions refer to it, so two files with identical
+// contents can't share an entry.
+// Lexing & parsing is a significant part of the cost of parsing BUILD files on a large repo,
+// and most of them don't change from one run to the next.
+//
+// Entries are stored under a directory for the current version, since the AST can change
+// between versions; those for any other version are removed when the cache is opened so they
+// don't build up over upgrades.
+type parseCache struct {
+	dir string
+}
+
+// newParseCache returns a new parseCache using the given directory.
+// It returns nil if the directory is empty, in which case nothing is cached.
+func newParseCache(dir string) *parseCache {
+	if dir == "" {
+		return nil
+	}
+	version := core.PleaseVersion.String()
+	pruneParseCache(dir, version)
+	return &parseCache{dir: path.Join(dir, version)}
+}
+
+// pruneParseCache removes the entries for any version other than the given one from the given directory.
+// Anything that isn't named like a version is left alone, in case the directory is shared with something else.
+func pruneParseCache(dir, version string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read parse cache directory: %s", err)
+		}
+		return
+	}
+	for _, info := range infos {
+		if _, err := semver.NewVersion(info.Name()); err == nil && info.IsDir() && info.Name() != version {
+			if err := os.RemoveAll(path.Join(dir, info.Name())); err != nil {
+				log.Warning("Failed to remove old parse cache entries: %s", err)
+			}
+		}
+	}
+}
+
+// Get returns the statements previously stored for a file with the given name & contents, or nil if
+// there aren't any.
+func (c *parseCache) Get(filename string, contents []byte) []*Statement {
+	b, err := ioutil.ReadFile(c.filename(filename, contents))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to read from parse cache: %s", err)
+		}
+		return nil
+	}
+	var stmts []*Statement
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&stmts); err != nil {
+		log.Warning("Failed to decode cached parse result: %s", err)
+		return nil
+	}
+	return stmts
+}
+
+// Store stores the statements parsed from a file with the given name & contents.
+func (c *parseCache) Store(filename string, contents []byte, stmts []*Statement) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(stmts); err != nil {
+		log.Warning("Failed to encode parse result: %s", err)
+	} else if err := fs.WriteFile(&buf, c.filename(filename, contents), 0644); err != nil {
+		log.Warning("Failed to write to parse cache: %s", err)
+	}
+}
+
+// filename returns the name of the cache file for the given file name & contents.
+func (c *parseCache) filename(filename string, contents []byte) string {
+	h := sha256.New()
+	h.Write([]byte(filename))
+	h.Write([]byte{0})
+	h.Write(contents)
+	key := hex.EncodeToString(h.Sum(nil))
+	return path.Join(c.dir, key[:2], key)
+}
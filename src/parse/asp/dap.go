@@ -0,0 +1,453 @@
+package asp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// dapThreadID is the ID of the only thread we report; the parser runs many goroutines but they
+// are never stopped at the same time, so it's simplest to present them as one.
+const dapThreadID = 1
+
+// A dapServer is a debugFrontend that implements the Debug Adapter Protocol, which allows
+// editors to attach to the debugger.
+// See https://microsoft.github.io/debug-adapter-protocol/specification for details.
+type dapServer struct {
+	d          *debugger
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	seq        int
+	// Closed when the client has finished configuration (e.g. has set its initial breakpoints).
+	configured chan struct{}
+	configOnce sync.Once
+	// Receives how to resume when we're stopped.
+	resume chan stepMode
+
+	// Protects the fields below.
+	mutex        sync.Mutex
+	disconnected bool
+	// The frame we're currently stopped at, and its call stack. Nil if we aren't stopped.
+	frame  *frame
+	frames map[int]*frame
+	// Objects that can be expanded in the variables view, by their reference.
+	// These are only valid while stopped.
+	refs map[int]pyObject
+	// Builtin files that we've given a reference to, since they aren't on disk.
+	sources []string
+}
+
+// newDAPServer creates a new DAP server listening on the given port.
+// It blocks until a client has connected and configured it.
+func newDAPServer(d *debugger, port int) *dapServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("Failed to start debug server: %s", err)
+	}
+	log.Notice("Waiting for debug client to attach on port %d...", port)
+	return serveDAP(d, lis)
+}
+
+// serveDAP accepts a single client from the given listener and serves the DAP to it.
+// It blocks until the client has connected and configured it.
+func serveDAP(d *debugger, lis net.Listener) *dapServer {
+	conn, err := lis.Accept()
+	if err != nil {
+		log.Fatalf("Failed to accept debug client: %s", err)
+	}
+	lis.Close()
+	s := &dapServer{
+		d:          d,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		configured: make(chan struct{}),
+		resume:     make(chan stepMode),
+	}
+	go s.serve()
+	<-s.configured
+	return s
+}
+
+// A dapRequest is a request from the client.
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// A dapResponse is our response to a request.
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// A dapEvent is an event that we send to the client.
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name            string `json:"name"`
+	Path            string `json:"path,omitempty"`
+	SourceReference int    `json:"sourceReference,omitempty"`
+}
+
+type dapStackFrame struct {
+	ID     int       `json:"id"`
+	Name   string    `json:"name"`
+	Source dapSource `json:"source"`
+	Line   int       `json:"line"`
+	Column int       `json:"column"`
+}
+
+type dapScope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type dapBreakpoint struct {
+	Verified bool `json:"verified"`
+	Line     int  `json:"line"`
+}
+
+func (s *dapServer) Stopped(f *frame, reason string) stepMode {
+	s.mutex.Lock()
+	if s.disconnected {
+		s.mutex.Unlock()
+		return stepContinue
+	}
+	s.frame = f
+	s.frames = map[int]*frame{}
+	for _, frame := range f.Stack() {
+		s.frames[frame.ID] = frame
+	}
+	s.refs = map[int]pyObject{}
+	s.mutex.Unlock()
+	s.sendEvent("stopped", map[string]interface{}{
+		"reason":            reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	})
+	mode := <-s.resume
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.frame = nil
+	s.frames = nil
+	s.refs = nil
+	return mode
+}
+
+// serve reads and handles requests until the client disconnects.
+func (s *dapServer) serve() {
+	for {
+		req, err := s.read()
+		if err != nil {
+			if err != io.EOF {
+				log.Error("Error reading from debug client: %s", err)
+			}
+			s.disconnect()
+			return
+		}
+		body, err := s.handle(req)
+		resp := &dapResponse{
+			Type:       "response",
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Command:    req.Command,
+			Body:       body,
+		}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		s.send(resp)
+		switch req.Command {
+		case "initialize":
+			s.sendEvent("initialized", nil)
+		case "disconnect":
+			s.disconnect()
+			return
+		}
+	}
+}
+
+// disconnect stops serving the client and lets execution run to completion.
+func (s *dapServer) disconnect() {
+	s.d.ClearBreakpoints()
+	s.configOnce.Do(func() { close(s.configured) })
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.disconnected = true
+	if s.frame != nil {
+		s.resume <- stepContinue
+	}
+	s.conn.Close()
+}
+
+// read reads a single request from the client.
+func (s *dapServer) read() (*dapRequest, error) {
+	headers, err := textproto.NewReader(s.reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Content-Length header: %s", err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, data); err != nil {
+		return nil, err
+	}
+	req := &dapRequest{}
+	return req, json.Unmarshal(data, req)
+}
+
+func (s *dapServer) sendEvent(event string, body interface{}) {
+	s.send(&dapEvent{Type: "event", Event: event, Body: body})
+}
+
+// send sends a single message to the client.
+func (s *dapServer) send(msg interface{}) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.seq++
+	switch msg := msg.(type) {
+	case *dapResponse:
+		msg.Seq = s.seq
+	case *dapEvent:
+		msg.Seq = s.seq
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("Failed to encode debug message: %s", err)
+		return
+	}
+	if _, err := fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		log.Warning("Failed to send debug message: %s", err)
+	}
+}
+
+// handle handles a single request and returns the body of the response.
+func (s *dapServer) handle(req *dapRequest) (interface{}, error) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		SourceReference    int    `json:"sourceReference"`
+		Expression         string `json:"expression"`
+	}
+	if len(req.Arguments) != 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+	switch req.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch", "attach", "disconnect":
+		return nil, nil
+	case "configurationDone":
+		s.configOnce.Do(func() { close(s.configured) })
+		return nil, nil
+	case "setBreakpoints":
+		lines := make([]int, len(args.Breakpoints))
+		bps := make([]dapBreakpoint, len(args.Breakpoints))
+		for i, bp := range args.Breakpoints {
+			lines[i] = bp.Line
+			bps[i] = dapBreakpoint{Verified: true, Line: bp.Line}
+		}
+		s.d.SetBreakpoints(args.Source.Path, lines)
+		return map[string]interface{}{"breakpoints": bps}, nil
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []dapBreakpoint{}}, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadID, "name": "parse"}},
+		}, nil
+	case "pause":
+		s.d.Pause()
+		return nil, nil
+	case "continue":
+		return map[string]bool{"allThreadsContinued": true}, s.resumeWith(stepContinue)
+	case "next":
+		return nil, s.resumeWith(stepOver)
+	case "stepIn":
+		return nil, s.resumeWith(stepIn)
+	case "stepOut":
+		return nil, s.resumeWith(stepOut)
+	case "source":
+		return s.source(args.SourceReference)
+	}
+	// Everything else needs us to be stopped.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.frame == nil {
+		return nil, fmt.Errorf("Not stopped")
+	}
+	switch req.Command {
+	case "stackTrace":
+		frames := []dapStackFrame{}
+		for _, f := range s.frame.Stack() {
+			frames = append(frames, dapStackFrame{
+				ID:     f.ID,
+				Name:   f.Name,
+				Source: s.dapSource(f.Pos.Filename),
+				Line:   f.Pos.Line,
+				Column: f.Pos.Column,
+			})
+		}
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		f, present := s.frames[args.FrameID]
+		if !present {
+			return nil, fmt.Errorf("Unknown frame %d", args.FrameID)
+		}
+		return map[string]interface{}{"scopes": []dapScope{
+			{Name: "Locals", VariablesReference: s.ref(f.Locals())},
+			{Name: "Globals", VariablesReference: s.ref(f.Globals())},
+		}}, nil
+	case "variables":
+		obj, present := s.refs[args.VariablesReference]
+		if !present {
+			return nil, fmt.Errorf("Unknown variables reference %d", args.VariablesReference)
+		}
+		return map[string]interface{}{"variables": s.variables(obj)}, nil
+	case "evaluate":
+		f := s.frame
+		if args.FrameID != 0 {
+			if f = s.frames[args.FrameID]; f == nil {
+				return nil, fmt.Errorf("Unknown frame %d", args.FrameID)
+			}
+		}
+		ret, err := f.scope.evaluate(args.Expression)
+		if err != nil {
+			return nil, err
+		} else if ret == nil {
+			ret = None
+		}
+		return map[string]interface{}{"result": ret.String(), "variablesReference": s.ref(ret)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported request %s", req.Command)
+}
+
+// resumeWith resumes execution if we are stopped.
+func (s *dapServer) resumeWith(mode stepMode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.frame == nil {
+		return fmt.Errorf("Not stopped")
+	}
+	s.frame = nil // Prevents anything resuming it again before it's noticed.
+	s.resume <- mode
+	return nil
+}
+
+// source returns the contents of a builtin file, given its reference.
+func (s *dapServer) source(ref int) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ref <= 0 || ref > len(s.sources) {
+		return nil, fmt.Errorf("Unknown source reference %d", ref)
+	}
+	contents, err := s.d.Source(s.sources[ref-1])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"content": string(contents)}, nil
+}
+
+// dapSource returns the source description for the given filename.
+// Builtin files aren't on disk so the client has to ask us for them.
+func (s *dapServer) dapSource(filename string) dapSource {
+	if _, present := s.d.interpreter.parser.builtins[filename]; !present {
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(core.RepoRoot, filename)
+		}
+		return dapSource{Name: filepath.Base(filename), Path: filename}
+	}
+	for i, f := range s.sources {
+		if f == filename {
+			return dapSource{Name: filename, SourceReference: i + 1}
+		}
+	}
+	s.sources = append(s.sources, filename)
+	return dapSource{Name: filename, SourceReference: len(s.sources)}
+}
+
+// ref returns a reference for an object that can be expanded in the variables view,
+// or zero if it can't be.
+func (s *dapServer) ref(obj pyObject) int {
+	switch obj := obj.(type) {
+	case pyList, pyDict, pySet:
+		s.refs[len(s.refs)+1] = obj
+		return len(s.refs)
+	case pyFrozenList:
+		return s.ref(obj.pyList)
+	case pyFrozenDict:
+		return s.ref(obj.pyDict)
+	case pyFrozenSet:
+		return s.ref(obj.pySet)
+	}
+	return 0
+}
+
+// variables returns the children of an expandable object.
+func (s *dapServer) variables(obj pyObject) []dapVariable {
+	ret := []dapVariable{}
+	add := func(name string, value pyObject) {
+		ret = append(ret, dapVariable{
+			Name:               name,
+			Value:              value.String(),
+			Type:               value.Type(),
+			VariablesReference: s.ref(value),
+		})
+	}
+	switch obj := obj.(type) {
+	case pyList:
+		for i, v := range obj {
+			add(strconv.Itoa(i), v)
+		}
+	case pyDict:
+		for _, k := range obj.Keys() {
+			add(k, obj[k])
+		}
+	case pySet:
+		for i, v := range obj.Items() {
+			add(strconv.Itoa(i), v)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,193 @@
+package asp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestDAP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	parser, stmts := newDebugParser(debugTestFile)
+	done := make(chan error)
+	go func() {
+		d := &debugger{
+			interpreter: parser.interpreter,
+			breakpoints: map[string]map[int]bool{},
+		}
+		d.frontend = serveDAP(d, lis)
+		parser.interpreter.debugger = d
+		_, err := parser.interpreter.interpretAll(core.NewPackage("test/package"), stmts)
+		done <- err
+	}()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	c := &testDAPClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	c.Request("initialize", map[string]string{"adapterID": "plz"}, nil)
+	c.WaitForEvent("initialized")
+	var bps struct {
+		Breakpoints []dapBreakpoint `json:"breakpoints"`
+	}
+	c.Request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": debugTestFile},
+		"breakpoints": []map[string]int{{"line": 3}},
+	}, &bps)
+	assert.Equal(t, []dapBreakpoint{{Verified: true, Line: 3}}, bps.Breakpoints)
+	c.Request("configurationDone", nil, nil)
+
+	var stopped struct {
+		Reason   string `json:"reason"`
+		ThreadID int    `json:"threadId"`
+	}
+	c.WaitForEvent("stopped", &stopped)
+	assert.Equal(t, "breakpoint", stopped.Reason)
+	assert.Equal(t, dapThreadID, stopped.ThreadID)
+
+	var trace struct {
+		StackFrames []dapStackFrame `json:"stackFrames"`
+	}
+	c.Request("stackTrace", map[string]int{"threadId": dapThreadID}, &trace)
+	require.Equal(t, 2, len(trace.StackFrames))
+	assert.Equal(t, "add", trace.StackFrames[0].Name)
+	assert.Equal(t, 3, trace.StackFrames[0].Line)
+	assert.Equal(t, "steps.build", trace.StackFrames[0].Source.Name)
+	assert.Equal(t, "//test/package:all", trace.StackFrames[1].Name)
+	assert.Equal(t, 5, trace.StackFrames[1].Line)
+
+	var scopes struct {
+		Scopes []dapScope `json:"scopes"`
+	}
+	c.Request("scopes", map[string]int{"frameId": trace.StackFrames[0].ID}, &scopes)
+	require.Equal(t, 2, len(scopes.Scopes))
+	assert.Equal(t, "Locals", scopes.Scopes[0].Name)
+	var vars struct {
+		Variables []dapVariable `json:"variables"`
+	}
+	c.Request("variables", map[string]int{"variablesReference": scopes.Scopes[0].VariablesReference}, &vars)
+	assert.Equal(t, []dapVariable{
+		{Name: "a", Value: "1", Type: "int"},
+		{Name: "b", Value: "2", Type: "int"},
+		{Name: "c", Value: "3", Type: "int"},
+	}, vars.Variables)
+
+	var result struct {
+		Result             string `json:"result"`
+		VariablesReference int    `json:"variablesReference"`
+	}
+	c.Request("evaluate", map[string]interface{}{"expression": "[a, b]", "frameId": trace.StackFrames[0].ID}, &result)
+	assert.Equal(t, "[1 2]", result.Result)
+	assert.NotEqual(t, 0, result.VariablesReference)
+	c.Request("variables", map[string]int{"variablesReference": result.VariablesReference}, &vars)
+	assert.Equal(t, []dapVariable{
+		{Name: "0", Value: "1", Type: "int"},
+		{Name: "1", Value: "2", Type: "int"},
+	}, vars.Variables)
+
+	// Step back out to the top level.
+	c.Request("stepOut", map[string]int{"threadId": dapThreadID}, nil)
+	c.WaitForEvent("stopped", &stopped)
+	assert.Equal(t, "step", stopped.Reason)
+	c.Request("stackTrace", map[string]int{"threadId": dapThreadID}, &trace)
+	require.Equal(t, 1, len(trace.StackFrames))
+	assert.Equal(t, 6, trace.StackFrames[0].Line)
+
+	c.Request("continue", map[string]int{"threadId": dapThreadID}, nil)
+	c.WaitForEvent("stopped", &stopped)
+	c.Request("disconnect", nil, nil)
+	assert.NoError(t, <-done)
+}
+
+// A testDAPClient is a minimal client for the Debug Adapter Protocol.
+type testDAPClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    int
+	// Events we've received but not waited for yet.
+	events []*testDAPMessage
+}
+
+type testDAPMessage struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// Request sends a request and waits for its response, decoding its body into the given object if non-nil.
+func (c *testDAPClient) Request(command string, args, body interface{}) {
+	c.seq++
+	data, err := json.Marshal(map[string]interface{}{
+		"seq":       c.seq,
+		"type":      "request",
+		"command":   command,
+		"arguments": args,
+	})
+	require.NoError(c.t, err)
+	_, err = fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	require.NoError(c.t, err)
+	for {
+		msg := c.read()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		require.Equal(c.t, c.seq, msg.RequestSeq)
+		require.True(c.t, msg.Success, "%s failed: %s", command, msg.Message)
+		c.decode(msg, body)
+		return
+	}
+}
+
+// WaitForEvent waits for an event of the given type, decoding its body into the given object if any.
+func (c *testDAPClient) WaitForEvent(event string, body ...interface{}) {
+	for {
+		var msg *testDAPMessage
+		if len(c.events) > 0 {
+			msg, c.events = c.events[0], c.events[1:]
+		} else {
+			msg = c.read()
+		}
+		if msg.Type == "event" && msg.Event == event {
+			if len(body) > 0 {
+				c.decode(msg, body[0])
+			}
+			return
+		}
+	}
+}
+
+func (c *testDAPClient) decode(msg *testDAPMessage, body interface{}) {
+	if body != nil && len(msg.Body) > 0 {
+		require.NoError(c.t, json.Unmarshal(msg.Body, body))
+	}
+}
+
+func (c *testDAPClient) read() *testDAPMessage {
+	headers, err := textproto.NewReader(c.reader).ReadMIMEHeader()
+	require.NoError(c.t, err)
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	require.NoError(c.t, err)
+	data := make([]byte, length)
+	_, err = io.ReadFull(c.reader, data)
+	require.NoError(c.t, err)
+	msg := &testDAPMessage{}
+	require.NoError(c.t, json.Unmarshal(data, msg))
+	return msg
+}
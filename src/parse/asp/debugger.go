@@ -0,0 +1,389 @@
+package asp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/manifoldco/promptui"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A stepMode describes how execution resumes after the debugger stops.
+type stepMode int
+
+const (
+	// stepContinue runs until the next breakpoint.
+	stepContinue stepMode = iota
+	// stepIn stops at the next statement, including inside any function called.
+	stepIn
+	// stepOver stops at the next statement in the current function or its callers.
+	stepOver
+	// stepOut stops at the next statement in a caller of the current function.
+	stepOut
+	// stepPause stops at the next statement anywhere.
+	stepPause
+)
+
+// A debugFrontend is the user-facing part of the debugger.
+type debugFrontend interface {
+	// Stopped is called when execution stops at the given frame, and blocks until the user
+	// chooses how to resume.
+	Stopped(f *frame, reason string) stepMode
+}
+
+// A debugger implements breakpoints and stepping through BUILD file evaluation.
+type debugger struct {
+	interpreter *interpreter
+	frontend    debugFrontend
+	// Held while execution is stopped, so only one thing is being debugged at once.
+	stopMutex sync.Mutex
+	// Protects the fields below.
+	mutex       sync.Mutex
+	breakpoints map[string]map[int]bool
+	mode        stepMode
+	stepFrame   *frame
+	stopOnEntry bool
+	// The root frame that we are currently stopped in. Anything evaluated in it while we're
+	// stopped doesn't stop again.
+	stoppedRoot *frame
+}
+
+// newDebugger creates a new debugger for the given interpreter.
+func newDebugger(i *interpreter, opts *core.DebugBuildFiles) *debugger {
+	d := &debugger{
+		interpreter: i,
+		breakpoints: map[string]map[int]bool{},
+	}
+	for _, bp := range opts.Breakpoints {
+		if err := d.AddBreakpoint(bp); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if opts.Port != 0 {
+		d.frontend = newDAPServer(d, opts.Port)
+	} else {
+		d.frontend = &terminalDebugger{d: d}
+		d.stopOnEntry = len(opts.Breakpoints) == 0
+	}
+	return d
+}
+
+// Statement is called before each statement is executed, and stops if appropriate.
+func (d *debugger) Statement(s *scope, stmt *Statement) {
+	f := s.frame
+	if f == nil {
+		f = d.interpreter.enterFrame(nil, stmt.Pos.Filename, stmt.Pos, s)
+	}
+	if d.isStopped(f) {
+		return // Don't disturb anything while the user is evaluating things in a stopped frame.
+	}
+	f.scope = s
+	f.Pos = stmt.Pos
+	if reason := d.shouldStop(f); reason != "" {
+		d.Stop(f, reason)
+	}
+}
+
+// Stop stops execution at the given frame and waits for the frontend to resume it.
+func (d *debugger) Stop(f *frame, reason string) {
+	d.stopMutex.Lock()
+	defer d.stopMutex.Unlock()
+	d.mutex.Lock()
+	d.stoppedRoot = f.Root
+	d.mutex.Unlock()
+	mode := d.frontend.Stopped(f, reason)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.stoppedRoot = nil
+	d.mode = mode
+	d.stepFrame = f
+}
+
+// isStopped returns true if we're currently stopped in the given frame's call stack.
+func (d *debugger) isStopped(f *frame) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return f.Root == d.stoppedRoot
+}
+
+// shouldStop returns the reason to stop at the given frame, or the empty string if we shouldn't.
+func (d *debugger) shouldStop(f *frame) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopOnEntry && f.Root == f && f.base.pkg != nil {
+		d.stopOnEntry = false
+		return "entry"
+	} else if d.breakpoints[normaliseDebugFilename(f.Pos.Filename)][f.Pos.Line] {
+		return "breakpoint"
+	}
+	switch d.mode {
+	case stepPause:
+		return "pause"
+	case stepIn:
+		if f.Root == d.stepFrame.Root {
+			return "step"
+		}
+	case stepOver:
+		if f.Root == d.stepFrame.Root && f.Depth <= d.stepFrame.Depth {
+			return "step"
+		}
+	case stepOut:
+		if f.Root == d.stepFrame.Root && f.Depth < d.stepFrame.Depth {
+			return "step"
+		}
+	}
+	return ""
+}
+
+// Pause stops execution at the next statement that's run.
+func (d *debugger) Pause() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.mode = stepPause
+}
+
+// AddBreakpoint adds a breakpoint, given as filename:line.
+func (d *debugger) AddBreakpoint(bp string) error {
+	filename, line, err := parseBreakpoint(bp)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.breakpoints[filename] == nil {
+		d.breakpoints[filename] = map[int]bool{}
+	}
+	d.breakpoints[filename][line] = true
+	return nil
+}
+
+// RemoveBreakpoint removes a breakpoint, given as filename:line.
+func (d *debugger) RemoveBreakpoint(bp string) error {
+	filename, line, err := parseBreakpoint(bp)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.breakpoints[filename], line)
+	return nil
+}
+
+// SetBreakpoints replaces all the breakpoints in a file.
+func (d *debugger) SetBreakpoints(filename string, lines []int) {
+	filename = normaliseDebugFilename(filename)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.breakpoints[filename] = map[int]bool{}
+	for _, line := range lines {
+		d.breakpoints[filename][line] = true
+	}
+}
+
+// ClearBreakpoints removes all breakpoints and stops any stepping, so execution will run to completion.
+func (d *debugger) ClearBreakpoints() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.breakpoints = map[string]map[int]bool{}
+	d.mode = stepContinue
+	d.stopOnEntry = false
+}
+
+// Breakpoints returns all the current breakpoints, sorted.
+func (d *debugger) Breakpoints() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ret := []string{}
+	for filename, lines := range d.breakpoints {
+		for line := range lines {
+			ret = append(ret, filename+":"+strconv.Itoa(line))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// parseBreakpoint parses a breakpoint given as filename:line.
+func parseBreakpoint(bp string) (string, int, error) {
+	idx := strings.LastIndexByte(bp, ':')
+	if idx == -1 {
+		return "", 0, fmt.Errorf("Invalid breakpoint %s, must be in the form filename:line", bp)
+	}
+	line, err := strconv.Atoi(bp[idx+1:])
+	if err != nil || line <= 0 {
+		return "", 0, fmt.Errorf("Invalid line number in breakpoint %s", bp)
+	}
+	return normaliseDebugFilename(bp[:idx]), line, nil
+}
+
+// normaliseDebugFilename converts a filename to be relative to the repo root, so breakpoints match
+// however the file was originally referred to.
+func normaliseDebugFilename(filename string) string {
+	if filepath.IsAbs(filename) && core.RepoRoot != "" {
+		return strings.TrimPrefix(filename, core.RepoRoot+"/")
+	}
+	return filepath.Clean(filename)
+}
+
+// evaluate evaluates an expression or statement in this scope and returns the result, if any.
+func (s *scope) evaluate(input string) (ret pyObject, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", r)
+		}
+	}()
+	// The grammar has no standalone expression statements, so we try parsing it as the
+	// right-hand side of an assignment to get at the expression.
+	if stmts, err := s.interpreter.parser.ParseData([]byte("_ = "+input), "<stdin>"); err == nil && len(stmts) == 1 {
+		if ident := stmts[0].Ident; ident != nil && ident.Action != nil && ident.Action.Assign != nil {
+			return s.interpretExpression(ident.Action.Assign), nil
+		}
+	}
+	stmts, err := s.interpreter.parser.ParseData([]byte(input), "<stdin>")
+	if err != nil {
+		return nil, err
+	}
+	return s.interpreter.interpretStatements(s, stmts)
+}
+
+// Source returns the source code of a file being debugged.
+func (d *debugger) Source(filename string) ([]byte, error) {
+	if contents, present := d.interpreter.parser.builtins[filename]; present {
+		return contents, nil
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// Lines returns the source lines around the given position, with the current one marked.
+func (d *debugger) Lines(pos Position, context int) string {
+	data, err := d.Source(pos.Filename)
+	if err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	for i, line := range bytes.Split(data, []byte{'\n'}) {
+		if n := i + 1; n >= pos.Line-context && n <= pos.Line+context {
+			marker := "  "
+			if n == pos.Line {
+				marker = "->"
+			}
+			fmt.Fprintf(&buf, "%4d %s %s\n", n, marker, line)
+		}
+	}
+	return buf.String()
+}
+
+// A terminalDebugger is a debugFrontend that runs interactively in the terminal.
+type terminalDebugger struct {
+	d *debugger
+}
+
+const terminalDebuggerHelp = `Commands:
+  c, continue      Continue until the next breakpoint
+  n, next          Step to the next statement, stepping over function calls
+  s, step          Step to the next statement, stepping into function calls
+  r, return        Continue until the current function returns
+  b, break [f:l]   Set a breakpoint at file:line, or list breakpoints if none given
+  clear f:l        Remove the breakpoint at file:line
+  bt, where        Print the call stack
+  up, down         Move up or down the call stack
+  locals           Print the local variables of the current frame
+  l, list          Print the source code around the current statement
+  p <expr>         Print the value of an expression
+  q, quit          Remove all breakpoints and run to completion
+  h, help          Print this message
+Anything else is evaluated as a statement in the current frame.
+`
+
+func (t *terminalDebugger) Stopped(f *frame, reason string) stepMode {
+	stack := f.Stack()
+	idx := 0
+	fmt.Printf("Stopped at %s (%s) in %s\n%s", f.Pos, reason, f.Name, t.d.Lines(f.Pos, 0))
+	for {
+		current := stack[idx]
+		prompt := promptui.Prompt{Label: "plz debug"}
+		input, err := prompt.Run()
+		if err == io.EOF {
+			return stepContinue
+		} else if err != nil {
+			if err.Error() != "^C" {
+				log.Error("%s", err)
+			}
+			continue
+		}
+		cmd, arg := input, ""
+		if i := strings.IndexByte(input, ' '); i != -1 {
+			cmd, arg = input[:i], strings.TrimSpace(input[i+1:])
+		}
+		switch cmd {
+		case "c", "continue":
+			return stepContinue
+		case "n", "next":
+			return stepOver
+		case "s", "step":
+			return stepIn
+		case "r", "return":
+			return stepOut
+		case "q", "quit":
+			t.d.ClearBreakpoints()
+			return stepContinue
+		case "h", "help":
+			fmt.Print(terminalDebuggerHelp)
+		case "b", "break":
+			if arg == "" {
+				fmt.Println(strings.Join(t.d.Breakpoints(), "\n"))
+			} else if err := t.d.AddBreakpoint(arg); err != nil {
+				log.Error("%s", err)
+			}
+		case "clear":
+			if err := t.d.RemoveBreakpoint(arg); err != nil {
+				log.Error("%s", err)
+			}
+		case "bt", "where":
+			for i, frame := range stack {
+				marker := " "
+				if i == idx {
+					marker = ">"
+				}
+				fmt.Printf("%s %s in %s\n", marker, frame.Pos, frame.Name)
+			}
+		case "up":
+			if idx < len(stack)-1 {
+				idx++
+			}
+			fmt.Printf("%s in %s\n", stack[idx].Pos, stack[idx].Name)
+		case "down":
+			if idx > 0 {
+				idx--
+			}
+			fmt.Printf("%s in %s\n", stack[idx].Pos, stack[idx].Name)
+		case "locals":
+			locals := current.Locals()
+			for _, k := range locals.Keys() {
+				fmt.Printf("%s = %s\n", k, locals[k])
+			}
+		case "l", "list":
+			fmt.Print(t.d.Lines(current.Pos, 5))
+		case "p":
+			t.evaluate(current, arg)
+		default:
+			t.evaluate(current, input)
+		}
+	}
+}
+
+func (t *terminalDebugger) evaluate(f *frame, input string) {
+	if ret, err := f.scope.evaluate(input); err != nil {
+		log.Error("%s", err)
+	} else if ret != nil && ret != None {
+		fmt.Printf("%s\n", ret)
+	}
+}
@@ -0,0 +1,138 @@
+package asp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/rules"
+	"github.com/thought-machine/please/src/core"
+)
+
+const debugTestFile = "src/parse/asp/test_data/debugger/steps.build"
+
+// A stop records where the fake frontend stopped.
+type stop struct {
+	Line   int
+	Reason string
+	Stack  []string
+}
+
+// A fakeFrontend records where it stops and resumes with a predetermined sequence of step modes.
+type fakeFrontend struct {
+	modes []stepMode
+	stops []stop
+	// Called on each stop, if set.
+	inspect func(f *frame)
+}
+
+func (f *fakeFrontend) Stopped(fr *frame, reason string) stepMode {
+	s := stop{Line: fr.Pos.Line, Reason: reason}
+	for _, frame := range fr.Stack() {
+		s.Stack = append(s.Stack, frame.Name)
+	}
+	f.stops = append(f.stops, s)
+	if f.inspect != nil {
+		f.inspect(fr)
+	}
+	if len(f.stops) > len(f.modes) {
+		return stepContinue
+	}
+	return f.modes[len(f.stops)-1]
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	f := debugFile(t, []string{debugTestFile + ":2"}, nil)
+	assert.Equal(t, []stop{
+		{Line: 2, Reason: "breakpoint", Stack: []string{"add", "//test/package:all"}},
+		{Line: 2, Reason: "breakpoint", Stack: []string{"add", "//test/package:all"}},
+	}, f.stops)
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	f := debugFile(t, []string{debugTestFile + ":5"}, nil, stepIn, stepOver, stepOver, stepOver)
+	assert.Equal(t, []stop{
+		{Line: 5, Reason: "breakpoint", Stack: []string{"//test/package:all"}},
+		{Line: 2, Reason: "step", Stack: []string{"add", "//test/package:all"}},
+		{Line: 3, Reason: "step", Stack: []string{"add", "//test/package:all"}},
+		{Line: 6, Reason: "step", Stack: []string{"//test/package:all"}},
+		{Line: 7, Reason: "step", Stack: []string{"//test/package:all"}},
+	}, f.stops)
+}
+
+func TestDebuggerStepOut(t *testing.T) {
+	f := debugFile(t, []string{debugTestFile + ":2"}, nil, stepOut, stepContinue)
+	assert.Equal(t, []stop{
+		{Line: 2, Reason: "breakpoint", Stack: []string{"add", "//test/package:all"}},
+		{Line: 6, Reason: "step", Stack: []string{"//test/package:all"}},
+		{Line: 2, Reason: "breakpoint", Stack: []string{"add", "//test/package:all"}},
+	}, f.stops)
+}
+
+func TestDebuggerVariables(t *testing.T) {
+	calls := 0
+	debugFile(t, []string{debugTestFile + ":3"}, func(f *frame) {
+		if calls++; calls != 2 {
+			return
+		}
+		assert.Equal(t, pyDict{"a": pyInt(3), "b": pyInt(3), "c": pyInt(6)}, f.Locals())
+		ret, err := f.scope.evaluate("a * c")
+		assert.NoError(t, err)
+		assert.Equal(t, pyInt(18), ret)
+		// Statements can be run too, and don't move where we're stopped.
+		_, err = f.scope.evaluate("c = add(c, 1)")
+		assert.NoError(t, err)
+		assert.Equal(t, pyInt(7), f.Locals()["c"])
+		assert.Equal(t, 3, f.Pos.Line)
+		// The caller's frame can see what's been assigned so far.
+		locals := f.Parent.Locals()
+		assert.Equal(t, pyInt(3), locals["x"])
+		_, present := locals["y"]
+		assert.False(t, present)
+	})
+	assert.Equal(t, 2, calls)
+}
+
+func TestParseBreakpoint(t *testing.T) {
+	filename, line, err := parseBreakpoint("src/BUILD:12")
+	assert.NoError(t, err)
+	assert.Equal(t, "src/BUILD", filename)
+	assert.Equal(t, 12, line)
+	_, _, err = parseBreakpoint("src/BUILD")
+	assert.Error(t, err)
+	_, _, err = parseBreakpoint("src/BUILD:wibble")
+	assert.Error(t, err)
+}
+
+// debugFile interprets the debugger test file with the given breakpoints, resuming with the given modes.
+// The given function, if non-nil, is called at each stop.
+func debugFile(t *testing.T, breakpoints []string, inspect func(f *frame), modes ...stepMode) *fakeFrontend {
+	f := &fakeFrontend{modes: modes, inspect: inspect}
+	parser, stmts := newDebugParser(debugTestFile)
+	d := &debugger{
+		interpreter: parser.interpreter,
+		frontend:    f,
+		breakpoints: map[string]map[int]bool{},
+	}
+	for _, bp := range breakpoints {
+		require.NoError(t, d.AddBreakpoint(bp))
+	}
+	parser.interpreter.debugger = d
+	_, err := parser.interpreter.interpretAll(core.NewPackage("test/package"), stmts)
+	require.NoError(t, err)
+	return f
+}
+
+// newDebugParser returns a new parser with builtins loaded, and the parsed statements of the given file.
+func newDebugParser(filename string) (*Parser, []*Statement) {
+	parser := NewParser(core.NewDefaultBuildState())
+	parser.MustLoadBuiltins("builtins.build_defs", nil, rules.MustAsset("builtins.build_defs.gob"))
+	stmts, err := parser.parse(filename)
+	if err != nil {
+		panic(err)
+	}
+	stmts = parser.optimise(stmts)
+	parser.interpreter.optimiseExpressions(stmts)
+	return parser, stmts
+}
@@ -0,0 +1,94 @@
+package asp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A frame is a single level of the call stack, as seen by the debugger and profiler.
+// Frames are only tracked while one of those is enabled.
+type frame struct {
+	ID     int
+	Name   string
+	Parent *frame
+	// The outermost frame of this one's call stack, i.e. the package or callback it's part of.
+	Root  *frame
+	Depth int
+	// Where the function is defined, or the file for an outermost frame.
+	Def Position
+	// The scope that this frame started with, and the one currently executing within it.
+	base, scope *scope
+	// Position of the statement currently being executed.
+	Pos Position
+	// When this frame started and how long has been spent in frames called from it.
+	start     time.Time
+	childTime time.Duration
+}
+
+// enterFrame creates a new frame for a function call, or a new root frame if parent is nil.
+// It returns nil if frames aren't being tracked.
+func (i *interpreter) enterFrame(parent *frame, name string, def Position, s *scope) *frame {
+	if i.debugger == nil && i.profiler == nil {
+		return nil
+	}
+	f := &frame{
+		ID:     int(atomic.AddInt64(&i.lastFrameID, 1)),
+		Name:   name,
+		Parent: parent,
+		Def:    def,
+		base:   s,
+		scope:  s,
+		start:  time.Now(),
+	}
+	if parent != nil {
+		f.Root = parent.Root
+		f.Depth = parent.Depth + 1
+	} else {
+		f.Root = f
+	}
+	s.frame = f
+	return f
+}
+
+// exitFrame is called when a frame finishes executing.
+func (i *interpreter) exitFrame(f *frame) {
+	if i.profiler != nil {
+		i.profiler.Record(f)
+	}
+}
+
+// Stack returns the call stack from this frame, innermost first.
+func (f *frame) Stack() []*frame {
+	ret := []*frame{}
+	for ; f != nil; f = f.Parent {
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// Locals returns the local variables of this frame.
+func (f *frame) Locals() pyDict {
+	return f.variables(f.scope, f.base.parent)
+}
+
+// Globals returns the global variables visible to this frame, excluding the builtins.
+// For the outermost frame they're all locals so this returns nothing.
+func (f *frame) Globals() pyDict {
+	if f.base.parent == nil {
+		return pyDict{}
+	}
+	return f.variables(f.base.parent, f.base.interpreter.scope)
+}
+
+// variables returns the variables visible from the given scope, up to but not including the given ancestor.
+func (f *frame) variables(s, until *scope) pyDict {
+	ret := pyDict{}
+	for ; s != nil && s != until && s != s.interpreter.scope; s = s.parent {
+		for k, v := range s.locals {
+			if _, present := ret[k]; !present && k != "CONFIG" {
+				ret[k] = v
+			}
+		}
+	}
+	return ret
+}
@@ -265,7 +265,7 @@ type Operator rune
 const (
 	// Add etc are arithmetic operators - these are implemented on a per-type basis
 	Add Operator = '+'
-	// Subtract implements binary - (only works on integers)
+	// Subtract implements binary - (only works on integers and sets)
 	Subtract = '-'
 	// Multiply implements multiplication between two types
 	Multiply = '×'
@@ -293,8 +293,10 @@ const (
 	And Operator = '&'
 	// Or implements the or operator
 	Or = '∨'
-	// Union implements the | or binary or operator, which is only used for dict unions.
+	// Union implements the | or binary or operator, which is only used for dict and set unions.
 	Union = '∪'
+	// Intersection implements the & or binary and operator, which is only used for set intersections.
+	Intersection = '∩'
 	// Is implements type identity.
 	Is = '≡'
 	// IsNot is the inverse of Is.
@@ -333,4 +335,5 @@ var operators = map[string]Operator{
 	">=":     GreaterThanOrEqual,
 	"<=":     LessThanOrEqual,
 	"|":      Union,
+	"&":      Intersection,
 }
@@ -233,7 +233,7 @@ func (p *parser) parseFuncDef() *FuncDef {
 		p.next('-')
 		p.next('>')
 
-		tok := p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+		tok := p.oneofval("bool", "str", "int", "list", "dict", "set", "function", "config")
 		fd.Return = tok.Value
 	}
 
@@ -268,7 +268,7 @@ func (p *parser) parseArgument() Argument {
 	if tok.Type == ':' {
 		// Type annotations
 		for {
-			tok = p.oneofval("bool", "str", "int", "list", "dict", "function", "config")
+			tok = p.oneofval("bool", "str", "int", "list", "dict", "set", "function", "config")
 			a.Type = append(a.Type, tok.Value)
 			if !p.optional('|') {
 				break
@@ -12,6 +12,8 @@ import (
 
 // An interpreter holds the package-independent state about our parsing process.
 type interpreter struct {
+	// Used to allocate IDs to debugger & profiler frames. Accessed atomically so needs to be first for alignment.
+	lastFrameID     int64
 	scope           *scope
 	parser          *Parser
 	subincludes     map[string]pyDict
@@ -20,6 +22,9 @@ type interpreter struct {
 	configMutex     sync.RWMutex
 	breakpointMutex sync.Mutex
 	limiter         semaphore
+	// Only set if we're debugging or profiling BUILD file evaluation.
+	debugger *debugger
+	profiler *profiler
 }
 
 // newInterpreter creates and returns a new interpreter instance.
@@ -38,6 +43,12 @@ func newInterpreter(state *core.BuildState, p *Parser) *interpreter {
 	}
 	s.interpreter = i
 	s.LoadSingletons(state)
+	if state.DebugBuildFiles != nil {
+		i.debugger = newDebugger(i, state.DebugBuildFiles)
+	}
+	if state.ProfileBuildFiles != nil {
+		i.profiler = newProfiler()
+	}
 	return i
 }
 
@@ -85,6 +96,9 @@ func (i *interpreter) interpretAll(pkg *core.Package, statements []*Statement) (
 	// mutating operations like .setdefault() otherwise.
 	s.config = i.pkgConfig(pkg).Copy()
 	s.Set("CONFIG", s.config)
+	if f := i.enterFrame(nil, pkg.Label().String(), Position{Filename: pkg.Filename}, s); f != nil {
+		defer i.exitFrame(f)
+	}
 	_, err = i.interpretStatements(s, statements)
 	if err == nil {
 		s.Callback = true // From here on, if anything else uses this scope, it's in a post-build callback.
@@ -108,7 +122,8 @@ func (i *interpreter) interpretStatements(s *scope, statements []*Statement) (re
 }
 
 // Subinclude returns the global values corresponding to subincluding the given file.
-func (i *interpreter) Subinclude(path string, label core.BuildLabel, pkg *core.Package) pyDict {
+// The given scope is the one calling subinclude().
+func (i *interpreter) Subinclude(caller *scope, path string, label core.BuildLabel, pkg *core.Package) pyDict {
 	i.mutex.RLock()
 	globals, present := i.subincludes[path]
 	i.mutex.RUnlock()
@@ -130,6 +145,9 @@ func (i *interpreter) Subinclude(path string, label core.BuildLabel, pkg *core.P
 	// Scope needs a local version of CONFIG
 	s.config = i.scope.config.Copy()
 	s.Set("CONFIG", s.config)
+	if f := i.enterFrame(caller.frame, "subinclude("+label.String()+")", Position{Filename: path}, s); f != nil {
+		defer i.exitFrame(f)
+	}
 	i.optimiseExpressions(stmts)
 	s.interpretStatements(stmts)
 	locals := s.Freeze()
@@ -202,6 +220,8 @@ type scope struct {
 	contextPkg *core.Package
 	// The label that was passed to subinclude(...)
 	subincludeLabel *core.BuildLabel
+	// The debugger's stack frame that this scope is part of. Only set when debugging.
+	frame *frame
 }
 
 // NewScope creates a new child scope of this one.
@@ -220,6 +240,7 @@ func (s *scope) NewPackagedScope(pkg *core.Package) *scope {
 		locals:      pyDict{},
 		config:      s.config,
 		Callback:    s.Callback,
+		frame:       s.frame,
 	}
 	if pkg != nil && pkg.Subrepo != nil && pkg.Subrepo.State != nil {
 		s2.state = pkg.Subrepo.State
@@ -319,6 +340,9 @@ func (s *scope) interpretStatements(statements []*Statement) pyObject {
 		}
 	}()
 	for _, stmt = range statements {
+		if d := s.interpreter.debugger; d != nil {
+			d.Statement(s, stmt)
+		}
 		if stmt.FuncDef != nil {
 			s.Set(stmt.FuncDef.Name, newPyFunc(s, stmt.FuncDef))
 		} else if stmt.If != nil {
@@ -690,16 +714,19 @@ func (s *scope) unpackNames(names []string, obj pyObject) {
 	}
 }
 
-// iterate returns the result of the given expression as a pyList, which is our only iterable type.
+// iterate returns the result of the given expression as a pyList.
+// Sets are also iterable, in which case they're converted to a list in sorted order.
 func (s *scope) iterate(expr *Expression) pyList {
 	o := s.interpretExpression(expr)
 	l, ok := o.(pyList)
 	if !ok {
 		if l, ok := o.(pyFrozenList); ok {
 			return l.pyList
+		} else if set, ok := asSet(o); ok {
+			return set.Items()
 		}
 	}
-	s.Assert(ok, "Non-iterable type %s; must be a list", o.Type())
+	s.Assert(ok, "Non-iterable type %s; must be a list or set", o.Type())
 	return l
 }
 
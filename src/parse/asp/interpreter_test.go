@@ -267,7 +267,7 @@ func TestInterpreterSubincludeConfig(t *testing.T) {
 	s, err := parseFile("src/parse/asp/test_data/interpreter/partition.build")
 	assert.NoError(t, err)
 	pkg := core.NewPackage("test")
-	s.SetAll(s.interpreter.Subinclude("src/parse/asp/test_data/interpreter/subinclude_config.build", pkg.Label(), pkg), false)
+	s.SetAll(s.interpreter.Subinclude(s, "src/parse/asp/test_data/interpreter/subinclude_config.build", pkg.Label(), pkg), false)
 	assert.EqualValues(t, "test test", s.config.Get("test", None))
 }
 
@@ -362,3 +362,53 @@ func TestFStringOptimisation(t *testing.T) {
 	assert.NotNil(t, assign.Optimised.Constant)
 	assert.EqualValues(t, "test", assign.Optimised.Constant)
 }
+
+func TestSets(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/sets.build")
+	require.NoError(t, err)
+	set := func(items ...pyObject) pySet { return newPySet(items) }
+	abc := set(pyString("a"), pyString("b"), pyString("c"))
+	assert.EqualValues(t, abc, s.Lookup("a"))
+	assert.EqualValues(t, pyFrozenSet{set(pyString("b"), pyString("c"), pyString("d"))}, s.Lookup("b"))
+	assert.EqualValues(t, set(pyString("a"), pyString("b"), pyString("c"), pyString("d")), s.Lookup("union"))
+	assert.EqualValues(t, set(pyString("b"), pyString("c")), s.Lookup("intersection"))
+	assert.EqualValues(t, set(pyString("a")), s.Lookup("difference"))
+	assert.EqualValues(t, pyList{
+		set(pyString("a"), pyString("b"), pyString("c"), pyString("e")),
+		set(pyString("b"), pyString("c")),
+		set(pyString("b"), pyString("c")),
+	}, s.Lookup("methods"))
+	assert.EqualValues(t, pyList{True, True, False, True, True, False}, s.Lookup("subset"))
+	assert.EqualValues(t, pyList{True, False, True, False}, s.Lookup("contains"))
+	assert.EqualValues(t, pyList{pyInt(2), pyInt(3), pyInt(4)}, s.Lookup("iterated"))
+	assert.EqualValues(t, 3, s.Lookup("length"))
+	assert.EqualValues(t, pyList{True, True, True, False}, s.Lookup("is_set"))
+	assert.EqualValues(t, pyList{pyString(`{"a", "b", "c"}`), pyString("set()")}, s.Lookup("as_str"))
+	assert.EqualValues(t, `["a","b","c"]`, s.Lookup("as_json"))
+	assert.EqualValues(t, pyList{pyInt(2), pyInt(3), pyInt(4)}, s.Lookup("sorted_set"))
+}
+
+func TestFrozenSet(t *testing.T) {
+	_, err := parseFile("src/parse/asp/test_data/interpreter/frozenset.build")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "set is immutable")
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	s, err := parseFile("src/parse/asp/test_data/interpreter/builtin_functions.build")
+	require.NoError(t, err)
+	assert.EqualValues(t, pyList{True, False, True, False, False, True}, s.Lookup("any_all"))
+	assert.EqualValues(t, pyList{pyInt(1), pyInt(1), pyString("a")}, s.Lookup("minimum"))
+	assert.EqualValues(t, pyList{pyInt(3), pyInt(3), pyString("b")}, s.Lookup("maximum"))
+	assert.EqualValues(t, pyList{pyInt(6), pyInt(16), pyList{pyInt(1), pyInt(2)}}, s.Lookup("total"))
+	assert.EqualValues(t, pyList{pyInt(3), pyInt(2), pyInt(1)}, s.Lookup("reverse"))
+	assert.EqualValues(t, pyList{
+		pyList{pyInt(1), pyInt(3)},
+		pyList{pyInt(1), pyString("a")},
+	}, s.Lookup("filtered"))
+	assert.EqualValues(t, pyList{
+		pyList{pyInt(2), pyInt(4)},
+		pyList{pyString("A"), pyString("B")},
+	}, s.Lookup("mapped"))
+	assert.EqualValues(t, pyList{pyInt(5), pyInt(1), True, False}, s.Lookup("hashes"))
+}
@@ -1,6 +1,7 @@
 package asp
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"sort"
@@ -517,6 +518,200 @@ func (d pyFrozenDict) IndexAssign(index, value pyObject) {
 	panic("dict is immutable")
 }
 
+// A pySet is an unordered collection of distinct objects.
+// Only hashable objects (strings, ints, bools and None) can be members. It's always
+// iterated in sorted order so that the results are deterministic.
+type pySet map[pyObject]struct{}
+
+// isHashable returns true if the given object can be a member of a set.
+func isHashable(obj pyObject) bool {
+	switch obj.(type) {
+	case pyString, pyInt, pyBool, pyNone:
+		return true
+	}
+	return false
+}
+
+// newPySet creates a new set from the given items.
+func newPySet(items pyList) pySet {
+	s := make(pySet, len(items))
+	for _, item := range items {
+		s.Add(item)
+	}
+	return s
+}
+
+func (s pySet) Type() string {
+	return "set"
+}
+
+func (s pySet) IsTruthy() bool {
+	return len(s) > 0
+}
+
+func (s pySet) Property(name string) pyObject {
+	if prop, present := setMethods[name]; present {
+		return prop.Member(s)
+	}
+	panic("set object has no property " + name)
+}
+
+func (s pySet) Operator(operator Operator, operand pyObject) pyObject {
+	if operator == In || operator == NotIn {
+		if !isHashable(operand) {
+			return newPyBool(operator == NotIn)
+		}
+		_, present := s[operand]
+		return newPyBool(present == (operator == In))
+	}
+	s2, ok := asSet(operand)
+	if !ok {
+		panic("Cannot operate on set and " + operand.Type())
+	}
+	switch operator {
+	case Union:
+		return s.Union(s2)
+	case Intersection:
+		return s.Intersection(s2)
+	case Subtract:
+		return s.Difference(s2)
+	case LessThanOrEqual:
+		return newPyBool(s.IsSubset(s2))
+	case LessThan:
+		return newPyBool(len(s) < len(s2) && s.IsSubset(s2))
+	case GreaterThanOrEqual:
+		return newPyBool(s2.IsSubset(s))
+	case GreaterThan:
+		return newPyBool(len(s) > len(s2) && s2.IsSubset(s))
+	}
+	panic("Unsupported operator on set: " + operator.String())
+}
+
+func (s pySet) IndexAssign(index, value pyObject) {
+	panic("set type is not indexable")
+}
+
+func (s pySet) String() string {
+	if len(s) == 0 {
+		return "set()"
+	}
+	items := s.Items()
+	strs := make([]string, len(items))
+	for i, item := range items {
+		if str, ok := item.(pyString); ok {
+			strs[i] = strconv.Quote(string(str))
+		} else {
+			strs[i] = item.String()
+		}
+	}
+	return "{" + strings.Join(strs, ", ") + "}"
+}
+
+func (s pySet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Items())
+}
+
+// Add adds an item to this set.
+func (s pySet) Add(item pyObject) {
+	if !isHashable(item) {
+		panic("unhashable type: " + item.Type())
+	}
+	s[item] = struct{}{}
+}
+
+// Items returns the contents of this set as a list, in sorted order.
+func (s pySet) Items() pyList {
+	ret := make(pyList, 0, len(s))
+	for item := range s {
+		ret = append(ret, item)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if ta, tb := a.Type(), b.Type(); ta != tb {
+			return ta < tb
+		}
+		switch a := a.(type) {
+		case pyString:
+			return a < b.(pyString)
+		case pyInt:
+			return a < b.(pyInt)
+		case pyBool:
+			return !bool(a) && bool(b.(pyBool))
+		}
+		return false
+	})
+	return ret
+}
+
+// Copy creates a shallow duplicate of this set.
+func (s pySet) Copy() pySet {
+	ret := make(pySet, len(s))
+	for item := range s {
+		ret[item] = struct{}{}
+	}
+	return ret
+}
+
+// Union returns a new set containing all the items in either this set or the other.
+func (s pySet) Union(other pySet) pySet {
+	ret := s.Copy()
+	for item := range other {
+		ret[item] = struct{}{}
+	}
+	return ret
+}
+
+// Intersection returns a new set containing the items that are in both this set and the other.
+func (s pySet) Intersection(other pySet) pySet {
+	ret := pySet{}
+	for item := range s {
+		if _, present := other[item]; present {
+			ret[item] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// Difference returns a new set containing the items in this set that aren't in the other.
+func (s pySet) Difference(other pySet) pySet {
+	ret := pySet{}
+	for item := range s {
+		if _, present := other[item]; !present {
+			ret[item] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// IsSubset returns true if every item in this set is also in the other.
+func (s pySet) IsSubset(other pySet) bool {
+	for item := range s {
+		if _, present := other[item]; !present {
+			return false
+		}
+	}
+	return true
+}
+
+// Freeze freezes this set for further updates.
+// Note that this is a "soft" freeze; callers holding the original unfrozen
+// reference can still modify it.
+func (s pySet) Freeze() pyObject {
+	return pyFrozenSet{pySet: s}
+}
+
+// A pyFrozenSet implements an immutable set.
+// Unlike Python it has the same type as a normal set; as with lists and dicts, the difference
+// is only whether it can be modified.
+type pyFrozenSet struct{ pySet }
+
+func (s pyFrozenSet) Property(name string) pyObject {
+	if name == "add" || name == "discard" {
+		panic("set is immutable")
+	}
+	return s.pySet.Property(name)
+}
+
 type pyFunc struct {
 	name       string
 	docstring  string
@@ -604,8 +799,19 @@ func (f *pyFunc) String() string {
 	return fmt.Sprintf("<function %s>", f.name)
 }
 
+// pos returns the position where this function is defined, as near as we can tell.
+func (f *pyFunc) pos() Position {
+	if len(f.code) == 0 {
+		return Position{}
+	}
+	return f.code[0].Pos
+}
+
 func (f *pyFunc) Call(s *scope, c *Call) pyObject {
 	if f.nativeCode != nil {
+		if p := s.interpreter.profiler; p != nil {
+			defer p.Native(s.frame, f.name)()
+		}
 		if f.kwargs {
 			return f.callNative(s.NewScope(), c)
 		}
@@ -615,6 +821,9 @@ func (f *pyFunc) Call(s *scope, c *Call) pyObject {
 	s2.config = s.config
 	s2.Set("CONFIG", s.config) // This needs to be copied across too :(
 	s2.Callback = s.Callback
+	if fr := s.interpreter.enterFrame(s.frame, f.name, f.pos(), s2); fr != nil {
+		defer s.interpreter.exitFrame(fr)
+	}
 	// Handle implicit 'self' parameter for bound functions.
 	args := c.Arguments
 	if f.self != nil {
@@ -6,7 +6,9 @@ package asp
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -40,6 +42,8 @@ type Parser struct {
 	builtins map[string][]byte
 	// Parallelism limiter to ensure we don't try to run too many parses simultaneously
 	limiter semaphore
+	// Cache of previously parsed files. May be nil if they aren't being cached.
+	cache *parseCache
 }
 
 // NewParser creates a new parser instance. One is normally sufficient for a process lifetime.
@@ -47,6 +51,7 @@ func NewParser(state *core.BuildState) *Parser {
 	p := newParser()
 	p.interpreter = newInterpreter(state, p)
 	p.limiter = p.interpreter.limiter
+	p.cache = newParseCache(state.Config.Parse.CacheDir)
 	return p
 }
 
@@ -86,6 +91,17 @@ func (p *Parser) MustLoadBuiltins(filename string, contents, encoded []byte) {
 	}
 }
 
+// WriteProfile writes the profile of evaluating BUILD files, in either pprof or trace format.
+// Profiling must have been enabled in the state the parser was created with.
+func (p *Parser) WriteProfile(w io.Writer, format string) error {
+	if p.interpreter.profiler == nil {
+		return fmt.Errorf("Profiling of BUILD files is not enabled")
+	} else if format == "trace" {
+		return p.interpreter.profiler.WriteTrace(w)
+	}
+	return p.interpreter.profiler.WritePprof(w)
+}
+
 // ParseFile parses the contents of a single file in the BUILD language.
 // It returns true if the call was deferred at some point awaiting  target to build,
 // along with any error encountered.
@@ -164,7 +180,11 @@ func (p *Parser) ParseFileOnly(filename string) ([]*Statement, error) {
 }
 
 // parse reads the given file and parses it into a set of statements.
+// If the same contents have been parsed before, the previous result is reused.
 func (p *Parser) parse(filename string) ([]*Statement, error) {
+	if p.cache != nil {
+		return p.parseCached(filename)
+	}
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -178,6 +198,21 @@ func (p *Parser) parse(filename string) ([]*Statement, error) {
 	return stmts, err
 }
 
+// parseCached is like parse but checks the cache first, and stores anything it parses.
+func (p *Parser) parseCached(filename string) ([]*Statement, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	} else if stmts := p.cache.Get(filename, contents); stmts != nil {
+		return stmts, nil
+	}
+	stmts, err := p.ParseData(contents, filename)
+	if err == nil {
+		p.cache.Store(filename, contents, stmts)
+	}
+	return stmts, err
+}
+
 // ParseData reads the given byteslice and parses it into a set of statements.
 // The 'filename' argument is only used in case of errors so doesn't necessarily have to correspond to a real file.
 func (p *Parser) ParseData(data []byte, filename string) ([]*Statement, error) {
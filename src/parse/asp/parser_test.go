@@ -1,11 +1,16 @@
 package asp
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
 )
 
 func TestParseBasic(t *testing.T) {
@@ -805,3 +810,61 @@ func TestFStringIncompleteError(t *testing.T) {
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "Unterminated brace in fstring")
 }
+
+func TestParseCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"basic", "example", "function_def", "fstring", "comprehension", "for_statement", "if_statement", "operators", "inline_if", "unary_op"} {
+		filename := "src/parse/asp/test_data/" + name + ".build"
+		expected, err := newParser().parse(filename)
+		require.NoError(t, err)
+		p := newParser()
+		p.cache = newParseCache(dir)
+		stored, err := p.parse(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, stored, filename)
+		contents, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, expected, p.cache.Get(filename, contents), filename)
+	}
+}
+
+func TestParseCacheIdenticalFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	contents, err := ioutil.ReadFile("src/parse/asp/test_data/basic.build")
+	require.NoError(t, err)
+	filename1 := path.Join(dir, "pkg1", "BUILD")
+	filename2 := path.Join(dir, "pkg2", "BUILD")
+	for _, filename := range []string{filename1, filename2} {
+		require.NoError(t, os.MkdirAll(path.Dir(filename), 0755))
+		require.NoError(t, ioutil.WriteFile(filename, contents, 0644))
+	}
+	p := newParser()
+	p.cache = newParseCache(path.Join(dir, "cache"))
+	stmts1, err := p.parse(filename1)
+	require.NoError(t, err)
+	stmts2, err := p.parse(filename2)
+	require.NoError(t, err)
+	assert.Equal(t, filename1, stmts1[0].Pos.Filename)
+	assert.Equal(t, filename2, stmts2[0].Pos.Filename)
+	// Check it again now they're both in the cache.
+	stmts1, err = p.parse(filename1)
+	require.NoError(t, err)
+	assert.Equal(t, filename1, stmts1[0].Pos.Filename)
+}
+
+func TestParseCachePrunesOtherVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parse_cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"15.0.0/ab", core.PleaseVersion.String() + "/ab", "not_a_version"} {
+		require.NoError(t, os.MkdirAll(path.Join(dir, name), 0755))
+	}
+	newParseCache(dir)
+	assert.False(t, core.PathExists(path.Join(dir, "15.0.0")))
+	assert.True(t, core.PathExists(path.Join(dir, core.PleaseVersion.String(), "ab")))
+	assert.True(t, core.PathExists(path.Join(dir, "not_a_version")))
+}
@@ -0,0 +1,298 @@
+package asp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// defaultMinTraceDuration is the shortest call we write into trace output.
+// Without a cutoff the trace can get unmanageably large since there are typically a lot of
+// very quick calls to things like len().
+const defaultMinTraceDuration = 10 * time.Microsecond
+
+// A profiler records where time is spent evaluating BUILD files.
+// It attributes time to each call stack of BUILD files, functions and native builtins.
+type profiler struct {
+	start            time.Time
+	minTraceDuration time.Duration
+	mutex            sync.Mutex
+	samples          map[string]*profileSample
+	events           []traceEvent
+}
+
+// A profileLocation identifies a single function (or file) in the profile.
+type profileLocation struct {
+	Name     string
+	Filename string
+	Line     int
+}
+
+// A profileSample aggregates all calls that had the same call stack.
+type profileSample struct {
+	Stack []profileLocation // Innermost first
+	Calls int64
+	// Time spent in this call, excluding anything it called.
+	Self time.Duration
+}
+
+// A traceEvent is a single event in Chrome's trace format.
+type traceEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"` // in microseconds
+	Duration int64             `json:"dur,omitempty"`
+	PID      int               `json:"pid"`
+	TID      int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// newProfiler creates a new profiler.
+func newProfiler() *profiler {
+	return &profiler{
+		start:            time.Now(),
+		minTraceDuration: defaultMinTraceDuration,
+		samples:          map[string]*profileSample{},
+	}
+}
+
+// Record records a frame that has just finished executing.
+func (p *profiler) Record(f *frame) {
+	elapsed := time.Since(f.start)
+	if f.Parent != nil {
+		f.Parent.childTime += elapsed
+	}
+	category := "function"
+	if f.Def.Line == 0 {
+		category = "file" // A BUILD file or subinclude
+	}
+	p.record(f.location(), f.Parent, f.Root.ID, category, f.start, elapsed, elapsed-f.childTime)
+	if f.Root == f {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.events = append(p.events, traceEvent{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   1,
+			TID:   f.ID,
+			Args:  map[string]string{"name": f.Name},
+		})
+	}
+}
+
+// Native is called when a call to a native builtin begins. It returns a function that should be
+// called when it finishes.
+func (p *profiler) Native(parent *frame, name string) func() {
+	start := time.Now()
+	var before time.Duration
+	tid := 0
+	if parent != nil {
+		before = parent.childTime
+		tid = parent.Root.ID
+	}
+	return func() {
+		elapsed := time.Since(start)
+		self := elapsed
+		if parent != nil {
+			// Natives don't get their own frames, so anything they call (e.g. a function passed to map())
+			// attributes its time to the parent; we need to undo that here.
+			self -= parent.childTime - before
+			parent.childTime = before + elapsed
+		}
+		p.record(profileLocation{Name: name}, parent, tid, "builtin", start, elapsed, self)
+	}
+}
+
+// record records a single call.
+func (p *profiler) record(loc profileLocation, parent *frame, tid int, category string, start time.Time, elapsed, self time.Duration) {
+	if self < 0 {
+		self = 0
+	}
+	stack := []profileLocation{loc}
+	for f := parent; f != nil; f = f.Parent {
+		stack = append(stack, f.location())
+	}
+	key := profileKey(stack)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sample, present := p.samples[key]
+	if !present {
+		sample = &profileSample{Stack: stack}
+		p.samples[key] = sample
+	}
+	sample.Calls++
+	sample.Self += self
+	if elapsed >= p.minTraceDuration {
+		p.events = append(p.events, traceEvent{
+			Name:     loc.Name,
+			Category: category,
+			Phase:    "X",
+			Time:     int64(start.Sub(p.start) / time.Microsecond),
+			Duration: int64(elapsed / time.Microsecond),
+			PID:      1,
+			TID:      tid,
+		})
+	}
+}
+
+// location returns the profile location for a frame.
+func (f *frame) location() profileLocation {
+	return profileLocation{Name: f.Name, Filename: f.Def.Filename, Line: f.Def.Line}
+}
+
+// profileKey returns a key uniquely identifying a call stack.
+func profileKey(stack []profileLocation) string {
+	var b strings.Builder
+	for _, loc := range stack {
+		b.WriteString(loc.Name)
+		b.WriteByte(0)
+		b.WriteString(loc.Filename)
+		b.WriteByte(0)
+		b.WriteString(strconv.Itoa(loc.Line))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// Samples returns all the samples recorded so far, sorted by call stack.
+func (p *profiler) Samples() []*profileSample {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]*profileSample, len(keys))
+	for i, k := range keys {
+		ret[i] = p.samples[k]
+	}
+	return ret
+}
+
+// WriteTrace writes the profile out in Chrome's trace format.
+func (p *profiler) WriteTrace(w io.Writer) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b := bufio.NewWriter(w)
+	b.WriteString("[\n")
+	for i, event := range p.events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		b.Write(data)
+	}
+	b.WriteString("\n]\n")
+	return b.Flush()
+}
+
+// WritePprof writes the profile out in pprof's format, which is a gzipped protobuf.
+// See https://github.com/google/pprof/blob/master/proto/profile.proto for the schema.
+func (p *profiler) WritePprof(w io.Writer) error {
+	samples := p.Samples()
+	strs := map[string]int{}
+	strTable := []string{}
+	str := func(s string) uint64 {
+		idx, present := strs[s]
+		if !present {
+			idx = len(strTable)
+			strs[s] = idx
+			strTable = append(strTable, s)
+		}
+		return uint64(idx)
+	}
+	str("") // The first entry must always be the empty string.
+	valueType := func(typ, unit string) []byte {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, str(typ))
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		return protowire.AppendVarint(b, str(unit))
+	}
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.BytesType) // sample_type
+	out = protowire.AppendBytes(out, valueType("calls", "count"))
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	out = protowire.AppendBytes(out, valueType("wall", "nanoseconds"))
+
+	// Each distinct location gets one function and one location entry, with the same ID.
+	locations := map[profileLocation]uint64{}
+	var locs, funcs []byte
+	locationID := func(loc profileLocation) uint64 {
+		if id, present := locations[loc]; present {
+			return id
+		}
+		id := uint64(len(locations) + 1)
+		locations[loc] = id
+		var fn []byte
+		fn = protowire.AppendTag(fn, 1, protowire.VarintType) // id
+		fn = protowire.AppendVarint(fn, id)
+		fn = protowire.AppendTag(fn, 2, protowire.VarintType) // name
+		fn = protowire.AppendVarint(fn, str(loc.Name))
+		fn = protowire.AppendTag(fn, 4, protowire.VarintType) // filename
+		fn = protowire.AppendVarint(fn, str(loc.Filename))
+		fn = protowire.AppendTag(fn, 5, protowire.VarintType) // start_line
+		fn = protowire.AppendVarint(fn, uint64(loc.Line))
+		funcs = protowire.AppendTag(funcs, 5, protowire.BytesType)
+		funcs = protowire.AppendBytes(funcs, fn)
+
+		var line []byte
+		line = protowire.AppendTag(line, 1, protowire.VarintType) // function_id
+		line = protowire.AppendVarint(line, id)
+		line = protowire.AppendTag(line, 2, protowire.VarintType) // line
+		line = protowire.AppendVarint(line, uint64(loc.Line))
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.VarintType) // id
+		l = protowire.AppendVarint(l, id)
+		l = protowire.AppendTag(l, 4, protowire.BytesType) // line
+		l = protowire.AppendBytes(l, line)
+		locs = protowire.AppendTag(locs, 4, protowire.BytesType)
+		locs = protowire.AppendBytes(locs, l)
+		return id
+	}
+	for _, sample := range samples {
+		var ids, values, s []byte
+		for _, loc := range sample.Stack {
+			ids = protowire.AppendVarint(ids, locationID(loc))
+		}
+		values = protowire.AppendVarint(values, uint64(sample.Calls))
+		values = protowire.AppendVarint(values, uint64(sample.Self))
+		s = protowire.AppendTag(s, 1, protowire.BytesType) // location_id, packed
+		s = protowire.AppendBytes(s, ids)
+		s = protowire.AppendTag(s, 2, protowire.BytesType) // value, packed
+		s = protowire.AppendBytes(s, values)
+		out = protowire.AppendTag(out, 2, protowire.BytesType)
+		out = protowire.AppendBytes(out, s)
+	}
+	out = append(out, locs...)
+	out = append(out, funcs...)
+	out = protowire.AppendTag(out, 9, protowire.VarintType) // time_nanos
+	out = protowire.AppendVarint(out, uint64(p.start.UnixNano()))
+	out = protowire.AppendTag(out, 10, protowire.VarintType) // duration_nanos
+	out = protowire.AppendVarint(out, uint64(time.Since(p.start)))
+	out = protowire.AppendTag(out, 14, protowire.VarintType) // default_sample_type
+	out = protowire.AppendVarint(out, str("wall"))
+	// The string table has to go last since everything else adds to it.
+	for _, s := range strTable {
+		out = protowire.AppendTag(out, 6, protowire.BytesType)
+		out = protowire.AppendString(out, s)
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out); err != nil {
+		return err
+	}
+	return zw.Close()
+}
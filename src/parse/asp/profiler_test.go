@@ -0,0 +1,104 @@
+package asp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+const profileTestFile = "src/parse/asp/test_data/profiler/profile.build"
+
+func TestProfilerSamples(t *testing.T) {
+	p := profileFile(t)
+	calls := map[string]int64{}
+	for _, sample := range p.Samples() {
+		names := ""
+		for i := len(sample.Stack) - 1; i >= 0; i-- {
+			names += "/" + sample.Stack[i].Name
+		}
+		calls[names] = sample.Calls
+		assert.True(t, sample.Self >= 0)
+	}
+	assert.Equal(t, map[string]int64{
+		"/" + testPackageLabel:                     1,
+		"/" + testPackageLabel + "/doubles":        1,
+		"/" + testPackageLabel + "/doubles/double": 3,
+		"/" + testPackageLabel + "/len":            1,
+	}, calls)
+	for _, sample := range p.Samples() {
+		if sample.Stack[0].Name == "double" {
+			assert.Equal(t, profileLocation{Name: "double", Filename: profileTestFile, Line: 2}, sample.Stack[0])
+		}
+	}
+}
+
+func TestProfilerWriteTrace(t *testing.T) {
+	p := profileFile(t)
+	var buf bytes.Buffer
+	require.NoError(t, p.WriteTrace(&buf))
+	events := []traceEvent{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &events))
+	names := map[string]int{}
+	for _, event := range events {
+		if event.Phase == "X" {
+			names[event.Name]++
+		}
+	}
+	assert.Equal(t, map[string]int{testPackageLabel: 1, "doubles": 1, "double": 3, "len": 1}, names)
+}
+
+func TestProfilerWritePprof(t *testing.T) {
+	p := profileFile(t)
+	var buf bytes.Buffer
+	require.NoError(t, p.WritePprof(&buf))
+	r, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	// Decode just enough of the message to check it looks sensible.
+	fields := map[protowire.Number]int{}
+	strs := []string{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		require.True(t, n > 0)
+		data = data[n:]
+		fields[num]++
+		if num == 6 {
+			s, n := protowire.ConsumeString(data)
+			strs = append(strs, s)
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		require.True(t, n > 0)
+		data = data[n:]
+	}
+	assert.Equal(t, 2, fields[1]) // sample_type
+	assert.Equal(t, 4, fields[2]) // sample
+	assert.Equal(t, 4, fields[4]) // location
+	assert.Equal(t, 4, fields[5]) // function
+	assert.Equal(t, "", strs[0])
+	assert.Contains(t, strs, "double")
+	assert.Contains(t, strs, "wall")
+}
+
+const testPackageLabel = "//test/package:all"
+
+// profileFile interprets the profiler test file and returns the profiler afterwards.
+func profileFile(t *testing.T) *profiler {
+	parser, stmts := newDebugParser(profileTestFile)
+	p := newProfiler()
+	p.minTraceDuration = 0
+	parser.interpreter.profiler = p
+	_, err := parser.interpreter.interpretAll(core.NewPackage("test/package"), stmts)
+	require.NoError(t, err)
+	return p
+}
@@ -64,6 +64,8 @@ const (
 	entryPointsArgIdx
 	envArgIdx
 	fileContentArgIdx
+	remotePlatformArgIdx
+	urlHeadersArgIdx
 )
 
 // createTarget creates a new build target as part of build_rule().
@@ -229,6 +231,8 @@ func populateTarget(s *scope, t *core.BuildTarget, args []pyObject) {
 	})
 	addEntryPoints(s, args[entryPointsArgIdx], t)
 	addEnv(s, args[envArgIdx], t)
+	addRemotePlatform(s, args[remotePlatformArgIdx], t)
+	addURLHeaders(s, args[urlHeadersArgIdx], t)
 	addMaybeNamedSecret(s, "secrets", args[secretsBuildRuleArgIdx], t.AddSecret, t.AddNamedSecret, t, true)
 	addProvides(s, "provides", args[providesBuildRuleArgIdx], t)
 	if f := callbackFunction(s, "pre_build", args[preBuildBuildRuleArgIdx], 1, "argument"); f != nil {
@@ -270,6 +274,39 @@ func addEnv(s *scope, arg pyObject, target *core.BuildTarget) {
 	target.Env = env
 }
 
+// addRemotePlatform adds remote execution platform properties to a target
+func addRemotePlatform(s *scope, arg pyObject, target *core.BuildTarget) {
+	platformPy, ok := asDict(arg)
+	s.Assert(ok, "remote_platform must be a dict")
+	if len(platformPy) == 0 {
+		return
+	}
+	platform := make(map[string]string, len(platformPy))
+	for name, val := range platformPy {
+		v, ok := val.(pyString)
+		s.Assert(ok, "Values of remote_platform must be strings, found %v at key %v", val.Type(), name)
+		platform[name] = string(v)
+	}
+	target.RemotePlatform = platform
+}
+
+// addURLHeaders adds HTTP headers to send when fetching a remote file
+func addURLHeaders(s *scope, arg pyObject, target *core.BuildTarget) {
+	headersPy, ok := asDict(arg)
+	s.Assert(ok, "_url_headers must be a dict")
+	if len(headersPy) == 0 {
+		return
+	}
+	s.Assert(target.IsRemoteFile, "_url_headers can only be given for remote files")
+	headers := make(map[string]string, len(headersPy))
+	for name, val := range headersPy {
+		v, ok := val.(pyString)
+		s.Assert(ok, "Values of _url_headers must be strings, found %v at key %v", val.Type(), name)
+		headers[name] = string(v)
+	}
+	target.URLHeaders = headers
+}
+
 // addMaybeNamed adds inputs to a target, possibly in named groups.
 func addMaybeNamed(s *scope, name string, obj pyObject, anon func(core.BuildInput), named func(string, core.BuildInput), systemAllowed, tool bool) {
 	if obj == nil {
@@ -526,6 +563,9 @@ func (f *preBuildFunction) Call(target *core.BuildTarget) error {
 	s := f.f.scope.NewPackagedScope(f.f.scope.state.Graph.PackageOrDie(target.Label))
 	s.Callback = true
 	s.Set(f.f.args[0], pyString(target.Label.Name))
+	if fr := s.interpreter.enterFrame(nil, "pre_build("+target.Label.String()+")", f.f.pos(), s); fr != nil {
+		defer s.interpreter.exitFrame(fr)
+	}
 	_, err := s.interpreter.interpretStatements(s, f.f.code)
 	return annotateCallbackError(s, target, err)
 }
@@ -545,6 +585,9 @@ func (f *postBuildFunction) Call(target *core.BuildTarget, output string) error
 	s.Callback = true
 	s.Set(f.f.args[0], pyString(target.Label.Name))
 	s.Set(f.f.args[1], fromStringList(strings.Split(strings.TrimSpace(output), "\n")))
+	if fr := s.interpreter.enterFrame(nil, "post_build("+target.Label.String()+")", f.f.pos(), s); fr != nil {
+		defer s.interpreter.exitFrame(fr)
+	}
 	_, err := s.interpreter.interpretStatements(s, f.f.code)
 	return annotateCallbackError(s, target, err)
 }
@@ -584,6 +627,16 @@ func asDict(obj pyObject) (pyDict, bool) {
 	return nil, false
 }
 
+// asSet converts an object to a pySet, accounting for frozen sets.
+func asSet(obj pyObject) (pySet, bool) {
+	if s, ok := obj.(pySet); ok {
+		return s, true
+	} else if s, ok := obj.(pyFrozenSet); ok {
+		return s.pySet, true
+	}
+	return nil, false
+}
+
 // asString converts an object to a pyString
 func asString(obj pyObject) (pyString, bool) {
 	if s, ok := obj.(pyString); ok {
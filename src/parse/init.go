@@ -23,6 +23,23 @@ func InitParser(state *core.BuildState) {
 	}
 }
 
+// WriteProfile writes out the profile of evaluating BUILD files, if that was enabled.
+func WriteProfile(state *core.BuildState) {
+	p, ok := state.Parser.(*aspParser)
+	if !ok || state.ProfileBuildFiles == nil {
+		return
+	}
+	f, err := os.Create(state.ProfileBuildFiles.Filename)
+	if err != nil {
+		log.Error("Failed to create parse profile: %s", err)
+		return
+	}
+	defer f.Close()
+	if err := p.asp.WriteProfile(f, state.ProfileBuildFiles.Format); err != nil {
+		log.Error("Failed to write parse profile: %s", err)
+	}
+}
+
 // An aspParser implements the core.Parser interface around our asp package.
 type aspParser struct {
 	asp *asp.Parser
@@ -123,7 +140,7 @@ func (p *aspParser) runBuildFunction(tid int, state *core.BuildState, target *co
 
 func createBazelSubrepo(state *core.BuildState) {
 	dir := path.Join(core.OutDir, "bazel_tools")
-	state.Graph.AddSubrepo(&core.Subrepo{
+	state.Graph.MaybeAddSubrepo(&core.Subrepo{
 		Name:  "bazel_tools",
 		Root:  dir,
 		State: state,
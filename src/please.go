@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/thought-machine/go-flags"
 	"gopkg.in/op/go-logging.v1"
@@ -22,6 +23,7 @@ import (
 	"github.com/thought-machine/please/src/clean"
 	"github.com/thought-machine/please/src/cli"
 	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/daemon"
 	"github.com/thought-machine/please/src/export"
 	"github.com/thought-machine/please/src/format"
 	"github.com/thought-machine/please/src/fs"
@@ -29,10 +31,12 @@ import (
 	"github.com/thought-machine/please/src/generate"
 	"github.com/thought-machine/please/src/hashes"
 	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/lint"
 	"github.com/thought-machine/please/src/output"
 	"github.com/thought-machine/please/src/plz"
 	"github.com/thought-machine/please/src/plzinit"
 	"github.com/thought-machine/please/src/query"
+	"github.com/thought-machine/please/src/remote"
 	"github.com/thought-machine/please/src/run"
 	"github.com/thought-machine/please/src/scm"
 	"github.com/thought-machine/please/src/test"
@@ -71,6 +75,8 @@ var opts struct {
 		Colour            bool          `long:"colour" description:"Forces coloured output from logging & other shell output."`
 		NoColour          bool          `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
 		TraceFile         cli.Filepath  `long:"trace_file" description:"File to write Chrome tracing output into"`
+		EventFile         cli.Filepath  `long:"event_file" description:"File to write a stream of structured build events into"`
+		EventFormat       string        `long:"event_format" choice:"json" choice:"proto" default:"json" description:"Format to write build events in; either JSON lines or length-delimited protobufs"`
 		ShowAllOutput     bool          `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
 		CompletionScript  bool          `long:"completion_script" description:"Prints the bash / zsh completion script to stdout"`
 	} `group:"Options controlling output & logging"`
@@ -81,8 +87,17 @@ var opts struct {
 		NoLock             bool    `long:"nolock" description:"Don't attempt to lock the repo exclusively. Use with care."`
 		KeepWorkdirs       bool    `long:"keep_workdirs" description:"Don't clean directories in plz-out/tmp after successfully building targets."`
 		HTTPProxy          cli.URL `long:"http_proxy" env:"HTTP_PROXY" description:"HTTP proxy to use for downloads"`
+		NoDaemon           bool    `long:"nodaemon" env:"PLZ_NO_DAEMON" description:"Don't forward this command to a running daemon."`
 	} `group:"Options that enable / disable certain features"`
 
+	DebugFlags struct {
+		DebugBuildFiles bool         `long:"debug_build_files" description:"Runs an interactive debugger while evaluating BUILD files."`
+		Breakpoints     []string     `long:"debug_breakpoint" description:"Sets a breakpoint in the BUILD file debugger, in the form file:line. Implies --debug_build_files."`
+		Port            int          `long:"debug_port" description:"Serves the BUILD file debugger over the Debug Adapter Protocol on this port instead of running it in the terminal. Implies --debug_build_files."`
+		ProfileFile     cli.Filepath `long:"parse_profile_file" description:"File to write a profile of time spent evaluating BUILD files into"`
+		ProfileFormat   string       `long:"parse_profile_format" choice:"pprof" choice:"trace" default:"pprof" description:"Format to write the parse profile in; either pprof or Chrome tracing"`
+	} `group:"Options for debugging & profiling BUILD files"`
+
 	HelpFlags struct {
 		Help    bool `short:"h" long:"help" description:"Show this help message"`
 		Version bool `long:"version" description:"Print the version of Please"`
@@ -99,7 +114,8 @@ var opts struct {
 		Shell      bool `long:"shell" description:"Like --prepare, but opens a shell in the build directory with the appropriate environment variables."`
 		Rebuild    bool `long:"rebuild" description:"To force the optimisation and rebuild one or more targets."`
 		NoDownload bool `long:"nodownload" hidden:"true" description:"Don't download outputs after building. Only applies when using remote build execution."`
-		Download   bool `long:"download" hidden:"true" description:"Force download of all outputs regardless of original target spec. Only applies when using remote build execution."`
+		Download   bool `long:"download" description:"Force download of all outputs regardless of original target spec or the remote.downloadminimal setting. Only applies when using remote build execution."`
+		Explain    bool `long:"explain" description:"Explains which inputs changed for each target that had to be rebuilt."`
 		Args       struct {
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to build"`
 		} `positional-args:"true" required:"true"`
@@ -195,6 +211,58 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"clean" description:"Cleans build artifacts" subcommands-optional:"true"`
 
+	Cache struct {
+		Stats struct {
+		} `command:"stats" description:"Shows the size of each cache and how it was used in the last build"`
+		Ls struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to list entries for (default is everything)"`
+			} `positional-args:"true"`
+		} `command:"ls" description:"Lists the entries in the caches"`
+		Verify struct {
+			Remove bool `long:"remove" description:"Remove any entries that fail verification"`
+			Args   struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to verify entries for (default is everything)"`
+			} `positional-args:"true"`
+		} `command:"verify" description:"Verifies the integrity of the entries in the caches"`
+		Prune struct {
+			MaxAge  cli.Duration `long:"max_age" description:"Remove entries that haven't been used for this long"`
+			MaxSize cli.ByteSize `long:"max_size" description:"Remove least recently used entries until each cache is smaller than this"`
+			Args    struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to prune entries for (default is everything)"`
+			} `positional-args:"true"`
+		} `command:"prune" description:"Removes old entries from the caches"`
+		Rm struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" required:"true" description:"Targets to remove entries for"`
+			} `positional-args:"true" required:"true"`
+		} `command:"rm" description:"Removes all entries for the given targets from the caches"`
+	} `command:"cache" description:"Inspects and maintains the build caches"`
+
+	Daemon struct {
+		Start struct {
+		} `command:"start" description:"Starts the daemon in the foreground"`
+		Stop struct {
+		} `command:"stop" description:"Stops the daemon once it's finished any command it's running"`
+		Status struct {
+		} `command:"status" description:"Shows the status of the daemon"`
+	} `command:"daemon" description:"Manages a daemon that keeps the build graph in memory between commands"`
+
+	Remote struct {
+		Show struct {
+			Action string `long:"action" description:"Digest of an action to show, in the form hash/size, instead of building targets to find theirs"`
+			Args   struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to show the remote actions of"`
+			} `positional-args:"true"`
+		} `command:"show" description:"Shows the remote action that built a target, including its inputs, command and result"`
+		Diff struct {
+			Args struct {
+				Before string `positional-arg-name:"before" required:"true" description:"First target or action digest (as hash/size) to compare"`
+				After  string `positional-arg-name:"after" required:"true" description:"Second target or action digest (as hash/size) to compare"`
+			} `positional-args:"true" required:"true"`
+		} `command:"diff" description:"Compares two remote actions to find out why they don't share cache hits"`
+	} `command:"remote" description:"Inspects actions on the remote execution server"`
+
 	Watch struct {
 		Run  bool `short:"r" long:"run" description:"Runs the specified targets when they change (default is to build or test as appropriate)."`
 		Args struct {
@@ -266,6 +334,17 @@ var opts struct {
 		} `positional-args:"true"`
 	} `command:"format" alias:"fmt" description:"Autoformats BUILD files"`
 
+	Lint struct {
+		Format  string   `long:"format" short:"f" choice:"text" choice:"json" choice:"sarif" default:"text" description:"Format to print issues in"`
+		Fix     bool     `long:"fix" description:"Fix issues in-place where it's safe to do so"`
+		Enable  []string `long:"enable" short:"e" description:"Lint rules to enable in addition to the configured ones"`
+		Disable []string `long:"disable" short:"d" description:"Lint rules to disable"`
+		List    bool     `long:"list" description:"List all available lint rules and exit"`
+		Args    struct {
+			Files cli.Filepaths `positional-arg-name:"files" description:"BUILD files to lint"`
+		} `positional-args:"true"`
+	} `command:"lint" description:"Checks BUILD files for common problems"`
+
 	Help struct {
 		Args struct {
 			Topic help.Topic `positional-arg-name:"topic" description:"Topic to display help on"`
@@ -368,6 +447,18 @@ var opts struct {
 				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to filter"`
 			} `positional-args:"true"`
 		} `command:"filter" description:"Filter the given set of targets according to some rules"`
+		WhyRebuilt struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to explain" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"why_rebuilt" description:"Explains which inputs of a target have changed since it was last built"`
+		Eval struct {
+			Hidden bool   `long:"hidden" description:"Show hidden targets as well"`
+			Output string `long:"output" default:"label" choice:"label" choice:"json" choice:"graph" description:"Format to print the results in"`
+			Args   struct {
+				Expr []string `positional-arg-name:"expression" description:"Query expression to evaluate, e.g. 'deps(//src/...) except tests(//src/...)'" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"eval" description:"Evaluates an expression combining targets, query functions and set operations"`
 	} `command:"query" description:"Queries information about the build graph"`
 	Codegen struct {
 		Gitignore string `long:"update_gitignore" description:"The gitignore file to write the generated sources to"`
@@ -381,7 +472,19 @@ var opts struct {
 // Functions are called after args are parsed and return true for success.
 var buildFunctions = map[string]func() int{
 	"build": func() int {
+		if config.Remote.DownloadMinimal && !opts.Build.Download {
+			opts.Build.NoDownload = true // Outputs stay remote until something needs them.
+		}
 		success, state := runBuild(opts.Build.Args.Targets, true, false, false)
+		if opts.Build.Explain && state != nil {
+			built := []*core.BuildTarget{}
+			for _, target := range state.Graph.AllTargets() {
+				if target.State() == core.Built {
+					built = append(built, target)
+				}
+			}
+			build.PrintRebuildReasons(built)
+		}
 		return toExitCode(success, state)
 	},
 	"hash": func() int {
@@ -497,6 +600,98 @@ var buildFunctions = map[string]func() int{
 		}
 		return 1
 	},
+	"stats": func() int {
+		cache.Stats(core.NewBuildState(config))
+		return 0
+	},
+	"ls": func() int {
+		cache.List(core.NewBuildState(config), opts.Cache.Ls.Args.Targets)
+		return 0
+	},
+	"verify": func() int {
+		if !cache.Verify(core.NewBuildState(config), opts.Cache.Verify.Args.Targets, opts.Cache.Verify.Remove) {
+			return 1
+		}
+		return 0
+	},
+	"prune": func() int {
+		if opts.Cache.Prune.MaxAge == 0 && opts.Cache.Prune.MaxSize == 0 {
+			log.Fatalf("At least one of --max_age or --max_size must be given")
+		}
+		cache.Prune(core.NewBuildState(config), opts.Cache.Prune.Args.Targets, time.Duration(opts.Cache.Prune.MaxAge), uint64(opts.Cache.Prune.MaxSize))
+		return 0
+	},
+	"rm": func() int {
+		cache.Remove(core.NewBuildState(config), opts.Cache.Rm.Args.Targets)
+		return 0
+	},
+	"stop": func() int {
+		if err := daemon.Stop(); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return 0
+	},
+	"status": func() int {
+		status, err := daemon.GetStatus()
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		fmt.Printf("Daemon running with pid %d, version %s\n", status.PID, status.Version)
+		fmt.Printf("Started at %s, has run %d commands\n", status.Started.Format(time.RFC1123), status.Commands)
+		fmt.Printf("Build graph has %d packages and %d targets\n", status.Packages, status.Targets)
+		return 0
+	},
+	"show": func() int {
+		if opts.Remote.Show.Action == "" && len(opts.Remote.Show.Args.Targets) == 0 {
+			log.Fatalf("Must pass either targets or --action to show")
+		}
+		state, client := remoteClient(opts.Remote.Show.Args.Targets)
+		if state == nil {
+			return 1
+		}
+		refs := []remote.ActionRef{}
+		if opts.Remote.Show.Action != "" {
+			refs = append(refs, remote.ActionRef{Digest: opts.Remote.Show.Action})
+		}
+		for _, label := range state.ExpandOriginalLabels() {
+			refs = append(refs, remote.ActionRef{Target: state.Graph.TargetOrDie(label)})
+		}
+		for i, ref := range refs {
+			if i > 0 {
+				fmt.Printf("\n")
+			}
+			if err := client.ShowAction(os.Stdout, ref); err != nil {
+				log.Fatalf("%s", err)
+			}
+		}
+		return 0
+	},
+	"diff": func() int {
+		args := []string{opts.Remote.Diff.Args.Before, opts.Remote.Diff.Args.After}
+		labels := []core.BuildLabel{}
+		for _, arg := range args {
+			if core.LooksLikeABuildLabel(arg) {
+				labels = append(labels, core.ParseBuildLabels([]string{arg})[0])
+			}
+		}
+		state, client := remoteClient(labels)
+		if state == nil {
+			return 1
+		}
+		refs := make([]remote.ActionRef, len(args))
+		for i, arg := range args {
+			if core.LooksLikeABuildLabel(arg) {
+				refs[i].Target = state.Graph.TargetOrDie(labels[0])
+				labels = labels[1:]
+			} else {
+				refs[i].Digest = arg
+			}
+		}
+		if err := client.DiffActions(os.Stdout, refs[0], refs[1]); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return 0
+	},
 	"update": func() int {
 		fmt.Printf("Up to date (version %s).\n", core.PleaseVersion)
 		return 0 // We'd have died already if something was wrong.
@@ -528,6 +723,35 @@ var buildFunctions = map[string]func() int{
 		}
 		return 0
 	},
+	"lint": func() int {
+		if opts.Lint.List {
+			for _, rule := range lint.AllRules() {
+				fmt.Printf("%-20s %s\n", rule.Name, rule.Description)
+			}
+			return 0
+		}
+		rules, err := lint.EnabledRules(config, opts.Lint.Enable, opts.Lint.Disable)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		state := core.NewBuildState(config)
+		if lint.NeedsGraph(rules) {
+			success, s := runBuild(core.WholeGraph, false, false, true)
+			if !success {
+				return toExitCode(success, s)
+			}
+			state = s
+		}
+		issues, err := lint.Lint(state, rules, opts.Lint.Args.Files.AsStrings(), opts.Lint.Fix)
+		if err != nil {
+			log.Fatalf("Failed to lint files: %s", err)
+		} else if err := lint.Write(os.Stdout, issues, rules, opts.Lint.Format); err != nil {
+			log.Fatalf("Failed to write lint output: %s", err)
+		} else if len(issues) > 0 {
+			return 1
+		}
+		return 0
+	},
 	"init": func() int {
 		plzinit.InitConfig(string(opts.Init.Dir), opts.Init.BazelCompatibility, opts.Init.NoPrompt)
 
@@ -720,6 +944,31 @@ var buildFunctions = map[string]func() int{
 			query.Roots(state.Graph, state.ExpandOriginalLabels(), opts.Query.Roots.Hidden)
 		})
 	},
+	"why_rebuilt": func() int {
+		return runQuery(true, opts.Query.WhyRebuilt.Args.Targets, func(state *core.BuildState) {
+			build.PrintWhyRebuilt(state, state.ExpandOriginalLabels())
+		})
+	},
+	"eval": func() int {
+		expr, err := query.ParseExpr(strings.Join(opts.Query.Eval.Args.Expr, " "))
+		if err != nil {
+			log.Errorf("%s", err)
+			return 1
+		}
+		labels := expr.Labels()
+		if expr.NeedsWholeGraph() {
+			labels = core.WholeGraph
+		}
+		if code := runQuery(true, labels, func(state *core.BuildState) {
+			err = query.Evaluate(state, expr, opts.Query.Eval.Output, opts.Query.Eval.Hidden)
+		}); code != 0 {
+			return code
+		} else if err != nil {
+			log.Errorf("%s", err)
+			return 1
+		}
+		return 0
+	},
 	"watch": func() int {
 		// Don't ask it to test now since we don't know if any of them are tests yet.
 		success, state := runBuild(opts.Watch.Args.Targets, true, false, false)
@@ -849,6 +1098,18 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 	state.ForceRerun = opts.Test.Rerun || opts.Cover.Rerun
 	state.ShowTestOutput = opts.Test.ShowOutput || opts.Cover.ShowOutput
 	state.DebugTests = debugTests
+	if opts.DebugFlags.DebugBuildFiles || len(opts.DebugFlags.Breakpoints) > 0 || opts.DebugFlags.Port != 0 {
+		state.DebugBuildFiles = &core.DebugBuildFiles{
+			Breakpoints: opts.DebugFlags.Breakpoints,
+			Port:        opts.DebugFlags.Port,
+		}
+	}
+	if opts.DebugFlags.ProfileFile != "" {
+		state.ProfileBuildFiles = &core.ProfileBuildFiles{
+			Filename: string(opts.DebugFlags.ProfileFile),
+			Format:   opts.DebugFlags.ProfileFormat,
+		}
+	}
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
 	state.ParsePackageOnly = opts.ParsePackageOnly
 	state.DownloadOutputs = (!opts.Build.NoDownload && !opts.Run.Remote && len(targets) > 0 && (!targets[0].IsAllSubpackages() || len(opts.BuildFlags.Include) > 0)) || opts.Build.Download
@@ -861,7 +1122,9 @@ func Please(targets []core.BuildLabel, config *core.Configuration, shouldBuild,
 		log.Fatalf("-d/--debug flag can only be used with a single test target")
 	}
 
+	daemon.PrepareState(state)
 	runPlease(state, targets)
+	daemon.StoreState(state)
 	return state.Successful(), state
 }
 
@@ -876,7 +1139,9 @@ func runPlease(state *core.BuildState, targets []core.BuildLabel) {
 		(len(targets) == 1 && !targets[0].IsAllTargets() &&
 			!targets[0].IsAllSubpackages() && targets[0] != core.BuildLabelStdin))
 	streamTests := opts.Test.StreamResults || opts.Cover.StreamResults
-	pretty := prettyOutput(opts.OutputFlags.InteractiveOutput, opts.OutputFlags.PlainOutput, opts.OutputFlags.Verbosity) && state.NeedBuild && !streamTests
+	// The terminal debugger can't coexist with the interactive display.
+	terminalDebugger := state.DebugBuildFiles != nil && state.DebugBuildFiles.Port == 0
+	pretty := prettyOutput(opts.OutputFlags.InteractiveOutput, opts.OutputFlags.PlainOutput, opts.OutputFlags.Verbosity) && state.NeedBuild && !streamTests && !terminalDebugger
 	state.Cache = cache.NewCache(state)
 
 	// Run the display
@@ -885,7 +1150,7 @@ func runPlease(state *core.BuildState, targets []core.BuildLabel) {
 	wg.Add(1)
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		output.MonitorState(ctx, state, !pretty, detailedTests, streamTests, string(opts.OutputFlags.TraceFile))
+		output.MonitorState(ctx, state, !pretty, detailedTests, streamTests, string(opts.OutputFlags.TraceFile), string(opts.OutputFlags.EventFile), opts.OutputFlags.EventFormat)
 		wg.Done()
 	}()
 	plz.Run(targets, opts.BuildFlags.PreTargets, state, config, state.TargetArch)
@@ -949,6 +1214,25 @@ func runBuild(targets []core.BuildLabel, shouldBuild, shouldTest, isQuery bool)
 
 var originalWorkingDirectory string
 
+// remoteClient returns the remote execution client for the plz remote commands.
+// If any targets are given, they are built first so that we know their action digests.
+// The returned state is nil if that fails.
+func remoteClient(targets []core.BuildLabel) (*core.BuildState, *remote.Client) {
+	if config.Remote.URL == "" {
+		log.Fatalf("Remote execution is not configured; set url in the [remote] section of your .plzconfig")
+	}
+	if len(targets) == 0 {
+		state := core.NewBuildState(config)
+		return state, remote.New(state)
+	}
+	opts.Build.NoDownload = true // We only want to know about the actions, not their outputs.
+	success, state := runBuild(targets, true, false, false)
+	if !success {
+		return nil, nil
+	}
+	return state, state.RemoteClient.(*remote.Client)
+}
+
 // readConfigAndSetRoot reads the .plzconfig files and moves to the repo root.
 func readConfigAndSetRoot(forceUpdate bool) *core.Configuration {
 	if opts.BuildFlags.RepoRoot == "" {
@@ -1067,6 +1351,9 @@ func initBuild(args []string) string {
 		// Query commands don't need either of these set.
 		opts.OutputFlags.PlainOutput = true
 		config.Cache.DirClean = false
+	} else if parser.Command.Active != nil && parser.Command.Active.Name == "cache" {
+		// Don't run the normal cleaner while we're inspecting the cache.
+		config.Cache.DirClean = false
 	}
 
 	// Now we've read the config file, we may need to re-run the parser; the aliases in the config
@@ -1137,6 +1424,58 @@ func execute(command string) int {
 	return buildFunctions[command]()
 }
 
+// defaultOpts is a copy of the flags before any have been parsed, so they can be reset to it.
+var defaultOpts = opts
+
+// canForward returns true if the given command can be forwarded to a running daemon.
+// Anything that runs interactively, or replaces this process, has to be run here.
+func canForward(command string) bool {
+	// The daemon reuses its graph so wouldn't reparse anything to debug, and a terminal debugger
+	// would end up running inside it rather than here.
+	if opts.DebugFlags.DebugBuildFiles || len(opts.DebugFlags.Breakpoints) > 0 || opts.DebugFlags.Port != 0 {
+		return false
+	}
+	// Likewise a parse profile would only cover whatever the daemon had to reparse.
+	if opts.DebugFlags.ProfileFile != "" {
+		return false
+	}
+	switch command {
+	case "build":
+		return !opts.Build.Prepare && !opts.Build.Shell
+	case "test":
+		return !opts.Test.Debug && !opts.Test.Shell
+	case "cover":
+		return !opts.Cover.Debug && !opts.Cover.Shell
+	case "hash", "deps", "revdeps", "somepath", "alltargets", "print", "input", "output", "graph", "whatoutputs", "roots", "filter", "why_rebuilt", "eval":
+		return true
+	}
+	return false
+}
+
+func init() {
+	// This is registered here since running commands in the daemon refers back to buildFunctions.
+	buildFunctions["start"] = func() int {
+		if err := daemon.Serve(runInDaemon); err != nil {
+			log.Fatalf("Failed to run daemon: %s", err)
+		}
+		return 0
+	}
+}
+
+// runInDaemon runs a command that's been forwarded to the daemon.
+func runInDaemon(args []string) int {
+	opts = defaultOpts
+	// The client will already have updated if needed, and we mustn't replace ourselves.
+	args = append([]string{args[0], "--noupdate"}, args[1:]...)
+	return execute(initBuild(args))
+}
+
 func main() {
-	os.Exit(execute(initBuild(os.Args)))
+	command := initBuild(os.Args)
+	if !opts.FeatureFlags.NoDaemon && canForward(command) {
+		if code, forwarded := daemon.Forward(os.Args, originalWorkingDirectory); forwarded {
+			os.Exit(code)
+		}
+	}
+	os.Exit(execute(command))
 }
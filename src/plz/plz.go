@@ -55,12 +55,16 @@ func Run(targets, preTargets []core.BuildLabel, state *core.BuildState, config *
 	}
 	// Wait until they've all exited, which they'll do once they have no tasks left.
 	wg.Wait()
+	parse.WriteProfile(state)
 	if state.Cache != nil {
 		state.Cache.Shutdown()
 	}
 	if state.RemoteClient != nil {
 		_, _, in, out := state.RemoteClient.DataRate()
 		log.Info("Total remote RPC data in: %d out: %d", in, out)
+		if config.Remote.Dynamic {
+			build.WriteDynamicStats(state)
+		}
 	}
 	state.CloseResults()
 }
@@ -110,7 +114,7 @@ func findOriginalTasks(state *core.BuildState, preTargets, targets []core.BuildL
 	}
 	if arch.Arch != "" {
 		// Set up a new subrepo for this architecture.
-		state.Graph.AddSubrepo(core.SubrepoForArch(state, arch))
+		state.Graph.MaybeAddSubrepo(core.SubrepoForArch(state, arch))
 	}
 	if len(preTargets) > 0 {
 		findOriginalTaskSet(state, preTargets, false, arch)
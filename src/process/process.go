@@ -33,7 +33,7 @@ func New(sandboxCommand string) *Executor {
 		sandboxCommand: sandboxCommand,
 		processes:      map[*exec.Cmd]struct{}{},
 	}
-	cli.AtExit(o.killAll) // Kill any subprocess if we are ourselves killed
+	cli.AtExit(o.KillAll) // Kill any subprocess if we are ourselves killed
 	return o
 }
 
@@ -57,9 +57,15 @@ type Target interface {
 // If showOutput is true then output will be printed to stderr as well as returned.
 // It returns the stdout only, combined stdout and stderr and any error that occurred.
 func (e *Executor) ExecWithTimeout(target Target, dir string, env []string, timeout time.Duration, showOutput, attachStdin, attachStdout bool, argv []string) ([]byte, []byte, error) {
+	return e.ExecWithTimeoutContext(context.Background(), target, dir, env, timeout, showOutput, attachStdin, attachStdout, argv)
+}
+
+// ExecWithTimeoutContext is as ExecWithTimeout but also terminates the command early if the given
+// context is cancelled, in which case the returned error is the context's error.
+func (e *Executor) ExecWithTimeoutContext(parent context.Context, target Target, dir string, env []string, timeout time.Duration, showOutput, attachStdin, attachStdout bool, argv []string) ([]byte, []byte, error) {
 	// We deliberately don't attach this context to the command, so we have better
 	// control over how the process gets terminated.
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
 	cmd := e.ExecCommand(argv[0], argv[1:]...)
 	defer e.removeProcess(cmd)
@@ -106,10 +112,38 @@ func (e *Executor) ExecWithTimeout(target Target, dir string, env []string, time
 	case <-time.After(timeout):
 		e.KillProcess(cmd)
 		err = fmt.Errorf("Timeout exceeded: %s", outerr.String())
+	case <-parent.Done():
+		e.KillProcess(cmd)
+		<-ch
+		err = parent.Err()
 	}
 	return out.Bytes(), outerr.Bytes(), err
 }
 
+// ExecWithTimeoutStreams runs an external command with a timeout, writing its stdout and stderr
+// separately to the given writers. There's no progress display or output to the terminal.
+// If the command times out the returned error will be context.DeadlineExceeded.
+func (e *Executor) ExecWithTimeoutStreams(dir string, env []string, timeout time.Duration, stdout, stderr io.Writer, argv []string) error {
+	cmd := e.ExecCommand(argv[0], argv[1:]...)
+	defer e.removeProcess(cmd)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ch := make(chan error, 1)
+	go runCommand(cmd, ch)
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(timeout):
+		e.KillProcess(cmd)
+		return context.DeadlineExceeded
+	}
+}
+
 // runCommand runs a command and signals on the given channel when it's done.
 func runCommand(cmd *exec.Cmd, ch chan error) {
 	ch <- cmd.Wait()
@@ -124,6 +158,17 @@ func (e *Executor) ExecWithTimeoutShell(target Target, dir string, env []string,
 
 // ExecWithTimeoutShellStdStreams is as ExecWithTimeoutShell but optionally attaches stdin to the subprocess.
 func (e *Executor) ExecWithTimeoutShellStdStreams(target Target, dir string, env []string, timeout time.Duration, showOutput bool, cmd string, sandbox, attachStdStreams bool) ([]byte, []byte, error) {
+	return e.ExecWithTimeoutContext(context.Background(), target, dir, env, timeout, showOutput, attachStdStreams, attachStdStreams, e.shellCommand(target, cmd, sandbox))
+}
+
+// ExecWithTimeoutShellContext is as ExecWithTimeoutShell but terminates the command early if the
+// given context is cancelled.
+func (e *Executor) ExecWithTimeoutShellContext(ctx context.Context, target Target, dir string, env []string, timeout time.Duration, showOutput bool, cmd string, sandbox bool) ([]byte, []byte, error) {
+	return e.ExecWithTimeoutContext(ctx, target, dir, env, timeout, showOutput, false, false, e.shellCommand(target, cmd, sandbox))
+}
+
+// shellCommand returns the argv to run the given command in a Bash shell, optionally sandboxed.
+func (e *Executor) shellCommand(target Target, cmd string, sandbox bool) []string {
 	c := BashCommand("bash", cmd, target.ShouldExitOnError())
 	if sandbox {
 		if e.sandboxCommand == "" {
@@ -131,7 +176,7 @@ func (e *Executor) ExecWithTimeoutShellStdStreams(target Target, dir string, env
 		}
 		c = append([]string{e.sandboxCommand}, c...)
 	}
-	return e.ExecWithTimeout(target, dir, env, timeout, showOutput, attachStdStreams, attachStdStreams, c)
+	return c
 }
 
 // KillProcess kills a process, attempting to send it a SIGTERM first followed by a SIGKILL
@@ -227,8 +272,8 @@ func progressMessage(progress *float32) string {
 	return ""
 }
 
-// killAll kills all subprocesses of this executor.
-func (e *Executor) killAll() {
+// KillAll kills all subprocesses of this executor.
+func (e *Executor) KillAll() {
 	e.mutex.Lock()
 	processes := make([]*exec.Cmd, 0, len(e.processes))
 	for proc := range e.processes {
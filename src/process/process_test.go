@@ -1,6 +1,8 @@
 package process
 
 import (
+	"bytes"
+	"context"
 	"strings"
 	"testing"
 	"time"
@@ -27,6 +29,18 @@ func TestExecWithTimeoutDeadline(t *testing.T) {
 	assert.Equal(t, 0, len(out))
 }
 
+func TestExecWithTimeoutContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, _, err := New("").ExecWithTimeoutShellContext(ctx, &target{}, "", nil, 10*time.Second, false, "sleep 10", false)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
 func TestExecWithTimeoutOutput(t *testing.T) {
 	targ := &target{}
 	out, stderr, err := New("").ExecWithTimeoutShell(targ, "", nil, 10*time.Second, false, "echo hello", false)
@@ -43,13 +57,27 @@ func TestExecWithTimeoutStderr(t *testing.T) {
 	assert.Equal(t, "hello\n", string(stderr))
 }
 
+func TestExecWithTimeoutStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := New("").ExecWithTimeoutStreams("", nil, 10*time.Second, &stdout, &stderr, []string{"bash", "-c", "echo hello && echo world 1>&2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", stdout.String())
+	assert.Equal(t, "world\n", stderr.String())
+}
+
+func TestExecWithTimeoutStreamsDeadline(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := New("").ExecWithTimeoutStreams("", nil, time.Nanosecond, &stdout, &stderr, []string{"sleep", "10"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
 func TestKillSubprocesses(t *testing.T) {
 	e := New("")
 	cmd := e.ExecCommand("sleep", "infinity")
 	assert.Equal(t, 1, len(e.processes))
 	err := cmd.Start()
 	assert.NoError(t, err)
-	e.killAll()
+	e.KillAll()
 	err = cmd.Wait()
 	assert.Error(t, err)
 	assert.Equal(t, 0, len(e.processes))
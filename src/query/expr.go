@@ -0,0 +1,641 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// An Expr is a parsed query expression, for example
+//
+//	deps(//src/...) intersect rdeps(//lib:x) except attr(labels, "manual")
+//
+// Expressions are made up of target patterns (//src:please, //src:all, //src/...), functions
+// which compute a set of targets from their arguments, and the binary set operators
+// 'union' (or '+'), 'intersect' (or '^') and 'except' (or '-'). The operators all have the same
+// precedence and associate to the left; parentheses can be used to group them otherwise.
+//
+// The following functions are available:
+//
+//	deps(x[, depth])          all targets that x transitively depends on, including x itself.
+//	rdeps(x[, depth])         all targets that transitively depend on x, including x itself.
+//	attr(name, regex[, x])    targets in x that have a value of the given attribute matching the regex.
+//	filter(regex, x)          targets in x whose label matches the regex.
+//	tests(x)                  targets in x that are tests.
+//
+// A depth of 1 means direct dependencies only; the default is unlimited.
+// If x is omitted from attr() it considers every target in the graph.
+type Expr struct {
+	root node
+}
+
+// A node is a single node in the syntax tree of an expression.
+type node interface {
+	// eval evaluates this node against the given state.
+	eval(state *core.BuildState) (targetSet, error)
+}
+
+// A targetSet is the result of evaluating a node.
+type targetSet map[core.BuildLabel]struct{}
+
+// sorted returns the labels in this set in sorted order.
+func (s targetSet) sorted() core.BuildLabels {
+	ret := make(core.BuildLabels, 0, len(s))
+	for label := range s {
+		ret = append(ret, label)
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+// A patternNode is a single target pattern, e.g. //src/core:all.
+type patternNode struct {
+	label core.BuildLabel
+}
+
+func (n *patternNode) eval(state *core.BuildState) (targetSet, error) {
+	ret := targetSet{}
+	if !n.label.IsAllTargets() && !n.label.IsAllSubpackages() && state.Graph.Target(n.label) == nil {
+		return nil, fmt.Errorf("Unknown target %s", n.label)
+	}
+	for _, label := range state.ExpandLabels([]core.BuildLabel{n.label}) {
+		ret[label] = struct{}{}
+	}
+	return ret, nil
+}
+
+// A binaryNode is a set operation between two other nodes.
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(state *core.BuildState) (targetSet, error) {
+	left, err := n.left.eval(state)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(state)
+	if err != nil {
+		return nil, err
+	}
+	ret := targetSet{}
+	switch n.op {
+	case "union":
+		for label := range left {
+			ret[label] = struct{}{}
+		}
+		for label := range right {
+			ret[label] = struct{}{}
+		}
+	case "intersect":
+		for label := range left {
+			if _, present := right[label]; present {
+				ret[label] = struct{}{}
+			}
+		}
+	case "except":
+		for label := range left {
+			if _, present := right[label]; !present {
+				ret[label] = struct{}{}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// A funcNode is a call to one of the builtin functions.
+type funcNode struct {
+	name  string
+	args  []node
+	depth int
+	regex *regexp.Regexp
+	attr  string
+}
+
+func (n *funcNode) eval(state *core.BuildState) (targetSet, error) {
+	var input targetSet
+	if len(n.args) == 0 {
+		input = allTargets(state)
+	} else {
+		in, err := n.args[0].eval(state)
+		if err != nil {
+			return nil, err
+		}
+		input = in
+	}
+	switch n.name {
+	case "deps":
+		return walk(input, n.depth, func(labels []core.BuildLabel) []core.BuildLabel {
+			ret := []core.BuildLabel{}
+			for _, label := range labels {
+				for _, dep := range state.Graph.TargetOrDie(label).Dependencies() {
+					ret = append(ret, dep.Label)
+				}
+			}
+			return ret
+		}), nil
+	case "rdeps":
+		// This is done a level at a time since finding reverse dependencies has to look at every package.
+		return walk(input, n.depth, func(labels []core.BuildLabel) []core.BuildLabel {
+			return getRevDepsLabels(state, labels)
+		}), nil
+	case "attr":
+		return filterSet(state, input, func(target *core.BuildTarget) bool {
+			for _, value := range attrValues(target, n.attr) {
+				if n.regex.MatchString(value) {
+					return true
+				}
+			}
+			return false
+		}), nil
+	case "filter":
+		return filterSet(state, input, func(target *core.BuildTarget) bool {
+			return n.regex.MatchString(target.Label.String())
+		}), nil
+	case "tests":
+		return filterSet(state, input, func(target *core.BuildTarget) bool {
+			return target.IsTest
+		}), nil
+	}
+	return nil, fmt.Errorf("Unknown function %s", n.name)
+}
+
+// allTargets returns the set of every target in the graph.
+func allTargets(state *core.BuildState) targetSet {
+	ret := targetSet{}
+	for _, target := range state.Graph.AllTargets() {
+		if state.ShouldInclude(target) {
+			ret[target.Label] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// walk returns the given set plus everything reachable from it within the given depth (-1 for unlimited).
+// The next function returns everything one step away from the given labels.
+func walk(input targetSet, depth int, next func([]core.BuildLabel) []core.BuildLabel) targetSet {
+	ret := targetSet{}
+	frontier := make([]core.BuildLabel, 0, len(input))
+	for label := range input {
+		ret[label] = struct{}{}
+		frontier = append(frontier, label)
+	}
+	for ; depth != 0 && len(frontier) > 0; depth-- {
+		nextFrontier := []core.BuildLabel{}
+		for _, label := range next(frontier) {
+			if _, present := ret[label]; !present {
+				ret[label] = struct{}{}
+				nextFrontier = append(nextFrontier, label)
+			}
+		}
+		frontier = nextFrontier
+	}
+	return ret
+}
+
+// filterSet returns the members of the given set that match the given function.
+func filterSet(state *core.BuildState, input targetSet, f func(*core.BuildTarget) bool) targetSet {
+	ret := targetSet{}
+	for label := range input {
+		if f(state.Graph.TargetOrDie(label)) {
+			ret[label] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// specialAttrs are attributes whose values come from methods on the target rather than
+// directly from its fields.
+var specialAttrs = map[string]func(*core.BuildTarget) interface{}{
+	"name":          func(t *core.BuildTarget) interface{} { return t.Label.Name },
+	"deps":          func(t *core.BuildTarget) interface{} { return t.DeclaredDependenciesStrict() },
+	"exported_deps": func(t *core.BuildTarget) interface{} { return t.ExportedDependencies() },
+	"outs":          func(t *core.BuildTarget) interface{} { return t.Outputs() },
+	"data":          func(t *core.BuildTarget) interface{} { return t.AllData() },
+	"tools":         func(t *core.BuildTarget) interface{} { return t.AllTools() },
+	"test_tools":    func(t *core.BuildTarget) interface{} { return t.TestTools() },
+}
+
+// isAttr returns true if the given name is an attribute of build targets.
+func isAttr(name string) bool {
+	if _, present := specialAttrs[name]; present {
+		return true
+	}
+	t := reflect.TypeOf(core.BuildTarget{})
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Tag.Get("print") != "false" && new(printer).fieldName(f) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// attrValues returns the values of an attribute of a target. Unlike printing them, strings are
+// returned as they are without any quoting; lists and maps give one value per item (map items
+// are given as key=value) and unset attributes give none.
+func attrValues(target *core.BuildTarget, name string) []string {
+	if f, present := specialAttrs[name]; present {
+		return rawValues(reflect.ValueOf(f(target)))
+	}
+	v := reflect.ValueOf(target).Elem()
+	t := v.Type()
+	var values []string
+	for i := 0; i < t.NumField(); i++ {
+		// Several fields can share a name (e.g. srcs and named srcs).
+		if f := t.Field(i); f.Tag.Get("print") != "false" && new(printer).fieldName(f) == name {
+			values = append(values, rawValues(v.Field(i))...)
+		}
+	}
+	return values
+}
+
+// rawValues returns the values of a single field for attrValues.
+func rawValues(v reflect.Value) []string {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil // Hashes and the like, which aren't meaningful to match against.
+		}
+		values := []string{}
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, rawValues(v.Index(i))...)
+		}
+		return values
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		values := []string{}
+		for _, key := range keys {
+			for _, value := range rawValues(v.MapIndex(key)) {
+				values = append(values, key.String()+"="+value)
+			}
+		}
+		return values
+	case reflect.String:
+		if v.Len() == 0 {
+			return nil
+		}
+		return []string{v.String()}
+	case reflect.Bool:
+		if v.Bool() {
+			return []string{"True"}
+		}
+	case reflect.Int, reflect.Int32:
+		if v.Int() > 0 {
+			return []string{strconv.FormatInt(v.Int(), 10)}
+		}
+	case reflect.Int64:
+		if d, ok := v.Interface().(time.Duration); ok && d > 0 {
+			return []string{strconv.FormatFloat(d.Seconds(), 'f', 0, 64)}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			if stringer, ok := v.Interface().(fmt.Stringer); ok {
+				return []string{stringer.String()}
+			}
+			return rawValues(v.Elem())
+		}
+	case reflect.Struct:
+		if stringer, ok := v.Interface().(fmt.Stringer); ok {
+			return []string{stringer.String()}
+		}
+	}
+	return nil
+}
+
+// ParseExpr parses a query expression.
+func ParseExpr(s string) (*Expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %s at end of expression", p.tokens[p.pos])
+	}
+	return &Expr{root: root}, nil
+}
+
+// Labels returns the target patterns mentioned in this expression. These are the parts of the
+// graph that need to be parsed to evaluate it (unless NeedsWholeGraph returns true).
+func (expr *Expr) Labels() []core.BuildLabel {
+	labels := []core.BuildLabel{}
+	visit(expr.root, func(n node) {
+		if p, ok := n.(*patternNode); ok {
+			labels = append(labels, p.label)
+		}
+	})
+	return labels
+}
+
+// NeedsWholeGraph returns true if evaluating this expression requires the entire graph to be parsed,
+// for example because it's looking for reverse dependencies.
+func (expr *Expr) NeedsWholeGraph() bool {
+	whole := false
+	visit(expr.root, func(n node) {
+		if f, ok := n.(*funcNode); ok && (f.name == "rdeps" || len(f.args) == 0) {
+			whole = true
+		}
+	})
+	return whole
+}
+
+// Evaluate evaluates this expression against the graph in the given state, and returns the
+// resulting targets in sorted order. Hidden targets are omitted unless hidden is true.
+func (expr *Expr) Evaluate(state *core.BuildState, hidden bool) (core.BuildLabels, error) {
+	set, err := expr.root.eval(state)
+	if err != nil {
+		return nil, err
+	}
+	labels := set.sorted()
+	ret := labels[:0]
+	for _, label := range labels {
+		if hidden || !strings.HasPrefix(label.Name, "_") {
+			ret = append(ret, label)
+		}
+	}
+	return ret, nil
+}
+
+// visit calls the given function on every node in the tree rooted at n.
+func visit(n node, f func(node)) {
+	f(n)
+	switch n := n.(type) {
+	case *binaryNode:
+		visit(n.left, f)
+		visit(n.right, f)
+	case *funcNode:
+		for _, arg := range n.args {
+			visit(arg, f)
+		}
+	}
+}
+
+// Evaluate evaluates a query expression and prints the result in the given format, which is
+// one of "label" (one per line), "json" (a list of labels) or "graph" (as for 'plz query graph').
+func Evaluate(state *core.BuildState, expr *Expr, format string, hidden bool) error {
+	labels, err := expr.Evaluate(state, hidden)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "", "label":
+		for _, label := range labels {
+			fmt.Println(label)
+		}
+		return nil
+	case "json":
+		strs := make([]string, len(labels))
+		for i, label := range labels {
+			strs[i] = label.String()
+		}
+		return printJSON(strs)
+	case "graph":
+		if len(labels) == 0 {
+			// makeJSONGraph would give us the whole graph if we passed no labels.
+			return printJSON(&JSONGraph{Packages: map[string]JSONPackage{}})
+		}
+		return printJSON(makeJSONGraph(state, labels))
+	}
+	return fmt.Errorf("Unknown output format %s", format)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+	return nil
+}
+
+// operators maps the spellings of the binary operators to their canonical names.
+var operators = map[string]string{
+	"union":     "union",
+	"+":         "union",
+	"intersect": "intersect",
+	"^":         "intersect",
+	"except":    "except",
+	"-":         "except",
+}
+
+// functionArgs is the minimum & maximum number of arguments each function takes.
+var functionArgs = map[string][2]int{
+	"deps":   {1, 2},
+	"rdeps":  {1, 2},
+	"attr":   {2, 3},
+	"filter": {2, 2},
+	"tests":  {1, 1},
+}
+
+// A token is a single token in a query expression.
+type token struct {
+	value  string
+	quoted bool // True if this was a quoted string
+	pos    int
+}
+
+func (t token) String() string {
+	if t.quoted {
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("'%s' at position %d", t.value, t.pos)
+}
+
+// tokenize splits an expression into tokens.
+// Parentheses and commas are always tokens by themselves; anything else is delimited by them or whitespace.
+func tokenize(s string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		if unicode.IsSpace(c) {
+			i++
+		} else if c == '(' || c == ')' || c == ',' {
+			tokens = append(tokens, token{value: s[i : i+1], pos: i})
+			i++
+		} else if c == '"' || c == '\'' {
+			end := strings.IndexRune(s[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{value: s[i+1 : i+1+end], quoted: true, pos: i})
+			i += end + 2
+		} else {
+			start := i
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) && !strings.ContainsRune(`(),"'`, rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, token{value: s[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+// An exprParser parses a sequence of tokens into an expression.
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+// peek returns the next token without consuming it. The second return value is false at the end of input.
+func (p *exprParser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// next consumes and returns the next token.
+func (p *exprParser) next() (token, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("Unexpected end of expression")
+	}
+	p.pos++
+	return t, nil
+}
+
+// expect consumes the next token, which must have the given value.
+func (p *exprParser) expect(value string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	} else if t.value != value || t.quoted {
+		return fmt.Errorf("Expected '%s', got %s", value, t)
+	}
+	return nil
+}
+
+// parseExpr parses an expression, i.e. a sequence of terms separated by set operators.
+func (p *exprParser) parseExpr() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.quoted {
+			return left, nil
+		}
+		op, present := operators[t.value]
+		if !present {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// parseTerm parses a single term: a parenthesised expression, a function call or a target pattern.
+func (p *exprParser) parseTerm() (node, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	} else if t.quoted {
+		return nil, fmt.Errorf("Unexpected string %s; expected a target or function call", t)
+	} else if t.value == "(" {
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	} else if next, ok := p.peek(); ok && next.value == "(" && !next.quoted {
+		return p.parseFunc(t)
+	}
+	label, err := core.TryParseBuildLabel(t.value, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid target pattern %s", t)
+	}
+	return &patternNode{label: label}, nil
+}
+
+// parseFunc parses a call to the function named by the given token.
+func (p *exprParser) parseFunc(name token) (node, error) {
+	nargs, present := functionArgs[name.value]
+	if !present {
+		return nil, fmt.Errorf("Unknown function %s", name)
+	}
+	p.pos++ // Skip the opening bracket
+	f := &funcNode{name: name.value, depth: -1}
+	var args []token // The leading arguments that aren't expressions
+	switch f.name {
+	case "attr", "filter":
+		if f.name == "attr" {
+			t, err := p.nextArg()
+			if err != nil {
+				return nil, err
+			}
+			if !isAttr(t.value) {
+				return nil, fmt.Errorf("Unknown attribute %s", t)
+			}
+			f.attr = t.value
+			args = append(args, t)
+		}
+		t, err := p.nextArg()
+		if err != nil {
+			return nil, err
+		}
+		if f.regex, err = regexp.Compile(t.value); err != nil {
+			return nil, fmt.Errorf("Invalid regex %s: %s", t, err)
+		}
+		args = append(args, t)
+	}
+	if t, ok := p.peek(); ok && t.value == ")" && !t.quoted {
+		p.pos++
+		if len(args) < nargs[0] {
+			return nil, fmt.Errorf("Not enough arguments to %s", name.value)
+		}
+		return f, nil
+	}
+	arg, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	f.args = append(f.args, arg)
+	if t, ok := p.peek(); ok && t.value == "," && !t.quoted && (f.name == "deps" || f.name == "rdeps") {
+		p.pos++
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		depth, err := strconv.Atoi(t.value)
+		if err != nil || depth < 0 || t.quoted {
+			return nil, fmt.Errorf("Invalid depth %s; must be a non-negative integer", t)
+		}
+		f.depth = depth
+	}
+	return f, p.expect(")")
+}
+
+// nextArg consumes the next argument of a function, which must be a single word or string, and the following comma.
+func (p *exprParser) nextArg() (token, error) {
+	t, err := p.next()
+	if err != nil {
+		return t, err
+	} else if !t.quoted && (t.value == "(" || t.value == ")" || t.value == ",") {
+		return t, fmt.Errorf("Unexpected %s", t)
+	}
+	if next, ok := p.peek(); ok && next.value == "," && !next.quoted {
+		p.pos++
+	} else if !ok || next.value != ")" || next.quoted {
+		return t, fmt.Errorf("Expected ',' or ')' after %s", t)
+	}
+	return t, nil
+}
@@ -0,0 +1,131 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestParseExpr(t *testing.T) {
+	expr, err := ParseExpr(`deps(//src/...) intersect rdeps(//lib:x, 2) except attr(labels, "manual")`)
+	assert.NoError(t, err)
+	assert.Equal(t, []core.BuildLabel{
+		core.ParseBuildLabel("//src/...", ""),
+		core.ParseBuildLabel("//lib:x", ""),
+	}, expr.Labels())
+	assert.True(t, expr.NeedsWholeGraph())
+
+	expr, err = ParseExpr(`(//src:a + //src:b) - filter("_test$", deps(//src:all, 1))`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(expr.Labels()))
+	assert.False(t, expr.NeedsWholeGraph())
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`deps(//src:all`,
+		`deps(//src:all, x)`,
+		`deps(//src:all, -1)`,
+		`deps()`,
+		`filter("abc")`,
+		`filter("[", //src:all)`,
+		`attr(labels "manual")`,
+		`nope(//src:all)`,
+		`src:all`,
+		`//src:a union`,
+		`//src:a //src:b`,
+		`"//src:a"`,
+		`attr(labels, "manual`,
+		`attr(nonexistent, ".*")`,
+	} {
+		_, err := ParseExpr(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	state := makeExprGraph()
+	assertEval(t, state, `deps(//package2:target3)`, "//package1:target1", "//package1:target2", "//package2:target3")
+	assertEval(t, state, `deps(//package2:target3, 1)`, "//package1:target2", "//package2:target3")
+	assertEval(t, state, `rdeps(//package1:target1)`, "//package1:target1", "//package1:target2", "//package2:target3")
+	assertEval(t, state, `rdeps(//package1:target1, 1) except //package1:target1`, "//package1:target2")
+	assertEval(t, state, `deps(//package2:target3) intersect rdeps(//package1:target2)`, "//package1:target2", "//package2:target3")
+	assertEval(t, state, `//package1:all ^ //package2:all`)
+	assertEval(t, state, `//package1:all union //package2:all except //package1:target2`, "//package1:target1", "//package2:target3")
+	assertEval(t, state, `//package1:all union (//package2:all except //package1:target2)`, "//package1:target1", "//package1:target2", "//package2:target3")
+	assertEval(t, state, `attr(labels, "manual")`, "//package1:target2")
+	assertEval(t, state, `attr(labels, "^man", //package2:all)`)
+	assertEval(t, state, `attr(name, "^target2$")`, "//package1:target2")
+	assertEval(t, state, `attr(deps, "^//package1:target1$")`, "//package1:target2")
+	assertEval(t, state, `attr(cmd, "^echo 'hello' > \$OUT$")`, "//package1:target1")
+	assertEval(t, state, `attr(env, "^KEY=value$")`, "//package1:target1")
+	assertEval(t, state, `attr(test, "True")`, "//package2:target3")
+	assertEval(t, state, `filter("target[12]$", //...)`, "//package1:target1", "//package1:target2")
+	assertEval(t, state, `tests(//...)`, "//package2:target3")
+}
+
+func TestEvaluateHidden(t *testing.T) {
+	state := makeExprGraph()
+	expr, err := ParseExpr(`//package2:all`)
+	assert.NoError(t, err)
+	labels, err := expr.Evaluate(state, false)
+	assert.NoError(t, err)
+	assert.Equal(t, core.BuildLabels{core.ParseBuildLabel("//package2:target3", "")}, labels)
+	labels, err = expr.Evaluate(state, true)
+	assert.NoError(t, err)
+	assert.Equal(t, core.BuildLabels{core.ParseBuildLabel("//package2:_target3#hidden", ""), core.ParseBuildLabel("//package2:target3", "")}, labels)
+}
+
+func TestEvaluateUnknownTarget(t *testing.T) {
+	expr, err := ParseExpr(`deps(//package3:target4)`)
+	assert.NoError(t, err)
+	_, err = expr.Evaluate(makeExprGraph(), false)
+	assert.Error(t, err)
+}
+
+func assertEval(t *testing.T, state *core.BuildState, s string, expected ...string) {
+	expr, err := ParseExpr(s)
+	assert.NoError(t, err, s)
+	labels, err := expr.Evaluate(state, false)
+	assert.NoError(t, err, s)
+	strs := []string{}
+	for _, label := range labels {
+		strs = append(strs, label.String())
+	}
+	if expected == nil {
+		expected = []string{}
+	}
+	assert.Equal(t, expected, strs, s)
+}
+
+func makeExprGraph() *core.BuildState {
+	state := core.NewDefaultBuildState()
+	graph := state.Graph
+	target1 := core.NewBuildTarget(core.ParseBuildLabel("//package1:target1", ""))
+	target1.Command = "echo 'hello' > $OUT"
+	target1.Env = map[string]string{"KEY": "value"}
+	target2 := core.NewBuildTarget(core.ParseBuildLabel("//package1:target2", ""))
+	target2.AddLabel("manual")
+	target2.AddDependency(target1.Label)
+	target3 := core.NewBuildTarget(core.ParseBuildLabel("//package2:target3", ""))
+	target3.IsTest = true
+	target3.AddDependency(target2.Label)
+	hidden := core.NewBuildTarget(core.ParseBuildLabel("//package2:_target3#hidden", ""))
+	pkg1 := core.NewPackage("package1")
+	pkg1.AddTarget(target1)
+	pkg1.AddTarget(target2)
+	pkg2 := core.NewPackage("package2")
+	pkg2.AddTarget(target3)
+	pkg2.AddTarget(hidden)
+	graph.AddPackage(pkg1)
+	graph.AddPackage(pkg2)
+	for _, target := range []*core.BuildTarget{target1, target2, target3, hidden} {
+		graph.AddTarget(target)
+	}
+	graph.AddDependency(target2.Label, target1.Label)
+	graph.AddDependency(target3.Label, target2.Label)
+	return state
+}
@@ -3,13 +3,37 @@ package query
 import "fmt"
 import "path"
 import "github.com/thought-machine/please/src/core"
+import "github.com/thought-machine/please/src/fs"
 
 // TargetOutputs prints all output files for a set of targets.
+// Outputs of remotely built targets that haven't been downloaded are annotated with their digests.
 func TargetOutputs(graph *core.BuildGraph, labels []core.BuildLabel) {
 	for _, label := range labels {
-		target := graph.TargetOrDie(label)
-		for _, out := range target.Outputs() {
-			fmt.Printf("%s\n", path.Join(target.OutDir(), out))
+		for _, out := range targetOutputs(graph.TargetOrDie(label)) {
+			fmt.Printf("%s\n", out)
 		}
 	}
 }
+
+func targetOutputs(target *core.BuildTarget) []string {
+	remote, err := core.LoadRemoteOutputs(target)
+	if err != nil {
+		log.Warning("Failed to read remote outputs for %s: %s", target, err)
+	}
+	ret := make([]string, len(target.Outputs()))
+	for i, out := range target.Outputs() {
+		ret[i] = path.Join(target.OutDir(), out)
+		if remote == nil || fs.PathExists(ret[i]) {
+			continue
+		} else if o, present := remote.Outputs[out]; !present {
+			continue
+		} else if o.Symlink != "" {
+			ret[i] += " (remote symlink to " + o.Symlink + ")"
+		} else if o.IsDirectory {
+			ret[i] += " (remote directory " + o.Digest + ")"
+		} else {
+			ret[i] += " (remote " + o.Digest + ")"
+		}
+	}
+	return ret
+}
@@ -0,0 +1,40 @@
+package query
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestTargetOutputs(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/query/test_outputs:target1", ""))
+	target.AddOutput("local.txt")
+	target.AddOutput("remote.txt")
+	target.AddOutput("remote_dir")
+	assert.Equal(t, []string{
+		"plz-out/gen/src/query/test_outputs/local.txt",
+		"plz-out/gen/src/query/test_outputs/remote.txt",
+		"plz-out/gen/src/query/test_outputs/remote_dir",
+	}, targetOutputs(target))
+
+	assert.NoError(t, core.StoreRemoteOutputs(target, &core.RemoteOutputs{
+		Action: "4d3f0e63de66b3b0d61c5ca3a8f4c1f8ee0ee1c20aa00fdfe6b94bcc3bc9a4a3/142",
+		Outputs: map[string]core.RemoteOutput{
+			"local.txt":  {Digest: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03/6"},
+			"remote.txt": {Digest: "e70c151d26f755cea2162b627151416f4407ebc8502cea8e68f0d95a3950ea16/42"},
+			"remote_dir": {Digest: "a7f899acaabeaeecea132f782a5ebdddccd76fa1041f3e6d4a6e0d58638ffa0a/137", IsDirectory: true},
+		},
+	}))
+	defer os.RemoveAll("plz-out/gen/src/query/test_outputs")
+	// This one has been downloaded since, so isn't only held remotely any more.
+	assert.NoError(t, ioutil.WriteFile("plz-out/gen/src/query/test_outputs/local.txt", []byte("hello\n"), 0644))
+	assert.Equal(t, []string{
+		"plz-out/gen/src/query/test_outputs/local.txt",
+		"plz-out/gen/src/query/test_outputs/remote.txt (remote e70c151d26f755cea2162b627151416f4407ebc8502cea8e68f0d95a3950ea16/42)",
+		"plz-out/gen/src/query/test_outputs/remote_dir (remote directory a7f899acaabeaeecea132f782a5ebdddccd76fa1041f3e6d4a6e0d58638ffa0a/137)",
+	}, targetOutputs(target))
+}
@@ -21,6 +21,8 @@
 //             that are output by this rule.
 //   'graph': 'plz query graph' produces a JSON representation of the build graph
 //            that other programs can interpret for their own uses.
+//   'eval': 'plz query eval "deps(//src/...) except tests(//src/...)"' evaluates
+//           an expression combining the above with set operations; see Expr.
 package query
 
 import "gopkg.in/op/go-logging.v1"
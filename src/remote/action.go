@@ -55,6 +55,12 @@ func (c *Client) uploadAction(target *core.BuildTarget, isTest, isRun bool) (*pb
 
 // buildAction creates a build action for a target and returns the command and the action digest. No uploading is done.
 func (c *Client) buildAction(target *core.BuildTarget, isTest, stamp bool) (*pb.Command, *pb.Digest, error) {
+	return c.buildSaltedAction(target, isTest, stamp, nil)
+}
+
+// buildSaltedAction is like buildAction but sets the given salt on the action, which changes
+// its digest without affecting how it would be executed.
+func (c *Client) buildSaltedAction(target *core.BuildTarget, isTest, stamp bool, salt []byte) (*pb.Command, *pb.Digest, error) {
 	inputRoot, err := c.uploadInputs(nil, target, isTest)
 	if err != nil {
 		return nil, nil, err
@@ -69,6 +75,7 @@ func (c *Client) buildAction(target *core.BuildTarget, isTest, stamp bool) (*pb.
 		CommandDigest:   commandDigest,
 		InputRootDigest: inputRootDigest,
 		Timeout:         ptypes.DurationProto(timeout(target, isTest)),
+		Salt:            salt,
 	})
 	return command, actionDigest, nil
 }
@@ -99,10 +106,20 @@ func (c *Client) buildCommand(target *core.BuildTarget, inputRoot *pb.Directory,
 		// Synthesize something for the Command proto. We never execute this, but it does get hashed for caching
 		// purposes so it's useful to have it be a minimal expression of what we care about (for example, it should
 		// not include the environment variables since we don't communicate those to the remote server).
+		args := []string{
+			"fetch", strings.Join(target.AllURLs(state), " "), "verify", strings.Join(target.Hashes, " "),
+		}
+		if len(target.URLHeaders) > 0 {
+			// These are hashed unexpanded, for the same reason as the environment.
+			headers := make([]string, 0, len(target.URLHeaders))
+			for k, v := range target.URLHeaders {
+				headers = append(headers, k+": "+v)
+			}
+			sort.Strings(headers)
+			args = append(args, "headers", strings.Join(headers, "\n"))
+		}
 		return &pb.Command{
-			Arguments: []string{
-				"fetch", strings.Join(target.AllURLs(state), " "), "verify", strings.Join(target.Hashes, " "),
-			},
+			Arguments:         args,
 			OutputFiles:       files,
 			OutputDirectories: dirs,
 			OutputPaths:       append(files, dirs...),
@@ -112,14 +129,15 @@ func (c *Client) buildCommand(target *core.BuildTarget, inputRoot *pb.Directory,
 	if cmd == "" {
 		cmd = "true"
 	}
-	cmd, err := core.ReplaceSequences(state, target, cmd)
+	cmd, err := core.ReplaceRemoteSequences(state, target, cmd)
 	return &pb.Command{
-		Platform:             c.platform,
+		Platform:             c.targetPlatform(target),
 		Arguments:            process.BashCommand(c.shellPath, commandPrefix+cmd, state.Config.Build.ExitOnError),
 		EnvironmentVariables: c.buildEnv(target, c.stampedBuildEnvironment(state, target, inputRoot, stamp), target.Sandbox),
 		OutputFiles:          files,
 		OutputDirectories:    dirs,
 		OutputPaths:          append(files, dirs...),
+		OutputNodeProperties: c.outputNodeProperties(),
 	}, err
 }
 
@@ -157,14 +175,14 @@ func (c *Client) buildTestCommand(state *core.BuildState, target *core.BuildTarg
 		cmd += " " + strings.Join(state.TestArgs, " ")
 	}
 	return &pb.Command{
-		Platform: &pb.Platform{
+		Platform: mergePlatform(&pb.Platform{
 			Properties: []*pb.Platform_Property{
 				{
 					Name:  "OSFamily",
 					Value: translateOS(target.Subrepo),
 				},
 			},
-		},
+		}, target.RemotePlatform),
 		Arguments:            process.BashCommand(c.shellPath, commandPrefix+cmd, state.Config.Build.ExitOnError),
 		EnvironmentVariables: c.buildEnv(nil, core.TestEnvironment(state, target, "."), target.TestSandbox),
 		OutputFiles:          files,
@@ -180,7 +198,7 @@ func (c *Client) buildRunCommand(state *core.BuildState, target *core.BuildTarge
 		return nil, fmt.Errorf("Target %s has no outputs, it can't be run with `plz run`", target)
 	}
 	return &pb.Command{
-		Platform:             c.platform,
+		Platform:             c.targetPlatform(target),
 		Arguments:            outs,
 		EnvironmentVariables: c.buildEnv(target, core.GeneralBuildEnvironment(state), false),
 	}, nil
@@ -205,8 +223,14 @@ func (c *Client) uploadInputDir(ch chan<- *uploadinfo.Entry, target *core.BuildT
 	for input := range c.iterInputs(target, isTest, target.IsFilegroup) {
 		if l := input.Label(); l != nil {
 			o := c.targetOutputs(*l)
-			if o == nil {
-				if dep := c.state.Graph.TargetOrDie(*l); dep.Local {
+			if o == nil && c.cacheOnly {
+				// Everything has been built locally, so hash its outputs straight from disk.
+				if err := c.uploadInput(b, ch, input); err != nil {
+					return nil, err
+				}
+				continue
+			} else if o == nil {
+				if dep := c.state.Graph.TargetOrDie(*l); c.builtLocally(dep) {
 					// We have built this locally, need to upload its outputs
 					if err := c.uploadLocalTarget(dep); err != nil {
 						return nil, err
@@ -230,9 +254,10 @@ func (c *Client) uploadInputDir(ch chan<- *uploadinfo.Entry, target *core.BuildT
 			for _, f := range o.Files {
 				d := b.Dir(path.Join(pkgName, path.Dir(f.Name)))
 				d.Files = append(d.Files, &pb.FileNode{
-					Name:         path.Base(f.Name),
-					Digest:       f.Digest,
-					IsExecutable: f.IsExecutable,
+					Name:           path.Base(f.Name),
+					Digest:         f.Digest,
+					IsExecutable:   f.IsExecutable,
+					NodeProperties: f.NodeProperties,
 				})
 			}
 			for _, d := range o.Directories {
@@ -278,7 +303,7 @@ func (c *Client) uploadInputDir(ch chan<- *uploadinfo.Entry, target *core.BuildT
 // addChildDirs adds a set of child directories to a builder.
 func (c *Client) addChildDirs(b *dirBuilder, name string, dg *pb.Digest) error {
 	dir := &pb.Directory{}
-	if _, err := c.client.ReadProto(context.Background(), digest.NewFromProtoUnvalidated(dg), dir); err != nil {
+	if err := c.readProto(context.Background(), digest.NewFromProtoUnvalidated(dg), dir); err != nil {
 		return err
 	}
 	d := b.Dir(name)
@@ -332,9 +357,10 @@ func (c *Client) uploadInput(b *dirBuilder, ch chan<- *uploadinfo.Entry, input c
 				SizeBytes: info.Size(),
 			}
 			d.Files = append(d.Files, &pb.FileNode{
-				Name:         path.Base(dest),
-				Digest:       dg,
-				IsExecutable: info.Mode()&0100 != 0,
+				Name:           path.Base(dest),
+				Digest:         dg,
+				IsExecutable:   info.Mode()&0100 != 0,
+				NodeProperties: c.nodeProperties(info.Mode()),
 			})
 			if ch != nil {
 				ch <- uploadinfo.EntryFromFile(digest.NewFromProtoUnvalidated(dg), name)
@@ -374,14 +400,14 @@ func (c *Client) buildMetadata(ar *pb.ActionResult, needStdout, needStderr bool)
 		Stderr: ar.StderrRaw,
 	}
 	if needStdout && len(metadata.Stdout) == 0 && ar.StdoutDigest != nil {
-		b, _, err := c.client.ReadBlob(context.Background(), digest.NewFromProtoUnvalidated(ar.StdoutDigest))
+		b, err := c.readBlob(context.Background(), digest.NewFromProtoUnvalidated(ar.StdoutDigest))
 		if err != nil {
 			return metadata, err
 		}
 		metadata.Stdout = b
 	}
 	if needStderr && len(metadata.Stderr) == 0 && ar.StderrDigest != nil {
-		b, _, err := c.client.ReadBlob(context.Background(), digest.NewFromProtoUnvalidated(ar.StderrDigest))
+		b, err := c.readBlob(context.Background(), digest.NewFromProtoUnvalidated(ar.StderrDigest))
 		if err != nil {
 			return metadata, err
 		}
@@ -466,7 +492,7 @@ func (c *Client) verifyActionResult(target *core.BuildTarget, command *pb.Comman
 			digests = append(digests, output.Digest)
 		}
 	}
-	if missing, err := c.client.MissingBlobs(context.Background(), digests); err != nil {
+	if missing, err := c.missingBlobs(context.Background(), digests); err != nil {
 		return fmt.Errorf("Failed to verify action result outputs: %s", err)
 	} else if len(missing) != 0 {
 		return fmt.Errorf("Action result missing %d blobs", len(missing))
@@ -487,6 +513,8 @@ func (c *Client) uploadLocalTarget(target *core.BuildTarget) error {
 	}
 	if err := c.uploadIfMissing(context.Background(), entries); err != nil {
 		return err
+	} else if err := c.addLocalOutputProperties(target, ar); err != nil {
+		return err
 	}
 	return c.setOutputs(target, ar)
 }
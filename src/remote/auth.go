@@ -0,0 +1,262 @@
+// Authentication to the remote server, via TLS client certificates and per-RPC tokens.
+
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// The names of the endpoints that can be given their own credentials, as they appear in the config.
+const (
+	endpointURL   = "url"
+	endpointCAS   = "casurl"
+	endpointAsset = "asseturl"
+)
+
+// authFor returns the credentials to use for the given endpoint.
+// Anything not set specifically for it is taken from the [remote] section.
+func authFor(config *core.Configuration, endpoint string) core.RemoteAuth {
+	auth := core.RemoteAuth{
+		TokenFile:      config.Remote.TokenFile,
+		TokenCommand:   config.Remote.TokenCommand,
+		CACertFile:     config.Remote.CACertFile,
+		ClientCertFile: config.Remote.ClientCertFile,
+		ClientKeyFile:  config.Remote.ClientKeyFile,
+	}
+	if override, present := config.RemoteAuth[endpoint]; present {
+		if override.TokenFile != "" || override.TokenCommand != "" {
+			auth.TokenFile = override.TokenFile
+			auth.TokenCommand = override.TokenCommand
+		}
+		if override.CACertFile != "" {
+			auth.CACertFile = override.CACertFile
+		}
+		if override.ClientCertFile != "" || override.ClientKeyFile != "" {
+			auth.ClientCertFile = override.ClientCertFile
+			auth.ClientKeyFile = override.ClientKeyFile
+		}
+	}
+	return auth
+}
+
+// checkAuthConfig checks that the per-endpoint auth config is consistent.
+func checkAuthConfig(config *core.Configuration) error {
+	for endpoint := range config.RemoteAuth {
+		if endpoint != endpointURL && endpoint != endpointCAS && endpoint != endpointAsset {
+			return fmt.Errorf("Unknown endpoint in [remoteauth \"%s\"]; must be one of %s, %s or %s", endpoint, endpointURL, endpointCAS, endpointAsset)
+		}
+	}
+	for _, endpoint := range []string{endpointURL, endpointCAS, endpointAsset} {
+		if auth := authFor(config, endpoint); auth.TokenFile != "" && auth.TokenCommand != "" {
+			return fmt.Errorf("Can't set both a token file and a token command for the %s endpoint", endpoint)
+		} else if (auth.TokenFile != "" || auth.TokenCommand != "") && config.Remote.TokenRefresh <= 0 {
+			return fmt.Errorf("TokenRefresh must be positive, was %s", time.Duration(config.Remote.TokenRefresh))
+		} else if (auth.ClientCertFile == "") != (auth.ClientKeyFile == "") {
+			return fmt.Errorf("Must set both or neither of a client certificate and key for the %s endpoint", endpoint)
+		}
+	}
+	if config.Remote.CASURL != "" {
+		main, cas := authFor(config, endpointURL), authFor(config, endpointCAS)
+		if main.CACertFile != cas.CACertFile || main.ClientCertFile != cas.ClientCertFile {
+			return fmt.Errorf("The url and casurl endpoints must use the same TLS settings")
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS config for connecting to an endpoint with the given credentials.
+func tlsConfig(auth core.RemoteAuth) (*tls.Config, error) {
+	config := &tls.Config{}
+	if auth.CACertFile != "" {
+		b, err := ioutil.ReadFile(auth.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificates: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("Failed to load any CA certificates from %s", auth.CACertFile)
+		}
+	}
+	if auth.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(auth.ClientCertFile, auth.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tokenCommandTimeout is how long we allow a credential helper command to run for.
+// It's run while holding the token source's lock, which would otherwise block every RPC if it hung.
+var tokenCommandTimeout = 30 * time.Second
+
+// A tokenSource provides a token from a file or a credential helper command, refreshing it periodically.
+type tokenSource struct {
+	file, command string
+	refresh       time.Duration
+	mutex         sync.Mutex
+	token         string
+	fetched       time.Time
+}
+
+// Token returns the current token, refreshing it first if needed.
+// If refreshing fails, the previous token is used (if there was one) on the basis that it may well still be valid.
+func (ts *tokenSource) Token() (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.token != "" && time.Since(ts.fetched) < ts.refresh {
+		return ts.token, nil
+	}
+	token, err := ts.fetch()
+	if err != nil {
+		if ts.token == "" {
+			return "", err
+		}
+		log.Warning("Failed to refresh remote authentication token, will continue with the current one: %s", err)
+		ts.fetched = time.Now() // Don't retry on every RPC
+		return ts.token, nil
+	}
+	ts.token = token
+	ts.fetched = time.Now()
+	return token, nil
+}
+
+func (ts *tokenSource) fetch() (string, error) {
+	if ts.file != "" {
+		b, err := ioutil.ReadFile(ts.file)
+		if err != nil {
+			return "", fmt.Errorf("Failed to load token from file: %s", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	out, err := runTokenCommand(ts.command)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("Failed to run token command: %s\n%s", err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("Failed to run token command: %s", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("Token command didn't print a token")
+	}
+	return token, nil
+}
+
+// runTokenCommand runs a credential helper command and returns its output.
+// The command is killed if it runs for longer than tokenCommandTimeout; we don't wait for its output
+// after that since anything it started in the background may still be holding onto it.
+func runTokenCommand(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenCommandTimeout)
+	defer cancel()
+	type result struct {
+		out []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		out, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+		ch <- result{out: out, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.out, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out after %s", tokenCommandTimeout)
+	}
+}
+
+// endpointCredentials attaches tokens to outgoing RPCs, choosing them based on the server the RPC is going to.
+// It implements grpc's credentials.PerRPCCredentials.
+type endpointCredentials struct {
+	// Keyed by host:port of each endpoint.
+	sources map[string]*tokenSource
+	// Used for any endpoint we don't recognise (which shouldn't really happen).
+	fallback *tokenSource
+}
+
+// newEndpointCredentials returns the credentials for the given endpoints (keyed by the names in the config),
+// or nil if none of them are configured to use tokens.
+func newEndpointCredentials(config *core.Configuration, addresses map[string]string) *endpointCredentials {
+	creds := &endpointCredentials{sources: map[string]*tokenSource{}}
+	// Endpoints that share a token file or command share the same source, so we only refresh it once.
+	sources := map[core.RemoteAuth]*tokenSource{}
+	for _, endpoint := range []string{endpointURL, endpointCAS, endpointAsset} {
+		addr, present := addresses[endpoint]
+		auth := authFor(config, endpoint)
+		if !present || addr == "" || (auth.TokenFile == "" && auth.TokenCommand == "") {
+			continue
+		}
+		key := core.RemoteAuth{TokenFile: auth.TokenFile, TokenCommand: auth.TokenCommand}
+		source, present := sources[key]
+		if !present {
+			source = &tokenSource{file: auth.TokenFile, command: auth.TokenCommand, refresh: time.Duration(config.Remote.TokenRefresh)}
+			sources[key] = source
+		}
+		creds.sources[endpointAddress(addr)] = source
+		if endpoint == endpointURL {
+			creds.fallback = source
+		}
+	}
+	if len(creds.sources) == 0 {
+		return nil
+	}
+	return creds
+}
+
+// Check fetches all the tokens, returning an error if any of them can't be.
+func (creds *endpointCredentials) Check() error {
+	for _, source := range creds.sources {
+		if _, err := source.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRequestMetadata implements the credentials.PerRPCCredentials interface.
+// The uri is of the form https://host:port/service.
+func (creds *endpointCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	source := creds.fallback
+	if len(uri) > 0 {
+		if u, err := url.Parse(uri[0]); err == nil {
+			if s, present := creds.sources[endpointAddress(u.Host)]; present {
+				source = s
+			}
+		}
+	}
+	if source == nil {
+		return nil, nil // This endpoint doesn't need a token.
+	}
+	token, err := source.Token()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity implements the credentials.PerRPCCredentials interface.
+func (creds *endpointCredentials) RequireTransportSecurity() bool {
+	return false // Allow these to be provided over an insecure channel; this facilitates e.g. service meshes like Istio.
+}
+
+// endpointAddress normalises the address of an endpoint for comparison.
+// grpc omits the port from the URIs it gives us when it's the default one.
+func endpointAddress(addr string) string {
+	if idx := strings.Index(addr, "://"); idx != -1 {
+		addr = addr[idx+3:]
+	}
+	return strings.TrimSuffix(addr, ":443")
+}
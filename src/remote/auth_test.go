@@ -0,0 +1,154 @@
+package remote
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestTokenFileRefresh(t *testing.T) {
+	filename := writeToken(t, "token1\n")
+	ts := &tokenSource{file: filename, refresh: 50 * time.Millisecond}
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	// Doesn't change until the refresh interval is up.
+	writeTokenTo(t, filename, "token2")
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	time.Sleep(60 * time.Millisecond)
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token2", token)
+}
+
+func TestTokenRefreshFailureKeepsOldToken(t *testing.T) {
+	filename := writeToken(t, "token1")
+	ts := &tokenSource{file: filename}
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	assert.NoError(t, os.Remove(filename))
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+}
+
+func TestTokenCommand(t *testing.T) {
+	ts := &tokenSource{command: "echo tok3n"}
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "tok3n", token)
+
+	ts = &tokenSource{command: "echo nope >&2 && false"}
+	_, err = ts.Token()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "nope")
+}
+
+func TestTokenCommandTimeout(t *testing.T) {
+	oldTimeout := tokenCommandTimeout
+	tokenCommandTimeout = 50 * time.Millisecond
+	defer func() { tokenCommandTimeout = oldTimeout }()
+	ts := &tokenSource{command: "sleep 60"}
+	start := time.Now()
+	_, err := ts.Token()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
+
+func TestEndpointCredentials(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.TokenCommand = "echo main"
+	config.Remote.TokenRefresh = cli.Duration(time.Hour)
+	config.RemoteAuth = map[string]*core.RemoteAuth{
+		endpointAsset: {TokenCommand: "echo asset"},
+	}
+	assert.NoError(t, checkAuthConfig(config))
+	creds := newEndpointCredentials(config, map[string]string{
+		endpointURL:   "grpcs://remote.example.com:443",
+		endpointCAS:   "cas.example.com:8980",
+		endpointAsset: "asset.example.com:8981",
+	})
+	assert.NoError(t, creds.Check())
+	// The url and casurl endpoints share a source.
+	assert.Equal(t, 2, len(map[*tokenSource]bool{
+		creds.sources["remote.example.com"]:     true,
+		creds.sources["cas.example.com:8980"]:   true,
+		creds.sources["asset.example.com:8981"]: true,
+	}))
+	for uri, expected := range map[string]string{
+		"https://remote.example.com/build.bazel.remote.execution.v2.Execution":                   "Bearer main",
+		"https://cas.example.com:8980/build.bazel.remote.execution.v2.ContentAddressableStorage": "Bearer main",
+		"https://asset.example.com:8981/build.bazel.remote.asset.v1.Fetch":                       "Bearer asset",
+		"https://unknown.example.com/build.bazel.remote.execution.v2.Execution":                  "Bearer main",
+	} {
+		md, err := creds.GetRequestMetadata(context.Background(), uri)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, md["authorization"], uri)
+	}
+}
+
+func TestNoEndpointCredentials(t *testing.T) {
+	config := core.DefaultConfiguration()
+	assert.Nil(t, newEndpointCredentials(config, map[string]string{endpointURL: "127.0.0.1:8980"}))
+}
+
+func TestCheckAuthConfig(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.CASURL = "cas.example.com:443"
+	config.RemoteAuth = map[string]*core.RemoteAuth{"wibble": {}}
+	assert.Error(t, checkAuthConfig(config))
+
+	config.RemoteAuth = map[string]*core.RemoteAuth{endpointAsset: {TokenFile: "token", TokenCommand: "echo token"}}
+	assert.Error(t, checkAuthConfig(config))
+
+	config.RemoteAuth = map[string]*core.RemoteAuth{endpointAsset: {ClientCertFile: "client.crt"}}
+	assert.Error(t, checkAuthConfig(config))
+
+	// The asset endpoint can have its own certificates, but the CAS one must match the main one.
+	config.RemoteAuth = map[string]*core.RemoteAuth{endpointAsset: {ClientCertFile: "client.crt", ClientKeyFile: "client.key"}}
+	assert.NoError(t, checkAuthConfig(config))
+	config.RemoteAuth = map[string]*core.RemoteAuth{endpointCAS: {ClientCertFile: "client.crt", ClientKeyFile: "client.key"}}
+	assert.Error(t, checkAuthConfig(config))
+
+	config.RemoteAuth = map[string]*core.RemoteAuth{endpointAsset: {TokenCommand: "echo token"}}
+	assert.NoError(t, checkAuthConfig(config))
+	config.Remote.TokenRefresh = 0
+	assert.Error(t, checkAuthConfig(config))
+}
+
+func TestTLSConfig(t *testing.T) {
+	config, err := tlsConfig(core.RemoteAuth{})
+	assert.NoError(t, err)
+	assert.Nil(t, config.RootCAs)
+	assert.Equal(t, 0, len(config.Certificates))
+
+	_, err = tlsConfig(core.RemoteAuth{CACertFile: writeToken(t, "not a certificate")})
+	assert.Error(t, err)
+
+	_, err = tlsConfig(core.RemoteAuth{ClientCertFile: "missing.crt", ClientKeyFile: "missing.key"})
+	assert.Error(t, err)
+}
+
+func writeToken(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "auth_test")
+	assert.NoError(t, err)
+	filename := path.Join(dir, "token")
+	writeTokenTo(t, filename, contents)
+	return filename
+}
+
+func writeTokenTo(t *testing.T, filename, contents string) {
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+}
@@ -30,7 +30,10 @@ func (c *Client) uploadIfMissing(ctx context.Context, chomks []*uploadinfo.Entry
 	filtered := c.filterEntries(chomks)
 	if len(filtered) == 0 {
 		return nil
-	} else if _, _, err := c.client.UploadIfMissing(ctx, filtered...); err != nil {
+	} else if err := c.retry(ctx, rpcCASWrite, func() error {
+		_, _, err := c.client.UploadIfMissing(ctx, filtered...)
+		return err
+	}); err != nil {
 		return err
 	}
 	c.existingBlobMutex.Lock()
@@ -0,0 +1,127 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/uploadinfo"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// A Cache is an implementation of core.Cache that stores locally built targets in the
+// action cache & CAS of a remote execution server.
+//
+// Results are stored under the action digests that remote execution would use for them, salted
+// with the cache key so that different keys map to different action results. The server does not
+// need to support execution itself.
+type Cache struct {
+	client    *Client
+	writeable bool
+}
+
+// NewCache returns a new Cache communicating with the server configured in the [cache] section.
+// Like New, it begins contacting the server but does not wait for it.
+func NewCache(state *core.BuildState) *Cache {
+	return &Cache{
+		client:    newClientFor(state, state.Config.Cache.RemoteURL, state.Config.Cache.RemoteURL, true),
+		writeable: state.Config.Cache.RemoteWriteable,
+	}
+}
+
+// Store uploads the given outputs of a target and records an action result for them.
+func (cache *Cache) Store(target *core.BuildTarget, key []byte, files []string) {
+	if !cache.writeable {
+		return
+	}
+	if err := cache.store(target, key, files); err != nil {
+		log.Warning("Failed to store %s in remote cache: %s", target.Label, err)
+	}
+}
+
+func (cache *Cache) store(target *core.BuildTarget, key []byte, files []string) error {
+	c := cache.client
+	if err := c.CheckInitialised(); err != nil {
+		return err
+	}
+	_, digest, err := c.buildSaltedAction(target, false, false, key)
+	if err != nil {
+		return err
+	}
+	m, ar, err := c.client.ComputeOutputsToUpload(target.OutDir(), files, filemetadata.NewNoopCache())
+	if err != nil {
+		return err
+	}
+	entries := make([]*uploadinfo.Entry, 0, len(m))
+	for _, entry := range m {
+		entries = append(entries, entry)
+	}
+	if err := c.uploadIfMissing(context.Background(), entries); err != nil {
+		return err
+	}
+	if err := c.updateActionResult(context.Background(), &pb.UpdateActionResultRequest{
+		InstanceName: c.instance,
+		ActionDigest: digest,
+		ActionResult: ar,
+	}); err != nil {
+		return fmt.Errorf("Error updating action result: %s", err)
+	}
+	log.Debug("Stored %s in remote cache %s", target.Label, c.actionURL(digest, true))
+	return nil
+}
+
+// Retrieve looks up the action result for a target and downloads its outputs if found.
+func (cache *Cache) Retrieve(target *core.BuildTarget, key []byte, files []string) bool {
+	ok, err := cache.retrieve(target, key, files)
+	if err != nil {
+		log.Warning("%s: Failed to retrieve files from remote cache: %s", target.Label, err)
+	}
+	return ok
+}
+
+func (cache *Cache) retrieve(target *core.BuildTarget, key []byte, files []string) (bool, error) {
+	c := cache.client
+	if err := c.CheckInitialised(); err != nil {
+		return false, err
+	}
+	_, digest, err := c.buildSaltedAction(target, false, false, key)
+	if err != nil {
+		return false, err
+	}
+	ar, err := c.getActionResult(context.Background(), &pb.GetActionResultRequest{
+		InstanceName: c.instance,
+		ActionDigest: digest,
+	})
+	if IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// The same action might have been stored with a different set of files (e.g. only the
+	// metadata file for targets with post-build functions); make sure we have everything.
+	outs := outputsForActionResult(ar)
+	for _, file := range files {
+		if !outs[file] {
+			log.Debug("Remote cache entry for %s is missing %s", target.Label, file)
+			return false, nil
+		}
+	}
+	if err := removeOutputs(target); err != nil {
+		return false, err
+	} else if err := c.downloadOutputs(context.Background(), ar, target.OutDir()); err != nil {
+		return false, c.wrapActionErr(err, digest)
+	}
+	log.Debug("Retrieved %s from remote cache %s", target.Label, c.actionURL(digest, true))
+	return true, nil
+}
+
+// Clean is not possible for this implementation; the server is responsible for expiring entries.
+func (cache *Cache) Clean(target *core.BuildTarget) {}
+
+// CleanAll is also not possible.
+func (cache *Cache) CleanAll() {}
+
+// Shutdown is a no-op since all requests are synchronous.
+func (cache *Cache) Shutdown() {}
@@ -0,0 +1,80 @@
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func newCache() *Cache {
+	config := core.DefaultConfiguration()
+	config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	config.Build.HashFunction = "sha256"
+	config.Remote.Instance = "wibble"
+	config.Remote.Secure = false
+	config.Cache.RemoteURL = "127.0.0.1:9987"
+	config.Cache.RemoteWriteable = true
+	return NewCache(core.NewBuildState(config))
+}
+
+func newCacheTarget(name, contents string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: name})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput(name + ".txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "cp $SRC $OUT"
+	if err := ioutil.WriteFile("plz-out/gen/package/"+name+".txt", []byte(contents), 0644); err != nil {
+		panic(err)
+	}
+	return target
+}
+
+func TestCacheStoreAndRetrieve(t *testing.T) {
+	cache := newCache()
+	target := newCacheTarget("cache_target1", "wibble")
+	assert.False(t, cache.Retrieve(target, nil, target.Outputs()))
+	cache.Store(target, nil, target.Outputs())
+	assert.NoError(t, os.Remove("plz-out/gen/package/cache_target1.txt"))
+	assert.True(t, cache.Retrieve(target, nil, target.Outputs()))
+	b, err := ioutil.ReadFile("plz-out/gen/package/cache_target1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "wibble", string(b))
+}
+
+func TestCacheRetrieveMissingFiles(t *testing.T) {
+	cache := newCache()
+	target := newCacheTarget("cache_target2", "wobble")
+	cache.Store(target, nil, target.Outputs())
+	// This wasn't stored, so the entry isn't usable.
+	assert.False(t, cache.Retrieve(target, nil, []string{"cache_target2.txt", "something_else.txt"}))
+}
+
+func TestCacheReadOnly(t *testing.T) {
+	cache := newCache()
+	cache.writeable = false
+	target := newCacheTarget("cache_target3", "wubble")
+	cache.Store(target, nil, target.Outputs())
+	assert.False(t, cache.Retrieve(target, nil, target.Outputs()))
+}
+
+func TestCacheKeysAreDistinct(t *testing.T) {
+	cache := newCache()
+	target := newCacheTarget("cache_target4", "wabble")
+	cache.Store(target, []byte("key1"), target.Outputs())
+	assert.NoError(t, os.Remove("plz-out/gen/package/cache_target4.txt"))
+	assert.False(t, cache.Retrieve(target, []byte("key2"), target.Outputs()))
+	assert.True(t, cache.Retrieve(target, []byte("key1"), target.Outputs()))
+}
+
+func TestCacheDoesNotNeedExecution(t *testing.T) {
+	defer server.Reset()
+	server.noExecution = true
+	cache := newCache()
+	assert.NoError(t, cache.client.CheckInitialised())
+	assert.Error(t, newClientFor(cache.client.state, cache.client.url, cache.client.casURL, false).CheckInitialised())
+}
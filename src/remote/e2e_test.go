@@ -0,0 +1,84 @@
+package remote
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/thought-machine/please/src/core"
+	rserver "github.com/thought-machine/please/src/remote/server"
+)
+
+// These tests run against a real server rather than the mocks in impl_test.go.
+
+func TestEndToEndBuild(t *testing.T) {
+	c := newEndToEndClient(t)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "e2e_target"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddSource(core.FileLabel{File: "src2.txt", Package: "package"})
+	target.AddOutput("e2e_out.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "cat $SRCS > $OUT"
+	c.state.AddOriginalTarget(target.Label, true)
+	c.state.DownloadOutputs = true
+	c.state.Graph.AddTarget(target)
+	defer os.Remove(filepath.Join(target.OutDir(), "e2e_out.txt"))
+	metadata, err := c.Build(0, target)
+	require.NoError(t, err)
+	assert.False(t, metadata.Cached)
+
+	expected, err := ioutil.ReadFile("package/src1.txt")
+	require.NoError(t, err)
+	src2, err := ioutil.ReadFile("package/src2.txt")
+	require.NoError(t, err)
+	expected = append(expected, src2...)
+	out, err := ioutil.ReadFile(filepath.Join(target.OutDir(), "e2e_out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, out)
+
+	// Building the same target again should come from the server's action cache.
+	metadata, err = c.Build(0, target)
+	require.NoError(t, err)
+	assert.True(t, metadata.Cached)
+}
+
+func TestEndToEndBuildFailure(t *testing.T) {
+	c := newEndToEndClient(t)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "e2e_failure"})
+	target.AddOutput("e2e_failure.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "echo failed >&2 && exit 1"
+	_, err := c.Build(0, target)
+	assert.Error(t, err)
+}
+
+// newEndToEndClient starts a real server on a random port and returns a client connected to it.
+func newEndToEndClient(t *testing.T) *Client {
+	dir, err := ioutil.TempDir("", "remote_e2e_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := rserver.New(dir, "sha256", "", 2)
+	require.NoError(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	s.Register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	config := core.DefaultConfiguration()
+	config.Build.Path = []string{"/usr/local/bin", "/usr/bin", "/bin"}
+	config.Build.HashFunction = "sha256"
+	config.Remote.NumExecutors = 1
+	config.Remote.Instance = "e2e"
+	config.Remote.Secure = false
+	config.Remote.URL = lis.Addr().String()
+	return New(core.NewBuildState(config))
+}
@@ -54,10 +54,16 @@ type testServer struct {
 	blobs                         map[string][]byte
 	bytestreams                   map[string][]byte
 	mockActionResult              *pb.ActionResult
+	noExecution                   bool
+	dropExecution                 bool
+	droppedExecution              *pb.ExecuteRequest
+	resumedExecution              bool
+	fetchRequests                 []*fpb.FetchBlobRequest
+	pushRequests                  []*fpb.PushBlobRequest
 }
 
 func (s *testServer) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
-	return &pb.ServerCapabilities{
+	caps := &pb.ServerCapabilities{
 		CacheCapabilities: &pb.CacheCapabilities{
 			DigestFunction: s.DigestFunction,
 			ActionCacheUpdateCapabilities: &pb.ActionCacheUpdateCapabilities{
@@ -66,12 +72,17 @@ func (s *testServer) GetCapabilities(ctx context.Context, req *pb.GetCapabilitie
 			MaxBatchTotalSizeBytes: 2048,
 		},
 		ExecutionCapabilities: &pb.ExecutionCapabilities{
-			DigestFunction: pb.DigestFunction_SHA256,
-			ExecEnabled:    true,
+			DigestFunction:          pb.DigestFunction_SHA256,
+			ExecEnabled:             true,
+			SupportedNodeProperties: []string{"unix_mode"},
 		},
 		LowApiVersion:  &s.LowAPIVersion,
 		HighApiVersion: &s.HighAPIVersion,
-	}, nil
+	}
+	if s.noExecution {
+		caps.ExecutionCapabilities = nil
+	}
+	return caps, nil
 }
 
 func (s *testServer) Reset() {
@@ -85,6 +96,12 @@ func (s *testServer) Reset() {
 	s.blobs = map[string][]byte{}
 	s.bytestreams = map[string][]byte{}
 	s.mockActionResult = nil
+	s.noExecution = false
+	s.dropExecution = false
+	s.droppedExecution = nil
+	s.resumedExecution = false
+	s.fetchRequests = nil
+	s.pushRequests = nil
 }
 
 func (s *testServer) GetActionResult(ctx context.Context, req *pb.GetActionResultRequest) (*pb.ActionResult, error) {
@@ -156,8 +173,31 @@ func (s *testServer) BatchReadBlobs(ctx context.Context, req *pb.BatchReadBlobsR
 	return resp, nil
 }
 
-func (s *testServer) GetTree(*pb.GetTreeRequest, pb.ContentAddressableStorage_GetTreeServer) error {
-	return status.Errorf(codes.Unimplemented, "GetTree not implemented for test")
+func (s *testServer) GetTree(req *pb.GetTreeRequest, srv pb.ContentAddressableStorage_GetTreeServer) error {
+	s.checkDigest(req.RootDigest)
+	resp := &pb.GetTreeResponse{}
+	var walk func(dg *pb.Digest) error
+	walk = func(dg *pb.Digest) error {
+		blob, present := s.blobs[dg.Hash]
+		if !present {
+			return status.Errorf(codes.NotFound, "Blob %s not found", dg.Hash)
+		}
+		dir := &pb.Directory{}
+		if err := proto.Unmarshal(blob, dir); err != nil {
+			return err
+		}
+		resp.Directories = append(resp.Directories, dir)
+		for _, d := range dir.Directories {
+			if err := walk(d.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(req.RootDigest); err != nil {
+		return err
+	}
+	return srv.Send(resp)
 }
 
 func (s *testServer) Read(req *bs.ReadRequest, srv bs.ByteStream_ReadServer) error {
@@ -266,6 +306,12 @@ func (s *testServer) Execute(req *pb.ExecuteRequest, srv pb.Execution_ExecuteSer
 			Stage: pb.ExecutionStage_CACHE_CHECK,
 		}),
 	})
+	if s.dropExecution {
+		// Simulate the stream breaking while the action is in progress; the client should resume it.
+		s.dropExecution = false
+		s.droppedExecution = req
+		return status.Errorf(codes.Unavailable, "stream dropped")
+	}
 	queued := toTimestamp(time.Now())
 	srv.Send(&longrunning.Operation{
 		Name: "geoff",
@@ -392,8 +438,14 @@ func (s *testServer) Execute(req *pb.ExecuteRequest, srv pb.Execution_ExecuteSer
 	return nil
 }
 
-func (s *testServer) WaitExecution(*pb.WaitExecutionRequest, pb.Execution_WaitExecutionServer) error {
-	return fmt.Errorf("not implemented")
+func (s *testServer) WaitExecution(req *pb.WaitExecutionRequest, srv pb.Execution_WaitExecutionServer) error {
+	if s.droppedExecution == nil || req.Name != "geoff" {
+		return status.Errorf(codes.NotFound, "unknown operation %s", req.Name)
+	}
+	s.resumedExecution = true
+	req2 := s.droppedExecution
+	s.droppedExecution = nil
+	return s.Execute(req2, srv)
 }
 
 // checkDigest checks a digest is structurally valid and panics if not.
@@ -427,9 +479,10 @@ func (s *testServer) RecoverStreamPanics(srv interface{}, ss grpc.ServerStream,
 }
 
 func (s *testServer) FetchBlob(ctx context.Context, req *fpb.FetchBlobRequest) (*fpb.FetchBlobResponse, error) {
+	s.fetchRequests = append(s.fetchRequests, req)
 	// This is a little overly specific but wevs
-	if len(req.Qualifiers) != 1 {
-		return nil, fmt.Errorf("Expected exactly one qualifier, got %s", req.Qualifiers)
+	if len(req.Qualifiers) == 0 {
+		return nil, fmt.Errorf("Expected at least one qualifier, got %s", req.Qualifiers)
 	} else if req.Qualifiers[0].Name != "checksum.sri" {
 		return nil, fmt.Errorf("Missing checksum.sri qualifier")
 	}
@@ -449,6 +502,18 @@ func (s *testServer) FetchBlob(ctx context.Context, req *fpb.FetchBlobRequest) (
 	}, nil
 }
 
+func (s *testServer) PushBlob(ctx context.Context, req *fpb.PushBlobRequest) (*fpb.PushBlobResponse, error) {
+	if _, present := s.blobs[req.BlobDigest.Hash]; !present {
+		return nil, status.Errorf(codes.FailedPrecondition, "Blob %s not found", req.BlobDigest.Hash)
+	}
+	s.pushRequests = append(s.pushRequests, req)
+	return &fpb.PushBlobResponse{}, nil
+}
+
+func (s *testServer) PushDirectory(ctx context.Context, req *fpb.PushDirectoryRequest) (*fpb.PushDirectoryResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
 func (s *testServer) FetchDirectory(ctx context.Context, req *fpb.FetchDirectoryRequest) (*fpb.FetchDirectoryResponse, error) {
 	return nil, fmt.Errorf("not implemented")
 }
@@ -476,6 +541,7 @@ func TestMain(m *testing.M) {
 	bs.RegisterByteStreamServer(s, server)
 	pb.RegisterExecutionServer(s, server)
 	fpb.RegisterFetchServer(s, server)
+	fpb.RegisterPushServer(s, server)
 	go s.Serve(lis)
 	if err := os.Chdir("src/remote/test_data"); err != nil {
 		log.Fatalf("Failed to chdir: %s", err)
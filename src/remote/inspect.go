@@ -0,0 +1,426 @@
+// Inspection of actions and their results on the remote server, for plz remote show & diff.
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// maxInlineOutput is the largest stdout / stderr that we print in full; beyond this we just give the digest.
+const maxInlineOutput = 10 * 1024
+
+// An inspectedAction is everything we can find out about an action from the server.
+type inspectedAction struct {
+	Digest  *pb.Digest
+	Action  *pb.Action
+	Command *pb.Command
+	// Inputs, keyed by their path within the input root. Values describe them (digest, symlink target etc).
+	Inputs map[string]string
+	// The result, if the action cache has one for it.
+	Result *pb.ActionResult
+}
+
+// An ActionRef identifies an action to inspect. Exactly one of its fields should be set.
+type ActionRef struct {
+	// A target that was built remotely, either during this build or by a previous one whose
+	// outputs weren't downloaded.
+	Target *core.BuildTarget
+	// The digest of an action, in the form hash/size.
+	Digest string
+}
+
+// resolve returns the digest of the action that a reference identifies.
+func (c *Client) resolve(ref ActionRef) (*pb.Digest, error) {
+	if err := c.CheckInitialised(); err != nil {
+		return nil, err
+	} else if ref.Target == nil {
+		dg, err := digest.NewFromString(ref.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid action digest %s: %s", ref.Digest, err)
+		}
+		return dg.ToProto(), nil
+	} else if dg, present := c.unstampedBuildActionDigests.Lookup(ref.Target.Label); present {
+		return dg, nil
+	} else if dg, err := c.remoteOutputsAction(ref.Target); err == nil && dg != nil {
+		return dg, nil
+	}
+	return nil, fmt.Errorf("No remote action found for %s; was it built remotely?", ref.Target)
+}
+
+// ShowAction prints a description of an action and its result (if any) to the given writer.
+func (c *Client) ShowAction(w io.Writer, ref ActionRef) error {
+	actionDigest, err := c.resolve(ref)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	a, err := c.inspectAction(ctx, actionDigest)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Action: %s\n", formatDigest(a.Digest))
+	if c.state.Config.Remote.DisplayURL != "" {
+		fmt.Fprintf(w, "    URL: %s\n", c.actionURL(a.Digest, false))
+	}
+	if a.Action.Timeout != nil {
+		fmt.Fprintf(w, "Timeout: %s\n", formatTimeout(a.Action.Timeout))
+	}
+	if a.Action.DoNotCache {
+		fmt.Fprintf(w, "Not cacheable\n")
+	}
+	fmt.Fprintf(w, "\nCommand: %s\n", formatDigest(a.Action.CommandDigest))
+	fmt.Fprintf(w, "  Arguments:\n")
+	for _, arg := range a.Command.Arguments {
+		fmt.Fprintf(w, "    %s\n", arg)
+	}
+	if a.Command.WorkingDirectory != "" {
+		fmt.Fprintf(w, "  Working directory: %s\n", a.Command.WorkingDirectory)
+	}
+	printMap(w, "Environment", commandEnv(a.Command))
+	printMap(w, "Platform", commandPlatform(a.Command))
+	printList(w, "Outputs", commandOutputs(a.Command))
+	fmt.Fprintf(w, "\nInput root: %s\n", formatDigest(a.Action.InputRootDigest))
+	printMap(w, "", a.Inputs)
+	fmt.Fprintf(w, "\n")
+	if a.Result == nil {
+		fmt.Fprintf(w, "No result in the action cache\n")
+		return nil
+	}
+	return c.showResult(ctx, w, a.Result)
+}
+
+// showResult prints a description of an action result.
+func (c *Client) showResult(ctx context.Context, w io.Writer, ar *pb.ActionResult) error {
+	fmt.Fprintf(w, "Result:\n  Exit code: %d\n", ar.ExitCode)
+	outputs := map[string]string{}
+	for _, f := range ar.OutputFiles {
+		outputs[f.Path] = describeFile(f.Digest, f.IsExecutable)
+	}
+	for _, d := range ar.OutputDirectories {
+		outputs[d.Path] = "directory, tree " + formatDigest(d.TreeDigest)
+	}
+	for _, s := range ar.OutputSymlinks {
+		outputs[s.Path] = "symlink to " + s.Target
+	}
+	for _, s := range ar.OutputFileSymlinks {
+		outputs[s.Path] = "symlink to " + s.Target
+	}
+	for _, s := range ar.OutputDirectorySymlinks {
+		outputs[s.Path] = "symlink to " + s.Target
+	}
+	printMap(w, "Outputs", outputs)
+	if err := c.showOutput(ctx, w, "Stdout", ar.StdoutRaw, ar.StdoutDigest); err != nil {
+		return err
+	} else if err := c.showOutput(ctx, w, "Stderr", ar.StderrRaw, ar.StderrDigest); err != nil {
+		return err
+	}
+	if md := ar.ExecutionMetadata; md != nil {
+		fmt.Fprintf(w, "  Execution:\n")
+		if md.Worker != "" {
+			fmt.Fprintf(w, "    Worker: %s\n", md.Worker)
+		}
+		if md.QueuedTimestamp != nil {
+			fmt.Fprintf(w, "    Queued at: %s\n", toTime(md.QueuedTimestamp).Format(time.RFC3339))
+		}
+		printDuration(w, "Queued", md.QueuedTimestamp, md.WorkerStartTimestamp)
+		printDuration(w, "Input fetch", md.InputFetchStartTimestamp, md.InputFetchCompletedTimestamp)
+		printDuration(w, "Execution", md.ExecutionStartTimestamp, md.ExecutionCompletedTimestamp)
+		printDuration(w, "Output upload", md.OutputUploadStartTimestamp, md.OutputUploadCompletedTimestamp)
+		printDuration(w, "Total", md.WorkerStartTimestamp, md.WorkerCompletedTimestamp)
+	}
+	return nil
+}
+
+// showOutput prints the stdout or stderr of an action, fetching it from the CAS if needed.
+func (c *Client) showOutput(ctx context.Context, w io.Writer, name string, raw []byte, dg *pb.Digest) error {
+	if len(raw) == 0 && dg != nil && dg.SizeBytes > 0 {
+		if dg.SizeBytes > maxInlineOutput {
+			fmt.Fprintf(w, "  %s: %s (too large to show)\n", name, formatDigest(dg))
+			return nil
+		}
+		b, err := c.readBlob(ctx, digest.NewFromProtoUnvalidated(dg))
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %s", strings.ToLower(name), err)
+		}
+		raw = b
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "  %s:\n", name)
+	for _, line := range strings.Split(strings.TrimRight(string(raw), "\n"), "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+	return nil
+}
+
+// DiffActions prints the differences between two actions to the given writer, to explain why
+// they have different digests (and hence don't share cache hits).
+func (c *Client) DiffActions(w io.Writer, before, after ActionRef) error {
+	beforeDigest, err := c.resolve(before)
+	if err != nil {
+		return err
+	}
+	afterDigest, err := c.resolve(after)
+	if err != nil {
+		return err
+	}
+	if proto.Equal(beforeDigest, afterDigest) {
+		fmt.Fprintf(w, "Actions are identical: %s\n", formatDigest(beforeDigest))
+		return nil
+	}
+	ctx := context.Background()
+	a, err := c.inspectAction(ctx, beforeDigest)
+	if err != nil {
+		return err
+	}
+	b, err := c.inspectAction(ctx, afterDigest)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", formatDigest(beforeDigest), formatDigest(afterDigest))
+	differs := false
+	if !stringSlicesEqual(a.Command.Arguments, b.Command.Arguments) {
+		fmt.Fprintf(w, "Arguments:\n  - %s\n  + %s\n", strings.Join(a.Command.Arguments, " "), strings.Join(b.Command.Arguments, " "))
+		differs = true
+	}
+	if a.Command.WorkingDirectory != b.Command.WorkingDirectory {
+		fmt.Fprintf(w, "Working directory:\n  - %s\n  + %s\n", a.Command.WorkingDirectory, b.Command.WorkingDirectory)
+		differs = true
+	}
+	differs = diffMaps(w, "Environment", commandEnv(a.Command), commandEnv(b.Command)) || differs
+	differs = diffMaps(w, "Platform", commandPlatform(a.Command), commandPlatform(b.Command)) || differs
+	differs = diffMaps(w, "Outputs", listToMap(commandOutputs(a.Command)), listToMap(commandOutputs(b.Command))) || differs
+	differs = diffMaps(w, "Inputs", a.Inputs, b.Inputs) || differs
+	if !proto.Equal(a.Action.Timeout, b.Action.Timeout) {
+		fmt.Fprintf(w, "Timeout:\n  - %s\n  + %s\n", formatTimeout(a.Action.Timeout), formatTimeout(b.Action.Timeout))
+		differs = true
+	}
+	if a.Action.DoNotCache != b.Action.DoNotCache {
+		fmt.Fprintf(w, "Do not cache:\n  - %v\n  + %v\n", a.Action.DoNotCache, b.Action.DoNotCache)
+		differs = true
+	}
+	if !differs {
+		fmt.Fprintf(w, "No differences found in the command or inputs; the actions differ in fields that plz doesn't inspect\n")
+	}
+	return nil
+}
+
+// inspectAction fetches an action and everything relating to it from the server.
+func (c *Client) inspectAction(ctx context.Context, actionDigest *pb.Digest) (*inspectedAction, error) {
+	a := &inspectedAction{
+		Digest:  actionDigest,
+		Action:  &pb.Action{},
+		Command: &pb.Command{},
+	}
+	if err := c.readProto(ctx, digest.NewFromProtoUnvalidated(actionDigest), a.Action); err != nil {
+		return nil, fmt.Errorf("Failed to read action %s: %s", formatDigest(actionDigest), err)
+	} else if err := c.readProto(ctx, digest.NewFromProtoUnvalidated(a.Action.CommandDigest), a.Command); err != nil {
+		return nil, fmt.Errorf("Failed to read command %s: %s", formatDigest(a.Action.CommandDigest), err)
+	}
+	inputs, err := c.inputTree(ctx, a.Action.InputRootDigest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read input root %s: %s", formatDigest(a.Action.InputRootDigest), err)
+	}
+	a.Inputs = inputs
+	ar, err := c.getActionResult(ctx, &pb.GetActionResultRequest{
+		InstanceName: c.instance,
+		ActionDigest: actionDigest,
+		InlineStdout: true,
+		InlineStderr: true,
+	})
+	if err != nil && !IsNotFound(err) {
+		return nil, fmt.Errorf("Failed to retrieve action result: %s", err)
+	}
+	a.Result = ar
+	return a, nil
+}
+
+// inputTree fetches the input root of an action and flattens it into a map of path -> description.
+func (c *Client) inputTree(ctx context.Context, root *pb.Digest) (map[string]string, error) {
+	var dirs []*pb.Directory
+	if err := c.retry(ctx, rpcCASRead, func() (err error) {
+		dirs, err = c.client.GetDirectoryTree(ctx, root)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	byHash := make(map[string]*pb.Directory, len(dirs))
+	for _, dir := range dirs {
+		byHash[c.digestMessage(dir).Hash] = dir
+	}
+	inputs := map[string]string{}
+	var walk func(name string, dg *pb.Digest)
+	walk = func(name string, dg *pb.Digest) {
+		dir, present := byHash[dg.Hash]
+		if !present {
+			inputs[name] = "directory " + formatDigest(dg) + " (missing)"
+			return
+		} else if len(dir.Files) == 0 && len(dir.Directories) == 0 && len(dir.Symlinks) == 0 && name != "" {
+			inputs[name] = "empty directory"
+		}
+		for _, f := range dir.Files {
+			desc := describeFile(f.Digest, f.IsExecutable)
+			if f.NodeProperties != nil && f.NodeProperties.UnixMode != nil {
+				desc += fmt.Sprintf(", mode %04o", f.NodeProperties.UnixMode.Value)
+			}
+			inputs[path.Join(name, f.Name)] = desc
+		}
+		for _, s := range dir.Symlinks {
+			inputs[path.Join(name, s.Name)] = "symlink to " + s.Target
+		}
+		for _, d := range dir.Directories {
+			walk(path.Join(name, d.Name), d.Digest)
+		}
+	}
+	walk("", root)
+	return inputs, nil
+}
+
+func commandEnv(cmd *pb.Command) map[string]string {
+	env := make(map[string]string, len(cmd.EnvironmentVariables))
+	for _, v := range cmd.EnvironmentVariables {
+		env[v.Name] = v.Value
+	}
+	return env
+}
+
+func commandPlatform(cmd *pb.Command) map[string]string {
+	platform := map[string]string{}
+	if cmd.Platform != nil {
+		for _, p := range cmd.Platform.Properties {
+			platform[p.Name] = p.Value
+		}
+	}
+	return platform
+}
+
+func commandOutputs(cmd *pb.Command) []string {
+	outs := append(append(append([]string{}, cmd.OutputPaths...), cmd.OutputFiles...), cmd.OutputDirectories...)
+	sort.Strings(outs)
+	return outs
+}
+
+func describeFile(dg *pb.Digest, isExecutable bool) string {
+	if isExecutable {
+		return formatDigest(dg) + ", executable"
+	}
+	return formatDigest(dg)
+}
+
+// formatDigest formats a digest in the hash/size form that plz remote show accepts.
+func formatDigest(dg *pb.Digest) string {
+	if dg == nil {
+		return "<none>"
+	}
+	return fmt.Sprintf("%s/%d", dg.Hash, dg.SizeBytes)
+}
+
+func formatTimeout(d *duration.Duration) string {
+	if timeout, err := ptypes.Duration(d); err == nil {
+		return timeout.String()
+	}
+	return "none"
+}
+
+func printMap(w io.Writer, title string, m map[string]string) {
+	indent := "  "
+	if title != "" {
+		if len(m) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "  %s:\n", title)
+		indent = "    "
+	}
+	for _, k := range sortedKeys(m) {
+		fmt.Fprintf(w, "%s%s: %s\n", indent, k, m[k])
+	}
+}
+
+func printList(w io.Writer, title string, l []string) {
+	if len(l) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, s := range l {
+		fmt.Fprintf(w, "    %s\n", s)
+	}
+}
+
+func printDuration(w io.Writer, name string, start, end *timestamp.Timestamp) {
+	if start != nil && end != nil {
+		fmt.Fprintf(w, "    %s: %s\n", name, toTime(end).Sub(toTime(start)))
+	}
+}
+
+// diffMaps prints the differences between two maps, returning true if there were any.
+func diffMaps(w io.Writer, title string, before, after map[string]string) bool {
+	var lines []string
+	line := func(prefix, k, v string) string {
+		if v == "" {
+			return fmt.Sprintf("  %s %s", prefix, k)
+		}
+		return fmt.Sprintf("  %s %s: %s", prefix, k, v)
+	}
+	for _, k := range sortedKeys(before) {
+		if v, present := after[k]; !present {
+			lines = append(lines, line("-", k, before[k]))
+		} else if v != before[k] {
+			lines = append(lines, line("~", k, before[k]+" -> "+v))
+		}
+	}
+	for _, k := range sortedKeys(after) {
+		if _, present := before[k]; !present {
+			lines = append(lines, line("+", k, after[k]))
+		}
+	}
+	if len(lines) == 0 {
+		return false
+	}
+	fmt.Fprintf(w, "%s:\n%s\n", title, strings.Join(lines, "\n"))
+	return true
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func listToMap(l []string) map[string]string {
+	m := make(map[string]string, len(l))
+	for _, s := range l {
+		m[s] = ""
+	}
+	return m
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, s := range a {
+		if b[i] != s {
+			return false
+		}
+	}
+	return true
+}
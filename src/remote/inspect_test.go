@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestShowAction(t *testing.T) {
+	c := newClient()
+	target := inspectTarget("target_show", "echo hello && echo test > $OUT")
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	// The test server doesn't store results of executions in the action cache.
+	server.actionResults[c.unstampedBuildActionDigests.Get(target.Label).Hash] = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{
+			Path:   "out2.txt",
+			Digest: &pb.Digest{Hash: "5fb3d47e893061ea6627334a8582c37398cfdc68fe7fa59c16912e4a3ab7a5d6", SizeBytes: 19},
+		}},
+		StdoutDigest:      &pb.Digest{Hash: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", SizeBytes: 6},
+		ExecutionMetadata: &pb.ExecutedActionMetadata{Worker: "kev"},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, c.ShowAction(&buf, ActionRef{Target: target}))
+	out := buf.String()
+	assert.Contains(t, out, "echo hello && echo test > $OUT")
+	assert.Contains(t, out, "package/src1.txt: ")
+	assert.Contains(t, out, "Exit code: 0")
+	assert.Contains(t, out, "out2.txt: 5fb3d47e893061ea6627334a8582c37398cfdc68fe7fa59c16912e4a3ab7a5d6/19")
+	assert.Contains(t, out, "Stdout:\n    hello\n")
+	assert.Contains(t, out, "Worker: kev")
+}
+
+func TestShowActionByDigest(t *testing.T) {
+	c := newClient()
+	target := inspectTarget("target_show_digest", "echo hello > $OUT")
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	dg := c.unstampedBuildActionDigests.Get(target.Label)
+	var buf bytes.Buffer
+	assert.NoError(t, c.ShowAction(&buf, ActionRef{Digest: formatDigest(dg)}))
+	assert.Contains(t, buf.String(), "Action: "+formatDigest(dg))
+	assert.Error(t, c.ShowAction(&buf, ActionRef{Digest: "wibble"}))
+}
+
+func TestDiffActions(t *testing.T) {
+	c := newClient()
+	before := inspectTarget("target_diff1", "echo hello > $OUT")
+	after := inspectTarget("target_diff2", "echo hello > $OUT")
+	after.AddSource(core.FileLabel{File: "src2.txt", Package: "package"})
+	after.Command = "echo goodbye > $OUT"
+	_, err := c.Build(0, before)
+	assert.NoError(t, err)
+	_, err = c.Build(0, after)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, c.DiffActions(&buf, ActionRef{Target: before}, ActionRef{Target: after}))
+	out := buf.String()
+	assert.Contains(t, out, "Arguments:\n")
+	assert.Contains(t, out, "echo goodbye > $OUT")
+	assert.Contains(t, out, "Inputs:\n  + package/src2.txt: ")
+	assert.NotContains(t, out, "package/src1.txt: ") // The input is unchanged
+
+	buf.Reset()
+	assert.NoError(t, c.DiffActions(&buf, ActionRef{Target: before}, ActionRef{Target: before}))
+	assert.Contains(t, buf.String(), "Actions are identical")
+}
+
+func TestDiffMaps(t *testing.T) {
+	var buf bytes.Buffer
+	assert.False(t, diffMaps(&buf, "Environment", map[string]string{"A": "1"}, map[string]string{"A": "1"}))
+	assert.Equal(t, "", buf.String())
+	assert.True(t, diffMaps(&buf, "Environment", map[string]string{"A": "1", "B": "2"}, map[string]string{"A": "3", "C": "4"}))
+	assert.Equal(t, "Environment:\n  ~ A: 1 -> 3\n  - B: 2\n  + C: 4\n", buf.String())
+}
+
+func inspectTarget(name, command string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: name})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = command
+	return target
+}
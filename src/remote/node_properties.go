@@ -0,0 +1,211 @@
+// Preservation of symlinks and file modes across remote execution.
+
+package remote
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// unixModeProperty is the name of the node property for file modes.
+const unixModeProperty = "unix_mode"
+
+// outputNodeProperties returns the node properties that we request the server to report for outputs.
+func (c *Client) outputNodeProperties() []string {
+	if c.unixMode {
+		return []string{unixModeProperty}
+	}
+	return nil
+}
+
+// nodeProperties returns the node properties to record for a local file with the given mode.
+// Unless full modes are configured, only whether it's executable is recorded, so that the same
+// file doesn't hash differently on machines with a different umask.
+func (c *Client) nodeProperties(mode os.FileMode) *pb.NodeProperties {
+	if !c.unixMode {
+		return nil
+	} else if !c.state.Config.Remote.FullFileModes {
+		return modeProperties(mode&0100 != 0)
+	}
+	return &pb.NodeProperties{UnixMode: &wrappers.UInt32Value{Value: uint32(mode.Perm())}}
+}
+
+// inputNodeProperties returns the subset of an output's node properties that we pass on when it's used
+// as an input to another action. Only the mode is kept; anything else (notably the mtime) would make
+// otherwise identical inputs hash differently. As for nodeProperties, the mode is normalised unless
+// full modes are configured.
+func (c *Client) inputNodeProperties(props *pb.NodeProperties, isExecutable bool) *pb.NodeProperties {
+	if !c.unixMode {
+		return nil
+	} else if !c.state.Config.Remote.FullFileModes || props == nil || props.UnixMode == nil {
+		return modeProperties(isExecutable)
+	}
+	return &pb.NodeProperties{UnixMode: props.UnixMode}
+}
+
+// modeProperties returns node properties with a normalised mode for a file.
+func modeProperties(isExecutable bool) *pb.NodeProperties {
+	if isExecutable {
+		return &pb.NodeProperties{UnixMode: &wrappers.UInt32Value{Value: 0755}}
+	}
+	return &pb.NodeProperties{UnixMode: &wrappers.UInt32Value{Value: 0644}}
+}
+
+// treeNodeProperties returns the node properties of each file in a tree, keyed by their path
+// within it. It's only needed when full modes are configured, since otherwise they're
+// determined entirely by whether each file is executable; in that case it returns nil.
+func (c *Client) treeNodeProperties(tree *pb.Tree) map[string]*pb.NodeProperties {
+	if !c.unixMode || !c.state.Config.Remote.FullFileModes {
+		return nil
+	}
+	children := make(map[string]*pb.Directory, len(tree.Children))
+	for _, child := range tree.Children {
+		children[c.digestMessage(child).Hash] = child
+	}
+	props := map[string]*pb.NodeProperties{}
+	var walk func(dir string, d *pb.Directory)
+	walk = func(dir string, d *pb.Directory) {
+		for _, f := range d.Files {
+			props[path.Join(dir, f.Name)] = f.NodeProperties
+		}
+		for _, subdir := range d.Directories {
+			if child, present := children[subdir.Digest.Hash]; present {
+				walk(path.Join(dir, subdir.Name), child)
+			}
+		}
+	}
+	walk("", tree.Root)
+	return props
+}
+
+// restoreOutputs applies the parts of an action result to its downloaded outputs in the given directory
+// that the SDK doesn't handle itself: symlinks that are only reported in the newer output_symlinks
+// field, and the modes and mtimes of files.
+func (c *Client) restoreOutputs(ctx context.Context, ar *pb.ActionResult, dir string) error {
+	for _, s := range ar.OutputSymlinks {
+		filename := path.Join(dir, s.Path)
+		if _, err := os.Lstat(filename); err == nil {
+			continue // Already created from one of the older fields.
+		} else if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+			return err
+		} else if err := os.Symlink(s.Target, filename); err != nil {
+			return err
+		}
+	}
+	for _, f := range ar.OutputFiles {
+		if err := setNodeProperties(path.Join(dir, f.Path), f.NodeProperties); err != nil {
+			return err
+		}
+	}
+	if !c.unixMode {
+		return nil // Don't bother fetching trees if the server can't have given us anything useful.
+	}
+	for _, d := range ar.OutputDirectories {
+		tree := &pb.Tree{}
+		if err := c.readProto(ctx, digest.NewFromProtoUnvalidated(d.TreeDigest), tree); err != nil {
+			return err
+		}
+		children := make(map[string]*pb.Directory, len(tree.Children))
+		for _, child := range tree.Children {
+			children[c.digestMessage(child).Hash] = child
+		}
+		if err := restoreDirectory(path.Join(dir, d.Path), tree.Root, children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDirectory applies node properties to the files within a downloaded directory, recursively.
+func restoreDirectory(dir string, d *pb.Directory, children map[string]*pb.Directory) error {
+	for _, f := range d.Files {
+		if err := setNodeProperties(path.Join(dir, f.Name), f.NodeProperties); err != nil {
+			return err
+		}
+	}
+	for _, subdir := range d.Directories {
+		if child, present := children[subdir.Digest.Hash]; present {
+			if err := restoreDirectory(path.Join(dir, subdir.Name), child, children); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setNodeProperties applies a set of node properties to a file.
+func setNodeProperties(filename string, props *pb.NodeProperties) error {
+	if props == nil {
+		return nil
+	}
+	if props.UnixMode != nil {
+		if err := os.Chmod(filename, os.FileMode(props.UnixMode.Value)); err != nil {
+			return err
+		}
+	}
+	if props.Mtime != nil {
+		mtime, err := ptypes.Timestamp(props.Mtime)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(filename, mtime, mtime)
+	}
+	return nil
+}
+
+// addLocalOutputProperties adds to an action result computed for the outputs of a target built locally
+// the things that the SDK doesn't record: it follows symlinks (so we reinstate them) and doesn't
+// record the modes of files.
+func (c *Client) addLocalOutputProperties(target *core.BuildTarget, ar *pb.ActionResult) error {
+	symlinks := map[string]bool{}
+	for _, out := range target.Outputs() {
+		out = path.Clean(out)
+		filename := path.Join(target.OutDir(), out)
+		info, err := os.Lstat(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		} else if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		link, err := os.Readlink(filename)
+		if err != nil {
+			return err
+		}
+		symlinks[out] = true
+		ar.OutputSymlinks = append(ar.OutputSymlinks, &pb.OutputSymlink{Path: out, Target: link})
+	}
+	files := make([]*pb.OutputFile, 0, len(ar.OutputFiles))
+	for _, f := range ar.OutputFiles {
+		if symlinks[f.Path] {
+			continue
+		}
+		if c.unixMode {
+			info, err := os.Stat(path.Join(target.OutDir(), f.Path))
+			if err != nil {
+				return err
+			}
+			f.NodeProperties = c.nodeProperties(info.Mode())
+		}
+		files = append(files, f)
+	}
+	ar.OutputFiles = files
+	dirs := make([]*pb.OutputDirectory, 0, len(ar.OutputDirectories))
+	for _, d := range ar.OutputDirectories {
+		if !symlinks[d.Path] {
+			dirs = append(dirs, d)
+		}
+	}
+	ar.OutputDirectories = dirs
+	return nil
+}
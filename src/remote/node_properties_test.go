@@ -0,0 +1,181 @@
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestOutputSymlinksAndModes(t *testing.T) {
+	defer server.Reset()
+	c := newClientInstance("mock")
+
+	out := []byte("this is a versioned library")
+	outDigest := digest.NewFromBlob(out)
+	server.blobs[outDigest.Hash] = out
+	mtime := time.Date(2020, 2, 2, 12, 0, 0, 0, time.UTC)
+	mtimeProto, _ := ptypes.TimestampProto(mtime)
+	server.mockActionResult = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{
+			Path:   "libfoo.so.1",
+			Digest: outDigest.ToProto(),
+			NodeProperties: &pb.NodeProperties{
+				UnixMode: &wrappers.UInt32Value{Value: 0640},
+				Mtime:    mtimeProto,
+			},
+		}},
+		// Only reported in the newer field, which the SDK doesn't handle itself.
+		OutputSymlinks: []*pb.OutputSymlink{{Path: "libfoo.so", Target: "libfoo.so.1"}},
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                      "kev",
+			QueuedTimestamp:             ptypes.TimestampNow(),
+			ExecutionStartTimestamp:     ptypes.TimestampNow(),
+			ExecutionCompletedTimestamp: ptypes.TimestampNow(),
+		},
+	}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "symlinks"})
+	target.AddOutput("libfoo.so.1")
+	target.AddOutput("libfoo.so")
+	target.Command = "echo 'this is a versioned library' > libfoo.so.1 && ln -s libfoo.so.1 libfoo.so"
+	c.state.Graph.AddTarget(target)
+	c.state.AddOriginalTarget(target.Label, true)
+	c.state.DownloadOutputs = true
+	_, err := c.Build(0, target)
+	require.NoError(t, err)
+	defer os.RemoveAll(target.OutDir())
+
+	link, err := os.Readlink(filepath.Join(target.OutDir(), "libfoo.so"))
+	assert.NoError(t, err)
+	assert.Equal(t, "libfoo.so.1", link)
+	info, err := os.Stat(filepath.Join(target.OutDir(), "libfoo.so.1"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.True(t, mtime.Equal(info.ModTime()))
+
+	// When used as inputs, the mode is normalised and the mtime isn't passed on.
+	o := c.targetOutputs(target.Label)
+	require.Equal(t, 1, len(o.Files))
+	assert.EqualValues(t, 0644, o.Files[0].NodeProperties.UnixMode.Value)
+	assert.Nil(t, o.Files[0].NodeProperties.Mtime)
+	assert.Equal(t, []*pb.SymlinkNode{{Name: "libfoo.so", Target: "libfoo.so.1"}}, o.Symlinks)
+
+	// With full modes configured, the mode is passed on as it is.
+	c.state.Config.Remote.FullFileModes = true
+	defer func() { c.state.Config.Remote.FullFileModes = false }()
+	require.NoError(t, c.setOutputs(target, server.mockActionResult))
+	o = c.targetOutputs(target.Label)
+	require.Equal(t, 1, len(o.Files))
+	assert.EqualValues(t, 0640, o.Files[0].NodeProperties.UnixMode.Value)
+	assert.Nil(t, o.Files[0].NodeProperties.Mtime)
+}
+
+func TestOutputNodeProperties(t *testing.T) {
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "node_properties"})
+	target.Command = "true"
+	cmd, err := c.buildCommand(target, &pb.Directory{}, false, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unix_mode"}, cmd.OutputNodeProperties)
+}
+
+func TestOutDirSymlinks(t *testing.T) {
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	foo := digest.NewFromBlob([]byte("foo"))
+	tree := &pb.Tree{
+		Root: &pb.Directory{
+			Files:    []*pb.FileNode{{Name: "foo.txt", Digest: foo.ToProto()}},
+			Symlinks: []*pb.SymlinkNode{{Name: "bar.txt", Target: "foo.txt"}},
+		},
+	}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "out_dir_symlinks"})
+	files, dirs, symlinks, err := c.getOutputsForOutDir(target, core.OutputDirectory("out"), tree)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, 0, len(dirs))
+	assert.Equal(t, []*pb.SymlinkNode{{Name: "bar.txt", Target: "foo.txt"}}, symlinks)
+	assert.ElementsMatch(t, []string{"foo.txt", "bar.txt"}, target.Outputs())
+
+	target = core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "out_dir_symlinks_flattened"})
+	files, _, symlinks, err = c.getOutputsForOutDir(target, core.OutputDirectory("out/**"), tree)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, []*pb.SymlinkNode{{Name: "bar.txt", Target: "foo.txt"}}, symlinks)
+}
+
+func TestOutDirNodeProperties(t *testing.T) {
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	foo := digest.NewFromBlob([]byte("foo"))
+	bar := digest.NewFromBlob([]byte("bar"))
+	tree := &pb.Tree{
+		Root: &pb.Directory{
+			Files: []*pb.FileNode{
+				{Name: "foo.txt", Digest: foo.ToProto(), NodeProperties: &pb.NodeProperties{UnixMode: &wrappers.UInt32Value{Value: 0600}}},
+				{Name: "bar.sh", Digest: bar.ToProto(), IsExecutable: true, NodeProperties: &pb.NodeProperties{UnixMode: &wrappers.UInt32Value{Value: 0700}}},
+			},
+		},
+	}
+	modes := func(files []*pb.FileNode) map[string]uint32 {
+		m := map[string]uint32{}
+		for _, f := range files {
+			require.NotNil(t, f.NodeProperties, f.Name)
+			m[f.Name] = f.NodeProperties.UnixMode.Value
+		}
+		return m
+	}
+	// Both forms of output directory should record the same (normalised) modes.
+	for _, dir := range []core.OutputDirectory{"out", "out/**"} {
+		target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "out_dir_node_properties"})
+		files, _, _, err := c.getOutputsForOutDir(target, dir, tree)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]uint32{"foo.txt": 0644, "bar.sh": 0755}, modes(files), dir)
+	}
+	c.state.Config.Remote.FullFileModes = true
+	defer func() { c.state.Config.Remote.FullFileModes = false }()
+	for _, dir := range []core.OutputDirectory{"out", "out/**"} {
+		target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "out_dir_node_properties"})
+		files, _, _, err := c.getOutputsForOutDir(target, dir, tree)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]uint32{"foo.txt": 0600, "bar.sh": 0700}, modes(files), dir)
+	}
+}
+
+func TestUploadLocalTargetPreservesSymlinksAndModes(t *testing.T) {
+	c := newClient()
+	require.NoError(t, c.CheckInitialised())
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "local_symlinks"})
+	target.AddOutput("tool")
+	target.AddOutput("tool_link")
+	require.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	defer os.RemoveAll(target.OutDir())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target.OutDir(), "tool"), []byte("#!/bin/sh\n"), 0750))
+	require.NoError(t, os.Symlink("tool", filepath.Join(target.OutDir(), "tool_link")))
+
+	require.NoError(t, c.uploadLocalTarget(target))
+	o := c.targetOutputs(target.Label)
+	require.Equal(t, 1, len(o.Files))
+	assert.Equal(t, "tool", o.Files[0].Name)
+	assert.True(t, o.Files[0].IsExecutable)
+	assert.EqualValues(t, 0755, o.Files[0].NodeProperties.UnixMode.Value)
+	assert.Equal(t, []*pb.SymlinkNode{{Name: "tool_link", Target: "tool"}}, o.Symlinks)
+
+	c.state.Config.Remote.FullFileModes = true
+	defer func() { c.state.Config.Remote.FullFileModes = false }()
+	require.NoError(t, c.uploadLocalTarget(target))
+	o = c.targetOutputs(target.Label)
+	require.Equal(t, 1, len(o.Files))
+	assert.EqualValues(t, 0750, o.Files[0].NodeProperties.UnixMode.Value)
+}
@@ -49,10 +49,16 @@ var apiVersion = semver.SemVer{Major: 2}
 type Client struct {
 	client      *client.Client
 	fetchClient fpb.FetchClient
+	pushClient  fpb.PushClient
 	initOnce    sync.Once
 	state       *core.BuildState
 	err         error // for initialisation
 	instance    string
+	url, casURL string
+
+	// True if this client is only used for caching; it won't require the server to support
+	// remote execution, and outputs of locally built dependencies are hashed from disk.
+	cacheOnly bool
 
 	// Stored output directories from previously executed targets.
 	// This isn't just a cache - it is needed for cases where we don't actually
@@ -81,6 +87,9 @@ type Client struct {
 	// Path to the shell to use to execute actions in.
 	shellPath string
 
+	// True if the server supports the unix_mode node property, in which case we use it to preserve file modes.
+	unixMode bool
+
 	// Stats used to report RPC data rates
 	byteRateIn, byteRateOut, totalBytesIn, totalBytesOut int
 	stats                                                *statsHandler
@@ -94,6 +103,11 @@ type Client struct {
 	// existingBlobs is used to track the set of existing blobs remotely.
 	existingBlobs     map[string]struct{}
 	existingBlobMutex sync.Mutex
+
+	// Stops us sending requests to the server while it is repeatedly failing.
+	breaker *circuitBreaker
+	// Supplies authentication tokens to RPCs. Nil if we aren't configured to use any.
+	creds *endpointCredentials
 }
 
 type actionDigestMap struct {
@@ -108,6 +122,15 @@ func (m *actionDigestMap) Get(label core.BuildLabel) *pb.Digest {
 	return d.(*pb.Digest)
 }
 
+// Lookup returns the action digest for a label, and false if there isn't one.
+func (m *actionDigestMap) Lookup(label core.BuildLabel) (*pb.Digest, bool) {
+	d, ok := m.m.Load(label)
+	if !ok {
+		return nil, false
+	}
+	return d.(*pb.Digest), true
+}
+
 func (m *actionDigestMap) Put(label core.BuildLabel, actionDigest *pb.Digest) {
 	m.m.Store(label, actionDigest)
 }
@@ -122,16 +145,25 @@ type pendingDownload struct {
 // New returns a new Client instance.
 // It begins the process of contacting the remote server but does not wait for it.
 func New(state *core.BuildState) *Client {
+	return newClientFor(state, state.Config.Remote.URL, state.Config.Remote.CASURL, false)
+}
+
+// newClientFor returns a new Client communicating with the given URLs.
+func newClientFor(state *core.BuildState, url, casURL string, cacheOnly bool) *Client {
 	c := &Client{
-		state:    state,
-		instance: state.Config.Remote.Instance,
-		outputs:  map[core.BuildLabel]*pb.Directory{},
-		mdStore:  newDirMDStore(time.Duration(state.Config.Remote.CacheDuration)),
+		state:     state,
+		instance:  state.Config.Remote.Instance,
+		url:       url,
+		casURL:    casURL,
+		cacheOnly: cacheOnly,
+		outputs:   map[core.BuildLabel]*pb.Directory{},
+		mdStore:   newDirMDStore(time.Duration(state.Config.Remote.CacheDuration)),
 		existingBlobs: map[string]struct{}{
 			digest.Empty.Hash: {},
 		},
 		fileMetadataCache: filemetadata.NewNoopCache(),
 		shellPath:         state.Config.Remote.Shell,
+		breaker:           newCircuitBreaker(state.Config.Remote.CircuitBreakerThreshold, time.Duration(state.Config.Remote.CircuitBreakerCooldown)),
 	}
 	c.stats = newStatsHandler(c)
 	go c.CheckInitialised() // Kick off init now, but we don't have to wait for it.
@@ -144,13 +176,34 @@ func (c *Client) CheckInitialised() error {
 	return c.err
 }
 
+// Healthy returns true if the remote server is currently believed to be usable.
+// It is false if the client failed to initialise, or if the circuit breaker is open.
+func (c *Client) Healthy() bool {
+	return c.CheckInitialised() == nil && !c.breaker.Open()
+}
+
+// Degraded returns true if we have temporarily stopped sending requests to the remote server
+// because it has been failing. Unlike Healthy, it does not wait for the client to initialise.
+func (c *Client) Degraded() bool {
+	return c.breaker.Open()
+}
+
 // init is passed to the sync.Once to do the actual initialisation.
 func (c *Client) init() {
 	// Change grpc to log using our implementation
 	grpclog.SetLoggerV2(&grpcLogMabob{})
+	if c.err = checkAuthConfig(c.state.Config); c.err != nil {
+		log.Error("Error setting up remote execution client: %s", c.err)
+		return
+	}
+	c.creds = newEndpointCredentials(c.state.Config, map[string]string{
+		endpointURL:   c.url,
+		endpointCAS:   c.casURL,
+		endpointAsset: c.state.Config.Remote.AssetURL,
+	})
 	var g errgroup.Group
 	g.Go(c.initExec)
-	if c.state.Config.Remote.AssetURL != "" {
+	if c.state.Config.Remote.AssetURL != "" && !c.cacheOnly {
 		g.Go(c.initFetch)
 	}
 	c.err = g.Wait()
@@ -166,12 +219,17 @@ func (c *Client) initExec() error {
 	if err != nil {
 		return err
 	}
+	// The SDK dials both endpoints with the same parameters; checkAuthConfig ensures they agree.
+	auth := authFor(c.state.Config, endpointURL)
 	client.DefaultRPCTimeouts["default"] = time.Duration(c.state.Config.Remote.Timeout)
 	client, err := client.NewClient(context.Background(), c.instance, client.DialParams{
-		Service:            c.state.Config.Remote.URL,
-		CASService:         c.state.Config.Remote.CASURL,
+		Service:            c.url,
+		CASService:         c.casURL,
 		NoSecurity:         !c.state.Config.Remote.Secure,
 		TransportCredsOnly: c.state.Config.Remote.Secure,
+		TLSCACertFile:      auth.CACertFile,
+		TLSClientAuthCert:  auth.ClientCertFile,
+		TLSClientAuthKey:   auth.ClientKeyFile,
 		DialOpts:           dialOpts,
 	}, client.UseBatchOps(true), &client.TreeSymlinkOpts{Preserved: true}, client.RetryTransient(), client.RPCTimeouts(client.DefaultRPCTimeouts))
 	if err != nil {
@@ -216,7 +274,14 @@ func (c *Client) initExec() error {
 		}
 		c.shellPath = bash
 	}
+	c.platform = convertPlatform(c.state.Config)
+	// From here on we handle retries ourselves, with policies specific to each class of RPC (see retry.go),
+	// so the SDK only needs to make a single attempt.
+	c.client.Retrier.Backoff = retry.Immediately(retry.Attempts(1))
 	log.Debug("Remote execution client initialised for storage")
+	if c.cacheOnly {
+		return nil
+	}
 	// Now check if it can do remote execution
 	if resp.ExecutionCapabilities == nil {
 		return fmt.Errorf("Remote execution is configured but the build server doesn't support it")
@@ -226,10 +291,15 @@ func (c *Client) initExec() error {
 	} else if !resp.ExecutionCapabilities.ExecEnabled {
 		return fmt.Errorf("Remote execution not enabled for this server")
 	}
-	c.platform = convertPlatform(c.state.Config)
+	for _, prop := range resp.ExecutionCapabilities.SupportedNodeProperties {
+		if prop == unixModeProperty {
+			c.unixMode = true
+		}
+	}
 	log.Debug("Remote execution client initialised for execution")
 	if c.state.Config.Remote.AssetURL == "" {
 		c.fetchClient = fpb.NewFetchClient(client.Connection)
+		c.pushClient = fpb.NewPushClient(client.Connection)
 	}
 	return nil
 }
@@ -241,7 +311,11 @@ func (c *Client) initFetch() error {
 		return err
 	}
 	if c.state.Config.Remote.Secure {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")))
+		config, err := tlsConfig(authFor(c.state.Config, endpointAsset))
+		if err != nil {
+			return err
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
 	}
@@ -250,6 +324,7 @@ func (c *Client) initFetch() error {
 		return fmt.Errorf("Failed to connect to the remote fetch server: %s", err)
 	}
 	c.fetchClient = fpb.NewFetchClient(conn)
+	c.pushClient = fpb.NewPushClient(conn)
 	return nil
 }
 
@@ -278,12 +353,20 @@ func (c *Client) digestEnum(name string) pb.DigestFunction_Value {
 
 // Build executes a remote build of the given target.
 func (c *Client) Build(tid int, target *core.BuildTarget) (*core.BuildMetadata, error) {
+	return c.BuildContext(context.Background(), tid, target)
+}
+
+// BuildContext is like Build but gives up if the given context is cancelled before the remote
+// build has completed. In that case nothing is recorded about the target's outputs.
+func (c *Client) BuildContext(ctx context.Context, tid int, target *core.BuildTarget) (*core.BuildMetadata, error) {
 	if err := c.CheckInitialised(); err != nil {
 		return nil, err
 	}
-	metadata, ar, digest, err := c.build(tid, target)
+	metadata, ar, digest, err := c.build(ctx, tid, target)
 	if err != nil {
 		return metadata, err
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	if c.state.TargetHasher != nil {
 		hash, _ := hex.DecodeString(c.outputHash(ar))
@@ -310,6 +393,8 @@ func (c *Client) Build(tid int, target *core.BuildTarget) (*core.BuildMetadata,
 		if err := c.downloadData(target); err != nil {
 			return metadata, err
 		}
+	} else if err := c.storeRemoteOutputs(target, digest); err != nil {
+		log.Warning("Failed to record remote outputs for %s: %s", target, err)
 	}
 	return metadata, nil
 }
@@ -341,12 +426,12 @@ func (c *Client) Run(target *core.BuildTarget) error {
 		return err
 	}
 	// 24 hours is kind of an arbitrarily long timeout. Basically we just don't want to limit it here.
-	_, _, err = c.execute(0, target, cmd, digest, false, false)
+	_, _, err = c.execute(context.Background(), 0, target, cmd, digest, false, false)
 	return err
 }
 
 // build implements the actual build of a target.
-func (c *Client) build(tid int, target *core.BuildTarget) (*core.BuildMetadata, *pb.ActionResult, *pb.Digest, error) {
+func (c *Client) build(ctx context.Context, tid int, target *core.BuildTarget) (*core.BuildMetadata, *pb.ActionResult, *pb.Digest, error) {
 	needStdout := target.PostBuildFunction != nil
 	// If we're gonna stamp the target, first check the unstamped equivalent that we store results under.
 	// This implements the rules of stamp whereby we don't force rebuilds every time e.g. the SCM revision changes.
@@ -364,11 +449,11 @@ func (c *Client) build(tid int, target *core.BuildTarget) (*core.BuildMetadata,
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	metadata, ar, err := c.execute(tid, target, command, stampedDigest, false, needStdout)
+	metadata, ar, err := c.execute(ctx, tid, target, command, stampedDigest, false, needStdout)
 	if target.Stamp && err == nil {
 		// Store results under unstamped digest too.
 		c.locallyCacheResults(target, unstampedDigest, metadata, ar)
-		c.client.UpdateActionResult(context.Background(), &pb.UpdateActionResultRequest{
+		c.updateActionResult(context.Background(), &pb.UpdateActionResultRequest{
 			InstanceName: c.instance,
 			ActionDigest: unstampedDigest,
 			ActionResult: ar,
@@ -382,11 +467,22 @@ func (c *Client) build(tid int, target *core.BuildTarget) (*core.BuildMetadata,
 
 // Download downloads outputs for the given target.
 func (c *Client) Download(target *core.BuildTarget) error {
-	if target.Local {
+	if c.builtLocally(target) {
 		return nil // No download needed since this target was built locally
 	}
 	return c.download(target, func() error {
-		buildAction := c.unstampedBuildActionDigests.Get(target.Label)
+		buildAction, present := c.unstampedBuildActionDigests.Lookup(target.Label)
+		if !present {
+			// We didn't build it in this process, but an earlier one may have done so remotely.
+			if err := c.CheckInitialised(); err != nil {
+				return err
+			}
+			a, err := c.remoteOutputsAction(target)
+			if err != nil {
+				return err
+			}
+			buildAction = a
+		}
 		if c.outputsExist(target, buildAction) {
 			return nil
 		}
@@ -416,6 +512,9 @@ func (c *Client) reallyDownload(target *core.BuildTarget, digest *pb.Digest, ar
 		return c.wrapActionErr(err, digest)
 	}
 	c.recordAttrs(target, digest)
+	if err := core.RemoveRemoteOutputs(target); err != nil {
+		log.Warning("Failed to remove remote outputs manifest for %s: %s", target, err)
+	}
 	log.Debug("Downloaded outputs for %s", target)
 	return nil
 }
@@ -423,13 +522,17 @@ func (c *Client) reallyDownload(target *core.BuildTarget, digest *pb.Digest, ar
 func (c *Client) downloadActionOutputs(ctx context.Context, ar *pb.ActionResult, target *core.BuildTarget) error {
 	// We can download straight into the out dir if there are no outdirs to worry about
 	if len(target.OutputDirectories) == 0 {
-		_, err := c.client.DownloadActionOutputs(ctx, ar, target.OutDir(), c.fileMetadataCache)
-		return err
+		if err := c.downloadOutputs(ctx, ar, target.OutDir()); err != nil {
+			return err
+		}
+		return c.restoreOutputs(ctx, ar, target.OutDir())
 	}
 
 	defer os.RemoveAll(target.TmpDir())
 
-	if _, err := c.client.DownloadActionOutputs(ctx, ar, target.TmpDir(), c.fileMetadataCache); err != nil {
+	if err := c.downloadOutputs(ctx, ar, target.TmpDir()); err != nil {
+		return err
+	} else if err := c.restoreOutputs(ctx, ar, target.TmpDir()); err != nil {
 		return err
 	}
 
@@ -504,10 +607,10 @@ func (c *Client) Test(tid int, target *core.BuildTarget, run int) (metadata *cor
 	if err != nil {
 		return nil, err
 	}
-	metadata, ar, err := c.execute(tid, target, command, digest, true, false)
+	metadata, ar, err := c.execute(context.Background(), tid, target, command, digest, true, false)
 
 	if ar != nil {
-		_, dlErr := c.client.DownloadActionOutputs(context.Background(), ar, target.TestDir(run), c.fileMetadataCache)
+		dlErr := c.downloadOutputs(context.Background(), ar, target.TestDir(run))
 		if dlErr != nil {
 			log.Warningf("%v: failed to download test outputs: %v", target.Label, dlErr)
 		}
@@ -525,7 +628,7 @@ func (c *Client) retrieveResults(target *core.BuildTarget, command *pb.Command,
 		return metadata, ar
 	}
 	// Now see if it is cached on the remote server
-	if ar, err := c.client.GetActionResult(context.Background(), &pb.GetActionResultRequest{
+	if ar, err := c.getActionResult(context.Background(), &pb.GetActionResultRequest{
 		InstanceName: c.instance,
 		ActionDigest: digest,
 		InlineStdout: needStdout,
@@ -561,7 +664,7 @@ func (c *Client) maybeRetrieveResults(tid int, target *core.BuildTarget, command
 
 // execute submits an action to the remote executor and monitors its progress.
 // The returned ActionResult may be nil on failure.
-func (c *Client) execute(tid int, target *core.BuildTarget, command *pb.Command, digest *pb.Digest, isTest, needStdout bool) (*core.BuildMetadata, *pb.ActionResult, error) {
+func (c *Client) execute(ctx context.Context, tid int, target *core.BuildTarget, command *pb.Command, digest *pb.Digest, isTest, needStdout bool) (*core.BuildMetadata, *pb.ActionResult, error) {
 	if !isTest || !c.state.ForceRerun || c.state.NumTestRuns == 1 {
 		if metadata, ar := c.maybeRetrieveResults(tid, target, command, digest, isTest, needStdout); metadata != nil {
 			return metadata, ar, nil
@@ -581,12 +684,12 @@ func (c *Client) execute(tid int, target *core.BuildTarget, command *pb.Command,
 	} else if target.IsTextFile {
 		return c.buildTextFile(target, command, digest)
 	}
-	return c.reallyExecute(tid, target, command, digest, needStdout, isTest)
+	return c.reallyExecute(ctx, tid, target, command, digest, needStdout, isTest)
 }
 
 // reallyExecute is like execute but after the initial cache check etc.
 // The action & sources must have already been uploaded.
-func (c *Client) reallyExecute(tid int, target *core.BuildTarget, command *pb.Command, digest *pb.Digest, needStdout, isTest bool) (*core.BuildMetadata, *pb.ActionResult, error) {
+func (c *Client) reallyExecute(parent context.Context, tid int, target *core.BuildTarget, command *pb.Command, digest *pb.Digest, needStdout, isTest bool) (*core.BuildMetadata, *pb.ActionResult, error) {
 	executing := false
 	updateProgress := func(metadata *pb.ExecuteOperationMetadata) {
 		if c.state.Config.Remote.DisplayURL != "" {
@@ -619,7 +722,7 @@ func (c *Client) reallyExecute(tid int, target *core.BuildTarget, command *pb.Co
 		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 	go func() {
 		for i := 1; i < 1000000; i++ {
@@ -640,7 +743,7 @@ func (c *Client) reallyExecute(tid int, target *core.BuildTarget, command *pb.Co
 		}
 	}()
 
-	resp, err := c.client.ExecuteAndWaitProgress(c.contextWithMetadata(target), &pb.ExecuteRequest{
+	resp, err := c.executeAndWait(c.contextWithMetadata(ctx, target), &pb.ExecuteRequest{
 		InstanceName:    c.instance,
 		ActionDigest:    digest,
 		SkipCacheLookup: true, // We've already done it above.
@@ -652,6 +755,8 @@ func (c *Client) reallyExecute(tid int, target *core.BuildTarget, command *pb.Co
 			if metadata, ar := c.retrieveResults(target, command, digest, needStdout, isTest); metadata != nil {
 				return metadata, ar, nil
 			}
+		} else if parent.Err() != nil {
+			return nil, nil, parent.Err()
 		}
 		return nil, nil, c.wrapActionErr(fmt.Errorf("Failed to execute %s: %s", target, err), digest)
 	}
@@ -769,19 +874,11 @@ func (c *Client) DataRate() (int, int, int, int) {
 // fetchRemoteFile sends a request to fetch a file using the remote asset API.
 func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest *pb.Digest) (*core.BuildMetadata, *pb.ActionResult, error) {
 	c.state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Downloading...")
-	urls := target.AllURLs(c.state)
 	req := &fpb.FetchBlobRequest{
 		InstanceName: c.instance,
 		Timeout:      ptypes.DurationProto(target.BuildTimeout),
-		Uris:         urls,
-	}
-	if !c.state.NeedHashesOnly || !c.state.IsOriginalTargetOrParent(target) {
-		if sri := subresourceIntegrity(target); sri != "" {
-			req.Qualifiers = []*fpb.Qualifier{{
-				Name:  "checksum.sri",
-				Value: sri,
-			}}
-		}
+		Uris:         c.fetchURLs(target),
+		Qualifiers:   c.assetQualifiers(target),
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), target.BuildTimeout)
 	defer cancel()
@@ -799,7 +896,7 @@ func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest
 			IsExecutable: target.IsBinary,
 		}},
 	}
-	if _, err := c.client.UpdateActionResult(context.Background(), &pb.UpdateActionResultRequest{
+	if err := c.updateActionResult(context.Background(), &pb.UpdateActionResultRequest{
 		InstanceName: c.instance,
 		ActionDigest: actionDigest,
 		ActionResult: ar,
@@ -809,6 +906,43 @@ func (c *Client) fetchRemoteFile(tid int, target *core.BuildTarget, actionDigest
 	return &core.BuildMetadata{}, ar, nil
 }
 
+// PushRemoteFile pushes the output of a remote_file target, which has been fetched locally, to the
+// remote asset server so later fetches of it can be served from there.
+func (c *Client) PushRemoteFile(target *core.BuildTarget) error {
+	if err := c.CheckInitialised(); err != nil {
+		return err
+	} else if c.pushClient == nil {
+		return fmt.Errorf("No remote asset server is configured")
+	}
+	filename := path.Join(target.OutDir(), target.Outputs()[0])
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	// Recalculate the hash since the file may have been rewritten since it was last memoised.
+	h, err := c.state.PathHasher.Hash(filename, true, true)
+	if err != nil {
+		return err
+	}
+	dg := &pb.Digest{Hash: hex.EncodeToString(h), SizeBytes: info.Size()}
+	if err := c.uploadBlobs(func(ch chan<- *uploadinfo.Entry) error {
+		defer close(ch)
+		ch <- uploadinfo.EntryFromFile(digest.NewFromProtoUnvalidated(dg), filename)
+		return nil
+	}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), target.BuildTimeout)
+	defer cancel()
+	_, err = c.pushClient.PushBlob(ctx, &fpb.PushBlobRequest{
+		InstanceName: c.instance,
+		Uris:         target.AllURLs(c.state),
+		Qualifiers:   c.assetQualifiers(target),
+		BlobDigest:   dg,
+	})
+	return err
+}
+
 // buildFilegroup "builds" a single filegroup target.
 func (c *Client) buildFilegroup(target *core.BuildTarget, command *pb.Command, actionDigest *pb.Digest) (*core.BuildMetadata, *pb.ActionResult, error) {
 	inputDir, err := c.uploadInputDir(nil, target, false) // We don't need to actually upload the inputs here, that is already done.
@@ -842,7 +976,7 @@ func (c *Client) buildFilegroup(target *core.BuildTarget, command *pb.Command, a
 	}); err != nil {
 		return nil, nil, err
 	}
-	if _, err := c.client.UpdateActionResult(context.Background(), &pb.UpdateActionResultRequest{
+	if err := c.updateActionResult(context.Background(), &pb.UpdateActionResultRequest{
 		InstanceName: c.instance,
 		ActionDigest: actionDigest,
 		ActionResult: ar,
@@ -870,7 +1004,7 @@ func (c *Client) buildTextFile(target *core.BuildTarget, command *pb.Command, ac
 	}); err != nil {
 		return nil, nil, err
 	}
-	if _, err := c.client.UpdateActionResult(context.Background(), &pb.UpdateActionResultRequest{
+	if err := c.updateActionResult(context.Background(), &pb.UpdateActionResultRequest{
 		InstanceName: c.instance,
 		ActionDigest: actionDigest,
 		ActionResult: ar,
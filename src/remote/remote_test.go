@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	fpb "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/stretchr/testify/assert"
@@ -97,6 +98,69 @@ func TestExecuteFetch(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestExecuteFetchHeadersAndMirrors(t *testing.T) {
+	server.fetchRequests = nil
+	defer server.Reset()
+	os.Setenv("FETCH_TEST_TOKEN", "abc123")
+	defer os.Unsetenv("FETCH_TEST_TOKEN")
+	c := newClient()
+	c.state.Config.Build.Mirror = []string{"https://mirror.example.com"}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "remote2"})
+	target.IsRemoteFile = true
+	target.AddSource(core.URLLabel("https://get.please.build/linux_amd64/14.2.0/please_14.2.0.tar.gz"))
+	target.AddOutput("please_14.2.0.tar.gz")
+	target.Hashes = []string{"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	target.URLHeaders = map[string]string{"Authorization": "Bearer $FETCH_TEST_TOKEN", "Accept": "*/*"}
+	target.BuildTimeout = time.Minute
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(server.fetchRequests))
+	req := server.fetchRequests[0]
+	assert.Equal(t, []string{
+		"https://mirror.example.com/get.please.build/linux_amd64/14.2.0/please_14.2.0.tar.gz",
+		"https://get.please.build/linux_amd64/14.2.0/please_14.2.0.tar.gz",
+	}, req.Uris)
+	// The Authorization header refers to an environment variable so shouldn't be sent.
+	assert.Equal(t, []string{
+		"checksum.sri=sha256-ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=",
+		"http_header:Accept=*/*",
+	}, qualifierStrings(req.Qualifiers))
+}
+
+func TestPushRemoteFile(t *testing.T) {
+	defer server.Reset()
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "remote3"})
+	target.IsRemoteFile = true
+	target.AddSource(core.URLLabel("https://example.com/remote3.txt"))
+	target.AddOutput("remote3.txt")
+	target.Hashes = []string{"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}
+	target.URLHeaders = map[string]string{"Authorization": "Bearer $PUSH_TEST_TOKEN", "Accept": "*/*"}
+	target.BuildTimeout = time.Minute
+	filename := filepath.Join(target.OutDir(), "remote3.txt")
+	require.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	require.NoError(t, ioutil.WriteFile(filename, []byte("abc"), 0644))
+	defer os.Remove(filename)
+	require.NoError(t, c.PushRemoteFile(target))
+	require.Equal(t, 1, len(server.pushRequests))
+	req := server.pushRequests[0]
+	assert.Equal(t, []string{"https://example.com/remote3.txt"}, req.Uris)
+	// The Authorization header refers to an environment variable so shouldn't be pushed.
+	assert.Equal(t, []string{
+		"checksum.sri=sha256-ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=",
+		"http_header:Accept=*/*",
+	}, qualifierStrings(req.Qualifiers))
+	assert.Equal(t, []byte("abc"), server.blobs[req.BlobDigest.Hash])
+}
+
+func qualifierStrings(qualifiers []*fpb.Qualifier) []string {
+	ret := make([]string, len(qualifiers))
+	for i, q := range qualifiers {
+		ret[i] = q.Name + "=" + q.Value
+	}
+	return ret
+}
+
 func TestExecuteTest(t *testing.T) {
 	c := newClientInstance("test")
 	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target3"})
@@ -209,6 +273,30 @@ func TestRemoteFilesHashConsistently(t *testing.T) {
 	assert.Equal(t, digest, digest2)
 }
 
+func TestTargetPlatform(t *testing.T) {
+	c := newClientInstance("test")
+	c.state.Config.Remote.Platform = []string{"OSFamily=linux", "pool=default"}
+	c.platform = convertPlatform(c.state.Config)
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target6"})
+	target.AddOutput("out6")
+	cmd, digest, err := c.buildAction(target, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, c.platform, cmd.Platform)
+
+	target.RemotePlatform = map[string]string{"pool": "large", "container-image": "docker://toolchain"}
+	cmd2, digest2, err := c.buildAction(target, false, false)
+	assert.NoError(t, err)
+	props := []string{}
+	for _, prop := range cmd2.Platform.Properties {
+		props = append(props, prop.Name+"="+prop.Value)
+	}
+	assert.Equal(t, []string{"OSFamily=linux", "container-image=docker://toolchain", "pool=large"}, props)
+	assert.NotEqual(t, digest, digest2)
+	// The global platform shouldn't have been modified.
+	assert.Equal(t, 2, len(c.platform.Properties))
+	assert.Equal(t, "default", c.platform.Properties[1].Value)
+}
+
 func TestOutDirsSetOutsOnTarget(t *testing.T) {
 	c := newClientInstance("mock")
 
@@ -272,6 +360,53 @@ func TestOutDirsSetOutsOnTarget(t *testing.T) {
 	}
 }
 
+func TestDownloadMinimal(t *testing.T) {
+	defer server.Reset()
+	c := newClientInstance("mock")
+
+	out := []byte("this is the content of the output")
+	outDigest := digest.NewFromBlob(out)
+	server.blobs[outDigest.Hash] = out
+	server.mockActionResult = &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{Path: "minimal.txt", Digest: outDigest.ToProto()}},
+		ExecutionMetadata: &pb.ExecutedActionMetadata{
+			Worker:                      "kev",
+			QueuedTimestamp:             ptypes.TimestampNow(),
+			ExecutionStartTimestamp:     ptypes.TimestampNow(),
+			ExecutionCompletedTimestamp: ptypes.TimestampNow(),
+		},
+	}
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "minimal"})
+	target.AddOutput("minimal.txt")
+	target.Command = "echo 'this is the content of the output' > $OUT"
+	c.state.Graph.AddTarget(target)
+	require.False(t, c.state.ShouldDownload(target))
+	_, err := c.Build(0, target)
+	require.NoError(t, err)
+	defer os.RemoveAll(target.OutDir())
+
+	// The output shouldn't have been downloaded, but should be recorded.
+	assert.False(t, fs.FileExists(filepath.Join(target.OutDir(), "minimal.txt")))
+	outputs, err := core.LoadRemoteOutputs(target)
+	require.NoError(t, err)
+	require.NotNil(t, outputs)
+	assert.Equal(t, outDigest.String(), outputs.Outputs["minimal.txt"].Digest)
+
+	// A new client that hasn't built it can still fetch it from the manifest.
+	// A real server would have stored the result in the action cache.
+	server.actionResults[strings.Split(outputs.Action, "/")[0]] = server.mockActionResult
+	c2 := newClientInstance("mock")
+	c2.state.Graph.AddTarget(target)
+	target.SetState(core.ReusedRemotely)
+	require.NoError(t, c2.Download(target))
+	b, err := ioutil.ReadFile(filepath.Join(target.OutDir(), "minimal.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, out, b)
+	outputs, err = core.LoadRemoteOutputs(target)
+	assert.NoError(t, err)
+	assert.Nil(t, outputs)
+}
+
 func TestDirectoryMetadataStore(t *testing.T) {
 	cacheDuration := time.Hour
 	now := time.Now().UTC()
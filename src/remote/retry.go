@@ -0,0 +1,273 @@
+// Retries and circuit breaking for RPCs to the remote server.
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+// An rpcClass is a class of RPCs that share a retry policy.
+type rpcClass string
+
+const (
+	rpcExecute       rpcClass = "execute"
+	rpcWaitExecution rpcClass = "waitexecution"
+	rpcCASRead       rpcClass = "casread"
+	rpcCASWrite      rpcClass = "caswrite"
+	rpcActionCache   rpcClass = "actioncache"
+)
+
+// defaultRetryPolicies are the policies used for each class when not overridden in config.
+// Execute is retried fairly conservatively since it is expensive to repeat; WaitExecution is
+// retried harder since it's the only way to recover an action that is already in flight.
+var defaultRetryPolicies = map[rpcClass]core.RemoteRetry{
+	rpcExecute:       {Attempts: 4, BaseDelay: cli.Duration(time.Second), MaxDelay: cli.Duration(20 * time.Second)},
+	rpcWaitExecution: {Attempts: 10, BaseDelay: cli.Duration(500 * time.Millisecond), MaxDelay: cli.Duration(10 * time.Second)},
+	rpcCASRead:       {Attempts: 8, BaseDelay: cli.Duration(250 * time.Millisecond), MaxDelay: cli.Duration(5 * time.Second)},
+	rpcCASWrite:      {Attempts: 8, BaseDelay: cli.Duration(250 * time.Millisecond), MaxDelay: cli.Duration(5 * time.Second)},
+	rpcActionCache:   {Attempts: 5, BaseDelay: cli.Duration(250 * time.Millisecond), MaxDelay: cli.Duration(2 * time.Second)},
+}
+
+// retryPolicy returns the retry policy to use for the given class of RPC.
+func (c *Client) retryPolicy(class rpcClass) core.RemoteRetry {
+	policy := defaultRetryPolicies[class]
+	if override, present := c.state.Config.RemoteRetry[string(class)]; present {
+		if override.Attempts > 0 {
+			policy.Attempts = override.Attempts
+		}
+		if override.BaseDelay > 0 {
+			policy.BaseDelay = override.BaseDelay
+		}
+		if override.MaxDelay > 0 {
+			policy.MaxDelay = override.MaxDelay
+		}
+	}
+	return policy
+}
+
+// retry calls f until it succeeds, fails with an error that isn't transient, or the retry policy for
+// the given class is exhausted. Every attempt is reported to the circuit breaker; if that is open
+// f isn't called at all.
+func (c *Client) retry(ctx context.Context, class rpcClass, f func() error) error {
+	policy := c.retryPolicy(class)
+	for attempt := 1; ; attempt++ {
+		if !c.breaker.Allow() {
+			return errCircuitOpen
+		}
+		err := f()
+		if err == nil {
+			c.breaker.Success()
+			return nil
+		} else if ctx.Err() != nil {
+			return err // Cancelled by the caller, which says nothing about the server.
+		} else if !isTransient(err) {
+			c.breaker.Success() // The server is responding, even if it doesn't like this request.
+			return err
+		}
+		c.breaker.Failure()
+		if attempt >= policy.Attempts {
+			return err
+		}
+		delay := backoff(policy, attempt)
+		log.Debug("%s RPC failed, retrying in %s (attempt %d of %d): %s", class, delay, attempt, policy.Attempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransient returns true if the given error is one that could succeed if retried.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before the next attempt after the given number of attempts so far.
+// The delay grows exponentially up to the policy's maximum, and is then reduced by a random amount
+// of up to half so clients that failed together don't all retry together.
+func backoff(policy core.RemoteRetry, attempt int) time.Duration {
+	delay := time.Duration(policy.BaseDelay)
+	for i := 1; i < attempt && delay < time.Duration(policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(policy.MaxDelay) {
+		delay = time.Duration(policy.MaxDelay)
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// errCircuitOpen is returned for requests that aren't sent because the circuit breaker is open.
+var errCircuitOpen = status.Error(codes.Unavailable, "Not sending request; the remote server appears to be degraded")
+
+// A circuitBreaker stops us sending requests to a server that is repeatedly failing.
+// After a number of consecutive failures it opens, and rejects all requests for a cooldown period.
+// After that it allows requests through again; one more failure reopens it, and a success closes it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow returns true if a request may be sent now.
+func (cb *circuitBreaker) Allow() bool {
+	return !cb.Open()
+}
+
+// Open returns true if the breaker is currently rejecting requests.
+func (cb *circuitBreaker) Open() bool {
+	if cb.threshold <= 0 {
+		return false
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return time.Now().Before(cb.openUntil)
+}
+
+// Success records a request that the server handled.
+func (cb *circuitBreaker) Success() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.threshold > 0 && cb.failures >= cb.threshold {
+		log.Notice("Remote server has recovered, resuming normal operation")
+	}
+	cb.failures = 0
+}
+
+// Failure records a request that failed transiently.
+func (cb *circuitBreaker) Failure() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.failures++
+	if cb.threshold <= 0 || cb.failures < cb.threshold {
+		return
+	} else if now := time.Now(); !now.Before(cb.openUntil) {
+		log.Warning("Remote server appears to be degraded after %d consecutive failures, not sending requests for %s", cb.failures, cb.cooldown)
+		cb.openUntil = now.Add(cb.cooldown)
+	}
+}
+
+// readProto reads a proto from the CAS, retrying as needed.
+func (c *Client) readProto(ctx context.Context, dg digest.Digest, msg proto.Message) error {
+	return c.retry(ctx, rpcCASRead, func() error {
+		_, err := c.client.ReadProto(ctx, dg, msg)
+		return err
+	})
+}
+
+// readBlob reads a blob from the CAS, retrying as needed.
+func (c *Client) readBlob(ctx context.Context, dg digest.Digest) (b []byte, err error) {
+	err = c.retry(ctx, rpcCASRead, func() error {
+		b, _, err = c.client.ReadBlob(ctx, dg)
+		return err
+	})
+	return b, err
+}
+
+// missingBlobs returns the digests that aren't present in the CAS, retrying as needed.
+func (c *Client) missingBlobs(ctx context.Context, digests []digest.Digest) (missing []digest.Digest, err error) {
+	err = c.retry(ctx, rpcCASRead, func() error {
+		missing, err = c.client.MissingBlobs(ctx, digests)
+		return err
+	})
+	return missing, err
+}
+
+// downloadOutputs downloads the outputs of an action into the given directory, retrying as needed.
+func (c *Client) downloadOutputs(ctx context.Context, ar *pb.ActionResult, dir string) error {
+	return c.retry(ctx, rpcCASRead, func() error {
+		_, err := c.client.DownloadActionOutputs(ctx, ar, dir, c.fileMetadataCache)
+		return err
+	})
+}
+
+// getActionResult retrieves an action result from the action cache, retrying as needed.
+func (c *Client) getActionResult(ctx context.Context, req *pb.GetActionResultRequest) (ar *pb.ActionResult, err error) {
+	err = c.retry(ctx, rpcActionCache, func() error {
+		ar, err = c.client.GetActionResult(ctx, req)
+		return err
+	})
+	return ar, err
+}
+
+// updateActionResult stores an action result in the action cache, retrying as needed.
+func (c *Client) updateActionResult(ctx context.Context, req *pb.UpdateActionResultRequest) error {
+	return c.retry(ctx, rpcActionCache, func() error {
+		_, err := c.client.UpdateActionResult(ctx, req)
+		return err
+	})
+}
+
+// executeAndWait submits an action for execution and waits for it to complete, calling progress with
+// each update. If the stream breaks while the operation is in flight, it is resumed with WaitExecution
+// rather than being submitted again; if that fails too, it is resubmitted per the Execute policy.
+func (c *Client) executeAndWait(ctx context.Context, req *pb.ExecuteRequest, progress func(*pb.ExecuteOperationMetadata)) (*longrunning.Operation, error) {
+	var op *longrunning.Operation
+	err := c.retry(ctx, rpcExecute, func() error {
+		op = nil
+		stream, err := c.client.Execute(ctx, req)
+		if err != nil {
+			return err
+		} else if err := receiveOperation(stream, &op, progress); err == nil || op == nil || op.Done {
+			return err
+		}
+		return c.retry(ctx, rpcWaitExecution, func() error {
+			log.Debug("Resuming execution of %s", op.Name)
+			stream, err := c.client.WaitExecution(ctx, &pb.WaitExecutionRequest{Name: op.Name})
+			if err != nil {
+				return err
+			}
+			return receiveOperation(stream, &op, progress)
+		})
+	})
+	if err != nil {
+		return nil, err
+	} else if op == nil {
+		return nil, fmt.Errorf("Server did not return any operation for execution")
+	}
+	return op, nil
+}
+
+// receiveOperation receives updates to an operation from the given stream until it ends.
+// op is updated with each one as it arrives.
+func receiveOperation(stream pb.Execution_ExecuteClient, op **longrunning.Operation, progress func(*pb.ExecuteOperationMetadata)) error {
+	for {
+		o, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		*op = o
+		metadata := &pb.ExecuteOperationMetadata{}
+		if err := ptypes.UnmarshalAny(o.Metadata, metadata); err == nil {
+			progress(metadata)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/core"
+)
+
+func TestRetryTransientErrors(t *testing.T) {
+	c := newRetryClient()
+	calls := 0
+	err := c.retry(context.Background(), rpcCASRead, func() error {
+		calls++
+		if calls < 3 {
+			return status.Errorf(codes.Unavailable, "try again")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.False(t, c.breaker.Open())
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	c := newRetryClient()
+	calls := 0
+	err := c.retry(context.Background(), rpcCASRead, func() error {
+		calls++
+		return status.Errorf(codes.NotFound, "not here")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryExhausted(t *testing.T) {
+	c := newRetryClient()
+	calls := 0
+	err := c.retry(context.Background(), rpcActionCache, func() error {
+		calls++
+		return status.Errorf(codes.ResourceExhausted, "busy")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryPolicyOverride(t *testing.T) {
+	c := newRetryClient()
+	assert.Equal(t, 2, c.retryPolicy(rpcActionCache).Attempts)
+	// Things not overridden keep their defaults.
+	assert.Equal(t, defaultRetryPolicies[rpcActionCache].MaxDelay, c.retryPolicy(rpcActionCache).MaxDelay)
+	assert.Equal(t, defaultRetryPolicies[rpcExecute], c.retryPolicy(rpcExecute))
+}
+
+func TestBackoff(t *testing.T) {
+	policy := core.RemoteRetry{BaseDelay: cli.Duration(100 * time.Millisecond), MaxDelay: cli.Duration(time.Second)}
+	for i := 0; i < 20; i++ {
+		d := backoff(policy, 1)
+		assert.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond, "%s out of range", d)
+		d = backoff(policy, 3)
+		assert.True(t, d >= 200*time.Millisecond && d <= 400*time.Millisecond, "%s out of range", d)
+		d = backoff(policy, 100)
+		assert.True(t, d >= 500*time.Millisecond && d <= time.Second, "%s out of range", d)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := newRetryClient()
+	c.breaker = newCircuitBreaker(3, 50*time.Millisecond)
+	fail := func() error { return status.Errorf(codes.Unavailable, "down") }
+	assert.Error(t, c.retry(context.Background(), rpcActionCache, fail))
+	assert.False(t, c.breaker.Open())
+	assert.Error(t, c.retry(context.Background(), rpcActionCache, fail))
+	assert.True(t, c.breaker.Open())
+	assert.True(t, c.Degraded())
+	// Nothing gets sent while it's open.
+	err := c.retry(context.Background(), rpcActionCache, func() error {
+		panic("should not be called")
+	})
+	assert.Equal(t, errCircuitOpen, err)
+	// Once it's cooled down, a success closes it again.
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, c.retry(context.Background(), rpcActionCache, func() error { return nil }))
+	assert.False(t, c.breaker.Open())
+}
+
+func TestExecuteResumesAfterStreamDrop(t *testing.T) {
+	defer server.Reset()
+	server.dropExecution = true
+	c := newClient()
+	target := core.NewBuildTarget(core.BuildLabel{PackageName: "package", Name: "target_resumed"})
+	target.AddSource(core.FileLabel{File: "src1.txt", Package: "package"})
+	target.AddOutput("out2.txt")
+	target.BuildTimeout = time.Minute
+	target.Command = "echo hello && echo test > $OUT"
+	_, err := c.Build(0, target)
+	assert.NoError(t, err)
+	assert.True(t, server.resumedExecution)
+}
+
+// newRetryClient returns a client with short retry policies for testing. It is never initialised.
+func newRetryClient() *Client {
+	state := core.NewDefaultBuildState()
+	state.Config.RemoteRetry = map[string]*core.RemoteRetry{
+		"actioncache": {Attempts: 2, BaseDelay: cli.Duration(time.Millisecond)},
+		"casread":     {BaseDelay: cli.Duration(time.Millisecond), MaxDelay: cli.Duration(time.Millisecond)},
+	}
+	return New(state)
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// readChunkSize is the size of chunks we send blobs back in over ByteStream.
+const readChunkSize = 64 * 1024
+
+// FindMissingBlobs implements the CAS service.
+func (s *Server) FindMissingBlobs(ctx context.Context, req *pb.FindMissingBlobsRequest) (*pb.FindMissingBlobsResponse, error) {
+	resp := &pb.FindMissingBlobsResponse{}
+	for _, dg := range req.BlobDigests {
+		if !s.blobExists(dg) {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, dg)
+		}
+	}
+	return resp, nil
+}
+
+// BatchUpdateBlobs implements the CAS service.
+func (s *Server) BatchUpdateBlobs(ctx context.Context, req *pb.BatchUpdateBlobsRequest) (*pb.BatchUpdateBlobsResponse, error) {
+	resp := &pb.BatchUpdateBlobsResponse{
+		Responses: make([]*pb.BatchUpdateBlobsResponse_Response, len(req.Requests)),
+	}
+	for i, r := range req.Requests {
+		resp.Responses[i] = &pb.BatchUpdateBlobsResponse_Response{
+			Digest: r.Digest,
+			Status: toStatus(s.storeBlob(r.Digest, r.Data)),
+		}
+	}
+	return resp, nil
+}
+
+// BatchReadBlobs implements the CAS service.
+func (s *Server) BatchReadBlobs(ctx context.Context, req *pb.BatchReadBlobsRequest) (*pb.BatchReadBlobsResponse, error) {
+	resp := &pb.BatchReadBlobsResponse{
+		Responses: make([]*pb.BatchReadBlobsResponse_Response, len(req.Digests)),
+	}
+	for i, dg := range req.Digests {
+		b, err := s.readBlob(dg)
+		resp.Responses[i] = &pb.BatchReadBlobsResponse_Response{
+			Digest: dg,
+			Data:   b,
+			Status: toStatus(err),
+		}
+	}
+	return resp, nil
+}
+
+// GetTree implements the CAS service. It always returns the whole tree in a single response.
+func (s *Server) GetTree(req *pb.GetTreeRequest, srv pb.ContentAddressableStorage_GetTreeServer) error {
+	resp := &pb.GetTreeResponse{}
+	var walk func(dg *pb.Digest) error
+	walk = func(dg *pb.Digest) error {
+		dir := &pb.Directory{}
+		if err := s.readMessage(dg, dir); err != nil {
+			return err
+		}
+		resp.Directories = append(resp.Directories, dir)
+		for _, child := range dir.Directories {
+			if err := walk(child.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(req.RootDigest); err != nil {
+		return err
+	}
+	return srv.Send(resp)
+}
+
+// Read implements the ByteStream service.
+func (s *Server) Read(req *bs.ReadRequest, srv bs.ByteStream_ReadServer) error {
+	dg, err := parseResourceName(req.ResourceName, "blobs")
+	if err != nil {
+		return err
+	}
+	filename, err := s.blobPath(dg)
+	if err != nil {
+		return err
+	} else if dg.SizeBytes == 0 {
+		return nil
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return status.Errorf(codes.NotFound, "Blob %s not found", dg.Hash)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if req.ReadOffset > 0 {
+		if _, err := f.Seek(req.ReadOffset, io.SeekStart); err != nil {
+			return status.Errorf(codes.OutOfRange, "Invalid read offset %d: %s", req.ReadOffset, err)
+		}
+	}
+	var r io.Reader = f
+	if req.ReadLimit > 0 {
+		r = io.LimitReader(f, req.ReadLimit)
+	}
+	buf := make([]byte, readChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := srv.Send(&bs.ReadResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Write implements the ByteStream service.
+func (s *Server) Write(srv bs.ByteStream_WriteServer) error {
+	req, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+	dg, err := parseResourceName(req.ResourceName, "uploads")
+	if err != nil {
+		return err
+	} else if err := s.checkHash(dg); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Join(s.dir, "uploads"), dg.Hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := s.newHash()
+	w := io.MultiWriter(f, h)
+	var size int64
+	for {
+		if _, err := w.Write(req.Data); err != nil {
+			return err
+		}
+		size += int64(len(req.Data))
+		if req.FinishWrite {
+			break
+		}
+		if req, err = srv.Recv(); err != nil {
+			return err
+		}
+	}
+	if err := s.checkDigest(dg, hex.EncodeToString(h.Sum(nil)), size); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	} else if err := s.moveBlob(f.Name(), dg); err != nil {
+		return err
+	}
+	return srv.SendAndClose(&bs.WriteResponse{CommittedSize: size})
+}
+
+// QueryWriteStatus implements the ByteStream service.
+// We don't support resuming writes, so it only reports on whether a blob is complete.
+func (s *Server) QueryWriteStatus(ctx context.Context, req *bs.QueryWriteStatusRequest) (*bs.QueryWriteStatusResponse, error) {
+	dg, err := parseResourceName(req.ResourceName, "uploads")
+	if err != nil {
+		return nil, err
+	} else if !s.blobExists(dg) {
+		return nil, status.Errorf(codes.NotFound, "Write of %s not found", dg.Hash)
+	}
+	return &bs.QueryWriteStatusResponse{CommittedSize: dg.SizeBytes, Complete: true}, nil
+}
+
+// blobPath returns the path that a blob is stored at.
+func (s *Server) blobPath(dg *pb.Digest) (string, error) {
+	if err := s.checkHash(dg); err != nil {
+		return "", err
+	}
+	return path.Join(s.dir, "cas", dg.Hash[:2], dg.Hash), nil
+}
+
+// blobExists returns true if the given blob is in the CAS.
+// The empty blob always exists, since clients are not required to upload it.
+func (s *Server) blobExists(dg *pb.Digest) bool {
+	filename, err := s.blobPath(dg)
+	if err != nil {
+		return false
+	} else if dg.SizeBytes == 0 {
+		return true
+	}
+	info, err := os.Stat(filename)
+	return err == nil && info.Size() == dg.SizeBytes
+}
+
+// readBlob reads a blob from the CAS.
+func (s *Server) readBlob(dg *pb.Digest) ([]byte, error) {
+	filename, err := s.blobPath(dg)
+	if err != nil {
+		return nil, err
+	} else if dg.SizeBytes == 0 {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "Blob %s not found", dg.Hash)
+	}
+	return b, err
+}
+
+// readMessage reads a proto message from the CAS.
+func (s *Server) readMessage(dg *pb.Digest, msg proto.Message) error {
+	b, err := s.readBlob(dg)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, msg)
+}
+
+// storeBlob stores a blob in the CAS, after checking that it matches its digest.
+func (s *Server) storeBlob(dg *pb.Digest, data []byte) error {
+	if err := s.checkDigest(dg, s.hash(data), int64(len(data))); err != nil {
+		return err
+	} else if s.blobExists(dg) {
+		return nil
+	}
+	f, err := ioutil.TempFile(path.Join(s.dir, "uploads"), dg.Hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return s.moveBlob(f.Name(), dg)
+}
+
+// storeMessage stores a proto message in the CAS and returns its digest.
+func (s *Server) storeMessage(msg proto.Message) (*pb.Digest, error) {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	dg := s.digest(b)
+	return dg, s.storeBlob(dg, b)
+}
+
+// moveBlob moves a completed file into the CAS.
+func (s *Server) moveBlob(filename string, dg *pb.Digest) error {
+	dest, err := s.blobPath(dg)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filename, dest)
+}
+
+// hash returns the hex-encoded hash of the given data.
+func (s *Server) hash(data []byte) string {
+	h := s.newHash()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digest returns the digest of the given data.
+func (s *Server) digest(data []byte) *pb.Digest {
+	return &pb.Digest{Hash: s.hash(data), SizeBytes: int64(len(data))}
+}
+
+// checkHash checks that a digest's hash is valid for our digest function, i.e. that it's lowercase hex
+// of the right length. This must be done before using it in any path, since it comes from the client.
+func (s *Server) checkHash(dg *pb.Digest) error {
+	if dg == nil {
+		return status.Errorf(codes.InvalidArgument, "Missing digest")
+	} else if len(dg.Hash) != 2*s.newHash().Size() {
+		return status.Errorf(codes.InvalidArgument, "Invalid hash %q: must be %d characters", dg.Hash, 2*s.newHash().Size())
+	}
+	for _, c := range dg.Hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return status.Errorf(codes.InvalidArgument, "Invalid hash %q: must be lowercase hex", dg.Hash)
+		}
+	}
+	return nil
+}
+
+// checkDigest checks that some data with the given hash and size matches the expected digest.
+func (s *Server) checkDigest(dg *pb.Digest, hash string, size int64) error {
+	if dg == nil {
+		return status.Errorf(codes.InvalidArgument, "Missing digest")
+	} else if dg.Hash != hash {
+		return status.Errorf(codes.InvalidArgument, "Digest mismatch: expected hash %s, was %s", dg.Hash, hash)
+	} else if dg.SizeBytes != size {
+		return status.Errorf(codes.InvalidArgument, "Digest mismatch: expected size %d, was %d", dg.SizeBytes, size)
+	}
+	return nil
+}
+
+// parseResourceName parses a ByteStream resource name and returns the digest it refers to.
+// These are of the form [{instance_name}/]blobs/{hash}/{size} for reads, and
+// [{instance_name}/]uploads/{uuid}/blobs/{hash}/{size}[/{anything}] for writes.
+func parseResourceName(name, kind string) (*pb.Digest, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part != kind {
+			continue
+		}
+		rest := parts[i+1:]
+		if kind == "uploads" && len(rest) > 0 {
+			rest = rest[1:] // Skip the uuid
+			if len(rest) == 0 || rest[0] != "blobs" {
+				break
+			}
+			rest = rest[1:]
+		}
+		if len(rest) < 2 {
+			break
+		}
+		size, err := strconv.ParseInt(rest[1], 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid size in resource name %s: %s", name, err)
+		}
+		return &pb.Digest{Hash: rest[0], SizeBytes: size}, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "Invalid resource name: %s", name)
+}
+
+// toStatus converts an error to a status proto for a batch response.
+func toStatus(err error) *rpcstatus.Status {
+	if err == nil {
+		return &rpcstatus.Status{}
+	} else if s, ok := status.FromError(err); ok {
+		return s.Proto()
+	}
+	return &rpcstatus.Status{Code: int32(codes.Internal), Message: fmt.Sprintf("%s", err)}
+}
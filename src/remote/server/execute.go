@@ -0,0 +1,556 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/googleapis/longrunning"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thought-machine/please/src/core"
+)
+
+// defaultTimeout is the timeout we apply to actions that don't specify one.
+const defaultTimeout = 10 * time.Minute
+
+// operationRetention is how long we keep completed operations around for, so clients can
+// still retrieve them with WaitExecution if their stream broke near the end.
+const operationRetention = time.Minute
+
+// nextOperation is used to give operations unique names.
+var nextOperation int64
+
+// An operation is an action that has been submitted for execution.
+type operation struct {
+	name   string
+	digest *pb.Digest
+	// Closed once the operation starts executing.
+	executing chan struct{}
+	done      chan struct{}
+	// Only set once done is closed.
+	result *longrunning.Operation
+}
+
+// GetActionResult implements the ActionCache service.
+func (s *Server) GetActionResult(ctx context.Context, req *pb.GetActionResultRequest) (*pb.ActionResult, error) {
+	filename, err := s.actionResultPath(req.ActionDigest)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "Action result for %s not found", req.ActionDigest.Hash)
+	} else if err != nil {
+		return nil, err
+	}
+	ar := &pb.ActionResult{}
+	if err := proto.Unmarshal(b, ar); err != nil {
+		return nil, err
+	}
+	// Check that all the outputs still exist; if they don't the result isn't usable.
+	for _, f := range ar.OutputFiles {
+		if !s.blobExists(f.Digest) {
+			return nil, status.Errorf(codes.NotFound, "Output %s of action %s is missing from the CAS", f.Path, req.ActionDigest.Hash)
+		}
+	}
+	if req.InlineStdout && ar.StdoutDigest != nil && ar.StdoutDigest.SizeBytes < maxBatchSize {
+		ar.StdoutRaw, _ = s.readBlob(ar.StdoutDigest)
+	}
+	if req.InlineStderr && ar.StderrDigest != nil && ar.StderrDigest.SizeBytes < maxBatchSize {
+		ar.StderrRaw, _ = s.readBlob(ar.StderrDigest)
+	}
+	return ar, nil
+}
+
+// UpdateActionResult implements the ActionCache service.
+func (s *Server) UpdateActionResult(ctx context.Context, req *pb.UpdateActionResultRequest) (*pb.ActionResult, error) {
+	if req.ActionDigest == nil || req.ActionResult == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Missing action digest or result")
+	}
+	return req.ActionResult, s.storeActionResult(req.ActionDigest, req.ActionResult)
+}
+
+// actionResultPath returns the path that the result for an action is stored at.
+func (s *Server) actionResultPath(dg *pb.Digest) (string, error) {
+	if err := s.checkHash(dg); err != nil {
+		return "", err
+	}
+	return path.Join(s.dir, "ac", dg.Hash), nil
+}
+
+// storeActionResult stores a result in the action cache.
+func (s *Server) storeActionResult(dg *pb.Digest, ar *pb.ActionResult) error {
+	filename, err := s.actionResultPath(dg)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(ar)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Join(s.dir, "uploads"), dg.Hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Execute implements the Execution service.
+func (s *Server) Execute(req *pb.ExecuteRequest, srv pb.Execution_ExecuteServer) error {
+	if req.ActionDigest == nil {
+		return status.Errorf(codes.InvalidArgument, "Missing action digest")
+	}
+	name := fmt.Sprintf("operations/%s-%d", req.ActionDigest.Hash, atomic.AddInt64(&nextOperation, 1))
+	if !req.SkipCacheLookup {
+		if ar, err := s.GetActionResult(srv.Context(), &pb.GetActionResultRequest{ActionDigest: req.ActionDigest}); err == nil {
+			return srv.Send(s.completedOperation(name, req.ActionDigest, &pb.ExecuteResponse{
+				Result:       ar,
+				CachedResult: true,
+			}))
+		}
+	}
+	op := &operation{name: name, digest: req.ActionDigest, executing: make(chan struct{}), done: make(chan struct{})}
+	s.opMutex.Lock()
+	s.operations[name] = op
+	s.opMutex.Unlock()
+	if err := srv.Send(s.inProgressOperation(op, pb.ExecutionStage_QUEUED)); err != nil {
+		return err
+	}
+	// This runs in the background so it can be resumed with WaitExecution if the client's stream breaks.
+	go s.run(op)
+	return s.wait(srv.Context(), op, srv)
+}
+
+// WaitExecution implements the Execution service.
+func (s *Server) WaitExecution(req *pb.WaitExecutionRequest, srv pb.Execution_WaitExecutionServer) error {
+	s.opMutex.Lock()
+	op, present := s.operations[req.Name]
+	s.opMutex.Unlock()
+	if !present {
+		return status.Errorf(codes.NotFound, "Operation %s not found", req.Name)
+	}
+	return s.wait(srv.Context(), op, srv)
+}
+
+// wait waits for an operation to complete and sends it to the client, along with an update
+// when it starts executing. It's the only thing that sends on the stream, since gRPC streams
+// can't be sent on from multiple goroutines.
+func (s *Server) wait(ctx context.Context, op *operation, srv interface {
+	Send(*longrunning.Operation) error
+}) error {
+	executing := op.executing
+	for {
+		select {
+		case <-executing:
+			executing = nil // Only report it once
+			if err := srv.Send(s.inProgressOperation(op, pb.ExecutionStage_EXECUTING)); err != nil {
+				return err
+			}
+		case <-op.done:
+			return srv.Send(op.result)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run runs an operation and records its result.
+func (s *Server) run(op *operation) {
+	s.workers <- struct{}{}
+	close(op.executing)
+	ar, err := s.execute(op.digest)
+	<-s.workers
+	resp := &pb.ExecuteResponse{Result: ar, Status: toStatus(err)}
+	if err != nil {
+		log.Warning("Failed to execute action %s: %s", op.digest.Hash, err)
+		resp.Message = err.Error()
+	}
+	op.result = s.completedOperation(op.name, op.digest, resp)
+	close(op.done)
+	time.AfterFunc(operationRetention, func() {
+		s.opMutex.Lock()
+		defer s.opMutex.Unlock()
+		delete(s.operations, op.name)
+	})
+}
+
+// execute runs a single action. The returned result may be non-nil even if there is an error
+// (for example if the action timed out).
+func (s *Server) execute(actionDigest *pb.Digest) (*pb.ActionResult, error) {
+	md := &pb.ExecutedActionMetadata{Worker: worker(), WorkerStartTimestamp: ptypes.TimestampNow()}
+	action := &pb.Action{}
+	command := &pb.Command{}
+	if err := s.readMessage(actionDigest, action); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to read action: %s", err)
+	} else if err := s.readMessage(action.CommandDigest, command); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to read command: %s", err)
+	} else if len(command.Arguments) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Command has no arguments")
+	}
+	dir, err := ioutil.TempDir(path.Join(s.dir, "exec"), actionDigest.Hash)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	md.InputFetchStartTimestamp = ptypes.TimestampNow()
+	if err := s.materialise(dir, action.InputRootDigest); err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to set up inputs: %s", err)
+	}
+	md.InputFetchCompletedTimestamp = ptypes.TimestampNow()
+	if err := checkPath(command.WorkingDirectory); err != nil {
+		return nil, err
+	}
+	workDir := path.Join(dir, command.WorkingDirectory)
+	outputs := outputPaths(command)
+	for _, out := range outputs {
+		filename, err := resolveOutput(dir, command, out)
+		if err != nil {
+			return nil, err
+		} else if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+			return nil, err
+		}
+	}
+	timeout := defaultTimeout
+	if action.Timeout != nil {
+		if t, err := ptypes.Duration(action.Timeout); err == nil && t > 0 {
+			timeout = t
+		}
+	}
+	md.ExecutionStartTimestamp = ptypes.TimestampNow()
+	stdout, stderr, exitCode, runErr := s.runCommand(workDir, command, timeout)
+	md.ExecutionCompletedTimestamp = ptypes.TimestampNow()
+	md.OutputUploadStartTimestamp = ptypes.TimestampNow()
+	ar := &pb.ActionResult{ExitCode: exitCode, ExecutionMetadata: md}
+	if ar.StdoutDigest, err = s.storeOutput(stdout); err != nil {
+		return nil, err
+	} else if ar.StderrDigest, err = s.storeOutput(stderr); err != nil {
+		return nil, err
+	} else if runErr != nil {
+		return ar, runErr
+	} else if err := s.collectOutputs(dir, outputs, command, ar); err != nil {
+		return nil, err
+	}
+	md.OutputUploadCompletedTimestamp = ptypes.TimestampNow()
+	md.WorkerCompletedTimestamp = ptypes.TimestampNow()
+	if exitCode == 0 && !action.DoNotCache {
+		if err := s.storeActionResult(actionDigest, ar); err != nil {
+			return nil, err
+		}
+	}
+	return ar, nil
+}
+
+// runCommand runs a command in the given directory. It returns an error only if the command
+// couldn't be run at all or timed out; a nonzero exit is reported through the exit code.
+func (s *Server) runCommand(dir string, command *pb.Command, timeout time.Duration) ([]byte, []byte, int32, error) {
+	argv := command.Arguments
+	if s.sandbox {
+		argv = s.executor.MustSandboxCommand(argv)
+	}
+	env := make([]string, len(command.EnvironmentVariables))
+	for i, v := range command.EnvironmentVariables {
+		env[i] = v.Name + "=" + v.Value
+	}
+	var stdout, stderr bytes.Buffer
+	err := s.executor.ExecWithTimeoutStreams(dir, env, timeout, &stdout, &stderr, argv)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.Bytes(), stderr.Bytes(), int32(exitErr.ExitCode()), nil
+	} else if err == context.DeadlineExceeded {
+		return nil, nil, -1, status.Errorf(codes.DeadlineExceeded, "Action timed out after %s", timeout)
+	} else if err != nil {
+		return nil, nil, 0, status.Errorf(codes.InvalidArgument, "Failed to run command: %s", err)
+	}
+	return stdout.Bytes(), stderr.Bytes(), 0, nil
+}
+
+// materialise writes out the input tree with the given root into a directory.
+func (s *Server) materialise(dir string, root *pb.Digest) error {
+	d := &pb.Directory{}
+	if err := s.readMessage(root, d); err != nil {
+		return err
+	} else if err := checkNames(d); err != nil {
+		return err
+	} else if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		return err
+	}
+	for _, f := range d.Files {
+		mode := os.FileMode(0644)
+		if f.IsExecutable {
+			mode = 0755
+		}
+		if f.NodeProperties != nil && f.NodeProperties.UnixMode != nil {
+			mode = os.FileMode(f.NodeProperties.UnixMode.Value)
+		}
+		b, err := s.readBlob(f.Digest)
+		if err != nil {
+			return err
+		}
+		filename := path.Join(dir, f.Name)
+		if err := ioutil.WriteFile(filename, b, mode); err != nil {
+			return err
+		} else if err := os.Chmod(filename, mode); err != nil { // In case the umask got in the way
+			return err
+		}
+	}
+	for _, l := range d.Symlinks {
+		if err := os.Symlink(l.Target, path.Join(dir, l.Name)); err != nil {
+			return err
+		}
+	}
+	for _, child := range d.Directories {
+		if err := s.materialise(path.Join(dir, child.Name), child.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectOutputs stores the outputs of an action in the CAS and adds them to its result.
+// The outputs are relative to the command's working directory within the given directory.
+func (s *Server) collectOutputs(dir string, outputs []string, command *pb.Command, ar *pb.ActionResult) error {
+	unixMode := false
+	for _, prop := range command.OutputNodeProperties {
+		unixMode = unixMode || prop == unixModeProperty
+	}
+	for _, out := range outputs {
+		filename, err := resolveOutput(dir, command, out)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(filename)
+		if os.IsNotExist(err) {
+			continue // Missing outputs are not an error here; the client decides whether it needs them.
+		} else if err != nil {
+			return err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filename)
+			if err != nil {
+				return err
+			}
+			symlink := &pb.OutputSymlink{Path: out, Target: target}
+			ar.OutputSymlinks = append(ar.OutputSymlinks, symlink)
+			// Also populate the older fields for clients that only understand those.
+			if info, err := os.Stat(filename); err == nil && info.IsDir() {
+				ar.OutputDirectorySymlinks = append(ar.OutputDirectorySymlinks, symlink)
+			} else {
+				ar.OutputFileSymlinks = append(ar.OutputFileSymlinks, symlink)
+			}
+		} else if info.IsDir() {
+			tree := &pb.Tree{}
+			root, err := s.storeDirectory(filename, tree, unixMode)
+			if err != nil {
+				return err
+			}
+			tree.Root = root
+			dg, err := s.storeMessage(tree)
+			if err != nil {
+				return err
+			}
+			ar.OutputDirectories = append(ar.OutputDirectories, &pb.OutputDirectory{Path: out, TreeDigest: dg})
+		} else {
+			node, err := s.storeFile(filename, info, unixMode)
+			if err != nil {
+				return err
+			}
+			ar.OutputFiles = append(ar.OutputFiles, &pb.OutputFile{
+				Path:           out,
+				Digest:         node.Digest,
+				IsExecutable:   node.IsExecutable,
+				NodeProperties: node.NodeProperties,
+			})
+		}
+	}
+	return nil
+}
+
+// storeDirectory stores the contents of a directory in the CAS, adding all its descendants to the given tree.
+func (s *Server) storeDirectory(dir string, tree *pb.Tree, unixMode bool) (*pb.Directory, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := &pb.Directory{}
+	for _, info := range infos { // ReadDir returns these sorted by name, as the API requires.
+		filename := path.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filename)
+			if err != nil {
+				return nil, err
+			}
+			d.Symlinks = append(d.Symlinks, &pb.SymlinkNode{Name: info.Name(), Target: target})
+		} else if info.IsDir() {
+			child, err := s.storeDirectory(filename, tree, unixMode)
+			if err != nil {
+				return nil, err
+			}
+			tree.Children = append(tree.Children, child)
+			dg, err := s.storeMessage(child)
+			if err != nil {
+				return nil, err
+			}
+			d.Directories = append(d.Directories, &pb.DirectoryNode{Name: info.Name(), Digest: dg})
+		} else {
+			node, err := s.storeFile(filename, info, unixMode)
+			if err != nil {
+				return nil, err
+			}
+			d.Files = append(d.Files, node)
+		}
+	}
+	return d, nil
+}
+
+// storeFile stores a single file in the CAS.
+func (s *Server) storeFile(filename string, info os.FileInfo, unixMode bool) (*pb.FileNode, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dg := s.digest(b)
+	if err := s.storeBlob(dg, b); err != nil {
+		return nil, err
+	}
+	node := &pb.FileNode{
+		Name:         info.Name(),
+		Digest:       dg,
+		IsExecutable: info.Mode()&0111 != 0,
+	}
+	if unixMode {
+		node.NodeProperties = &pb.NodeProperties{UnixMode: &wrappers.UInt32Value{Value: uint32(info.Mode().Perm())}}
+	}
+	return node, nil
+}
+
+// storeOutput stores stdout or stderr in the CAS.
+func (s *Server) storeOutput(b []byte) (*pb.Digest, error) {
+	dg := s.digest(b)
+	return dg, s.storeBlob(dg, b)
+}
+
+// inProgressOperation returns an operation that's not yet complete.
+func (s *Server) inProgressOperation(op *operation, stage pb.ExecutionStage_Value) *longrunning.Operation {
+	md, _ := ptypes.MarshalAny(&pb.ExecuteOperationMetadata{Stage: stage, ActionDigest: op.digest})
+	return &longrunning.Operation{Name: op.name, Metadata: md}
+}
+
+// completedOperation returns a completed operation with the given response.
+func (s *Server) completedOperation(name string, digest *pb.Digest, resp *pb.ExecuteResponse) *longrunning.Operation {
+	if resp.Status == nil {
+		resp.Status = &rpcstatus.Status{}
+	}
+	md, _ := ptypes.MarshalAny(&pb.ExecuteOperationMetadata{Stage: pb.ExecutionStage_COMPLETED, ActionDigest: digest})
+	r, _ := ptypes.MarshalAny(resp)
+	return &longrunning.Operation{
+		Name:     name,
+		Metadata: md,
+		Done:     true,
+		Result:   &longrunning.Operation_Response{Response: r},
+	}
+}
+
+// checkNames returns an error if any of the entries in a directory have names that aren't a single
+// path component, or if any of them are duplicated (which would let a symlink redirect a file or
+// directory elsewhere).
+func checkNames(d *pb.Directory) error {
+	names := make(map[string]bool, len(d.Files)+len(d.Directories)+len(d.Symlinks))
+	check := func(name string) error {
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+			return status.Errorf(codes.InvalidArgument, "Invalid name in input tree: %q", name)
+		} else if names[name] {
+			return status.Errorf(codes.InvalidArgument, "Duplicate name in input tree: %s", name)
+		}
+		names[name] = true
+		return nil
+	}
+	for _, f := range d.Files {
+		if err := check(f.Name); err != nil {
+			return err
+		}
+	}
+	for _, dir := range d.Directories {
+		if err := check(dir.Name); err != nil {
+			return err
+		}
+	}
+	for _, l := range d.Symlinks {
+		if err := check(l.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPath returns an error if the given path is absolute or has any .. components, i.e. if it
+// could refer to something outside the directory it's relative to.
+func checkPath(p string) error {
+	if path.IsAbs(p) {
+		return status.Errorf(codes.InvalidArgument, "Invalid absolute path %s", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return status.Errorf(codes.InvalidArgument, "Invalid path %s", p)
+		}
+	}
+	return nil
+}
+
+// resolveOutput returns the location of one of a command's outputs within the given directory.
+// It's an error if it could be outside it, either lexically or by passing through a symlink.
+func resolveOutput(dir string, command *pb.Command, out string) (string, error) {
+	if err := checkPath(out); err != nil {
+		return "", err
+	}
+	filename := path.Join(dir, command.WorkingDirectory, out)
+	if !strings.HasPrefix(filename, dir+"/") {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid output path %q", out)
+	}
+	for d := path.Dir(filename); d != dir; d = path.Dir(d) {
+		if info, err := os.Lstat(d); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", status.Errorf(codes.InvalidArgument, "Output %s is within a symlink", out)
+		}
+	}
+	return filename, nil
+}
+
+// outputPaths returns the paths of the outputs that a command requests.
+func outputPaths(command *pb.Command) []string {
+	if len(command.OutputPaths) > 0 {
+		return command.OutputPaths
+	}
+	outs := append(append([]string{}, command.OutputFiles...), command.OutputDirectories...)
+	sort.Strings(outs)
+	return outs
+}
+
+// worker returns the name we report for the worker that ran an action.
+func worker() string {
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "please-remote-server"
+}
@@ -0,0 +1,125 @@
+// Package server implements a self-contained remote execution server, backed by the local filesystem.
+//
+// It implements the CAS, ActionCache, Capabilities and Execution services of the remote execution API
+// (plus ByteStream, which the CAS needs for large blobs), which is enough for Please to build against it.
+// It's intended for development and testing, for example to run remote-mode builds offline; it makes no
+// attempt to be a scalable or secure server.
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/process"
+)
+
+var log = logging.MustGetLogger("server")
+
+// maxBatchSize is the largest total size of blobs we accept in a batch request.
+// Larger blobs are sent via ByteStream instead.
+const maxBatchSize = 4 * 1024 * 1024
+
+// maxMessageSize is the largest gRPC message we accept.
+const maxMessageSize = 419430400
+
+// unixModeProperty is the name of the node property for file modes.
+const unixModeProperty = "unix_mode"
+
+// A Server is an implementation of the remote execution API.
+type Server struct {
+	dir        string
+	digestFunc pb.DigestFunction_Value
+	newHash    func() hash.Hash
+	executor   *process.Executor
+	sandbox    bool
+	// Limits how many actions we run at once.
+	workers chan struct{}
+	// Operations currently in progress (or recently completed), keyed by name.
+	operations map[string]*operation
+	opMutex    sync.Mutex
+}
+
+// New creates a new Server storing its data in the given directory.
+// hashFunction is either sha256 or sha1 (which must match the client's configuration).
+// If sandboxTool is non-empty, actions are run in the sandbox using that tool.
+// numWorkers limits how many actions are run at once; if it's zero it defaults to the number of CPUs.
+func New(dir, hashFunction, sandboxTool string, numWorkers int) (*Server, error) {
+	s := &Server{
+		dir:        dir,
+		executor:   process.New(sandboxTool),
+		sandbox:    sandboxTool != "",
+		operations: map[string]*operation{},
+	}
+	switch hashFunction {
+	case "sha256", "":
+		s.digestFunc = pb.DigestFunction_SHA256
+		s.newHash = sha256.New
+	case "sha1":
+		s.digestFunc = pb.DigestFunction_SHA1
+		s.newHash = sha1.New
+	default:
+		return nil, fmt.Errorf("Unsupported hash function %s; must be sha256 or sha1", hashFunction)
+	}
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	s.workers = make(chan struct{}, numWorkers)
+	for _, subdir := range []string{"cas", "ac", "exec", "uploads"} {
+		if err := os.MkdirAll(path.Join(dir, subdir), core.DirPermissions); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Register registers all the services of this server on the given gRPC server.
+func (s *Server) Register(srv *grpc.Server) {
+	pb.RegisterCapabilitiesServer(srv, s)
+	pb.RegisterActionCacheServer(srv, s)
+	pb.RegisterContentAddressableStorageServer(srv, s)
+	pb.RegisterExecutionServer(srv, s)
+	bs.RegisterByteStreamServer(srv, s)
+}
+
+// Serve serves on the given listener until it fails.
+func (s *Server) Serve(lis net.Listener) error {
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(maxMessageSize), grpc.MaxSendMsgSize(maxMessageSize))
+	s.Register(srv)
+	return srv.Serve(lis)
+}
+
+// GetCapabilities implements the Capabilities service.
+func (s *Server) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
+	return &pb.ServerCapabilities{
+		CacheCapabilities: &pb.CacheCapabilities{
+			DigestFunction: []pb.DigestFunction_Value{s.digestFunc},
+			ActionCacheUpdateCapabilities: &pb.ActionCacheUpdateCapabilities{
+				UpdateEnabled: true,
+			},
+			MaxBatchTotalSizeBytes:      maxBatchSize,
+			SymlinkAbsolutePathStrategy: pb.SymlinkAbsolutePathStrategy_ALLOWED,
+		},
+		ExecutionCapabilities: &pb.ExecutionCapabilities{
+			DigestFunction:          s.digestFunc,
+			ExecEnabled:             true,
+			SupportedNodeProperties: []string{unixModeProperty},
+		},
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2, Minor: 1},
+	}, nil
+}
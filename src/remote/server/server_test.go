@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bs "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlobs(t *testing.T) {
+	s := newServer(t)
+	ctx := context.Background()
+	dg := s.digest([]byte("hello"))
+	missing, err := s.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{BlobDigests: []*pb.Digest{dg}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(missing.MissingBlobDigests))
+
+	updated, err := s.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{Requests: []*pb.BatchUpdateBlobsRequest_Request{
+		{Digest: dg, Data: []byte("hello")},
+		{Digest: dg, Data: []byte("wibble")},
+	}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, codes.OK, updated.Responses[0].Status.Code)
+	assert.EqualValues(t, codes.InvalidArgument, updated.Responses[1].Status.Code)
+
+	missing, err = s.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{BlobDigests: []*pb.Digest{dg}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(missing.MissingBlobDigests))
+
+	read, err := s.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{Digests: []*pb.Digest{dg, s.digest([]byte("wibble"))}})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), read.Responses[0].Data)
+	assert.EqualValues(t, codes.NotFound, read.Responses[1].Status.Code)
+}
+
+func TestInvalidHashes(t *testing.T) {
+	s := newServer(t)
+	ctx := context.Background()
+	for _, hash := range []string{
+		"../../../../etc/passwd",
+		"2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824",
+		"2cf24dba5fb0a30e",
+	} {
+		dg := &pb.Digest{Hash: hash, SizeBytes: 5}
+		read, err := s.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{Digests: []*pb.Digest{dg}})
+		assert.NoError(t, err)
+		assert.EqualValues(t, codes.InvalidArgument, read.Responses[0].Status.Code)
+		_, err = s.GetActionResult(ctx, &pb.GetActionResultRequest{ActionDigest: dg})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = s.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{ActionDigest: dg, ActionResult: &pb.ActionResult{}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestByteStream(t *testing.T) {
+	s := newServer(t)
+	client := bs.NewByteStreamClient(dial(t, s))
+	ctx := context.Background()
+	data := []byte("hello world")
+	dg := s.digest(data)
+
+	w, err := client.Write(ctx)
+	require.NoError(t, err)
+	name := "instance/uploads/1234/blobs/" + dg.Hash + "/11"
+	assert.NoError(t, w.Send(&bs.WriteRequest{ResourceName: name, Data: data[:5]}))
+	assert.NoError(t, w.Send(&bs.WriteRequest{WriteOffset: 5, Data: data[5:], FinishWrite: true}))
+	resp, err := w.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 11, resp.CommittedSize)
+
+	r, err := client.Read(ctx, &bs.ReadRequest{ResourceName: "instance/blobs/" + dg.Hash + "/11", ReadOffset: 6})
+	require.NoError(t, err)
+	msg, err := r.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("world"), msg.Data)
+}
+
+func TestParseResourceName(t *testing.T) {
+	dg, err := parseResourceName("blobs/abcdef/12", "blobs")
+	assert.NoError(t, err)
+	assert.Equal(t, &pb.Digest{Hash: "abcdef", SizeBytes: 12}, dg)
+	dg, err = parseResourceName("instance/uploads/uuid/blobs/abcdef/12/metadata", "uploads")
+	assert.NoError(t, err)
+	assert.Equal(t, &pb.Digest{Hash: "abcdef", SizeBytes: 12}, dg)
+	_, err = parseResourceName("blobs/abcdef", "blobs")
+	assert.Error(t, err)
+	_, err = parseResourceName("uploads/uuid/abcdef/12", "uploads")
+	assert.Error(t, err)
+}
+
+func TestExecute(t *testing.T) {
+	s := newServer(t)
+	client := pb.NewExecutionClient(dial(t, s))
+	actionDigest := storeAction(t, s, &pb.Command{
+		Arguments:   []string{"bash", "-c", "echo hello && cat in.txt > out/out.txt"},
+		OutputFiles: []string{"out/out.txt"},
+	}, &pb.Directory{Files: []*pb.FileNode{{Name: "in.txt", Digest: storeString(t, s, "input")}}})
+
+	resp := execute(t, client, actionDigest)
+	assert.False(t, resp.CachedResult)
+	assert.EqualValues(t, 0, resp.Result.ExitCode)
+	require.Equal(t, 1, len(resp.Result.OutputFiles))
+	assert.Equal(t, "out/out.txt", resp.Result.OutputFiles[0].Path)
+	assert.Equal(t, s.digest([]byte("input")), resp.Result.OutputFiles[0].Digest)
+	assert.Equal(t, s.digest([]byte("hello\n")), resp.Result.StdoutDigest)
+
+	// Second time around it should come from the action cache.
+	resp = execute(t, client, actionDigest)
+	assert.True(t, resp.CachedResult)
+	assert.Equal(t, "out/out.txt", resp.Result.OutputFiles[0].Path)
+}
+
+func TestExecuteFailure(t *testing.T) {
+	s := newServer(t)
+	client := pb.NewExecutionClient(dial(t, s))
+	actionDigest := storeAction(t, s, &pb.Command{
+		Arguments: []string{"bash", "-c", "echo failed >&2 && exit 3"},
+	}, &pb.Directory{})
+
+	resp := execute(t, client, actionDigest)
+	assert.EqualValues(t, 3, resp.Result.ExitCode)
+	assert.Equal(t, s.digest([]byte("failed\n")), resp.Result.StderrDigest)
+	// Failed actions aren't cached.
+	_, err := s.GetActionResult(context.Background(), &pb.GetActionResultRequest{ActionDigest: actionDigest})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	s := newServer(t)
+	client := pb.NewExecutionClient(dial(t, s))
+	actionDigest := storeAction(t, s, &pb.Command{
+		Arguments: []string{"sleep", "10"},
+	}, &pb.Directory{})
+	action := &pb.Action{}
+	require.NoError(t, s.readMessage(actionDigest, action))
+	action.Timeout = ptypes.DurationProto(1)
+	actionDigest, err := s.storeMessage(action)
+	require.NoError(t, err)
+
+	resp := execute(t, client, actionDigest)
+	assert.EqualValues(t, codes.DeadlineExceeded, resp.Status.Code)
+}
+
+func TestExecuteInvalidPaths(t *testing.T) {
+	s := newServer(t)
+	client := pb.NewExecutionClient(dial(t, s))
+	in := storeString(t, s, "input")
+	for name, action := range map[string]*pb.Digest{
+		"parent input": storeAction(t, s, &pb.Command{Arguments: []string{"true"}}, &pb.Directory{
+			Files: []*pb.FileNode{{Name: "..", Digest: in}},
+		}),
+		"nested input": storeAction(t, s, &pb.Command{Arguments: []string{"true"}}, &pb.Directory{
+			Files: []*pb.FileNode{{Name: "a/b.txt", Digest: in}},
+		}),
+		"duplicate input": storeAction(t, s, &pb.Command{Arguments: []string{"true"}}, &pb.Directory{
+			Symlinks:    []*pb.SymlinkNode{{Name: "a", Target: "/tmp"}},
+			Directories: []*pb.DirectoryNode{{Name: "a", Digest: storeMessage(t, s, &pb.Directory{})}},
+		}),
+		"absolute output": storeAction(t, s, &pb.Command{Arguments: []string{"true"}, OutputFiles: []string{"/tmp/out.txt"}}, &pb.Directory{}),
+		"parent output":   storeAction(t, s, &pb.Command{Arguments: []string{"true"}, OutputFiles: []string{"a/../../out.txt"}}, &pb.Directory{}),
+		"symlink output": storeAction(t, s, &pb.Command{Arguments: []string{"true"}, OutputFiles: []string{"a/out.txt"}}, &pb.Directory{
+			Symlinks: []*pb.SymlinkNode{{Name: "a", Target: "/tmp"}},
+		}),
+		"working directory": storeAction(t, s, &pb.Command{Arguments: []string{"true"}, WorkingDirectory: "../"}, &pb.Directory{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := execute(t, client, action)
+			assert.EqualValues(t, codes.InvalidArgument, resp.Status.Code)
+		})
+	}
+}
+
+func TestExecuteStages(t *testing.T) {
+	s := newServer(t)
+	client := pb.NewExecutionClient(dial(t, s))
+	// Sleep briefly so the action is still running once it's reported as executing.
+	actionDigest := storeAction(t, s, &pb.Command{Arguments: []string{"sleep", "0.2"}}, &pb.Directory{})
+	stream, err := client.Execute(context.Background(), &pb.ExecuteRequest{ActionDigest: actionDigest})
+	require.NoError(t, err)
+	stages := []pb.ExecutionStage_Value{}
+	for {
+		op, err := stream.Recv()
+		require.NoError(t, err)
+		if op.Done {
+			break
+		}
+		md := &pb.ExecuteOperationMetadata{}
+		require.NoError(t, ptypes.UnmarshalAny(op.Metadata, md))
+		stages = append(stages, md.Stage)
+	}
+	assert.Equal(t, []pb.ExecutionStage_Value{pb.ExecutionStage_QUEUED, pb.ExecutionStage_EXECUTING}, stages)
+}
+
+func TestGetCapabilities(t *testing.T) {
+	s := newServer(t)
+	caps, err := s.GetCapabilities(context.Background(), &pb.GetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, pb.DigestFunction_SHA256, caps.ExecutionCapabilities.DigestFunction)
+	assert.Equal(t, []string{unixModeProperty}, caps.ExecutionCapabilities.SupportedNodeProperties)
+}
+
+func newServer(t *testing.T) *Server {
+	dir, err := ioutil.TempDir("", "remote_server_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := New(dir, "sha256", "", 2)
+	require.NoError(t, err)
+	return s
+}
+
+// dial starts serving the given server on a random port and returns a connection to it.
+func dial(t *testing.T, s *Server) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	s.Register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func storeString(t *testing.T, s *Server, contents string) *pb.Digest {
+	dg := s.digest([]byte(contents))
+	require.NoError(t, s.storeBlob(dg, []byte(contents)))
+	return dg
+}
+
+func storeMessage(t *testing.T, s *Server, msg proto.Message) *pb.Digest {
+	dg, err := s.storeMessage(msg)
+	require.NoError(t, err)
+	return dg
+}
+
+func storeAction(t *testing.T, s *Server, command *pb.Command, root *pb.Directory) *pb.Digest {
+	commandDigest, err := s.storeMessage(command)
+	require.NoError(t, err)
+	rootDigest, err := s.storeMessage(root)
+	require.NoError(t, err)
+	actionDigest, err := s.storeMessage(&pb.Action{CommandDigest: commandDigest, InputRootDigest: rootDigest})
+	require.NoError(t, err)
+	return actionDigest
+}
+
+// execute executes an action and returns the final response.
+func execute(t *testing.T, client pb.ExecutionClient, actionDigest *pb.Digest) *pb.ExecuteResponse {
+	stream, err := client.Execute(context.Background(), &pb.ExecuteRequest{ActionDigest: actionDigest})
+	require.NoError(t, err)
+	for {
+		op, err := stream.Recv()
+		require.NoError(t, err)
+		if op.Done {
+			resp := &pb.ExecuteResponse{}
+			require.NoError(t, ptypes.UnmarshalAny(op.GetResponse(), resp))
+			return resp
+		}
+	}
+}
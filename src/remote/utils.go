@@ -8,7 +8,6 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
@@ -17,6 +16,7 @@ import (
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/uploadinfo"
+	fpb "github.com/bazelbuild/remote-apis/build/bazel/remote/asset/v1"
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/bazelbuild/remote-apis/build/bazel/semver"
 	"github.com/golang/protobuf/proto"
@@ -50,12 +50,24 @@ func (c *Client) targetOutputs(label core.BuildLabel) *pb.Directory {
 	return c.outputs[label]
 }
 
+// builtLocally returns true if the outputs of the given target were produced locally rather than
+// by a remote action. Aside from targets marked as local, this can happen in dynamic mode.
+func (c *Client) builtLocally(target *core.BuildTarget) bool {
+	if target.Local {
+		return true
+	} else if !c.state.Config.Remote.Dynamic {
+		return false
+	}
+	s := target.State()
+	return s != core.BuiltRemotely && s != core.ReusedRemotely
+}
+
 // setOutputs sets the outputs for a previously executed target.
 func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error {
 	o := &pb.Directory{
 		Files:       make([]*pb.FileNode, len(ar.OutputFiles)),
 		Directories: make([]*pb.DirectoryNode, 0, len(ar.OutputDirectories)),
-		Symlinks:    make([]*pb.SymlinkNode, len(ar.OutputFileSymlinks)+len(ar.OutputDirectorySymlinks)),
+		Symlinks:    make([]*pb.SymlinkNode, 0, len(ar.OutputSymlinks)+len(ar.OutputFileSymlinks)+len(ar.OutputDirectorySymlinks)),
 	}
 	// N.B. At this point the various things we stick into this Directory proto can be in
 	//      subdirectories. This is not how a Directory proto is meant to work but it makes things
@@ -64,24 +76,26 @@ func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error
 	//      uploadInputDir.
 	for i, f := range ar.OutputFiles {
 		o.Files[i] = &pb.FileNode{
-			Name:         f.Path,
-			Digest:       f.Digest,
-			IsExecutable: f.IsExecutable,
+			Name:           f.Path,
+			Digest:         f.Digest,
+			IsExecutable:   f.IsExecutable,
+			NodeProperties: c.inputNodeProperties(f.NodeProperties, f.IsExecutable),
 		}
 	}
 	for _, d := range ar.OutputDirectories {
 		tree := &pb.Tree{}
-		if _, err := c.client.ReadProto(context.Background(), digest.NewFromProtoUnvalidated(d.TreeDigest), tree); err != nil {
+		if err := c.readProto(context.Background(), digest.NewFromProtoUnvalidated(d.TreeDigest), tree); err != nil {
 			return wrap(err, "Downloading tree digest for %s [%s]", d.Path, d.TreeDigest.Hash)
 		}
 
 		if outDir := maybeGetOutDir(d.Path, target.OutputDirectories); outDir != "" {
-			files, dirs, err := c.getOutputsForOutDir(target, outDir, tree)
+			files, dirs, symlinks, err := c.getOutputsForOutDir(target, outDir, tree)
 			if err != nil {
 				return err
 			}
 			o.Directories = append(o.Directories, dirs...)
 			o.Files = append(o.Files, files...)
+			o.Symlinks = append(o.Symlinks, symlinks...)
 		} else {
 			o.Directories = append(o.Directories, &pb.DirectoryNode{
 				Name:   d.Path,
@@ -89,10 +103,17 @@ func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error
 			})
 		}
 	}
-	for i, s := range append(ar.OutputFileSymlinks, ar.OutputDirectorySymlinks...) {
-		o.Symlinks[i] = &pb.SymlinkNode{
-			Name:   s.Path,
-			Target: s.Target,
+	// Servers implementing v2.1 of the API may report symlinks in either or both of these places.
+	seen := map[string]bool{}
+	for _, syms := range [][]*pb.OutputSymlink{ar.OutputSymlinks, ar.OutputFileSymlinks, ar.OutputDirectorySymlinks} {
+		for _, s := range syms {
+			if !seen[s.Path] {
+				seen[s.Path] = true
+				o.Symlinks = append(o.Symlinks, &pb.SymlinkNode{
+					Name:   s.Path,
+					Target: s.Target,
+				})
+			}
 		}
 	}
 	c.outputMutex.Lock()
@@ -101,39 +122,61 @@ func (c *Client) setOutputs(target *core.BuildTarget, ar *pb.ActionResult) error
 	return nil
 }
 
-func (c *Client) getOutputsForOutDir(target *core.BuildTarget, outDir core.OutputDirectory, tree *pb.Tree) ([]*pb.FileNode, []*pb.DirectoryNode, error) {
+func (c *Client) getOutputsForOutDir(target *core.BuildTarget, outDir core.OutputDirectory, tree *pb.Tree) ([]*pb.FileNode, []*pb.DirectoryNode, []*pb.SymlinkNode, error) {
 	files := make([]*pb.FileNode, 0, len(tree.Root.Files))
 	dirs := make([]*pb.DirectoryNode, 0, len(tree.Root.Directories))
+	symlinks := make([]*pb.SymlinkNode, 0, len(tree.Root.Symlinks))
 
 	if outDir.ShouldAddFiles() {
 		outs, err := c.client.FlattenTree(tree, "")
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
+		props := c.treeNodeProperties(tree)
 		for _, o := range outs {
 			if o.IsEmptyDirectory {
 				continue
 			}
 			target.AddOutput(o.Path)
+			if o.SymlinkTarget != "" {
+				symlinks = append(symlinks, &pb.SymlinkNode{
+					Name:   o.Path,
+					Target: o.SymlinkTarget,
+				})
+				continue
+			}
 			files = append(files, &pb.FileNode{
-				Digest:       o.Digest.ToProto(),
-				Name:         o.Path,
-				IsExecutable: o.IsExecutable,
+				Digest:         o.Digest.ToProto(),
+				Name:           o.Path,
+				IsExecutable:   o.IsExecutable,
+				NodeProperties: c.inputNodeProperties(props[o.Path], o.IsExecutable),
 			})
 		}
-		return files, dirs, nil
+		return files, dirs, symlinks, nil
 	}
 
 	for _, out := range tree.Root.Files {
 		target.AddOutput(out.Name)
-		files = append(files, out)
+		files = append(files, &pb.FileNode{
+			Name:           out.Name,
+			Digest:         out.Digest,
+			IsExecutable:   out.IsExecutable,
+			NodeProperties: c.inputNodeProperties(out.NodeProperties, out.IsExecutable),
+		})
 	}
 	for _, out := range tree.Root.Directories {
 		target.AddOutput(out.Name)
 		dirs = append(dirs, out)
 	}
+	for _, out := range tree.Root.Symlinks {
+		target.AddOutput(out.Name)
+		symlinks = append(symlinks, &pb.SymlinkNode{
+			Name:   out.Name,
+			Target: out.Target,
+		})
+	}
 
-	return files, dirs, nil
+	return files, dirs, symlinks, nil
 }
 
 // maybeGetOutDir will get the output directory based on the directory provided. If there's no matching directory, this
@@ -243,6 +286,51 @@ func (c *Client) recordAttrs(target *core.BuildTarget, digest *pb.Digest) {
 	}
 }
 
+// storeRemoteOutputs records the outputs of a target built remotely that are not being downloaded,
+// so they can be found and fetched later on.
+func (c *Client) storeRemoteOutputs(target *core.BuildTarget, dg *pb.Digest) error {
+	if c.outputsExist(target, dg) {
+		return core.RemoveRemoteOutputs(target) // They're already here, we don't need to record anything.
+	}
+	o := c.targetOutputs(target.Label)
+	outputs := &core.RemoteOutputs{
+		Action:  digest.NewFromProtoUnvalidated(dg).String(),
+		Outputs: make(map[string]core.RemoteOutput, len(o.Files)+len(o.Directories)+len(o.Symlinks)),
+	}
+	for _, f := range o.Files {
+		outputs.Outputs[f.Name] = core.RemoteOutput{
+			Digest:       digest.NewFromProtoUnvalidated(f.Digest).String(),
+			IsExecutable: f.IsExecutable,
+		}
+	}
+	for _, d := range o.Directories {
+		outputs.Outputs[d.Name] = core.RemoteOutput{
+			Digest:      digest.NewFromProtoUnvalidated(d.Digest).String(),
+			IsDirectory: true,
+		}
+	}
+	for _, s := range o.Symlinks {
+		outputs.Outputs[s.Name] = core.RemoteOutput{Symlink: s.Target}
+	}
+	return core.StoreRemoteOutputs(target, outputs)
+}
+
+// remoteOutputsAction returns the digest of the action that built a target remotely, from its
+// manifest of remote outputs.
+func (c *Client) remoteOutputsAction(target *core.BuildTarget) (*pb.Digest, error) {
+	outputs, err := core.LoadRemoteOutputs(target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read remote outputs for %s: %s", target, err)
+	} else if outputs == nil {
+		return nil, fmt.Errorf("No record of remote outputs for %s; it must be rebuilt before it can be downloaded", target)
+	}
+	dg, err := digest.NewFromString(outputs.Action)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid action digest in remote outputs for %s: %s", target, err)
+	}
+	return dg.ToProto(), nil
+}
+
 // mustMarshal encodes a message to a binary string.
 func mustMarshal(msg proto.Message) []byte {
 	b, err := proto.Marshal(msg)
@@ -486,6 +574,39 @@ func convertPlatform(config *core.Configuration) *pb.Platform {
 	return platform
 }
 
+// targetPlatform returns the platform properties to request when building the given target.
+func (c *Client) targetPlatform(target *core.BuildTarget) *pb.Platform {
+	return mergePlatform(c.platform, target.RemotePlatform)
+}
+
+// mergePlatform returns a platform with the given properties added to the given one, replacing any
+// existing properties of the same names. The original platform is not modified.
+func mergePlatform(platform *pb.Platform, properties map[string]string) *pb.Platform {
+	if len(properties) == 0 {
+		return platform
+	}
+	ret := &pb.Platform{}
+	for _, p := range platform.Properties {
+		if _, present := properties[p.Name]; !present {
+			ret.Properties = append(ret.Properties, p)
+		}
+	}
+	for name, value := range properties {
+		ret.Properties = append(ret.Properties, &pb.Platform_Property{
+			Name:  name,
+			Value: value,
+		})
+	}
+	// The protocol requires properties to be sorted by name (and then value).
+	sort.Slice(ret.Properties, func(i, j int) bool {
+		if ret.Properties[i].Name != ret.Properties[j].Name {
+			return ret.Properties[i].Name < ret.Properties[j].Name
+		}
+		return ret.Properties[i].Value < ret.Properties[j].Value
+	})
+	return ret
+}
+
 // removeOutputs removes all outputs for a target.
 func removeOutputs(target *core.BuildTarget) error {
 	outDir := target.OutDir()
@@ -506,6 +627,47 @@ func subresourceIntegrity(target *core.BuildTarget) string {
 	return strings.Join(ret, " ")
 }
 
+// fetchURLs returns the URLs to ask the remote asset server to fetch a remote file from,
+// including any mirrors, with environment variables expanded.
+func (c *Client) fetchURLs(target *core.BuildTarget) []string {
+	env := core.GeneralBuildEnvironment(c.state)
+	urls := target.MirroredURLs(c.state.Config)
+	for i, url := range urls {
+		urls[i] = os.Expand(url, env.ReplaceEnvironment)
+	}
+	return urls
+}
+
+// assetQualifiers returns the qualifiers to send to the remote asset server for a remote file.
+// The same ones are used for both fetching and pushing so the two match up on the server.
+// Headers that refer to environment variables are omitted, since they're likely to be credentials
+// which we don't want the server to store.
+func (c *Client) assetQualifiers(target *core.BuildTarget) []*fpb.Qualifier {
+	var qualifiers []*fpb.Qualifier
+	if !c.state.NeedHashesOnly || !c.state.IsOriginalTargetOrParent(target) {
+		if sri := subresourceIntegrity(target); sri != "" {
+			qualifiers = append(qualifiers, &fpb.Qualifier{
+				Name:  "checksum.sri",
+				Value: sri,
+			})
+		}
+	}
+	names := make([]string, 0, len(target.URLHeaders))
+	for name, value := range target.URLHeaders {
+		if !strings.Contains(value, "$") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		qualifiers = append(qualifiers, &fpb.Qualifier{
+			Name:  "http_header:" + name,
+			Value: target.URLHeaders[name],
+		})
+	}
+	return qualifiers
+}
+
 // reencodeSRI re-encodes a hash from the hex format we use to base64-encoded.
 func reencodeSRI(target *core.BuildTarget, h string) string {
 	if idx := strings.LastIndexByte(h, ':'); idx != -1 {
@@ -530,14 +692,14 @@ func (c *Client) dialOpts() ([]grpc.DialOption, error) {
 		// Set an arbitrarily large (400MB) max message size so it isn't a limitation.
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(419430400)),
 	}
-	if c.state.Config.Remote.TokenFile == "" {
+	if c.creds == nil {
 		return opts, nil
 	}
-	token, err := ioutil.ReadFile(c.state.Config.Remote.TokenFile)
-	if err != nil {
-		return opts, fmt.Errorf("Failed to load token from file: %s", err)
+	// Fetch the tokens now so a misconfiguration fails up front rather than on the first RPC.
+	if err := c.creds.Check(); err != nil {
+		return opts, err
 	}
-	return append(opts, grpc.WithPerRPCCredentials(preSharedToken(string(token)))), nil
+	return append(opts, grpc.WithPerRPCCredentials(c.creds)), nil
 }
 
 // outputHash returns an output hash for a target. If it has a single output it's the hash
@@ -551,25 +713,8 @@ func (c *Client) outputHash(ar *pb.ActionResult) string {
 	return c.digestMessage(ar).Hash
 }
 
-// preSharedToken returns a gRPC credential provider for a pre-shared token.
-func preSharedToken(token string) tokenCredProvider {
-	return tokenCredProvider{
-		"authorization": "Bearer " + strings.TrimSpace(token),
-	}
-}
-
-type tokenCredProvider map[string]string
-
-func (cred tokenCredProvider) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	return cred, nil
-}
-
-func (cred tokenCredProvider) RequireTransportSecurity() bool {
-	return false // Allow these to be provided over an insecure channel; this facilitates e.g. service meshes like Istio.
-}
-
-// contextWithMetadata returns a context with metadata corresponding to the given build target.
-func (c *Client) contextWithMetadata(target *core.BuildTarget) context.Context {
+// contextWithMetadata returns a context derived from the given one with metadata corresponding to the given build target.
+func (c *Client) contextWithMetadata(ctx context.Context, target *core.BuildTarget) context.Context {
 	const key = "build.bazel.remote.execution.v2.requestmetadata-bin" // as defined by the proto
 	b, _ := proto.Marshal(&pb.RequestMetadata{
 		ActionId:                target.Label.String(),
@@ -579,5 +724,5 @@ func (c *Client) contextWithMetadata(target *core.BuildTarget) context.Context {
 			ToolVersion: core.PleaseVersion.String(),
 		},
 	})
-	return metadata.NewOutgoingContext(context.Background(), metadata.Pairs(key, string(b)))
+	return metadata.NewOutgoingContext(ctx, metadata.Pairs(key, string(b)))
 }
@@ -62,13 +62,14 @@ func Run(config *core.Configuration, tool Tool, args []string) {
 // matchingTools returns a set of matching tools for a string prefix.
 func matchingTools(config *core.Configuration, prefix string) map[string]string {
 	knownTools := map[string]string{
-		"jarcat":      config.Java.JarCatTool,
-		"javacworker": config.Java.JavacWorker,
-		"junitrunner": config.Java.JUnitRunner,
-		"langserver":  "build_langserver",
-		"lps":         "build_langserver",
-		"pex":         config.Python.PexTool,
-		"sandbox":     "please_sandbox",
+		"jarcat":        config.Java.JarCatTool,
+		"javacworker":   config.Java.JavacWorker,
+		"junitrunner":   config.Java.JUnitRunner,
+		"langserver":    "build_langserver",
+		"lps":           "build_langserver",
+		"pex":           config.Python.PexTool,
+		"remote-server": "please_remote_server",
+		"sandbox":       "please_sandbox",
 	}
 	ret := map[string]string{}
 	for k, v := range knownTools {
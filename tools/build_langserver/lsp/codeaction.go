@@ -0,0 +1,173 @@
+package lsp
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// A codeAction is a change that can be made to a document, typically to fix a diagnostic.
+// It's not defined in the version of go-lsp that we use.
+type codeAction struct {
+	Title       string             `json:"title"`
+	Kind        string             `json:"kind,omitempty"`
+	Diagnostics []lsp.Diagnostic   `json:"diagnostics,omitempty"`
+	Edit        *lsp.WorkspaceEdit `json:"edit,omitempty"`
+}
+
+// cmdLabelReplacement matches the sequences in a command that refer to other targets.
+// These mirror the ones in src/core/command_replacements.go.
+var cmdLabelReplacement = regexp.MustCompile(`\$\((location|locations|exe|out_exe|out_location|out_locations|dir|out_dir|hash) ([^\)]+)\)`)
+
+// A missingDep is a target that is used in a rule's command but that the rule doesn't depend on.
+type missingDep struct {
+	Label core.BuildLabel
+	// The command string that uses it.
+	Expr *asp.Expression
+	Call *asp.Call
+	// The argument that it should be added to.
+	Arg string
+}
+
+// Diagnostic returns the diagnostic describing this missing dependency.
+func (dep *missingDep) Diagnostic() lsp.Diagnostic {
+	return lsp.Diagnostic{
+		Range:    rng(dep.Expr.Pos, dep.Expr.EndPos),
+		Severity: lsp.Error,
+		Source:   diagSource,
+		Message:  "Target " + dep.Label.String() + " is used in the command but isn't a dependency of this rule",
+	}
+}
+
+// codeAction implements code actions, which currently offer to add dependencies that a rule is missing.
+func (h *Handler) codeAction(params *lsp.CodeActionParams) ([]codeAction, error) {
+	doc := h.doc(params.TextDocument.URI)
+	ast := h.parseIfNeeded(doc)
+	pkgLabel := core.BuildLabel{PackageName: packageName(doc.Filename), Name: "all"}
+	actions := []codeAction{}
+	for _, dep := range h.missingDeps(doc, ast) {
+		diag := dep.Diagnostic()
+		if comparePositions(params.Range.End, diag.Range.Start) || comparePositions(diag.Range.End, params.Range.Start) {
+			continue // Doesn't overlap the requested range
+		}
+		label := dep.Label.ShortString(pkgLabel)
+		if edit, ok := addDependency(doc, dep.Call, dep.Arg, label); ok {
+			actions = append(actions, codeAction{
+				Title:       "Add " + label + " to " + dep.Arg,
+				Kind:        "quickfix",
+				Diagnostics: []lsp.Diagnostic{diag},
+				Edit: &lsp.WorkspaceEdit{
+					Changes: map[string][]lsp.TextEdit{string(params.TextDocument.URI): {edit}},
+				},
+			})
+		}
+	}
+	return actions, nil
+}
+
+// missingDeps returns all the targets that are used in commands in the given document
+// but that aren't dependencies of the rule using them.
+func (h *Handler) missingDeps(d *doc, ast []*asp.Statement) []missingDep {
+	pkgName := packageName(d.Filename)
+	deps := []missingDep{}
+	walkCalls(ast, func(_ string, _ asp.Position, call *asp.Call) {
+		var target *core.BuildTarget
+		cmds := []*asp.Expression{}
+		labels := map[core.BuildLabel]bool{}
+		for i := range call.Arguments {
+			arg := &call.Arguments[i]
+			if arg.Name == "cmd" || arg.Name == "test_cmd" {
+				cmds = append(cmds, stringsIn(&arg.Value)...)
+				continue
+			}
+			for _, s := range stringsIn(&arg.Value) {
+				if arg.Name == "name" {
+					// Rules can always refer to themselves.
+					l := core.BuildLabel{PackageName: pkgName, Name: stringLiteral(s.Val.String)}
+					labels[l] = true
+					target = h.state.Graph.Target(l)
+				} else if l, ok := parseLabel(stringLiteral(s.Val.String), pkgName); ok {
+					labels[l] = true
+				}
+			}
+		}
+		for _, cmd := range cmds {
+			for _, match := range cmdLabelReplacement.FindAllStringSubmatch(stringLiteral(cmd.Val.String), -1) {
+				l, ok := parseLabel(strings.TrimSpace(match[2]), pkgName)
+				if !ok || labels[l] || (target != nil && target.HasDependency(l)) {
+					continue
+				}
+				labels[l] = true // Only report each one once
+				dep := missingDep{Label: l, Expr: cmd, Call: call, Arg: "deps"}
+				if match[1] == "exe" || match[1] == "out_exe" {
+					dep.Arg = "tools"
+				}
+				deps = append(deps, dep)
+			}
+		}
+	})
+	return deps
+}
+
+// addDependency returns an edit that adds a dependency to the given argument of a call.
+// It returns false if it isn't possible to do so (e.g. the argument is not a list literal).
+func addDependency(d *doc, call *asp.Call, argName, label string) (lsp.TextEdit, bool) {
+	lines := d.Lines()
+	indentOf := func(line int) string {
+		l := lines[line-1]
+		return l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+	}
+	insert := func(pos lsp.Position, text string) (lsp.TextEdit, bool) {
+		return lsp.TextEdit{Range: lsp.Range{Start: pos, End: pos}, NewText: text}, true
+	}
+	for _, arg := range call.Arguments {
+		if arg.Name != argName {
+			continue
+		} else if arg.Value.Val == nil || arg.Value.Val.List == nil || len(arg.Value.Op) > 0 || arg.Value.Val.List.Comprehension != nil {
+			return lsp.TextEdit{}, false
+		}
+		values := arg.Value.Val.List.Values
+		if len(values) == 0 {
+			return insert(lsp.Position{Line: arg.Value.Pos.Line - 1, Character: arg.Value.Pos.Column}, `"`+label+`"`)
+		}
+		last := values[len(values)-1]
+		if last.EndPos.Line == arg.Value.Pos.Line {
+			return insert(pos(last.EndPos), `, "`+label+`"`)
+		}
+		// It's formatted over multiple lines, add a new one after the last entry.
+		return insert(lsp.Position{Line: last.EndPos.Line - 1, Character: len(lines[last.EndPos.Line-1])},
+			trailingComma(lines[last.EndPos.Line-1])+"\n"+indentOf(last.Pos.Line)+`"`+label+`",`)
+	}
+	// The argument doesn't exist yet, add it after the last one.
+	last := call.Arguments[len(call.Arguments)-1]
+	if last.Value.EndPos.Line == call.Arguments[0].Pos.Line {
+		return insert(pos(last.Value.EndPos), ", "+argName+` = ["`+label+`"]`)
+	}
+	return insert(lsp.Position{Line: last.Value.EndPos.Line - 1, Character: len(lines[last.Value.EndPos.Line-1])},
+		trailingComma(lines[last.Value.EndPos.Line-1])+"\n"+indentOf(last.Pos.Line)+argName+` = ["`+label+`"],`)
+}
+
+// trailingComma returns a comma if the given line doesn't already end in one.
+func trailingComma(line string) string {
+	if strings.HasSuffix(strings.TrimSpace(line), ",") {
+		return ""
+	}
+	return ","
+}
+
+// stringsIn returns all the string literals in an expression.
+func stringsIn(expr *asp.Expression) []*asp.Expression {
+	ret := []*asp.Expression{}
+	asp.WalkAST([]*asp.Statement{{Literal: expr}}, func(e *asp.Expression) bool {
+		if e.Val != nil && e.Val.String != "" {
+			ret = append(ret, e)
+			return false
+		}
+		return true
+	})
+	return ret
+}
@@ -0,0 +1,77 @@
+package lsp
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCodeActionContent = `genrule(
+    name = "test",
+    srcs = ["test.txt"],
+    outs = ["test.out"],
+    cmd = "$(exe //src/core:core) $(location :other) $(location :dep) $(location :test) > $OUT",
+    deps = [
+        ":dep",
+    ],
+)
+`
+
+func TestCodeAction(t *testing.T) {
+	h := initHandlerText(testCodeActionContent)
+	actions := []codeAction{}
+	err := h.Request("textDocument/codeAction", &lsp.CodeActionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Range: xrng(4, 10, 4, 10),
+	}, &actions)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(actions))
+	assert.Equal(t, "Add //src/core to tools", actions[0].Title)
+	assert.Equal(t, "quickfix", actions[0].Kind)
+	assert.Equal(t, []lsp.Diagnostic{{
+		Range:    xrng(4, 10, 4, 95),
+		Severity: lsp.Error,
+		Source:   "plz tool langserver",
+		Message:  "Target //src/core:core is used in the command but isn't a dependency of this rule",
+	}}, actions[0].Diagnostics)
+	assert.Equal(t, map[string][]lsp.TextEdit{
+		testURI: {{Range: xrng(7, 6, 7, 6), NewText: "\n    tools = [\"//src/core\"],"}},
+	}, actions[0].Edit.Changes)
+	assert.Equal(t, "Add :other to deps", actions[1].Title)
+	assert.Equal(t, map[string][]lsp.TextEdit{
+		testURI: {{Range: xrng(6, 15, 6, 15), NewText: "\n        \":other\","}},
+	}, actions[1].Edit.Changes)
+}
+
+func TestCodeActionOutsideRange(t *testing.T) {
+	h := initHandlerText(testCodeActionContent)
+	actions := []codeAction{}
+	err := h.Request("textDocument/codeAction", &lsp.CodeActionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Range: xrng(1, 0, 2, 0),
+	}, &actions)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(actions))
+}
+
+func TestAddDependencySingleLine(t *testing.T) {
+	h := initHandlerText(`genrule(name = "test", cmd = "$(location :other)", srcs = ["a.txt"])`)
+	actions := []codeAction{}
+	err := h.Request("textDocument/codeAction", &lsp.CodeActionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Range: xrng(0, 0, 0, 60),
+	}, &actions)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(actions))
+	assert.Equal(t, map[string][]lsp.TextEdit{
+		testURI: {{Range: xrng(0, 67, 0, 67), NewText: `, deps = [":other"]`}},
+	}, actions[0].Edit.Changes)
+}
@@ -2,7 +2,6 @@ package lsp
 
 import (
 	"context"
-	"path"
 
 	"github.com/sourcegraph/go-lsp"
 
@@ -18,7 +17,7 @@ func (h *Handler) diagnose(d *doc) {
 	for ast := range d.Diagnostics {
 		if diags := h.diagnostics(d, ast); !diagnosticsEqual(diags, last) {
 			h.Conn.Notify(context.Background(), "textDocument/publishDiagnostics", &lsp.PublishDiagnosticsParams{
-				URI:         lsp.DocumentURI("file://" + path.Join(h.root, d.Filename)),
+				URI:         h.uri(d.Filename),
 				Diagnostics: diags,
 			})
 			last = diags
@@ -29,7 +28,7 @@ func (h *Handler) diagnose(d *doc) {
 func (h *Handler) diagnostics(d *doc, ast []*asp.Statement) []lsp.Diagnostic {
 	diags := []lsp.Diagnostic{}
 	pkgLabel := core.BuildLabel{
-		PackageName: path.Dir(d.Filename),
+		PackageName: packageName(d.Filename),
 		Name:        "all",
 	}
 	asp.WalkAST(ast, func(expr *asp.Expression) bool {
@@ -73,6 +72,9 @@ func (h *Handler) diagnostics(d *doc, ast []*asp.Statement) []lsp.Diagnostic {
 		}
 		return true
 	})
+	for _, dep := range h.missingDeps(d, ast) {
+		diags = append(diags, dep.Diagnostic())
+	}
 	return diags
 }
 
@@ -0,0 +1,110 @@
+package lsp
+
+import (
+	"strings"
+
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// hover implements hover support. It describes the target a build label refers to, or shows
+// the documentation of a function or argument at a call site.
+func (h *Handler) hover(params *lsp.TextDocumentPositionParams) (*lsp.Hover, error) {
+	doc := h.doc(params.TextDocument.URI)
+	ast := h.parseIfNeeded(doc)
+	pos := aspPos(params.Position)
+	if label, expr := h.labelAt(doc, pos); expr != nil {
+		r := rng(expr.Pos, expr.EndPos)
+		return &lsp.Hover{
+			Contents: []lsp.MarkedString{
+				{Language: "python", Value: label.String()},
+				lsp.RawMarkedString(h.describeTarget(label)),
+			},
+			Range: &r,
+		}, nil
+	}
+	hover := &lsp.Hover{}
+	walkCalls(ast, func(name string, namePos asp.Position, call *asp.Call) {
+		f := h.builtins[name]
+		if f == nil {
+			return
+		} else if withinName(pos, namePos, name) {
+			r := rng(namePos, asp.Position{Line: namePos.Line, Column: namePos.Column + len(name)})
+			hover.Contents = []lsp.MarkedString{
+				{Language: "python", Value: signature(f.FuncDef).Label},
+				lsp.RawMarkedString(f.FuncDef.Docstring),
+			}
+			hover.Range = &r
+			return
+		}
+		for _, arg := range call.Arguments {
+			if arg.Name != "" && withinName(pos, arg.Pos, arg.Name) {
+				for _, a := range f.FuncDef.Arguments {
+					if a.Name == arg.Name || contains(a.Aliases, arg.Name) {
+						r := rng(arg.Pos, asp.Position{Line: arg.Pos.Line, Column: arg.Pos.Column + len(arg.Name)})
+						hover.Contents = []lsp.MarkedString{
+							{Language: "python", Value: argumentLabel(a)},
+							lsp.RawMarkedString(help.ArgumentDocstring(f.FuncDef, a.Name)),
+						}
+						hover.Range = &r
+						return
+					}
+				}
+			}
+		}
+	})
+	return hover, nil
+}
+
+// describeTarget returns a description of the target with the given label.
+func (h *Handler) describeTarget(label core.BuildLabel) string {
+	t := h.state.Graph.Target(label)
+	if t == nil {
+		return "Target " + label.String() + " does not exist"
+	}
+	lines := []string{}
+	if pkg := h.state.Graph.PackageByLabel(label); pkg != nil {
+		lines = append(lines, "Defined in "+h.relPath(pkg.Filename))
+	}
+	if outs := t.Outputs(); len(outs) > 0 {
+		lines = append(lines, "Outputs: "+strings.Join(outs, ", "))
+	}
+	if len(t.Labels) > 0 {
+		lines = append(lines, "Labels: "+strings.Join(t.Labels, ", "))
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+// walkCalls calls the given function for each function call in the AST, along with the name of
+// the function being called and the position of that name.
+func walkCalls(ast []*asp.Statement, callback func(name string, pos asp.Position, call *asp.Call)) {
+	asp.WalkAST(ast, func(stmt *asp.Statement) bool {
+		if stmt.Ident != nil && stmt.Ident.Action != nil && stmt.Ident.Action.Call != nil {
+			callback(stmt.Ident.Name, stmt.Pos, stmt.Ident.Action.Call)
+		}
+		return true
+	})
+	asp.WalkAST(ast, func(ident *asp.IdentExpr) bool {
+		if len(ident.Action) > 0 && ident.Action[0].Call != nil {
+			callback(ident.Name, ident.Pos, ident.Action[0].Call)
+		}
+		return true
+	})
+}
+
+// withinName returns true if the given position is within a name that starts at the given position.
+func withinName(needle, start asp.Position, name string) bool {
+	return asp.WithinRange(needle, start, asp.Position{Line: start.Line, Column: start.Column + len(name)})
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package lsp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testHoverContent = `go_library(
+    name = "test",
+    srcs = ["test.go"],
+    deps = ["//src/core:core"],
+)
+`
+
+func TestHoverFunction(t *testing.T) {
+	h := initHandlerText(testHoverContent)
+	hover := hoverAt(t, h, 0, 3)
+	require.Equal(t, 2, len(hover.Contents))
+	assert.True(t, strings.HasPrefix(hover.Contents[0].Value, "go_library(name:str, srcs:list, "))
+	assert.Equal(t, h.builtins["go_library"].FuncDef.Docstring, hover.Contents[1].Value)
+	assert.Equal(t, xrng(0, 0, 0, 10), *hover.Range)
+}
+
+func TestHoverArgument(t *testing.T) {
+	h := initHandlerText(testHoverContent)
+	hover := hoverAt(t, h, 2, 6)
+	require.Equal(t, 2, len(hover.Contents))
+	assert.Equal(t, "srcs:list", hover.Contents[0].Value)
+	assert.Equal(t, "Go source files to compile.", hover.Contents[1].Value)
+	assert.Equal(t, xrng(2, 4, 2, 8), *hover.Range)
+}
+
+func TestHoverLabel(t *testing.T) {
+	h := initHandlerText(testHoverContent)
+	h.WaitForPackage("src/core")
+	hover := hoverAt(t, h, 3, 20)
+	require.Equal(t, 2, len(hover.Contents))
+	assert.Equal(t, "//src/core:core", hover.Contents[0].Value)
+	assert.True(t, strings.HasPrefix(hover.Contents[1].Value, "Defined in src/core/test.build"))
+	assert.Equal(t, xrng(3, 12, 3, 29), *hover.Range)
+}
+
+func TestHoverNothing(t *testing.T) {
+	h := initHandlerText(testHoverContent)
+	hover := hoverAt(t, h, 5, 0)
+	assert.Equal(t, 0, len(hover.Contents))
+}
+
+func hoverAt(t *testing.T, h *Handler, line, col int) *lsp.Hover {
+	hover := &lsp.Hover{}
+	err := h.Request("textDocument/hover", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: line, Character: col},
+	}, hover)
+	require.NoError(t, err)
+	return hover
+}
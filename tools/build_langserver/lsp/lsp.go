@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -69,6 +71,11 @@ func NewHandler() *Handler {
 		"textDocument/documentSymbol": h.method(h.symbols),
 		"textDocument/definition":     h.method(h.definition),
 		"textDocument/declaration":    h.method(h.definition),
+		"textDocument/hover":          h.method(h.hover),
+		"textDocument/signatureHelp":  h.method(h.signatureHelp),
+		"textDocument/references":     h.method(h.references),
+		"textDocument/rename":         h.method(h.rename),
+		"textDocument/codeAction":     h.method(h.codeAction),
 	}
 	return h
 }
@@ -168,9 +175,16 @@ func (h *Handler) initialize(params *lsp.InitializeParams) (*lsp.InitializeResul
 			DocumentFormattingProvider: true,
 			DocumentSymbolProvider:     true,
 			DefinitionProvider:         true,
+			HoverProvider:              true,
+			ReferencesProvider:         true,
+			RenameProvider:             true,
+			CodeActionProvider:         true,
 			CompletionProvider: &lsp.CompletionOptions{
 				TriggerCharacters: []string{"/", ":"},
 			},
+			SignatureHelpProvider: &lsp.SignatureHelpOptions{
+				TriggerCharacters: []string{"(", ","},
+			},
 		},
 	}, nil
 }
@@ -205,6 +219,21 @@ func fromURI(uri lsp.DocumentURI) string {
 	return string(uri[7:])
 }
 
+// uri returns the DocumentURI for a file relative to the repo root.
+func (h *Handler) uri(filename string) lsp.DocumentURI {
+	return lsp.DocumentURI("file://" + path.Join(h.root, filename))
+}
+
+// relPath returns a filename relative to the repo root.
+func (h *Handler) relPath(filename string) string {
+	if path.IsAbs(filename) {
+		if rel, err := filepath.Rel(h.root, filename); err == nil {
+			return rel
+		}
+	}
+	return filename
+}
+
 // A Logger provides an interface to our logger.
 type Logger struct{}
 
@@ -0,0 +1,233 @@
+package lsp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/core"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// A reference is a string in a BUILD file that refers to a build target.
+type reference struct {
+	Filename string
+	Expr     *asp.Expression
+	// The label as it's written in the file.
+	Label string
+	// True if this is the name argument that defines the target, rather than a reference to it.
+	Declaration bool
+}
+
+// references implements find-references for build labels.
+func (h *Handler) references(params *lsp.ReferenceParams) ([]lsp.Location, error) {
+	doc := h.doc(params.TextDocument.URI)
+	locs := []lsp.Location{}
+	label, expr := h.labelAt(doc, aspPos(params.Position))
+	if expr == nil {
+		return locs, nil
+	}
+	for _, ref := range h.findReferences(label) {
+		if !ref.Declaration || params.Context.IncludeDeclaration {
+			locs = append(locs, lsp.Location{
+				URI:   h.uri(ref.Filename),
+				Range: rng(ref.Expr.Pos, ref.Expr.EndPos),
+			})
+		}
+	}
+	return locs, nil
+}
+
+// rename implements renaming of build targets. The target's definition and everything that
+// refers to it are updated.
+func (h *Handler) rename(params *lsp.RenameParams) (*lsp.WorkspaceEdit, error) {
+	doc := h.doc(params.TextDocument.URI)
+	label, expr := h.labelAt(doc, aspPos(params.Position))
+	if expr == nil {
+		return nil, fmt.Errorf("no build target found at this position")
+	}
+	name := params.NewName
+	if core.LooksLikeABuildLabel(name) {
+		newLabel, err := core.TryParseBuildLabel(name, label.PackageName, label.Subrepo)
+		if err != nil {
+			return nil, err
+		} else if newLabel.PackageName != label.PackageName || newLabel.Subrepo != label.Subrepo {
+			return nil, fmt.Errorf("targets can only be renamed within their own package")
+		}
+		name = newLabel.Name
+	} else if _, err := core.TryParseBuildLabel(":"+name, label.PackageName, label.Subrepo); err != nil {
+		return nil, err
+	}
+	edit := &lsp.WorkspaceEdit{Changes: map[string][]lsp.TextEdit{}}
+	for _, ref := range h.findReferences(label) {
+		uri := string(h.uri(ref.Filename))
+		quote := ref.Expr.Val.String[:1]
+		edit.Changes[uri] = append(edit.Changes[uri], lsp.TextEdit{
+			Range:   rng(ref.Expr.Pos, ref.Expr.EndPos),
+			NewText: quote + renameLabel(ref.Label, name, ref.Declaration) + quote,
+		})
+	}
+	return edit, nil
+}
+
+// renameLabel returns a label as written in a BUILD file with its target name replaced,
+// preserving the form it was written in.
+func renameLabel(label, name string, declaration bool) string {
+	if declaration {
+		return name
+	}
+	annotation := ""
+	if idx := strings.IndexByte(label, '|'); idx != -1 {
+		label, annotation = label[:idx], label[idx:]
+	}
+	if idx := strings.LastIndexByte(label, ':'); idx != -1 {
+		return label[:idx+1] + name + annotation
+	}
+	return label + ":" + name + annotation // e.g. //src/core, which is short for //src/core:core
+}
+
+// labelAt returns the build label that's referred to at the given position in a document, and
+// the string that refers to it. If there isn't one the returned expression is nil.
+// The name argument of a call is taken to refer to the target that it defines.
+func (h *Handler) labelAt(d *doc, pos asp.Position) (core.BuildLabel, *asp.Expression) {
+	ast := h.parseIfNeeded(d)
+	pkgName := packageName(d.Filename)
+	var label core.BuildLabel
+	var expr *asp.Expression
+	walkCalls(ast, func(name string, namePos asp.Position, call *asp.Call) {
+		for i, arg := range call.Arguments {
+			if v := arg.Value.Val; arg.Name == "name" && v != nil && v.String != "" && asp.WithinRange(pos, arg.Value.Pos, arg.Value.EndPos) {
+				label = core.BuildLabel{PackageName: pkgName, Name: stringLiteral(v.String)}
+				expr = &call.Arguments[i].Value
+			}
+		}
+	})
+	if expr != nil {
+		return label, expr
+	}
+	asp.WalkAST(ast, func(e *asp.Expression) bool {
+		if !asp.WithinRange(pos, e.Pos, e.EndPos) {
+			return false
+		} else if e.Val != nil && e.Val.String != "" {
+			if l, ok := parseLabel(stringLiteral(e.Val.String), pkgName); ok {
+				label = l
+				expr = e
+			}
+			return false
+		}
+		return true
+	})
+	return label, expr
+}
+
+// findReferences finds everything in the repo that refers to the given build label.
+// The build graph is used to determine which packages might refer to it, and their BUILD files
+// (along with any currently open documents) are then searched for it.
+func (h *Handler) findReferences(label core.BuildLabel) []reference {
+	files := map[string]string{} // BUILD file -> package name
+	if pkg := h.state.Graph.PackageByLabel(label); pkg != nil {
+		files[h.relPath(pkg.Filename)] = pkg.Name
+	}
+	for _, t := range h.state.Graph.AllTargets() {
+		if t.HasDependency(label) {
+			if pkg := h.state.Graph.PackageByLabel(t.Label); pkg != nil {
+				files[h.relPath(pkg.Filename)] = pkg.Name
+			}
+		}
+	}
+	h.mutex.Lock()
+	for _, d := range h.docs {
+		files[d.Filename] = packageName(d.Filename)
+	}
+	h.mutex.Unlock()
+
+	refs := []reference{}
+	for filename, pkgName := range files {
+		ast, err := h.parseFile(filename)
+		if err != nil {
+			log.Warning("Failed to parse %s: %s", filename, err)
+			continue
+		}
+		if pkgName == label.PackageName {
+			walkCalls(ast, func(name string, pos asp.Position, call *asp.Call) {
+				for i, arg := range call.Arguments {
+					if v := arg.Value.Val; arg.Name == "name" && v != nil && v.String != "" && stringLiteral(v.String) == label.Name {
+						refs = append(refs, reference{
+							Filename:    filename,
+							Expr:        &call.Arguments[i].Value,
+							Label:       label.Name,
+							Declaration: true,
+						})
+					}
+				}
+			})
+		}
+		asp.WalkAST(ast, func(e *asp.Expression) bool {
+			if e.Val != nil && e.Val.String != "" {
+				s := stringLiteral(e.Val.String)
+				if l, ok := parseLabel(s, pkgName); ok && l == label {
+					refs = append(refs, reference{Filename: filename, Expr: e, Label: s})
+				}
+				return false
+			}
+			return true
+		})
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Filename != refs[j].Filename {
+			return refs[i].Filename < refs[j].Filename
+		}
+		return compareRanges(rng(refs[i].Expr.Pos, refs[i].Expr.EndPos), rng(refs[j].Expr.Pos, refs[j].Expr.EndPos))
+	})
+	return refs
+}
+
+// parseFile returns the parsed contents of a BUILD file. If it's currently open, the document's
+// contents are used, otherwise it's read from disk.
+func (h *Handler) parseFile(filename string) ([]*asp.Statement, error) {
+	h.mutex.Lock()
+	var d *doc
+	for _, doc := range h.docs {
+		if doc.Filename == filename {
+			d = doc
+			break
+		}
+	}
+	h.mutex.Unlock()
+	if d != nil {
+		return h.parseIfNeeded(d), nil
+	}
+	data, err := ioutil.ReadFile(path.Join(h.root, filename))
+	if err != nil {
+		return nil, err
+	}
+	return h.parser.ParseData(data, filename)
+}
+
+// parseLabel parses a string as a build label, if it looks like one, within the given package.
+// Any annotation (e.g. an entry point or named output) is ignored.
+func parseLabel(s, pkgName string) (core.BuildLabel, bool) {
+	if !core.LooksLikeABuildLabel(s) {
+		return core.BuildLabel{}, false
+	}
+	if idx := strings.IndexByte(s, '|'); idx != -1 {
+		s = s[:idx]
+	}
+	l, err := core.TryParseBuildLabel(s, pkgName, "")
+	if err != nil || l.IsAllTargets() || l.IsAllSubpackages() {
+		return core.BuildLabel{}, false
+	}
+	return l, true
+}
+
+// packageName returns the name of the package that a BUILD file defines.
+func packageName(filename string) string {
+	if dir := path.Dir(filename); dir != "." {
+		return dir
+	}
+	return ""
+}
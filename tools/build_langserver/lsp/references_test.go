@@ -0,0 +1,104 @@
+package lsp
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testReferencesContent = `go_test(
+    name = "test",
+    deps = ["//src/core:core"],
+)
+`
+
+func TestReferences(t *testing.T) {
+	h := initHandlerText(testReferencesContent)
+	h.WaitForPackage("src/core")
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/references", &lsp.ReferenceParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{
+				URI: testURI,
+			},
+			Position: lsp.Position{Line: 2, Character: 15},
+		},
+		Context: lsp.ReferenceContext{IncludeDeclaration: true},
+	}, &locs)
+	require.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{URI: testDataURI("src/core/test.build"), Range: xrng(1, 11, 1, 17)},
+		{URI: testDataURI("src/core/test.build"), Range: xrng(23, 8, 23, 15)},
+		{URI: testDataURI("test/test.build"), Range: xrng(2, 12, 2, 29)},
+	}, locs)
+}
+
+func TestReferencesWithoutDeclaration(t *testing.T) {
+	h := initHandlerText(testReferencesContent)
+	h.WaitForPackage("src/core")
+	locs := []lsp.Location{}
+	err := h.Request("textDocument/references", &lsp.ReferenceParams{
+		TextDocumentPositionParams: lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{
+				URI: testURI,
+			},
+			Position: lsp.Position{Line: 2, Character: 15},
+		},
+	}, &locs)
+	require.NoError(t, err)
+	assert.Equal(t, []lsp.Location{
+		{URI: testDataURI("src/core/test.build"), Range: xrng(23, 8, 23, 15)},
+		{URI: testDataURI("test/test.build"), Range: xrng(2, 12, 2, 29)},
+	}, locs)
+}
+
+func TestRename(t *testing.T) {
+	h := initHandlerText(testReferencesContent)
+	h.WaitForPackage("src/core")
+	edit := &lsp.WorkspaceEdit{}
+	err := h.Request("textDocument/rename", &lsp.RenameParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: 2, Character: 15},
+		NewName:  "core2",
+	}, edit)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]lsp.TextEdit{
+		string(testDataURI("src/core/test.build")): {
+			{Range: xrng(1, 11, 1, 17), NewText: `"core2"`},
+			{Range: xrng(23, 8, 23, 15), NewText: `":core2"`},
+		},
+		string(testDataURI("test/test.build")): {
+			{Range: xrng(2, 12, 2, 29), NewText: `"//src/core:core2"`},
+		},
+	}, edit.Changes)
+}
+
+func TestRenameToAnotherPackage(t *testing.T) {
+	h := initHandlerText(testReferencesContent)
+	h.WaitForPackage("src/core")
+	err := h.Request("textDocument/rename", &lsp.RenameParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: 2, Character: 15},
+		NewName:  "//src/parse:core",
+	}, &lsp.WorkspaceEdit{})
+	assert.Error(t, err)
+}
+
+func TestRenameLabel(t *testing.T) {
+	assert.Equal(t, "//src/core:core2", renameLabel("//src/core:core", "core2", false))
+	assert.Equal(t, "//src/core:core2", renameLabel("//src/core", "core2", false))
+	assert.Equal(t, ":core2|out", renameLabel(":core|out", "core2", false))
+	assert.Equal(t, "core2", renameLabel("core", "core2", true))
+}
+
+func testDataURI(filename string) lsp.DocumentURI {
+	return lsp.DocumentURI("file://" + path.Join(os.Getenv("TEST_DIR"), "tools/build_langserver/lsp/test_data", filename))
+}
@@ -0,0 +1,180 @@
+package lsp
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/sourcegraph/go-lsp"
+
+	"github.com/thought-machine/please/src/help"
+	"github.com/thought-machine/please/src/parse/asp"
+)
+
+// signatureHelp implements signature help, which describes the arguments of the function call
+// that the cursor is currently within.
+// Like completion, this works on the raw text since the document is usually incomplete at this point.
+func (h *Handler) signatureHelp(params *lsp.TextDocumentPositionParams) (*lsp.SignatureHelp, error) {
+	doc := h.doc(params.TextDocument.URI)
+	lines := doc.Lines()
+	line := params.Position.Line
+	if line >= len(lines) {
+		return &lsp.SignatureHelp{Signatures: []lsp.SignatureInformation{}}, nil
+	}
+	l := lines[line]
+	if col := params.Position.Character; col < len(l) {
+		l = l[:col]
+	}
+	call := currentCall(strings.Join(append(lines[:line:line], l), "\n"))
+	if call == nil || h.builtins[call.Name] == nil {
+		return &lsp.SignatureHelp{Signatures: []lsp.SignatureInformation{}}, nil
+	}
+	f := h.builtins[call.Name].FuncDef
+	return &lsp.SignatureHelp{
+		Signatures:      []lsp.SignatureInformation{signature(f)},
+		ActiveParameter: call.activeParameter(publicArguments(f)),
+	}, nil
+}
+
+// signature returns the signature of a function.
+func signature(f *asp.FuncDef) lsp.SignatureInformation {
+	args := publicArguments(f)
+	sig := lsp.SignatureInformation{
+		Documentation: help.FunctionComment(f),
+		Parameters:    make([]lsp.ParameterInformation, len(args)),
+	}
+	labels := make([]string, len(args))
+	for i, a := range args {
+		labels[i] = argumentLabel(a)
+		sig.Parameters[i] = lsp.ParameterInformation{
+			Label:         labels[i],
+			Documentation: help.ArgumentDocstring(f, a.Name),
+		}
+	}
+	sig.Label = f.Name + "(" + strings.Join(labels, ", ") + ")"
+	return sig
+}
+
+// publicArguments returns the arguments of a function that aren't private.
+func publicArguments(f *asp.FuncDef) []asp.Argument {
+	args := make([]asp.Argument, 0, len(f.Arguments))
+	for _, a := range f.Arguments {
+		if !a.IsPrivate {
+			args = append(args, a)
+		}
+	}
+	return args
+}
+
+// argumentLabel returns a description of a function argument, in the same form as it's declared.
+func argumentLabel(a asp.Argument) string {
+	if len(a.Type) == 0 {
+		return a.Name
+	}
+	return a.Name + ":" + strings.Join(a.Type, "|")
+}
+
+// A callContext describes a function call that is still open at some point in a document.
+type callContext struct {
+	Name string
+	// The number of arguments that come before the current one.
+	Args int
+	// The name of the current argument, if it's being passed by keyword.
+	Keyword string
+	// True if any of the arguments so far have been passed by keyword.
+	Keywords bool
+}
+
+// activeParameter returns the index of the argument that's currently being written, or the
+// number of arguments if it's not possible to tell.
+func (call *callContext) activeParameter(args []asp.Argument) int {
+	if call.Keyword != "" {
+		for i, a := range args {
+			if a.Name == call.Keyword || contains(a.Aliases, call.Keyword) {
+				return i
+			}
+		}
+		return len(args)
+	} else if call.Keywords || call.Args > len(args) {
+		// Positional arguments aren't allowed after keyword ones.
+		return len(args)
+	}
+	return call.Args
+}
+
+// currentCall returns the innermost function call that is still open at the end of the given text,
+// or nil if there isn't one.
+func currentCall(text string) *callContext {
+	r := []rune(text)
+	stack := []*callContext{} // Brackets that aren't function calls have nil entries.
+	var quote rune
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case '#':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case '(':
+			stack = append(stack, &callContext{Name: identBefore(r[:i])})
+		case '[', '{':
+			stack = append(stack, nil)
+		case ')', ']', '}':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case ',':
+			if call := top(stack); call != nil {
+				call.Args++
+				call.Keyword = ""
+			}
+		case '=':
+			if call := top(stack); call != nil && (i+1 >= len(r) || r[i+1] != '=') && (i == 0 || !strings.ContainsRune("=!<>", r[i-1])) {
+				if name := identBefore(r[:i]); name != "" {
+					call.Keyword = name
+					call.Keywords = true
+				}
+			}
+		}
+	}
+	// We might be in a list or similar that is an argument to a call, so look outwards for it.
+	for i := len(stack) - 1; i >= 0; i-- {
+		if call := stack[i]; call != nil {
+			if call.Name == "" {
+				return nil // Just a parenthesised expression
+			}
+			return call
+		}
+	}
+	return nil
+}
+
+// top returns the last item in a stack of calls, or nil if it's empty.
+func top(stack []*callContext) *callContext {
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[len(stack)-1]
+}
+
+// identBefore returns the identifier immediately preceding the end of the given text, ignoring any whitespace.
+func identBefore(r []rune) string {
+	end := len(r)
+	for end > 0 && unicode.IsSpace(r[end-1]) {
+		end--
+	}
+	start := end
+	for start > 0 && (unicode.IsLetter(r[start-1]) || unicode.IsDigit(r[start-1]) || r[start-1] == '_') {
+		start--
+	}
+	return string(r[start:end])
+}
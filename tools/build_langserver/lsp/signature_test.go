@@ -0,0 +1,55 @@
+package lsp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSignatureContent = `go_library(
+    name = "test",
+    srcs = ["test.go", `
+
+func TestSignatureHelp(t *testing.T) {
+	h := initHandlerText(testSignatureContent)
+	help := &lsp.SignatureHelp{}
+	err := h.Request("textDocument/signatureHelp", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: 2, Character: 23},
+	}, help)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(help.Signatures))
+	sig := help.Signatures[0]
+	assert.True(t, strings.HasPrefix(sig.Label, "go_library(name:str, srcs:list, "))
+	assert.Equal(t, "Generates a Go library which can be reused by other rules.", sig.Documentation)
+	assert.Equal(t, lsp.ParameterInformation{Label: "srcs:list", Documentation: "Go source files to compile."}, sig.Parameters[1])
+	assert.Equal(t, 1, help.ActiveParameter)
+}
+
+func TestSignatureHelpOutsideCall(t *testing.T) {
+	h := initHandlerText(testSignatureContent)
+	help := &lsp.SignatureHelp{}
+	err := h.Request("textDocument/signatureHelp", &lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{
+			URI: testURI,
+		},
+		Position: lsp.Position{Line: 0, Character: 5},
+	}, help)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(help.Signatures))
+}
+
+func TestCurrentCall(t *testing.T) {
+	assert.Equal(t, &callContext{Name: "genrule"}, currentCall(`genrule(`))
+	assert.Equal(t, &callContext{Name: "genrule", Args: 1}, currentCall(`genrule("a", `))
+	assert.Equal(t, &callContext{Name: "genrule", Args: 1, Keyword: "srcs", Keywords: true}, currentCall(`genrule(name = "x", srcs = [":a", `))
+	assert.Equal(t, &callContext{Name: "genrule", Args: 1, Keywords: true}, currentCall("genrule(\n    name = \"x\",\n    # a comment, with (brackets\n"))
+	assert.Equal(t, &callContext{Name: "glob"}, currentCall(`genrule(name = "(") + glob(`))
+	assert.Nil(t, currentCall(`genrule(name = "(")`))
+	assert.Nil(t, currentCall(`genrule(name = "x" if a == (1, `))
+}
@@ -121,6 +121,9 @@ func (h *Handler) didChange(params *lsp.DidChangeTextDocumentParams) (*struct{},
 func (h *Handler) didSave(params *lsp.DidSaveTextDocumentParams) (*struct{}, error) {
 	// TODO(peterebden): There should be a 'Text' property on the params that we can
 	//                   sync from. It's in the spec but doesn't seem to be in go-lsp.
+	// Re-parse what we have so diagnostics are updated for the saved version.
+	doc := h.doc(params.TextDocument.URI)
+	go h.parse(doc, doc.Text())
 	return nil, nil
 }
 
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var log = logging.MustGetLogger("httpcache")
@@ -27,7 +28,9 @@ func New(dir string) *Cache {
 // ServeHTTP implements the http.Handler interface for the cache
 func (c *Cache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	uri := req.RequestURI
-	if req.Method == http.MethodPut {
+	if strings.HasPrefix(uri, v2Prefix) {
+		c.serveV2(resp, req, strings.TrimPrefix(uri, v2Prefix))
+	} else if req.Method == http.MethodPut {
 		err := c.store(uri, req.Body)
 		if err != nil {
 			log.Errorf("Failed to store in cache: %v", err)
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thought-machine/please/src/cache/compression"
+	"github.com/thought-machine/please/src/fs"
+)
+
+// v2Prefix is the prefix of all URLs for the v2 protocol.
+// Under it, files are stored by their sha256 hash under cas/ and manifests under ac/.
+const v2Prefix = "/v2/"
+
+// validName matches the names of things we're willing to store; they're always hex-encoded.
+var validName = regexp.MustCompile("^[0-9a-f]+$")
+
+// serveV2 serves a request for the v2 protocol.
+func (c *Cache) serveV2(resp http.ResponseWriter, req *http.Request, uri string) {
+	parts := strings.Split(uri, "/")
+	if len(parts) != 2 || (parts[0] != "cas" && parts[0] != "ac") || !validName.MatchString(parts[1]) {
+		http.Error(resp, "invalid path "+uri, http.StatusBadRequest)
+		return
+	}
+	filename := filepath.Join(c.Dir, "v2", parts[0], parts[1])
+	switch req.Method {
+	case http.MethodHead:
+		if _, err := os.Stat(filename); err != nil {
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodGet:
+		if err := c.retrieveV2(resp, req, filename); os.IsNotExist(err) {
+			resp.WriteHeader(http.StatusNotFound)
+		} else if err != nil {
+			log.Errorf("Failed to retrieve from cache: %v", err)
+		}
+	case http.MethodPut:
+		digest := ""
+		if parts[0] == "cas" {
+			digest = parts[1]
+		}
+		if err := c.storeV2(filename, digest, req); err != nil {
+			log.Errorf("Failed to store in cache: %v", err)
+			http.Error(resp, fmt.Sprintf("failed to store in cache: %v", err), http.StatusBadRequest)
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// retrieveV2 sends back a stored file, compressed with whatever encoding the client prefers.
+func (c *Cache) retrieveV2(resp http.ResponseWriter, req *http.Request, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		http.ServeContent(resp, req, "", info.ModTime(), f)
+		return nil
+	}
+	resp.Header().Set("Content-Encoding", encoding)
+	enc, err := compression.NewEncoder(encoding, resp)
+	if err != nil {
+		return err
+	} else if _, err := io.Copy(enc, f); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// storeV2 stores the body of a request. If digest is given the contents are verified against it.
+func (c *Cache) storeV2(filename, digest string, req *http.Request) error {
+	r, err := compression.NewDecoder(req.Header.Get("Content-Encoding"), req.Body)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := fs.EnsureDir(filename); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	} else if actual := hex.EncodeToString(h.Sum(nil)); digest != "" && actual != digest {
+		return fmt.Errorf("digest mismatch: expected %s, was %s", digest, actual)
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// negotiateEncoding returns the encoding to use for a response, given the request's Accept-Encoding
+// header. Only zstd and gzip are supported; whichever the client gives the higher quality value
+// is used, preferring zstd if they're equal. An empty string means not to compress at all.
+func negotiateEncoding(accept string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if encoding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(param, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if q2, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = q2
+				} else {
+					q = 0 // Don't use anything we can't understand
+				}
+			}
+		}
+		qualities[encoding] = q
+	}
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range []string{"zstd", "gzip"} {
+		q, present := qualities[encoding]
+		if !present {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+	return best
+}
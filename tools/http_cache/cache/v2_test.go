@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/please/src/cache/compression"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "", negotiateEncoding(""))
+	assert.Equal(t, "", negotiateEncoding("identity"))
+	assert.Equal(t, "gzip", negotiateEncoding("gzip"))
+	assert.Equal(t, "zstd", negotiateEncoding("gzip, zstd"))
+	assert.Equal(t, "zstd", negotiateEncoding("zstd;q=0.5, gzip;q=0.5"))
+	assert.Equal(t, "gzip", negotiateEncoding("zstd;q=0.5, gzip;q=0.8"))
+	assert.Equal(t, "gzip", negotiateEncoding("zstd;q=0, gzip"))
+	assert.Equal(t, "gzip", negotiateEncoding("zstd; q=0.0, gzip"))
+	assert.Equal(t, "gzip", negotiateEncoding("zstd;q=0.00, GZIP;q=0.1"))
+	assert.Equal(t, "", negotiateEncoding("gzip;q=0, zstd;q=0"))
+	assert.Equal(t, "zstd", negotiateEncoding("*"))
+	assert.Equal(t, "gzip", negotiateEncoding("*, zstd;q=0"))
+	assert.Equal(t, "", negotiateEncoding("gzip;q=wibble"))
+}
+
+func TestStoreAndRetrieveV2(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	contents := []byte("wibble wobble")
+	digest := sha256Hex(contents)
+
+	resp := request(t, http.MethodHead, s.URL+"/v2/cas/"+digest, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = request(t, http.MethodPut, s.URL+"/v2/cas/"+digest, bytes.NewReader(contents), nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = request(t, http.MethodHead, s.URL+"/v2/cas/"+digest, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = request(t, http.MethodGet, s.URL+"/v2/cas/"+digest, nil, map[string]string{"Accept-Encoding": "identity"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, contents, readAll(t, resp.Header.Get("Content-Encoding"), resp))
+}
+
+func TestRetrieveV2Compressed(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	contents := []byte("wibble wobble wubble")
+	digest := sha256Hex(contents)
+	resp := request(t, http.MethodPut, s.URL+"/v2/cas/"+digest, bytes.NewReader(contents), nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	for _, encoding := range []string{"zstd", "gzip"} {
+		resp := request(t, http.MethodGet, s.URL+"/v2/cas/"+digest, nil, map[string]string{"Accept-Encoding": encoding})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, contents, readAll(t, encoding, resp))
+	}
+}
+
+func TestStoreV2Compressed(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	contents := []byte("compressed contents")
+	digest := sha256Hex(contents)
+	var buf bytes.Buffer
+	enc, err := compression.NewEncoder("zstd", &buf)
+	require.NoError(t, err)
+	_, err = enc.Write(contents)
+	require.NoError(t, err)
+	require.NoError(t, enc.Close())
+
+	resp := request(t, http.MethodPut, s.URL+"/v2/cas/"+digest, bytes.NewReader(buf.Bytes()), map[string]string{"Content-Encoding": "zstd"})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = request(t, http.MethodGet, s.URL+"/v2/cas/"+digest, nil, nil)
+	assert.Equal(t, contents, readAll(t, resp.Header.Get("Content-Encoding"), resp))
+}
+
+func TestStoreV2DigestMismatch(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	digest := sha256Hex([]byte("something else"))
+	resp := request(t, http.MethodPut, s.URL+"/v2/cas/"+digest, bytes.NewReader([]byte("wibble")), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = request(t, http.MethodHead, s.URL+"/v2/cas/"+digest, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestStoreV2ActionCache(t *testing.T) {
+	// Manifests aren't content addressed so aren't verified against their name.
+	s := newServer(t)
+	defer s.Close()
+	resp := request(t, http.MethodPut, s.URL+"/v2/ac/abcdef", bytes.NewReader([]byte(`{}`)), nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = request(t, http.MethodGet, s.URL+"/v2/ac/abcdef", nil, nil)
+	assert.Equal(t, []byte(`{}`), readAll(t, resp.Header.Get("Content-Encoding"), resp))
+}
+
+func TestInvalidPathsV2(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	for _, path := range []string{"/v2/cas/ABCDEF", "/v2/wibble/abcdef", "/v2/cas/abc/def", "/v2/cas/"} {
+		resp := request(t, http.MethodGet, s.URL+path, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+}
+
+// A server is a test server that cleans up its cache directory when it's closed.
+type server struct {
+	*httptest.Server
+	dir string
+}
+
+func newServer(t *testing.T) *server {
+	dir, err := ioutil.TempDir("", "http_cache")
+	require.NoError(t, err)
+	return &server{Server: httptest.NewServer(New(dir)), dir: dir}
+}
+
+func (s *server) Close() {
+	s.Server.Close()
+	os.RemoveAll(s.dir)
+}
+
+func request(t *testing.T, method, url string, body *bytes.Reader, headers map[string]string) *http.Response {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, url, body)
+	} else {
+		req, err = http.NewRequest(method, url, nil)
+	}
+	require.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	// Stop the transport from transparently negotiating gzip for us.
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return resp
+}
+
+func readAll(t *testing.T, encoding string, resp *http.Response) []byte {
+	r, err := compression.NewDecoder(encoding, resp.Body)
+	require.NoError(t, err)
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return b
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
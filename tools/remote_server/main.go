@@ -0,0 +1,61 @@
+// Package main implements a local remote execution server for Please.
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/thought-machine/please/src/cli"
+	"github.com/thought-machine/please/src/remote/server"
+)
+
+var log = logging.MustGetLogger("remote_server")
+
+var opts = struct {
+	Usage        string
+	Verbosity    cli.Verbosity `short:"v" long:"verbosity" default:"notice" description:"Verbosity of output (higher number = more output)"`
+	Dir          string        `short:"d" long:"dir" default:"" description:"The directory to store blobs, action results and execution roots in."`
+	Host         string        `long:"host" default:"127.0.0.1" description:"The address to listen on. Only local connections are accepted by default; anything that can connect can run arbitrary commands, so only listen more widely (e.g. on 0.0.0.0) on a trusted network."`
+	Port         int           `short:"p" long:"port" default:"8980" description:"The port to run the server on"`
+	HashFunction string        `long:"hash_function" default:"sha256" choice:"sha256" choice:"sha1" description:"The hash function to use. Must match the client's [remote] HashFunction setting."`
+	Sandbox      string        `short:"s" long:"sandbox" description:"Path to the sandbox tool to run actions with. If not given, actions are not sandboxed."`
+	NumWorkers   int           `short:"n" long:"num_workers" description:"Maximum number of actions to run at once. Defaults to the number of CPUs."`
+}{
+	Usage: `
+please_remote_server is a self-contained implementation of the remote execution API, backed by the local filesystem.
+
+It implements the CAS, ActionCache, Capabilities and Execution services, so Please can build against it with
+[remote] URL = 127.0.0.1:8980 (or whichever port you choose). It's intended for development and testing of remote
+execution, for example to run remote builds fully offline; it is not intended for production use.
+`,
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Remote server", &opts)
+	cli.InitLogging(opts.Verbosity)
+
+	if opts.Dir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("Failed to get user cache dir: %s", err)
+		}
+		opts.Dir = filepath.Join(userCacheDir, "please_remote_server")
+	}
+	srv, err := server.New(opts.Dir, opts.HashFunction, opts.Sandbox, opts.NumWorkers)
+	if err != nil {
+		log.Fatalf("Failed to create server: %s", err)
+	}
+	addr := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %s", addr, err)
+	}
+	log.Notice("Serving on %s out of %s", addr, opts.Dir)
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("%s", err)
+	}
+}